@@ -0,0 +1,336 @@
+package mqb
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+// Stats contains aggregate statistics of a numeric field.
+type Stats struct {
+	Min   float64 `json:"min" bson:"min"`
+	Max   float64 `json:"max" bson:"max"`
+	Avg   float64 `json:"avg" bson:"avg"`
+	Sum   float64 `json:"sum" bson:"sum"`
+	Count int     `json:"count" bson:"count"`
+}
+
+// Stats returns the minimum, maximum, average and sum of the numeric field over all
+// documents matching the request, as well as the number of matching documents.
+func (mq *MongoQuery) Stats(req *http.Request, field string) (Stats, error) {
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		return Stats{}, err
+	}
+	pipeline, err := mq.statsPipeline(spec.Filter, field)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{}
+	err = mq.collection().Pipe(pipeline).One(&stats)
+	if err == mgo.ErrNotFound {
+		return Stats{}, nil
+	}
+	if err != nil {
+		return Stats{}, merry.Prepend(err, "could not execute stats pipeline").WithHTTPCode(http.StatusInternalServerError)
+	}
+	return stats, nil
+}
+
+// statsPipeline returns the aggregation pipeline that computes the Stats of field for the
+// documents matching filter.
+func (mq *MongoQuery) statsPipeline(filter bson.M, field string) ([]bson.M, error) {
+	field = mq.resolveAlias(field)
+	if kindClass(mq.supportedParameters[field]) != "number" {
+		return nil, merry.Wrap(fmt.Errorf("parameter '%s' is not numeric", field)).WithHTTPCode(http.StatusBadRequest)
+	}
+	return []bson.M{
+		{"$match": filter},
+		{"$group": bson.M{
+			"_id":   nil,
+			"min":   bson.M{"$min": "$" + field},
+			"max":   bson.M{"$max": "$" + field},
+			"avg":   bson.M{"$avg": "$" + field},
+			"sum":   bson.M{"$sum": "$" + field},
+			"count": bson.M{"$sum": 1},
+		}},
+	}, nil
+}
+
+// CountDistinct returns the number of distinct values of field in the documents matching the
+// filter of req. Unlike Distinct it does not load the values, so it can be used for fields
+// with many distinct values. Requires MongoDB 3.4 or newer.
+//     n, _ := mq.CountDistinct(req, "customerid") // number of customers with matching orders
+func (mq *MongoQuery) CountDistinct(req *http.Request, field string) (int, error) {
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		return 0, err
+	}
+	pipeline, err := mq.countDistinctPipeline(spec.Filter, field)
+	if err != nil {
+		return 0, err
+	}
+	result := struct {
+		Count int `bson:"count"`
+	}{}
+	err = mq.collection().Pipe(pipeline).One(&result)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, merry.Prepend(err, "could not execute count distinct pipeline").WithHTTPCode(http.StatusInternalServerError)
+	}
+	return result.Count, nil
+}
+
+// countDistinctPipeline returns the aggregation pipeline counting the distinct values of field
+// in the documents matching filter. Arrays are unwound, so their elements are counted like
+// Distinct does.
+func (mq *MongoQuery) countDistinctPipeline(filter bson.M, field string) ([]bson.M, error) {
+	field = mq.resolveAlias(field)
+	_, ok := mq.supportedParameters[field]
+	if _, isMeta := validMetaParameters[field]; !ok || isMeta {
+		return nil, merry.Wrap(fmt.Errorf("parameter '%s' is not supported", field)).WithHTTPCode(http.StatusBadRequest)
+	}
+	pipeline := []bson.M{{"$match": filter}}
+	typ := reflect.TypeOf(mq.endPointStruct)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if v, ok := fieldByParameterName(reflect.New(typ).Elem(), field); ok && v.Kind() == reflect.Slice {
+		pipeline = append(pipeline, bson.M{"$unwind": "$" + field})
+	}
+	return append(pipeline,
+		bson.M{"$group": bson.M{"_id": "$" + field}},
+		bson.M{"$count": "count"},
+	), nil
+}
+
+// CreateFieldCountPipeline returns an aggregation pipeline that matches the documents matching
+// the filter of req with at least min and at most max top level fields, including _id. A
+// negative bound is not checked. This is meant for data quality checks, since the number of
+// fields of every matching document has to be computed. Requires MongoDB 3.6 or newer.
+//     p, _ := mq.CreateFieldCountPipeline(req, 10, -1) // documents with 10 or more fields
+//     err := db.C("people").Pipe(p).All(&result)
+func (mq *MongoQuery) CreateFieldCountPipeline(req *http.Request, min, max int) ([]bson.M, error) {
+	if min >= 0 && max >= 0 && min > max {
+		return nil, merry.Wrap(fmt.Errorf("min %d is greater than max %d", min, max)).WithHTTPCode(http.StatusBadRequest)
+	}
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		return nil, err
+	}
+	return fieldCountPipeline(spec.Filter, min, max), nil
+}
+
+// fieldCountPipeline returns the aggregation pipeline that matches the documents matching filter
+// with a number of fields between min and max.
+func fieldCountPipeline(filter bson.M, min, max int) []bson.M {
+	pipeline := []bson.M{{"$match": filter}}
+	size := bson.M{"$size": bson.M{"$objectToArray": "$$ROOT"}}
+	conditions := []interface{}{}
+	if min >= 0 {
+		conditions = append(conditions, bson.M{"$gte": []interface{}{size, min}})
+	}
+	if max >= 0 {
+		conditions = append(conditions, bson.M{"$lte": []interface{}{size, max}})
+	}
+	switch len(conditions) {
+	case 0:
+		return pipeline
+	case 1:
+		return append(pipeline, bson.M{"$match": bson.M{"$expr": conditions[0]}})
+	}
+	return append(pipeline, bson.M{"$match": bson.M{"$expr": bson.M{"$and": conditions}}})
+}
+
+// Bucket contains the number of documents in the time interval starting at Start.
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// timeSeriesIntervals contains the supported intervals of a time series with the format
+// of the bucket key and the corresponding time layout.
+var timeSeriesIntervals = map[string][2]string{
+	"hour":  {"%Y-%m-%dT%H", "2006-01-02T15"},
+	"day":   {"%Y-%m-%d", "2006-01-02"},
+	"week":  {"%G-%V", ""},
+	"month": {"%Y-%m", "2006-01"},
+}
+
+// maxFilledBuckets is the maximum number of buckets of a zero-filled time series.
+const maxFilledBuckets = 10000
+
+// SetTimeSeriesZeroFill enables or disables adding empty buckets for the intervals without
+// documents to the buckets returned by TimeSeries. The buckets are filled between the bounds of
+// the range filter of the time field, like /?createdat__gte=2015-03-01&createdat__lt=2015-04-01,
+// and between the first and the last bucket if the request has no such bounds. Requests for
+// more than 10000 buckets are rejected with 400.
+func (mq *MongoQuery) SetTimeSeriesZeroFill(fill bool) {
+	mq.timeSeriesZeroFill = fill
+}
+
+// TimeSeries returns the number of documents matching the request per interval of the time
+// field. The interval is one of hour, day, week or month, buckets are in UTC and weeks are
+// ISO weeks starting on monday.
+func (mq *MongoQuery) TimeSeries(req *http.Request, field string, interval string) ([]Bucket, error) {
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := mq.timeSeriesPipeline(spec.Filter, field, interval)
+	if err != nil {
+		return nil, err
+	}
+	result := []struct {
+		Key   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}{}
+	if err := mq.collection().Pipe(pipeline).All(&result); err != nil {
+		return nil, merry.Prepend(err, "could not execute time series pipeline").WithHTTPCode(http.StatusInternalServerError)
+	}
+	buckets := []Bucket{}
+	for _, r := range result {
+		start, err := bucketStart(r.Key, interval)
+		if err != nil {
+			return nil, merry.Wrap(err).WithHTTPCode(http.StatusInternalServerError)
+		}
+		buckets = append(buckets, Bucket{Start: start, Count: r.Count})
+	}
+	if mq.timeSeriesZeroFill {
+		lower, upper := timeRange(spec.Filter, mq.resolveAlias(field))
+		return fillBuckets(buckets, interval, lower, upper)
+	}
+	return buckets, nil
+}
+
+// timeSeriesPipeline returns the aggregation pipeline that counts the documents matching filter
+// per interval of field.
+func (mq *MongoQuery) timeSeriesPipeline(filter bson.M, field, interval string) ([]bson.M, error) {
+	field = mq.resolveAlias(field)
+	if !mq.isTimeParameter(field) {
+		return nil, merry.Wrap(fmt.Errorf("parameter '%s' is not a time field", field)).WithHTTPCode(http.StatusBadRequest)
+	}
+	format, ok := timeSeriesIntervals[interval]
+	if !ok {
+		return nil, merry.Wrap(fmt.Errorf("unsupported interval: %s", interval)).WithHTTPCode(http.StatusBadRequest)
+	}
+	return []bson.M{
+		{"$match": filter},
+		{"$group": bson.M{
+			"_id":   bson.M{"$dateToString": bson.M{"format": format[0], "date": "$" + field}},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}, nil
+}
+
+// bucketStart returns the start of the bucket with key.
+func bucketStart(key, interval string) (time.Time, error) {
+	if interval != "week" {
+		return time.Parse(timeSeriesIntervals[interval][1], key)
+	}
+	var year, week int
+	if _, err := fmt.Sscanf(key, "%d-%d", &year, &week); err != nil {
+		return time.Time{}, fmt.Errorf("invalid week bucket: %s", key)
+	}
+	// the 4th of january is always in the first ISO week
+	jan4 := time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC)
+	monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+	return monday.AddDate(0, 0, (week-1)*7), nil
+}
+
+// nextBucket returns the start of the bucket following the bucket starting at t.
+func nextBucket(t time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return t.Add(time.Hour)
+	case "day":
+		return t.AddDate(0, 0, 1)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	}
+	return t.AddDate(0, 1, 0)
+}
+
+// timeRange returns the bounds of the range filter of field in filter. The upper bound is
+// exclusive. A missing bound is the zero time.
+func timeRange(filter bson.M, field string) (lower, upper time.Time) {
+	doc, ok := filter[field].(map[string]interface{})
+	if !ok {
+		return lower, upper
+	}
+	for op, v := range doc {
+		t, ok := v.(time.Time)
+		if !ok {
+			continue
+		}
+		switch op {
+		case "$gt", "$gte":
+			lower = t
+		case "$lt":
+			upper = t
+		case "$lte":
+			upper = t.Add(time.Nanosecond)
+		}
+	}
+	return lower, upper
+}
+
+// truncateToBucket returns the start of the bucket containing t.
+func truncateToBucket(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	switch interval {
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// fillBuckets adds empty buckets for the missing intervals of the sorted buckets from the
+// bucket containing lower to the bucket containing the end of the exclusive upper bound. Zero
+// bounds are replaced by the first and the last bucket.
+func fillBuckets(buckets []Bucket, interval string, lower, upper time.Time) ([]Bucket, error) {
+	if len(buckets) == 0 && (lower.IsZero() || upper.IsZero()) {
+		return buckets, nil
+	}
+	next := truncateToBucket(lower, interval)
+	if lower.IsZero() {
+		next = buckets[0].Start
+	}
+	end := upper
+	if upper.IsZero() {
+		end = nextBucket(buckets[len(buckets)-1].Start, interval)
+	}
+	filled := []Bucket{}
+	for _, b := range buckets {
+		for next.Before(b.Start) && next.Before(end) {
+			filled = append(filled, Bucket{Start: next})
+			next = nextBucket(next, interval)
+			if len(filled) > maxFilledBuckets {
+				return nil, merry.Wrap(fmt.Errorf("time series has more than %d buckets", maxFilledBuckets)).WithHTTPCode(http.StatusBadRequest)
+			}
+		}
+		filled = append(filled, b)
+		next = nextBucket(b.Start, interval)
+	}
+	for next.Before(end) {
+		filled = append(filled, Bucket{Start: next})
+		next = nextBucket(next, interval)
+		if len(filled) > maxFilledBuckets {
+			return nil, merry.Wrap(fmt.Errorf("time series has more than %d buckets", maxFilledBuckets)).WithHTTPCode(http.StatusBadRequest)
+		}
+	}
+	return filled, nil
+}
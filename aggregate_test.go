@@ -0,0 +1,252 @@
+package mqb
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestStatsPipeline(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	p, err := mq.statsPipeline(bson.M{"mybool": true}, "intMember")
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(p, []bson.M{
+		{"$match": bson.M{"mybool": true}},
+		{"$group": bson.M{
+			"_id":   nil,
+			"min":   bson.M{"$min": "$intMember"},
+			"max":   bson.M{"$max": "$intMember"},
+			"avg":   bson.M{"$avg": "$intMember"},
+			"sum":   bson.M{"$sum": "$intMember"},
+			"count": bson.M{"$sum": 1},
+		}},
+	}) {
+		t.Errorf("wrong pipeline generated: %v", p)
+	}
+
+	for _, field := range []string{"stringmember", "mybool", "notAMember"} {
+		if _, err := mq.statsPipeline(bson.M{}, field); err == nil {
+			t.Errorf("stats for non numeric field %s did not produce an error", field)
+		}
+	}
+}
+
+func TestStatsDecoding(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	p, err := mq.statsPipeline(bson.M{}, "intMember")
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	// every output field of the $group stage is decoded
+	tags := map[string]bool{"_id": true}
+	typ := reflect.TypeOf(Stats{})
+	for i := 0; i < typ.NumField(); i++ {
+		tags[typ.Field(i).Tag.Get("bson")] = true
+	}
+	group := p[len(p)-1]["$group"].(bson.M)
+	for field := range group {
+		if !tags[field] {
+			t.Errorf("output field %s of the pipeline is not decoded", field)
+		}
+	}
+	if len(group) != len(tags) {
+		t.Errorf("not all fields of Stats are computed by the pipeline: %v", group)
+	}
+
+	// the types of the output for the values 1, 2 and 6: $min, $max and $sum keep the type of
+	// the field, $avg is a double and the count an int
+	for name, values := range map[string][]interface{}{
+		"int":    {int(1), int(6), int(9)},
+		"long":   {int64(1), int64(6), int64(9)},
+		"double": {1.0, 6.0, 9.0},
+	} {
+		b, err := bson.Marshal(bson.M{"_id": nil, "min": values[0], "max": values[1], "avg": 3.0, "sum": values[2], "count": 3})
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		stats := Stats{}
+		if err := bson.Unmarshal(b, &stats); err != nil {
+			t.Fatalf("%s: error occured: %s", name, err)
+		}
+		if stats != (Stats{Min: 1, Max: 6, Avg: 3, Sum: 9, Count: 3}) {
+			t.Errorf("%s: wrong stats decoded: %v", name, stats)
+		}
+	}
+}
+
+func TestTimeSeriesPipeline(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	p, err := mq.timeSeriesPipeline(bson.M{"mybool": true}, "timemember", "day")
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(p, []bson.M{
+		{"$match": bson.M{"mybool": true}},
+		{"$group": bson.M{
+			"_id":   bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$timemember"}},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}) {
+		t.Errorf("wrong pipeline generated: %v", p)
+	}
+
+	for field, interval := range map[string]string{"intMember": "day", "embeddedmember": "day", "timemember": "year"} {
+		if _, err := mq.timeSeriesPipeline(bson.M{}, field, interval); err == nil {
+			t.Errorf("time series for %s per %s did not produce an error", field, interval)
+		}
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	for key, expected := range map[[2]string]time.Time{
+		{"2015-03-01T13", "hour"}: time.Date(2015, 3, 1, 13, 0, 0, 0, time.UTC),
+		{"2015-03-01", "day"}:     time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC),
+		{"2015-03", "month"}:      time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC),
+		{"2015-01", "week"}:       time.Date(2014, 12, 29, 0, 0, 0, 0, time.UTC),
+		{"2015-10", "week"}:       time.Date(2015, 3, 2, 0, 0, 0, 0, time.UTC),
+		{"2015-53", "week"}:       time.Date(2015, 12, 28, 0, 0, 0, 0, time.UTC),
+	} {
+		start, err := bucketStart(key[0], key[1])
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if !start.Equal(expected) {
+			t.Errorf("wrong start %s for %v", start, key)
+		}
+	}
+}
+
+func TestFillBuckets(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2015, 3, d, 0, 0, 0, 0, time.UTC) }
+	buckets, err := fillBuckets([]Bucket{{day(1), 2}, {day(2), 1}, {day(5), 3}}, "day", time.Time{}, time.Time{})
+	if err != nil || !reflect.DeepEqual(buckets, []Bucket{{day(1), 2}, {day(2), 1}, {day(3), 0}, {day(4), 0}, {day(5), 3}}) {
+		t.Errorf("wrong buckets: %v, %v", buckets, err)
+	}
+	if buckets, err := fillBuckets([]Bucket{}, "day", time.Time{}, time.Time{}); err != nil || len(buckets) != 0 {
+		t.Error("empty buckets should stay empty")
+	}
+
+	// the buckets are filled between the bounds of the range filter
+	buckets, err = fillBuckets([]Bucket{{day(3), 2}}, "day", day(1).Add(12*time.Hour), day(5))
+	if err != nil || !reflect.DeepEqual(buckets, []Bucket{{day(1), 0}, {day(2), 0}, {day(3), 2}, {day(4), 0}}) {
+		t.Errorf("wrong buckets between the bounds: %v, %v", buckets, err)
+	}
+	buckets, err = fillBuckets([]Bucket{}, "day", day(1), day(3))
+	if err != nil || !reflect.DeepEqual(buckets, []Bucket{{day(1), 0}, {day(2), 0}}) {
+		t.Errorf("wrong buckets without documents: %v, %v", buckets, err)
+	}
+	buckets, err = fillBuckets([]Bucket{{day(2), 1}}, "day", time.Time{}, day(4))
+	if err != nil || !reflect.DeepEqual(buckets, []Bucket{{day(2), 1}, {day(3), 0}}) {
+		t.Errorf("wrong buckets with upper bound: %v, %v", buckets, err)
+	}
+	if _, err := fillBuckets([]Bucket{}, "hour", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), day(1)); err == nil {
+		t.Error("too many buckets did not produce an error")
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?timemember__gte=2015-03-01T00:00:00Z&timemember__lte=2015-03-31T00:00:00Z", nil)
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	lower, upper := timeRange(spec.Filter, "timemember")
+	if !lower.Equal(time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)) || !upper.Equal(time.Date(2015, 3, 31, 0, 0, 0, 1, time.UTC)) {
+		t.Errorf("wrong range: %s - %s", lower, upper)
+	}
+	if lower, upper := timeRange(bson.M{"mybool": true}, "timemember"); !lower.IsZero() || !upper.IsZero() {
+		t.Errorf("range of unfiltered field: %s - %s", lower, upper)
+	}
+	if start := truncateToBucket(time.Date(2015, 3, 5, 12, 0, 0, 0, time.UTC), "week"); !start.Equal(time.Date(2015, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong start of week: %s", start)
+	}
+}
+
+func TestCountDistinctPipeline(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddAlias("name", "stringmember")
+	p, err := mq.countDistinctPipeline(bson.M{"mybool": true}, "name")
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(p, []bson.M{
+		{"$match": bson.M{"mybool": true}},
+		{"$group": bson.M{"_id": "$stringmember"}},
+		{"$count": "count"},
+	}) {
+		t.Errorf("wrong pipeline generated: %v", p)
+	}
+
+	p, err = mq.countDistinctPipeline(bson.M{}, "strSliceMember")
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(p, []bson.M{
+		{"$match": bson.M{}},
+		{"$unwind": "$strSliceMember"},
+		{"$group": bson.M{"_id": "$strSliceMember"}},
+		{"$count": "count"},
+	}) {
+		t.Errorf("wrong pipeline generated for slice: %v", p)
+	}
+
+	for _, field := range []string{"notAMember", "limit"} {
+		if _, err := mq.countDistinctPipeline(bson.M{}, field); err == nil {
+			t.Errorf("unsupported field %s did not produce an error", field)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/?notAMember=1", nil)
+	if _, err := mq.CountDistinct(req, "stringmember"); err == nil {
+		t.Error("invalid request did not produce an error")
+	}
+}
+
+func TestFieldCountPipeline(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	size := bson.M{"$size": bson.M{"$objectToArray": "$$ROOT"}}
+	req, _ := http.NewRequest("GET", "/?mybool=true", nil)
+	p, err := mq.CreateFieldCountPipeline(req, 2, 10)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(p, []bson.M{
+		{"$match": bson.M{"mybool": true}},
+		{"$match": bson.M{"$expr": bson.M{"$and": []interface{}{
+			bson.M{"$gte": []interface{}{size, 2}},
+			bson.M{"$lte": []interface{}{size, 10}},
+		}}}},
+	}) {
+		t.Errorf("wrong pipeline generated: %v", p)
+	}
+
+	p, err = mq.CreateFieldCountPipeline(req, 10, -1)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(p, []bson.M{
+		{"$match": bson.M{"mybool": true}},
+		{"$match": bson.M{"$expr": bson.M{"$gte": []interface{}{size, 10}}}},
+	}) {
+		t.Errorf("wrong pipeline generated for min: %v", p)
+	}
+
+	if p := fieldCountPipeline(bson.M{}, -1, -1); !reflect.DeepEqual(p, []bson.M{{"$match": bson.M{}}}) {
+		t.Errorf("wrong pipeline generated without bounds: %v", p)
+	}
+
+	if _, err := mq.CreateFieldCountPipeline(req, 10, 2); err == nil {
+		t.Error("min greater than max did not produce an error")
+	}
+	req, _ = http.NewRequest("GET", "/?notAMember=1", nil)
+	if _, err := mq.CreateFieldCountPipeline(req, 1, 2); err == nil {
+		t.Error("unsupported parameter did not produce an error")
+	}
+}
@@ -0,0 +1,74 @@
+package mqb
+
+import (
+	"fmt"
+
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// SetInBatching splits the $in filter of the parameter into batches of at most size values if
+// a request contains more values, like /?id=1&id=2&... with thousands of ids. The batches are
+// run as separate queries, see SetMaxConcurrentSubqueries, their documents are merged, sorted
+// and paginated as if they were the result of one query, and their counts are summed.
+//
+// Every batch loads the documents up to the end of the requested page, so the memory usage
+// grows with the number of batches and the page number, and requests without limit load all
+// matching documents. Batching is therefore meant for MongoQuery instances of internal or batch
+// endpoints. Requests with cursors are rejected and aggregation pipelines are not supported with
+// batches. The parameter must not be an array, since a document could match several batches.
+func (mq *MongoQuery) SetInBatching(parameter string, size int) error {
+	parameter = mq.resolveAlias(parameter)
+	if _, ok := mq.supportedParameters[parameter]; !ok {
+		return fmt.Errorf("parameter '%s' is not supported", parameter)
+	}
+	if mq.isArrayParameter(parameter) {
+		return fmt.Errorf("parameter '%s' is an array", parameter)
+	}
+	if size <= 0 {
+		return fmt.Errorf("invalid batch size %d", size)
+	}
+	mq.batchParameter = parameter
+	mq.batchSize = size
+	return nil
+}
+
+// inBatches returns the values of the $in filter of the batch parameter in spec split into
+// batches, or nil if the filter has no more values than the batch size.
+func (mq *MongoQuery) inBatches(spec *QuerySpec) [][]interface{} {
+	if len(mq.batchParameter) == 0 {
+		return nil
+	}
+	doc, ok := spec.Filter[mq.batchParameter].(map[string]interface{})
+	if !ok || len(doc) != 1 {
+		return nil
+	}
+	values, ok := doc["$in"].([]interface{})
+	if !ok || len(values) <= mq.batchSize {
+		return nil
+	}
+	batches := [][]interface{}{}
+	for len(values) > mq.batchSize {
+		batches = append(batches, values[:mq.batchSize])
+		values = values[mq.batchSize:]
+	}
+	return append(batches, values)
+}
+
+// batchSpecs returns a copy of spec per batch of values of the batch parameter, without paging.
+// The projection of the copies contains the sort fields, see mergeProjection.
+func (mq *MongoQuery) batchSpecs(spec *QuerySpec, batches [][]interface{}) []*QuerySpec {
+	specs := []*QuerySpec{}
+	for _, values := range batches {
+		filter := bson.M{}
+		for k, v := range spec.Filter {
+			filter[k] = v
+		}
+		filter[mq.batchParameter] = map[string]interface{}{"$in": values}
+		batch := *spec
+		batch.Filter = filter
+		batch.Page = Page{Current: 1}
+		batch.Fields, _ = mergeProjection(spec.Fields, spec.Sort)
+		specs = append(specs, &batch)
+	}
+	return specs
+}
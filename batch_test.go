@@ -0,0 +1,220 @@
+package mqb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestInBatching(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	for parameter, size := range map[string]int{"notAMember": 10, "strSliceMember": 10, "intMember": 0} {
+		if err := mq.SetInBatching(parameter, size); err == nil {
+			t.Errorf("invalid batching of %s with size %d did not produce an error", parameter, size)
+		}
+	}
+	if err := mq.SetInBatching("intMember", 10); err != nil {
+		t.Fatal(err)
+	}
+	values := []string{}
+	for i := 1; i <= 25; i++ {
+		values = append(values, "intMember="+strconv.Itoa(i))
+	}
+	req := httptest.NewRequest("GET", "/?"+strings.Join(values, "&")+"&sort=-intMember&limit=5&page=2", nil)
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := mq.inBatches(spec)
+	if len(batches) != 3 || len(batches[0]) != 10 || len(batches[1]) != 10 || len(batches[2]) != 5 {
+		t.Errorf("wrong batches: %v", batches)
+	}
+
+	// the documents of the queries are the values of their $in filters
+	var mu sync.Mutex
+	argsOf := make(map[*mgo.Query]queryArgs)
+	mq.find = func(c *mgo.Collection, args queryArgs) *mgo.Query {
+		q := findQuery(c, args)
+		mu.Lock()
+		argsOf[q] = args
+		mu.Unlock()
+		return q
+	}
+	inValues := func(q *mgo.Query) []interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return argsOf[q].filter["intMember"].(map[string]interface{})["$in"].([]interface{})
+	}
+	loaded := [][]interface{}{}
+	mq.count = func(q *mgo.Query) (int, error) {
+		return len(inValues(q)), nil
+	}
+	mq.all = func(q *mgo.Query, content interface{}) error {
+		values := inValues(q)
+		mu.Lock()
+		loaded = append(loaded, values)
+		mu.Unlock()
+		docs := reflect.ValueOf(content).Elem()
+		for _, v := range values {
+			docs.Set(reflect.Append(docs, reflect.ValueOf(TestStruct{IntMember: int64(v.(int))})))
+		}
+		return nil
+	}
+	r, err := mq.RunSpec(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i][0].(int) < loaded[j][0].(int) })
+	if !reflect.DeepEqual(loaded, batches) {
+		t.Errorf("wrong batches queried: %v", loaded)
+	}
+	if r.Page.Items != 25 || r.Page.Last != 5 {
+		t.Errorf("wrong page: %+v", r.Page)
+	}
+	got := []int64{}
+	for _, doc := range *r.Content.(*[]TestStruct) {
+		got = append(got, doc.IntMember)
+	}
+	if !reflect.DeepEqual(got, []int64{20, 19, 18, 17, 16}) {
+		t.Errorf("wrong content: %v", got)
+	}
+
+	// requests with fewer values than the batch size are run as one query
+	req = httptest.NewRequest("GET", "/?intMember=1&intMember=2", nil)
+	if spec, err = mq.ParseSpec(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if b := mq.inBatches(spec); b != nil {
+		t.Errorf("small $in is split into batches: %v", b)
+	}
+}
+
+func TestBatchSpecs(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	if err := mq.SetInBatching("intMember", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := mq.SetAllowedHints("intMember_1"); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/?intMember=1&intMember=2&intMember=3&mybool=true&hint=intMember_1&limit=1&page=2", nil)
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs := mq.batchSpecs(spec, mq.inBatches(spec))
+	if len(specs) != 2 {
+		t.Fatalf("wrong number of batches: %d", len(specs))
+	}
+	for i, values := range [][]interface{}{{1, 2}, {3}} {
+		batch := specs[i]
+		if !reflect.DeepEqual(batch.Filter, bson.M{"mybool": true, "intMember": map[string]interface{}{"$in": values}}) {
+			t.Errorf("wrong filter of batch %d: %v", i, batch.Filter)
+		}
+		if !reflect.DeepEqual(batch.hint, []string{"intMember"}) {
+			t.Errorf("hint of batch %d not kept: %v", i, batch.hint)
+		}
+		if batch.Page != (Page{Current: 1}) {
+			t.Errorf("batch %d is paged: %+v", i, batch.Page)
+		}
+	}
+	if len(spec.Filter["intMember"].(map[string]interface{})["$in"].([]interface{})) != 3 {
+		t.Errorf("filter of spec changed: %v", spec.Filter)
+	}
+}
+
+func TestInBatchingProjection(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	if err := mq.SetInBatching("intMember", 2); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/?intMember=1&intMember=2&intMember=3&field=stringmember&sort=-intMember", nil)
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs := mq.batchSpecs(spec, mq.inBatches(spec))
+	for i, batch := range specs {
+		if !reflect.DeepEqual(batch.Fields, bson.M{"stringmember": 1, "intMember": 1}) {
+			t.Errorf("sort field not selected by batch %d: %v", i, batch.Fields)
+		}
+	}
+	if !reflect.DeepEqual(spec.Fields, bson.M{"stringmember": 1}) {
+		t.Errorf("projection of spec changed: %v", spec.Fields)
+	}
+
+	// the batches return their documents with the selected sort field
+	var mu sync.Mutex
+	batches := [][]TestStruct{
+		{{StringMember: "a", IntMember: 1}, {StringMember: "b", IntMember: 2}},
+		{{StringMember: "c", IntMember: 3}},
+	}
+	mq.count = func(q *mgo.Query) (int, error) { return 1, nil }
+	mq.all = func(q *mgo.Query, content interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		reflect.ValueOf(content).Elem().Set(reflect.ValueOf(batches[0]))
+		batches = batches[1:]
+		return nil
+	}
+	r, err := mq.RunSpec(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs := *r.Content.(*[]TestStruct); !reflect.DeepEqual(docs, []TestStruct{{StringMember: "c"}, {StringMember: "b"}, {StringMember: "a"}}) {
+		t.Errorf("wrong content: %v", docs)
+	}
+}
+
+func TestInBatchingResponse(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.SetCursorSecret([]byte("secret"))
+	if err := mq.SetInBatching("intMember", 2); err != nil {
+		t.Fatal(err)
+	}
+	mq.count = func(q *mgo.Query) (int, error) { return 1, nil }
+	mq.all = func(q *mgo.Query, content interface{}) error {
+		docs := reflect.ValueOf(content).Elem()
+		docs.Set(reflect.Append(docs, reflect.ValueOf(TestStruct{IntMember: 1})))
+		return nil
+	}
+	hooked := 0
+	mq.SetQueryHook(func(req *http.Request, info QueryInfo) {
+		hooked++
+		if info.Err == nil && info.Items != 2 {
+			t.Errorf("wrong items in query info: %d", info.Items)
+		}
+	})
+
+	req := httptest.NewRequest("GET", "/?intMember=1&intMember=2&intMember=3&sort=intMember", nil)
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := mq.RunSpec(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hooked != 1 || r.Page.Items != 2 || len(*r.Content.(*[]TestStruct)) != 2 {
+		t.Errorf("wrong response of batches: %+v, hook called %d times", r, hooked)
+	}
+
+	cursor, _ := mq.EncodeCursor([]interface{}{1})
+	req = httptest.NewRequest("GET", "/?intMember=1&intMember=2&intMember=3&sort=intMember&after="+cursor, nil)
+	if spec, err = mq.ParseSpec(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mq.RunSpec(context.Background(), spec); merry.HTTPCode(err) != http.StatusBadRequest || hooked != 2 {
+		t.Errorf("cursor with batches did not produce an error: %v", err)
+	}
+}
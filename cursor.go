@@ -0,0 +1,196 @@
+package mqb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// cursorMACSize is the number of bytes of the signature appended to a cursor.
+const cursorMACSize = 16
+
+// SetCursorSecret enables cursor pagination with opaque cursors signed with secret. A response
+// to a sorted request then contains a next and a previous cursor, which can be passed with the
+// after and before parameters to get the documents after the last or before the first document:
+//     /?sort=name&after=<nextCursor>
+func (mq *MongoQuery) SetCursorSecret(secret []byte) {
+	mq.cursorSecret = secret
+}
+
+// EncodeCursor encodes the sort values of a document into an opaque cursor.
+func (mq *MongoQuery) EncodeCursor(values []interface{}) (string, error) {
+	if len(mq.cursorSecret) == 0 {
+		return "", errors.New("cursor pagination is not enabled")
+	}
+	payload, err := bson.Marshal(bson.M{"v": values})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(payload, mq.cursorMAC(payload)...)), nil
+}
+
+// DecodeCursor decodes the sort values from a cursor created with EncodeCursor. An error is
+// returned if the cursor is malformed or was tampered with.
+func (mq *MongoQuery) DecodeCursor(cursor string) ([]interface{}, error) {
+	if len(mq.cursorSecret) == 0 {
+		return nil, merry.Wrap(errors.New("cursor pagination is not enabled")).WithHTTPCode(http.StatusBadRequest)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) <= cursorMACSize {
+		return nil, merry.Wrap(errors.New("malformed cursor")).WithHTTPCode(http.StatusBadRequest)
+	}
+	payload, mac := b[:len(b)-cursorMACSize], b[len(b)-cursorMACSize:]
+	if !hmac.Equal(mac, mq.cursorMAC(payload)) {
+		return nil, merry.Wrap(errors.New("invalid cursor")).WithHTTPCode(http.StatusBadRequest)
+	}
+	doc := struct {
+		V []interface{} `bson:"v"`
+	}{}
+	if err := bson.Unmarshal(payload, &doc); err != nil {
+		return nil, merry.Wrap(errors.New("malformed cursor")).WithHTTPCode(http.StatusBadRequest)
+	}
+	return doc.V, nil
+}
+
+// cursorMAC returns the signature of payload.
+func (mq *MongoQuery) cursorMAC(payload []byte) []byte {
+	h := hmac.New(sha256.New, mq.cursorSecret)
+	h.Write(payload)
+	return h.Sum(nil)[:cursorMACSize]
+}
+
+// cursorFilter returns the filter that matches the documents after (or before if before is true)
+// the document with the given values for the sort fields.
+func cursorFilter(sortFields []string, values []interface{}, before bool) map[string]interface{} {
+	or := []interface{}{}
+	for i, field := range sortFields {
+		clause := map[string]interface{}{}
+		for j := 0; j < i; j++ {
+			clause[strings.TrimPrefix(sortFields[j], "-")] = values[j]
+		}
+		operator := "$gt"
+		if strings.HasPrefix(field, "-") != before {
+			operator = "$lt"
+		}
+		clause[strings.TrimPrefix(field, "-")] = map[string]interface{}{operator: values[i]}
+		or = append(or, clause)
+	}
+	if len(or) == 1 {
+		return or[0].(map[string]interface{})
+	}
+	return map[string]interface{}{"$or": or}
+}
+
+// addCursorFilter adds the filter for the after or before parameter of req to spec.
+func (mq *MongoQuery) addCursorFilter(req *http.Request, spec *QuerySpec) error {
+	_, isAfter := req.URL.Query()["after"]
+	_, isBefore := req.URL.Query()["before"]
+	if !isAfter && !isBefore {
+		return nil
+	}
+	if isAfter && isBefore {
+		return merry.Wrap(errors.New("after cannot be combined with before")).WithHTTPCode(http.StatusBadRequest)
+	}
+	if _, ok := req.URL.Query()["page"]; ok {
+		return merry.Wrap(errors.New("page cannot be combined with a cursor")).WithHTTPCode(http.StatusBadRequest)
+	}
+	if len(spec.Sort) == 0 {
+		return merry.Wrap(errors.New("cursor pagination requires a sort")).WithHTTPCode(http.StatusBadRequest)
+	}
+	cursor := req.URL.Query().Get("after")
+	if isBefore {
+		cursor = req.URL.Query().Get("before")
+	}
+	values, err := mq.DecodeCursor(cursor)
+	if err != nil {
+		return err
+	}
+	if len(values) != len(spec.Sort) {
+		return merry.Wrap(errors.New("cursor does not match the sort")).WithHTTPCode(http.StatusBadRequest)
+	}
+	addAndClause(spec.Filter, cursorFilter(spec.Sort, values, isBefore))
+	spec.cursor = true
+	if isBefore {
+		// the documents before the cursor are fetched in reverse order and reversed again
+		// after they have been fetched
+		for i, field := range spec.Sort {
+			if strings.HasPrefix(field, "-") {
+				spec.Sort[i] = strings.TrimPrefix(field, "-")
+			} else {
+				spec.Sort[i] = "-" + field
+			}
+			if err := mq.checkSortDirection(strings.TrimPrefix(spec.Sort[i], "-"), strings.HasPrefix(spec.Sort[i], "-")); err != nil {
+				return merry.Prepend(err, "before cannot be used with this sort")
+			}
+		}
+		spec.reverse = true
+	}
+	return nil
+}
+
+// setCursors sets the next and previous cursor of response from the last and first document
+// of content.
+func (mq *MongoQuery) setCursors(response *Response, spec *QuerySpec, content interface{}) error {
+	s := reflect.ValueOf(content).Elem()
+	if len(mq.cursorSecret) == 0 || len(spec.Sort) == 0 || s.Len() == 0 {
+		return nil
+	}
+	first, ok := sortValues(s.Index(0), spec.Sort)
+	if !ok {
+		return nil
+	}
+	last, _ := sortValues(s.Index(s.Len()-1), spec.Sort)
+	var err error
+	if response.PrevCursor, err = mq.EncodeCursor(first); err != nil {
+		return fmt.Errorf("could not encode cursor: %s", err)
+	}
+	if response.NextCursor, err = mq.EncodeCursor(last); err != nil {
+		return fmt.Errorf("could not encode cursor: %s", err)
+	}
+	return nil
+}
+
+// SetPageBoundaries defines if the page of a sorted response contains the values of the sort
+// fields of its first and last document. Clients can compare them with the boundaries of the
+// adjacent pages to detect overlaps or gaps if the data changed during the pagination:
+//     /?sort=name&page=2 returns {"page": {"boundaries": {"first": ["jane"], "last": ["kate"]}, ...}, ...}
+func (mq *MongoQuery) SetPageBoundaries(boundaries bool) {
+	mq.pageBoundaries = boundaries
+}
+
+// setBoundaries sets the boundaries of page from the first and last document of content
+// if the documents are sorted by sortFields.
+func setBoundaries(page *Page, sortFields []string, content interface{}) {
+	s := reflect.ValueOf(content).Elem()
+	if len(sortFields) == 0 || s.Len() == 0 {
+		return
+	}
+	first, ok := sortValues(s.Index(0), sortFields)
+	if !ok {
+		return
+	}
+	last, _ := sortValues(s.Index(s.Len()-1), sortFields)
+	page.Boundaries = &Boundaries{First: first, Last: last}
+}
+
+// sortValues returns the values of the sort fields of doc. The bool value is false if
+// a sort field is not a field of doc.
+func sortValues(doc reflect.Value, sortFields []string) ([]interface{}, bool) {
+	values := []interface{}{}
+	for _, field := range sortFields {
+		v, ok := fieldByParameterName(doc, strings.TrimPrefix(field, "-"))
+		if !ok {
+			return nil, false
+		}
+		values = append(values, v.Interface())
+	}
+	return values, true
+}
@@ -0,0 +1,127 @@
+package mqb
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestEncodeDecodeCursor(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if _, err := mq.EncodeCursor([]interface{}{1}); err == nil {
+		t.Error("cursor without secret did not produce an error")
+	}
+
+	mq.SetCursorSecret([]byte("secret"))
+	id := bson.NewObjectId()
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	cursor, err := mq.EncodeCursor([]interface{}{"peter", 42, 1.5, id, now})
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	values, err := mq.DecodeCursor(cursor)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if len(values) != 5 || values[0] != "peter" || values[1] != 42 || values[2] != 1.5 || values[3] != id || !values[4].(time.Time).Equal(now) {
+		t.Errorf("wrong values decoded: %v", values)
+	}
+
+	tampered := []byte(cursor)
+	tampered[5] ^= 1
+	for _, c := range []string{string(tampered), cursor[:len(cursor)-2], "not a cursor", ""} {
+		if _, err := mq.DecodeCursor(c); err == nil {
+			t.Errorf("invalid cursor '%s' did not produce an error", c)
+		}
+	}
+
+	other := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	other.SetCursorSecret([]byte("other secret"))
+	if _, err := other.DecodeCursor(cursor); err == nil {
+		t.Error("cursor with other secret did not produce an error")
+	}
+}
+
+func TestCursorFilter(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetCursorSecret([]byte("secret"))
+	cursor, _ := mq.EncodeCursor([]interface{}{"peter", 42})
+
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true&sort=stringmember&sort=-intMember&after="+cursor, nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(spec.Filter, bson.M{
+		"mybool": true,
+		"$and": []interface{}{
+			map[string]interface{}{"$or": []interface{}{
+				map[string]interface{}{"stringmember": map[string]interface{}{"$gt": "peter"}},
+				map[string]interface{}{"stringmember": "peter", "intMember": map[string]interface{}{"$lt": 42}},
+			}},
+		},
+	}) {
+		t.Errorf("wrong filter generated: %v", spec.Filter)
+	}
+
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?sort=stringmember&sort=-intMember&before="+cursor, nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(spec.Sort, []string{"-stringmember", "intMember"}) || !spec.reverse {
+		t.Errorf("wrong sort for before cursor: %v", spec.Sort)
+	}
+	if !strings.Contains(fmt.Sprint(spec.Filter), "$lt:peter") {
+		t.Errorf("wrong filter generated: %v", spec.Filter)
+	}
+
+	for _, query := range []string{"/?after=" + cursor, "/?sort=stringmember&after=" + cursor, "/?sort=stringmember&sort=intMember&after=x", "/?sort=stringmember&sort=intMember&page=2&after=" + cursor, "/?sort=stringmember&sort=intMember&before=" + cursor + "&after=" + cursor} {
+		if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil)); err == nil {
+			t.Errorf("query %s did not produce an error", query)
+		}
+	}
+}
+
+func TestSetCursors(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetCursorSecret([]byte("secret"))
+	content := &[]TestStruct{{StringMember: "a", IntMember: 1}, {StringMember: "b", IntMember: 2}}
+	response := &Response{}
+	if err := mq.setCursors(response, &QuerySpec{Sort: []string{"stringmember", "-intMember"}}, content); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	prev, _ := mq.DecodeCursor(response.PrevCursor)
+	next, _ := mq.DecodeCursor(response.NextCursor)
+	if !reflect.DeepEqual(prev, []interface{}{"a", int64(1)}) || !reflect.DeepEqual(next, []interface{}{"b", int64(2)}) {
+		t.Errorf("wrong cursors: %v %v", prev, next)
+	}
+}
+
+func TestSetBoundaries(t *testing.T) {
+	content := &[]TestStruct{{StringMember: "a", IntMember: 3}, {StringMember: "b", IntMember: 2}, {StringMember: "c", IntMember: 1}}
+	page := Page{}
+	setBoundaries(&page, []string{"stringmember", "-intMember"}, content)
+	if !reflect.DeepEqual(page.Boundaries, &Boundaries{First: []interface{}{"a", int64(3)}, Last: []interface{}{"c", int64(1)}}) {
+		t.Errorf("wrong boundaries: %v", page.Boundaries)
+	}
+
+	page = Page{}
+	setBoundaries(&page, nil, content)
+	setBoundaries(&page, []string{"notAMember"}, content)
+	setBoundaries(&page, []string{"stringmember"}, &[]TestStruct{})
+	if page.Boundaries != nil {
+		t.Errorf("boundaries set without sort values: %v", page.Boundaries)
+	}
+
+	raw := &[]bson.M{{"name": "x", "n": 1}, {"name": "y"}}
+	setBoundaries(&page, []string{"-name"}, raw)
+	if !reflect.DeepEqual(page.Boundaries, &Boundaries{First: []interface{}{"x"}, Last: []interface{}{"y"}}) {
+		t.Errorf("wrong boundaries of raw documents: %v", page.Boundaries)
+	}
+}
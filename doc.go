@@ -15,4 +15,11 @@
 //     s := session.DB("dbname")
 //     q := s.C("people").Find(bson.M{"name": bson.RegExp{Pattern: "peter", Options: ""}, "age": 10}).Select(bson.M{"name": 1}).Limit(10).Skip(2).Sort("-name", "age")
 //
+// The package uses the driver gopkg.in/mgo.v2 per default. To use the maintained fork
+// github.com/globalsign/mgo instead, build with the tag globalsign:
+//
+//     go build -tags globalsign
+//
+// The databases passed to NewMongoQuery and the bson types of the filters are then those of
+// the fork.
 package mqb
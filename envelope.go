@@ -0,0 +1,141 @@
+package mqb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// EnvelopeConfig defines the shape of the JSON responses, see SetEnvelope.
+type EnvelopeConfig struct {
+	ContentKey     string                                           // ContentKey is the path of the content, content if empty.
+	PageKey        string                                           // PageKey is the path of the paging information, page if empty.
+	PageFieldNames map[string]string                                // PageFieldNames renames the fields of Page, like {"items": "total"}.
+	Build          func(content interface{}, page Page) interface{} // Build returns the whole response, the other fields are ignored if it is set.
+}
+
+// pageFieldNames are the JSON names of the fields of Page.
+var pageFieldNames = []string{"size", "items", "last", "current", "snapshot", "boundaries"}
+
+// responseKeys are the JSON names of the fields of Response besides the content and the page.
+var responseKeys = []string{"warnings", "nextCursor", "prevCursor", "applied", "syncedAt"}
+
+// SetEnvelope defines the shape of the JSON responses written by Handler, for example to comply
+// with an API standard:
+//     mq.SetEnvelope(mqb.EnvelopeConfig{ContentKey: "data", PageKey: "meta.pagination", PageFieldNames: map[string]string{"items": "total"}})
+//     {"data": [...], "meta": {"pagination": {"size": 10, "total": 42, "last": 5, "current": 1}}}
+// Keys with dots are nested objects. The other fields of Response, like warnings, keep their
+// names. A Build function replaces the whole response. Responses of Run can be converted with
+// Envelope. Per default the Response is serialized as it is.
+func (mq *MongoQuery) SetEnvelope(config EnvelopeConfig) error {
+	if config.Build == nil {
+		if len(config.ContentKey) == 0 {
+			config.ContentKey = "content"
+		}
+		if len(config.PageKey) == 0 {
+			config.PageKey = "page"
+		}
+		for _, key := range []string{config.ContentKey, config.PageKey} {
+			for _, segment := range strings.Split(key, ".") {
+				if len(segment) == 0 {
+					return fmt.Errorf("invalid envelope key '%s'", key)
+				}
+			}
+			if first := strings.Split(key, ".")[0]; contains(responseKeys, first) {
+				return fmt.Errorf("envelope key '%s' conflicts with the response field '%s'", key, first)
+			}
+		}
+		if isPathPrefix(config.ContentKey, config.PageKey) || isPathPrefix(config.PageKey, config.ContentKey) {
+			return fmt.Errorf("envelope keys '%s' and '%s' conflict", config.ContentKey, config.PageKey)
+		}
+		names := make(map[string]bool)
+		for field, name := range config.PageFieldNames {
+			if !contains(pageFieldNames, field) {
+				return fmt.Errorf("'%s' is not a field of the page", field)
+			}
+			if len(name) == 0 {
+				return fmt.Errorf("empty name for the page field '%s'", field)
+			}
+			names[name] = true
+		}
+		if len(names) != len(config.PageFieldNames) {
+			return fmt.Errorf("page field names are not unique: %v", config.PageFieldNames)
+		}
+		for _, field := range pageFieldNames {
+			if _, renamed := config.PageFieldNames[field]; !renamed && names[field] {
+				return fmt.Errorf("page field name '%s' is already used", field)
+			}
+		}
+	}
+	mq.envelope = &config
+	return nil
+}
+
+// isPathPrefix returns true if the dotted path prefix equals path or is one of its parents.
+func isPathPrefix(prefix, path string) bool {
+	return prefix == path || strings.HasPrefix(path, prefix+".")
+}
+
+// Envelope returns response in the shape defined with SetEnvelope, which is response itself if
+// no envelope is set.
+func (mq *MongoQuery) Envelope(response *Response) (interface{}, error) {
+	if mq.envelope == nil {
+		return response, nil
+	}
+	if mq.envelope.Build != nil {
+		return mq.envelope.Build(response.Content, response.Page), nil
+	}
+	rest := *response
+	rest.Content = nil
+	m, err := toJSONObject(&rest)
+	if err != nil {
+		return nil, err
+	}
+	delete(m, "page")
+	page, err := toJSONObject(&response.Page)
+	if err != nil {
+		return nil, err
+	}
+	renamed := make(map[string]interface{})
+	for field, v := range page {
+		if name, ok := mq.envelope.PageFieldNames[field]; ok {
+			field = name
+		}
+		renamed[field] = v
+	}
+	if response.Content != nil {
+		setPath(m, mq.envelope.ContentKey, response.Content)
+	}
+	setPath(m, mq.envelope.PageKey, renamed)
+	return m, nil
+}
+
+// toJSONObject returns the JSON object v is serialized to.
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// setPath sets the value at the dotted path in m, creating the parent objects.
+func setPath(m map[string]interface{}, path string, v interface{}) {
+	segments := strings.Split(path, ".")
+	for _, s := range segments[:len(segments)-1] {
+		child, ok := m[s].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			m[s] = child
+		}
+		m = child
+	}
+	m[segments[len(segments)-1]] = v
+}
@@ -0,0 +1,57 @@
+package mqb
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestEnvelope(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	response := &Response{
+		Content:  &[]TestStruct{{StringMember: "peter"}},
+		Page:     Page{Size: 20, Items: 1, Last: 1, Current: 1},
+		Warnings: []string{"slow"},
+	}
+	write := func() string {
+		w := httptest.NewRecorder()
+		mq.writeResponse(w, MediaTypeJSON, &QuerySpec{}, response)
+		return strings.TrimSpace(w.Body.String())
+	}
+	// the default is unchanged
+	if body := write(); !strings.HasPrefix(body, `{"content":[{"FloatMember":0`) || !strings.Contains(body, `"page":{"size":20,"items":1,"last":1,"current":1},"warnings":["slow"]}`) {
+		t.Errorf("wrong default response: %s", body)
+	}
+
+	for _, config := range []EnvelopeConfig{
+		{ContentKey: "data", PageKey: "data.page"},
+		{ContentKey: "meta", PageKey: "meta"},
+		{ContentKey: "warnings"},
+		{PageKey: "meta..pagination"},
+		{PageFieldNames: map[string]string{"total": "items"}},
+		{PageFieldNames: map[string]string{"items": "size"}},
+		{PageFieldNames: map[string]string{"items": "total", "last": "total"}},
+	} {
+		if err := mq.SetEnvelope(config); err == nil {
+			t.Errorf("invalid envelope %+v did not produce an error", config)
+		}
+	}
+
+	if err := mq.SetEnvelope(EnvelopeConfig{ContentKey: "data", PageKey: "meta.pagination", PageFieldNames: map[string]string{"items": "total", "size": "current", "current": "size"}}); err != nil {
+		t.Fatal(err)
+	}
+	if body := write(); !strings.HasPrefix(body, `{"data":[{"FloatMember":0`) || !strings.HasSuffix(body, `"meta":{"pagination":{"current":20,"last":1,"size":1,"total":1}},"warnings":["slow"]}`) {
+		t.Errorf("wrong response: %s", body)
+	}
+
+	if err := mq.SetEnvelope(EnvelopeConfig{Build: func(content interface{}, page Page) interface{} {
+		return map[string]interface{}{"results": content, "total": page.Items}
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if body := write(); !strings.HasPrefix(body, `{"results":[{"FloatMember":0`) || !strings.HasSuffix(body, `"total":1}`) {
+		t.Errorf("wrong built response: %s", body)
+	}
+}
@@ -0,0 +1,179 @@
+package mqb
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+// codes of validation errors
+const (
+	CodeInvalidValue         = "invalid_value"         // CodeInvalidValue is the code of an invalid parameter value.
+	CodeUnsupportedParameter = "unsupported_parameter" // CodeUnsupportedParameter is the code of a parameter that is not supported.
+	CodeConflict             = "conflict"              // CodeConflict is the code of parameters that contradict each other.
+	CodeMissingParameter     = "missing_parameter"     // CodeMissingParameter is the code of a required parameter that is missing.
+	CodeForbidden            = "forbidden"             // CodeForbidden is the code of a parameter the caller is not allowed to use.
+)
+
+type errorKey int
+
+const (
+	parameterKey errorKey = iota
+	codeKey
+)
+
+// Errors contains all validation errors of a request. Per default ParseSpec, Run and the
+// CreateQuery functions return an error wrapping Errors if a request has more than one invalid
+// parameter, the status code is the highest of the contained errors:
+//     var errs mqb.Errors
+//     if errors.As(err, &errs) {
+//         ...
+//     }
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the contained errors.
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// ErrorDetail describes a validation error.
+type ErrorDetail struct {
+	Parameter string `json:"parameter,omitempty"` // Parameter is the name of the invalid parameter.
+	Code      string `json:"code"`                // Code is the machine readable reason, like CodeInvalidValue.
+	Message   string `json:"message"`             // Message is the error message.
+}
+
+// Details returns the details of the validation errors in err. It returns nil if err contains
+// no validation errors.
+func Details(err error) []ErrorDetail {
+	var errs Errors
+	if !errors.As(err, &errs) {
+		if merry.Value(err, parameterKey) == nil && merry.Value(err, codeKey) == nil {
+			return nil
+		}
+		errs = Errors{err}
+	}
+	details := []ErrorDetail{}
+	for _, e := range errs {
+		d := ErrorDetail{Code: CodeInvalidValue, Message: e.Error()}
+		if p, ok := merry.Value(e, parameterKey).(string); ok {
+			d.Parameter = p
+		}
+		if c, ok := merry.Value(e, codeKey).(string); ok {
+			d.Code = c
+		}
+		details = append(details, d)
+	}
+	return details
+}
+
+// SetFailFast defines if parsing a request stops at the first validation error. Per default all
+// validation errors of a request are returned with Errors.
+func (mq *MongoQuery) SetFailFast(failFast bool) {
+	mq.failFast = failFast
+}
+
+// retryableCodes are the codes of server errors that are transient, like network errors and
+// elections of a new primary.
+var retryableCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	262:   true, // ExceededTimeLimit
+	9001:  true, // SocketException
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// IsRetryable returns true if err is caused by a transient database error, like a network
+// error or a primary that stepped down, so that the request can be retried. The errors returned
+// by Run and the other functions running queries wrap the error of mgo, which can be retrieved
+// with errors.As:
+//     var qErr *mgo.QueryError
+//     if errors.As(err, &qErr) { ... }
+// Validation errors, duplicate keys and documents that are not found are not retryable.
+func IsRetryable(err error) bool {
+	if err == nil || err == mgo.ErrNotFound || mgo.IsDup(err) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var qErr *mgo.QueryError
+	if errors.As(err, &qErr) {
+		return retryableCodes[qErr.Code]
+	}
+	var lastErr *mgo.LastError
+	if errors.As(err, &lastErr) {
+		return retryableCodes[lastErr.Code]
+	}
+	// mgo returns plain errors if no server can be reached or the session was closed
+	for errors.Unwrap(err) != nil {
+		err = errors.Unwrap(err)
+	}
+	return err.Error() == "no reachable servers" || err.Error() == "Closed explicitly"
+}
+
+// withCode adds the code to err.
+func withCode(err error, code string) error {
+	return merry.WithValue(err, codeKey, code)
+}
+
+// errorCollector collects the validation errors of a request.
+type errorCollector struct {
+	failFast bool
+	errs     Errors
+}
+
+// add adds err for the parameter to the collected errors, if err is not already assigned to a
+// parameter. It returns true if no further errors should be collected.
+func (c *errorCollector) add(parameter string, err error) bool {
+	if err == nil {
+		return false
+	}
+	var errs Errors
+	if errors.As(err, &errs) {
+		c.errs = append(c.errs, errs...)
+		return c.failFast
+	}
+	if merry.Value(err, parameterKey) == nil && len(parameter) > 0 {
+		err = merry.WithValue(err, parameterKey, parameter)
+	}
+	c.errs = append(c.errs, err)
+	return c.failFast
+}
+
+// err returns the collected errors. A single error is returned as is.
+func (c *errorCollector) err() error {
+	switch len(c.errs) {
+	case 0:
+		return nil
+	case 1:
+		return c.errs[0]
+	}
+	code := 0
+	for _, err := range c.errs {
+		if merry.HTTPCode(err) > code {
+			code = merry.HTTPCode(err)
+		}
+	}
+	return merry.WrapSkipping(c.errs, 1).WithHTTPCode(code)
+}
@@ -0,0 +1,123 @@
+package mqb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestMultipleValidationErrors(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.RequireTogether("uintmember", "floatmember")
+	req := httptest.NewRequest("GET", "/?intMember=abc&mybool=maybe&notAMember=1&uintmember=1&sort=foo&limit=x", nil)
+	_, err := mq.ParseSpec(context.Background(), req)
+	if err == nil {
+		t.Fatal("invalid request did not produce an error")
+	}
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("error does not contain Errors: %s", err)
+	}
+	if merry.HTTPCode(err) != http.StatusUnprocessableEntity {
+		t.Errorf("status code is not the highest code of the errors: %d", merry.HTTPCode(err))
+	}
+	details := Details(err)
+	expected := []ErrorDetail{
+		{Code: CodeMissingParameter},
+		{Parameter: "intMember", Code: CodeInvalidValue},
+		{Parameter: "mybool", Code: CodeInvalidValue},
+		{Parameter: "notAMember", Code: CodeUnsupportedParameter},
+		{Parameter: "sort", Code: CodeUnsupportedParameter},
+		{Parameter: "limit", Code: CodeInvalidValue},
+	}
+	if len(details) != len(expected) {
+		t.Fatalf("wrong number of errors: %v", details)
+	}
+	for i := range details {
+		if len(details[i].Message) == 0 {
+			t.Errorf("missing message for %v", details[i])
+		}
+		details[i].Message = ""
+	}
+	if !reflect.DeepEqual(details, expected) {
+		t.Errorf("wrong error details: %v", details)
+	}
+
+	mq.SetFailFast(true)
+	_, err = mq.ParseSpec(context.Background(), req)
+	if err == nil {
+		t.Fatal("invalid request did not produce an error")
+	}
+	if errors.As(err, &errs) {
+		t.Errorf("fail fast returned multiple errors: %s", err)
+	}
+}
+
+func TestWriteErrorDetails(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	w := httptest.NewRecorder()
+	_, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?intMember=abc&field=foo", nil))
+	WriteError(w, err)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code %d", w.Code)
+	}
+	body := struct {
+		Errors []ErrorDetail
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if len(body.Errors) != 2 || body.Errors[0].Parameter != "intMember" || body.Errors[1].Parameter != "field" || body.Errors[1].Code != CodeUnsupportedParameter {
+		t.Errorf("wrong error details: %v", body.Errors)
+	}
+
+	w = httptest.NewRecorder()
+	WriteError(w, merry.New("not found").WithHTTPCode(http.StatusNotFound))
+	if w.Body.String() != "{\"error\":\"not found\"}\n" {
+		t.Errorf("details written for error without details: %s", w.Body.String())
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	wrap := func(err error) error {
+		return merry.Prepend(err, "could not execute q.All()").WithHTTPCode(http.StatusInternalServerError)
+	}
+	netErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	wrapped := wrap(netErr)
+	if wrapped.Error() != "could not execute q.All(): read tcp: connection reset by peer" {
+		t.Errorf("wrong message: %s", wrapped)
+	}
+	var opErr *net.OpError
+	if !errors.As(wrapped, &opErr) || opErr != netErr {
+		t.Error("original error is not retrievable")
+	}
+	for err, expected := range map[error]bool{
+		wrapped:                                  true,
+		wrap(io.EOF):                             true,
+		wrap(errors.New("no reachable servers")): true,
+		wrap(&mgo.QueryError{Code: 189}):         true,
+		wrap(&mgo.LastError{Code: 10107}):        true,
+		wrap(&mgo.QueryError{Code: 2}):           false,
+		wrap(&mgo.LastError{Code: 11000}):        false,
+		wrap(mgo.ErrNotFound):                    false,
+		mgo.ErrNotFound:                          false,
+		merry.New("invalid").WithHTTPCode(400):   false,
+		wrap(errors.New("something else")):       false,
+	} {
+		if IsRetryable(err) != expected {
+			t.Errorf("wrong classification of %s", err)
+		}
+	}
+	if IsRetryable(nil) {
+		t.Error("nil is retryable")
+	}
+}
@@ -0,0 +1,168 @@
+package mqb
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipETagSuffix is appended to the entity tag of compressed responses, which are a different
+// representation than the uncompressed responses.
+const gzipETagSuffix = "-gzip"
+
+// gzipETag returns the entity tag of the compressed representation of a response with etag.
+func gzipETag(etag string) string {
+	if !strings.HasSuffix(etag, `"`) || strings.HasSuffix(etag, gzipETagSuffix+`"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + gzipETagSuffix + `"`
+}
+
+// SetGzipThreshold enables the compression of responses written by Handler that are at least
+// n bytes long, for clients that accept gzip with the Accept-Encoding header. The first n bytes
+// of a response are buffered to decide whether it is compressed. A value of 0 disables the
+// compression, which is the default. The ETag of a compressed response gets the suffix -gzip.
+func (mq *MongoQuery) SetGzipThreshold(n int) {
+	mq.gzipThreshold = n
+}
+
+// compressResponse returns the writer for the response to req, which compresses the response
+// if it is enabled with SetGzipThreshold and accepted by the client. The returned function has
+// to be called after the response is written.
+func (mq *MongoQuery) compressResponse(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, func()) {
+	if mq.gzipThreshold <= 0 {
+		return w, func() {}
+	}
+	// caches have to distinguish the responses even if this one is not compressed
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(req.Header.Get("Accept-Encoding")) {
+		return w, func() {}
+	}
+	gw := &gzipResponseWriter{ResponseWriter: w, threshold: mq.gzipThreshold}
+	return gw, gw.close
+}
+
+// acceptsGzip returns true if the Accept-Encoding header value acceptEncoding accepts gzip.
+// An explicit gzip entry takes precedence over the wildcard *.
+func acceptsGzip(acceptEncoding string) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if f, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if coding == "gzip" {
+			gzipQ = q
+		} else {
+			wildcardQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
+}
+
+// gzipResponseWriter buffers the response until it reaches the threshold, then it compresses
+// it. Shorter responses are written uncompressed when the writer is closed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	threshold int
+	status    int
+	buf       []byte
+	decided   bool
+	gz        *gzip.Writer
+}
+
+// WriteHeader records the status code, it is written when the encoding is decided.
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	w.status = code
+	// responses without body are not compressed
+	if code == http.StatusNoContent || code == http.StatusNotModified || code < http.StatusOK {
+		w.decide(false)
+	}
+}
+
+// Write buffers b until the threshold is reached.
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.threshold {
+			return len(b), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush writes the buffered data to the client. A response that is flushed before it reaches
+// the threshold is compressed, since it is streamed.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide writes the header and the buffered data, compressed if compress is true.
+func (w *gzipResponseWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		if etag := w.Header().Get("ETag"); len(etag) > 0 {
+			w.Header().Set("ETag", gzipETag(etag))
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// close writes a response shorter than the threshold uncompressed or completes the
+// compressed response.
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,296 @@
+package mqb
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+)
+
+// media types supported by Handler
+const (
+	MediaTypeJSON   = "application/json"
+	MediaTypeCSV    = "text/csv"
+	MediaTypeNDJSON = "application/x-ndjson"
+)
+
+// SetRejectUnacceptable defines how Handler treats requests that accept none of the supported
+// media types. Per default JSON is returned, if reject is true the request is rejected with 406.
+func (mq *MongoQuery) SetRejectUnacceptable(reject bool) {
+	mq.rejectUnacceptable = reject
+}
+
+// Handler returns a http.Handler that runs the query for each request with mq and writes the
+// result in the format requested by the Accept header:
+//     application/json      the Response as JSON (default)
+//     text/csv              the content as CSV with a header line
+//     application/x-ndjson  the content as newline delimited JSON
+// Errors are written with WriteError. The response has an ETag header, which differs between
+// the formats, and if it matches the If-None-Match header of the request, 304 Not Modified is
+// returned without body. Requests for a validation report get the report instead, see
+// SetVerboseValidation. Large responses are compressed if enabled with SetGzipThreshold.
+func Handler(mq *MongoQuery) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w, done := mq.compressResponse(w, req)
+		defer done()
+		mediaType, err := mq.negotiate(req)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		if mq.isVerboseRequest(req) {
+			writeValidationReport(w, mq.Validate(req))
+			return
+		}
+		spec, err := mq.ParseSpec(req.Context(), req)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		response, err := mq.RunSpec(req.Context(), spec)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		mq.serveResponse(w, req, mediaType, spec, response)
+	})
+}
+
+// serveResponse writes response to w unless it is not modified according to the If-None-Match
+// header of req.
+func (mq *MongoQuery) serveResponse(w http.ResponseWriter, req *http.Request, mediaType string, spec *QuerySpec, response *Response) {
+	etag := mediaTypeETag(response.ETag(), mediaType)
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Accept")
+	if matched, ok := matchETag(req.Header.Get("If-None-Match"), etag); ok {
+		// the tag of the representation the client has
+		w.Header().Set("ETag", matched)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	mq.writeResponse(w, mediaType, spec, response)
+}
+
+// ETag returns a strong entity tag of the response, which changes if the content, the paging
+// information, the warnings or the cursors change. The time syncedAt is ignored.
+func (r *Response) ETag() string {
+	tagged := *r
+	tagged.SyncedAt = nil
+	b, err := json.Marshal(&tagged)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256(b))[:32])
+}
+
+// mediaTypeETag returns the entity tag of the representation of a response with etag in the
+// given media type. The JSON representation has the tag of the response, the tags of the other
+// representations get the subtype of their media type as suffix, like "...-csv".
+func mediaTypeETag(etag, mediaType string) string {
+	if mediaType == MediaTypeJSON || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	subtype := mediaType[strings.Index(mediaType, "/")+1:]
+	return strings.TrimSuffix(etag, `"`) + "-" + strings.TrimPrefix(subtype, "x-") + `"`
+}
+
+// matchETag returns the tag of the If-None-Match header value ifNoneMatch that matches etag or
+// the tag of its compressed representation, see SetGzipThreshold. The bool value is false if
+// no tag matches.
+func matchETag(ifNoneMatch, etag string) (string, bool) {
+	if len(ifNoneMatch) == 0 || len(etag) == 0 {
+		return "", false
+	}
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		// If-None-Match uses the weak comparison
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		switch t {
+		case "*", etag:
+			return etag, true
+		case gzipETag(etag):
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// negotiate returns the media type of the response to req.
+func (mq *MongoQuery) negotiate(req *http.Request) (string, error) {
+	accept := req.Header.Get("Accept")
+	if len(accept) == 0 {
+		return MediaTypeJSON, nil
+	}
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		r := mediaRange{mediaType: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, p := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+		if r.q > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	for _, r := range ranges {
+		switch r.mediaType {
+		case MediaTypeJSON, "application/*", "*/*":
+			return MediaTypeJSON, nil
+		case MediaTypeCSV, "text/*":
+			return MediaTypeCSV, nil
+		case MediaTypeNDJSON:
+			return MediaTypeNDJSON, nil
+		}
+	}
+	if mq.rejectUnacceptable {
+		return "", merry.Wrap(fmt.Errorf("none of the accepted media types is supported: %s", accept)).WithHTTPCode(http.StatusNotAcceptable)
+	}
+	return MediaTypeJSON, nil
+}
+
+// writeResponse writes response in the given media type to w.
+func (mq *MongoQuery) writeResponse(w http.ResponseWriter, mediaType string, spec *QuerySpec, response *Response) {
+	w.Header().Set("Content-Type", mediaType)
+	switch mediaType {
+	case MediaTypeCSV:
+		documents := mq.documents(response)
+		columns, header, err := csvColumns(documents, spec.Fields)
+		if err != nil {
+			w.Header().Del("ETag")
+			WriteError(w, merry.Prepend(err, "could not write csv").WithHTTPCode(http.StatusInternalServerError))
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", mq.collectionName()+".csv"))
+		writeCSV(w, documents, columns, header)
+	case MediaTypeNDJSON:
+		enc := json.NewEncoder(w)
+		s := reflect.Indirect(reflect.ValueOf(mq.documents(response)))
+		for i := 0; i < s.Len(); i++ {
+			if err := enc.Encode(s.Index(i).Interface()); err != nil {
+				return
+			}
+		}
+	default:
+		v, err := mq.Envelope(response)
+		if err != nil {
+			WriteError(w, merry.Wrap(err).WithHTTPCode(http.StatusInternalServerError))
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// documents returns the content of response as pointer to a slice. Empty content, which is
+// nil or a slice of interfaces, is returned as empty slice of the endpoint struct.
+func (mq *MongoQuery) documents(response *Response) interface{} {
+	if s := reflect.Indirect(reflect.ValueOf(response.Content)); s.IsValid() && s.Kind() == reflect.Slice && s.Len() > 0 {
+		return response.Content
+	}
+	return reflect.New(reflect.SliceOf(reflect.TypeOf(mq.endPointStruct))).Interface()
+}
+
+// csvColumns returns the indexes and names of the CSV columns of the documents in content.
+// The columns are the top level fields of the documents, restricted to the fields in selected
+// if it is not empty.
+func csvColumns(content interface{}, selected map[string]interface{}) ([]int, []string, error) {
+	s := reflect.Indirect(reflect.ValueOf(content))
+	if s.Kind() != reflect.Slice {
+		return nil, nil, errors.New("content is not a slice")
+	}
+	typ := s.Type().Elem()
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil, nil, errors.New("content is not a slice of structs")
+	}
+	columns := []int{}
+	header := []string{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		fieldName := getFieldNameFromTag(field.Tag)
+		if len(fieldName) == 0 {
+			fieldName = strings.ToLower(field.Name)
+		}
+		if len(selected) > 0 && !isSelected(fieldName, selected) {
+			continue
+		}
+		columns = append(columns, i)
+		header = append(header, fieldName)
+	}
+	return columns, header, nil
+}
+
+// writeCSV writes the header and the given columns of the documents of content as CSV to w.
+func writeCSV(w http.ResponseWriter, content interface{}, columns []int, header []string) error {
+	s := reflect.Indirect(reflect.ValueOf(content))
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for i := 0; i < s.Len(); i++ {
+		doc := reflect.Indirect(s.Index(i))
+		record := []string{}
+		for _, c := range columns {
+			record = append(record, csvValue(doc.Field(c)))
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// isSelected returns true if the field or one of its sub fields is in selected. If selected
+// is an exclusion, it returns true if the field itself is not excluded.
+func isSelected(field string, selected map[string]interface{}) bool {
+	if isExclusion(selected) {
+		_, excluded := selected[field]
+		return !excluded
+	}
+	for k := range selected {
+		if k == field || strings.HasPrefix(k, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// csvValue returns the CSV representation of v. Times are formatted as RFC3339, structs,
+// maps and slices are encoded as JSON.
+func csvValue(v reflect.Value) string {
+	if t, ok := v.Interface().(time.Time); ok {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Ptr, reflect.Interface:
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,342 @@
+package mqb
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestNegotiate(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for accept, expected := range map[string]string{
+		"":                                     MediaTypeJSON,
+		"*/*":                                  MediaTypeJSON,
+		"application/json":                     MediaTypeJSON,
+		"text/csv":                             MediaTypeCSV,
+		"text/csv; charset=utf-8":              MediaTypeCSV,
+		"application/x-ndjson":                 MediaTypeNDJSON,
+		"text/csv;q=0.5, application/x-ndjson": MediaTypeNDJSON,
+		"text/html, text/csv;q=0.1":            MediaTypeCSV,
+		"text/csv;q=0, image/png":              MediaTypeJSON,
+		"image/png":                            MediaTypeJSON,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		mediaType, err := mq.negotiate(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if mediaType != expected {
+			t.Errorf("wrong media type %s for %s", mediaType, accept)
+		}
+	}
+
+	mq.SetRejectUnacceptable(true)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "image/png")
+	Handler(mq).ServeHTTP(w, req)
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("wrong status code %d", w.Code)
+	}
+}
+
+// serveDocuments serves query with Accept header accept by the Handler of mq, which finds the
+// given documents.
+func serveDocuments(mq *MongoQuery, query, accept string, docs []TestStruct) *httptest.ResponseRecorder {
+	mq.count = func(q *mgo.Query) (int, error) { return len(docs), nil }
+	mq.all = func(q *mgo.Query, content interface{}) error {
+		if len(docs) > 0 {
+			reflect.ValueOf(content).Elem().Set(reflect.ValueOf(docs))
+		}
+		return nil
+	}
+	req := httptest.NewRequest("GET", query, nil)
+	req.Header.Set("Accept", accept)
+	w := httptest.NewRecorder()
+	Handler(mq).ServeHTTP(w, req)
+	return w
+}
+
+func TestWriteResponse(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	docs := []TestStruct{
+		{StringMember: "peter", IntMember: 1, TimeMember: time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC), IntSliceMember: []int{1, 2}},
+		{StringMember: "paul, jr", IntMember: 2},
+	}
+
+	w := serveDocuments(mq, "/", MediaTypeJSON, docs)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != MediaTypeJSON {
+		t.Errorf("wrong json response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	r := struct {
+		Content []TestStruct `json:"content"`
+		Page    Page         `json:"page"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&r); err != nil || len(r.Content) != 2 || r.Page.Items != 2 {
+		t.Errorf("wrong json response: %v, %v", r, err)
+	}
+
+	w = serveDocuments(mq, "/", MediaTypeCSV, docs)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != MediaTypeCSV || w.Header().Get("Content-Disposition") != `attachment; filename="teststruct.csv"` {
+		t.Errorf("wrong headers: %d %v", w.Code, w.Header())
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 || lines[0] != "floatmember,uintmember,intMember,mybool,stringmember,embeddedmember,strSliceMember,intslicemember,timemember" {
+		t.Fatalf("wrong csv: %s", w.Body.String())
+	}
+	if lines[1] != `0,0,1,false,peter,"{""EmbeddedBool"":false,""EmbeddedInt"":0}",null,"[1,2]",2015-03-01T12:00:00Z` || lines[2] != `0,0,2,false,"paul, jr","{""EmbeddedBool"":false,""EmbeddedInt"":0}",null,null,` {
+		t.Errorf("wrong csv records: %s", w.Body.String())
+	}
+
+	w = serveDocuments(mq, "/?field=stringmember&field=embeddedmember.embeddedint", MediaTypeCSV, docs)
+	if lines := strings.Split(w.Body.String(), "\n"); lines[0] != "stringmember,embeddedmember" {
+		t.Errorf("wrong csv header for projection: %s", lines[0])
+	}
+
+	w = serveDocuments(mq, "/", MediaTypeNDJSON, docs)
+	lines = strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != MediaTypeNDJSON || len(lines) != 2 {
+		t.Fatalf("wrong ndjson: %d %s", w.Code, w.Body.String())
+	}
+	doc := TestStruct{}
+	if err := json.Unmarshal([]byte(lines[1]), &doc); err != nil || doc.StringMember != "paul, jr" {
+		t.Errorf("wrong ndjson document: %s", lines[1])
+	}
+
+	// documents that are not structs cannot be written as csv
+	mq.endPointStruct = map[string]interface{}{}
+	w = serveDocuments(mq, "/", MediaTypeCSV, nil)
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Type") != MediaTypeJSON || len(w.Header().Get("Content-Disposition")) > 0 {
+		t.Errorf("wrong response for csv of documents that are not structs: %d %v", w.Code, w.Header())
+	}
+	if !strings.Contains(w.Body.String(), "not a slice of structs") {
+		t.Errorf("wrong error: %s", w.Body.String())
+	}
+}
+
+func TestHandlerError(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for _, accept := range []string{"application/json", "text/csv", "application/x-ndjson"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/?notAMember=1", nil)
+		req.Header.Set("Accept", accept)
+		Handler(mq).ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != MediaTypeJSON {
+			t.Errorf("wrong error response for %s: %d %s", accept, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	response := &Response{Content: &[]TestStruct{{StringMember: "peter"}}, Page: Page{Size: 20, Items: 1, Last: 1, Current: 1}}
+	etag := response.ETag()
+	if len(etag) == 0 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		t.Fatalf("invalid etag: %s", etag)
+	}
+	changed := &Response{Content: &[]TestStruct{{StringMember: "paul"}}, Page: Page{Size: 20, Items: 1, Last: 1, Current: 1}}
+	if changed.ETag() == etag {
+		t.Error("etag did not change with the content")
+	}
+
+	for ifNoneMatch, expected := range map[string]int{
+		"":                 http.StatusOK,
+		etag:               http.StatusNotModified,
+		"W/" + etag:        http.StatusNotModified,
+		`"other", ` + etag: http.StatusNotModified,
+		"*":                http.StatusNotModified,
+		changed.ETag():     http.StatusOK,
+		`"other"`:          http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if len(ifNoneMatch) > 0 {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		mq.serveResponse(w, req, MediaTypeJSON, &QuerySpec{}, response)
+		if w.Code != expected {
+			t.Errorf("wrong status code %d for %s", w.Code, ifNoneMatch)
+		}
+		if w.Header().Get("ETag") != etag {
+			t.Errorf("wrong etag header %s", w.Header().Get("ETag"))
+		}
+		if expected == http.StatusNotModified && w.Body.Len() > 0 {
+			t.Errorf("body written for %s: %s", ifNoneMatch, w.Body.String())
+		}
+		if expected == http.StatusOK && w.Body.Len() == 0 {
+			t.Errorf("no body written for %s", ifNoneMatch)
+		}
+	}
+
+	// the formats are different representations of the response
+	tags := map[string]bool{}
+	for _, mediaType := range []string{MediaTypeJSON, MediaTypeCSV, MediaTypeNDJSON} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		mq.serveResponse(w, req, mediaType, &QuerySpec{}, response)
+		expected := http.StatusOK
+		if mediaType == MediaTypeJSON {
+			expected = http.StatusNotModified
+		}
+		if w.Code != expected {
+			t.Errorf("%s: wrong status code %d for the tag of the json response", mediaType, w.Code)
+		}
+		tags[w.Header().Get("ETag")] = true
+	}
+	if len(tags) != 3 {
+		t.Errorf("formats share etags: %v", tags)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	docs := []TestStruct{}
+	for i := 0; i < 100; i++ {
+		docs = append(docs, TestStruct{StringMember: "peter", IntMember: int64(i)})
+	}
+	large := &Response{Content: &docs, Page: Page{Size: 100, Items: 100, Last: 1, Current: 1}}
+	small := &Response{Content: &[]TestStruct{{StringMember: "peter"}}, Page: Page{Size: 20, Items: 1, Last: 1, Current: 1}}
+
+	serve := func(acceptEncoding, mediaType string, response *Response) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if len(acceptEncoding) > 0 {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		w, done := mq.compressResponse(rec, req)
+		mq.serveResponse(w, req, mediaType, &QuerySpec{}, response)
+		done()
+		return rec
+	}
+
+	// disabled per default
+	if w := serve("gzip", MediaTypeJSON, large); w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept" {
+		t.Errorf("response is compressed per default: %v", w.Header())
+	}
+
+	mq.SetGzipThreshold(1024)
+	for _, mediaType := range []string{MediaTypeJSON, MediaTypeCSV, MediaTypeNDJSON} {
+		w := serve("deflate, gzip", mediaType, large)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" || !contains(w.Header()["Vary"], "Accept-Encoding") {
+			t.Errorf("%s: large response is not compressed: %d %v", mediaType, w.Code, w.Header())
+			continue
+		}
+		r, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("%s: error occured: %s", mediaType, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil || !strings.Contains(string(b), "peter") || len(b) < 1024 {
+			t.Errorf("%s: wrong uncompressed response: %v %s", mediaType, err, b)
+		}
+		if w.Header().Get("ETag") != gzipETag(mediaTypeETag(large.ETag(), mediaType)) || !strings.HasSuffix(w.Header().Get("ETag"), `-gzip"`) {
+			t.Errorf("%s: wrong etag of compressed response: %s", mediaType, w.Header().Get("ETag"))
+		}
+		plain := serve("", mediaType, large)
+		if plain.Header().Get("ETag") != mediaTypeETag(large.ETag(), mediaType) {
+			t.Errorf("%s: wrong etag of uncompressed response: %s", mediaType, plain.Header().Get("ETag"))
+		}
+		if plain.Header().Get("Content-Encoding") != "" || plain.Body.String() != string(b) {
+			t.Errorf("%s: wrong response without Accept-Encoding: %v", mediaType, plain.Header())
+		}
+	}
+	for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0", "identity", "gzip;q=0, *", "*, gzip;q=0", "*;q=0"} {
+		if w := serve(acceptEncoding, MediaTypeJSON, large); w.Header().Get("Content-Encoding") != "" || !strings.Contains(w.Body.String(), "peter") {
+			t.Errorf("response is compressed for '%s'", acceptEncoding)
+		}
+	}
+	for _, acceptEncoding := range []string{"*", "identity, *;q=0.5", "*;q=0, gzip"} {
+		if w := serve(acceptEncoding, MediaTypeJSON, large); w.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("response is not compressed for '%s'", acceptEncoding)
+		}
+	}
+	w := serve("gzip", MediaTypeJSON, small)
+	if w.Header().Get("Content-Encoding") != "" || !strings.Contains(w.Body.String(), "peter") {
+		t.Errorf("small response is compressed: %v", w.Header())
+	}
+	if vary := w.Header()["Vary"]; len(vary) != 2 || !contains(vary, "Accept-Encoding") {
+		t.Errorf("wrong Vary header: %v", vary)
+	}
+
+	// not modified responses have no body
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", large.ETag())
+	rec := httptest.NewRecorder()
+	gw, done := mq.compressResponse(rec, req)
+	mq.serveResponse(gw, req, MediaTypeJSON, &QuerySpec{}, large)
+	done()
+	if rec.Code != http.StatusNotModified || rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() > 0 {
+		t.Errorf("wrong not modified response: %d %v", rec.Code, rec.Header())
+	}
+	// the tag of the compressed response matches too
+	req.Header.Set("If-None-Match", gzipETag(large.ETag()))
+	rec = httptest.NewRecorder()
+	gw, done = mq.compressResponse(rec, req)
+	mq.serveResponse(gw, req, MediaTypeJSON, &QuerySpec{}, large)
+	done()
+	if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != gzipETag(large.ETag()) {
+		t.Errorf("wrong not modified response for compressed tag: %d %v", rec.Code, rec.Header())
+	}
+
+	// a flush writes the data compressed so far
+	rec = httptest.NewRecorder()
+	gw, done = mq.compressResponse(rec, req)
+	gw.Write([]byte("first"))
+	gw.(http.Flusher).Flush()
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" || rec.Body.Len() == 0 {
+		t.Errorf("flush did not write the data: %v %d", rec.Header(), rec.Body.Len())
+	}
+	gw.Write([]byte(" second"))
+	done()
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "first second" {
+		t.Errorf("wrong flushed response: %v %s", err, b)
+	}
+
+	// errors are written through the compressing writer too
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/?notAMember=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	Handler(mq).ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "notAMember") {
+		t.Errorf("wrong error response: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEmptyContentStyle(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	for style, expected := range map[EmptyContentStyle]string{
+		EmptyContentArray: `{"content":[],"page":`,
+		EmptyContentOmit:  `{"page":`,
+	} {
+		mq.SetEmptyContentStyle(style)
+		w := serveDocuments(mq, "/", MediaTypeJSON, nil)
+		if !strings.HasPrefix(w.Body.String(), expected) {
+			t.Errorf("wrong json of empty content with style %d: %s", style, w.Body.String())
+		}
+
+		w = serveDocuments(mq, "/?field=stringmember", MediaTypeCSV, nil)
+		if w.Code != http.StatusOK || w.Body.String() != "stringmember\n" {
+			t.Errorf("wrong csv of empty content with style %d: %d %q", style, w.Code, w.Body.String())
+		}
+
+		w = serveDocuments(mq, "/", MediaTypeNDJSON, nil)
+		if w.Code != http.StatusOK || w.Body.Len() > 0 {
+			t.Errorf("wrong ndjson of empty content with style %d: %d %q", style, w.Code, w.Body.String())
+		}
+	}
+}
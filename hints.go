@@ -0,0 +1,78 @@
+package mqb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// SetAllowedHints allows clients to force one of the given indexes with the hint parameter:
+//     mq.SetAllowedHints("name_1", "name_1_createdat_-1")
+//     /?name=peter&hint=name_1
+// The hints are the names MongoDB creates for indexes, like name_1_createdat_-1 for the index
+// {"name": 1, "createdat": -1}. Only such ascending and descending indexes are supported.
+// Other hints are rejected with 400, so clients cannot force indexes that are not meant to be
+// used. Requests that are run as aggregation pipeline, like with SetRelevanceScoring, cannot
+// be combined with a hint and are rejected with 400 too.
+func (mq *MongoQuery) SetAllowedHints(hints ...string) error {
+	allowed := make(map[string][]string)
+	for _, h := range hints {
+		keys, err := parseIndexName(h)
+		if err != nil {
+			return err
+		}
+		allowed[h] = keys
+	}
+	mq.allowedHints = allowed
+	return nil
+}
+
+// parseIndexName returns the index key of the index name, in the form used by mgo like
+// []string{"name", "-createdat"} for name_1_createdat_-1.
+func parseIndexName(name string) ([]string, error) {
+	keys := []string{}
+	field := []string{}
+	for _, part := range strings.Split(name, "_") {
+		switch part {
+		case "1", "-1":
+			key := strings.Join(field, "_")
+			if len(key) == 0 {
+				return nil, fmt.Errorf("invalid index name '%s'", name)
+			}
+			if part == "-1" {
+				key = "-" + key
+			}
+			keys = append(keys, key)
+			field = field[:0]
+		default:
+			// field names can contain underscores
+			field = append(field, part)
+		}
+	}
+	if len(field) > 0 || len(keys) == 0 {
+		return nil, fmt.Errorf("invalid index name '%s', only ascending and descending indexes are supported", name)
+	}
+	return keys, nil
+}
+
+// getHint returns the index key of the hint parameter of req, or nil if req has no hint.
+func (mq *MongoQuery) getHint(req *http.Request) ([]string, error) {
+	values, ok := req.URL.Query()["hint"]
+	if !ok {
+		return nil, nil
+	}
+	if len(mq.allowedHints) == 0 {
+		return nil, merry.Wrap(errors.New("hint is not supported")).WithHTTPCode(http.StatusBadRequest)
+	}
+	if len(values) != 1 {
+		return nil, merry.Wrap(errors.New("parameter 'hint' supports only one value")).WithHTTPCode(http.StatusBadRequest)
+	}
+	keys, ok := mq.allowedHints[values[0]]
+	if !ok {
+		return nil, withCode(merry.Wrap(fmt.Errorf("hint '%s' is not allowed", values[0])).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	return keys, nil
+}
@@ -0,0 +1,247 @@
+package mqb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+const (
+	// WarningLatencyBudgetExceeded is added to the warnings if the data query took longer than the soft latency budget.
+	WarningLatencyBudgetExceeded = "latency_budget_exceeded"
+	// WarningSizeBudgetExceeded is added to the warnings if the estimated size of the content exceeds the soft size budget.
+	WarningSizeBudgetExceeded = "size_budget_exceeded"
+	// WarningCollectionScan is added to the warnings if the query plan scans the whole collection, see SetWarnOnCollscan.
+	WarningCollectionScan = "collection_scan"
+	// WarningResultTruncated is added to the warnings if the documents were truncated, see SetMaxResultDocuments.
+	WarningResultTruncated = "result_truncated"
+)
+
+// QueryInfo contains information about a query executed by Run. It is passed to the query hook.
+type QueryInfo struct {
+	Collection  string                 // Collection is the name of the queried collection.
+	Filter      map[string]interface{} // Filter is the filter of the query.
+	Duration    time.Duration          // Duration is the time the data query took.
+	Items       uint                   // Items is the total number of items the query matches.
+	Page        Page                   // Page is the paging information of the response.
+	ApproxBytes int                    // ApproxBytes is the estimated size of the returned documents.
+	Warnings    []string               // Warnings are the warnings added to the response.
+	Stats       ParsedStats            // Stats describes how the request used the parameters.
+	Err         error                  // Err is the error of the query, if it failed.
+}
+
+// ParsedStats describes how a request used the parameters, for example to aggregate which
+// fields are filtered most in a query hook.
+type ParsedStats struct {
+	FilterFieldNames     []string // FilterFieldNames are the filtered parameters without operators, aliases are resolved.
+	SortFieldNames       []string // SortFieldNames are the sort fields without direction.
+	ProjectionFieldNames []string // ProjectionFieldNames are the fields of the projection.
+	UsedRegex            bool     // UsedRegex is true if the filter contains a regular expression.
+	InValuesTotal        int      // InValuesTotal is the number of values of all $in filters.
+	PageDepth            uint     // PageDepth is the requested page.
+}
+
+// SetQueryHook sets a function that is called with the QueryInfo of every query executed by Run.
+// It is called after the query, also if it failed.
+func (mq *MongoQuery) SetQueryHook(hook func(req *http.Request, info QueryInfo)) {
+	mq.queryHook = hook
+}
+
+// SetQueryComment sets a function that returns the comment attached to the queries of a
+// request, which shows up in the profiler and in the logs of the database server. An empty
+// comment is not attached.
+func (mq *MongoQuery) SetQueryComment(comment func(ctx context.Context, req *http.Request) string) {
+	mq.queryComment = comment
+}
+
+// QueryComment is the structured comment attached by SetStructuredQueryComment.
+type QueryComment struct {
+	RequestID     string `json:"requestId,omitempty"`     // RequestID identifies the request.
+	Collection    string `json:"collection"`              // Collection is the name of the queried collection.
+	LatencyBudget string `json:"latencyBudget,omitempty"` // LatencyBudget is the soft latency budget, see SetSoftBudgets.
+}
+
+// SetStructuredQueryComment attaches a JSON encoded QueryComment to the queries of a request,
+// so that slow queries can be compared with the latency budget of the endpoint:
+//     {"requestId":"4f2a","collection":"people","latencyBudget":"200ms"}
+// The request id is returned by requestID, which can be nil.
+func (mq *MongoQuery) SetStructuredQueryComment(requestID func(ctx context.Context, req *http.Request) string) {
+	mq.SetQueryComment(func(ctx context.Context, req *http.Request) string {
+		comment := QueryComment{Collection: mq.collectionName()}
+		if requestID != nil {
+			comment.RequestID = requestID(ctx, req)
+		}
+		if mq.latencyBudget > 0 {
+			comment.LatencyBudget = mq.latencyBudget.String()
+		}
+		b, err := json.Marshal(comment)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	})
+}
+
+// SetSoftBudgets sets a soft latency budget for the data query and a soft size budget in bytes
+// for the returned documents. If a budget is exceeded, the results are still returned but a
+// warning is added to the response. A budget of 0 disables the corresponding check.
+func (mq *MongoQuery) SetSoftBudgets(latency time.Duration, approxBytes int) {
+	mq.latencyBudget = latency
+	mq.sizeBudget = approxBytes
+}
+
+// SetMaxResultDocuments sets the maximum number of documents loaded by Run, regardless of the
+// requested limit, to protect the memory of the server. If more documents match, the content is
+// truncated and a warning is added to the response. A maximum of 0 disables the check.
+func (mq *MongoQuery) SetMaxResultDocuments(n int) {
+	mq.maxResultDocuments = n
+}
+
+// resultLimit returns the limit of the data query for a page of the given size if it has to be
+// capped by the maximum number of result documents, 0 otherwise. One more document than the
+// maximum is loaded to detect the truncation.
+func (mq *MongoQuery) resultLimit(size uint) int {
+	if mq.maxResultDocuments <= 0 || (size > 0 && size <= uint(mq.maxResultDocuments)) {
+		return 0
+	}
+	return mq.maxResultDocuments + 1
+}
+
+// truncate truncates the slice content points to to n elements and returns true if it was longer.
+func truncate(content interface{}, n int) bool {
+	s := reflect.ValueOf(content).Elem()
+	if s.Len() <= n {
+		return false
+	}
+	s.Set(s.Slice(0, n))
+	return true
+}
+
+// SetWarnOnCollscan defines if the query of a request is explained and a warning is added to
+// the response if it cannot use an index and scans the whole collection. This is meant for
+// development, because every request costs an additional explain command.
+func (mq *MongoQuery) SetWarnOnCollscan(warn bool) {
+	mq.warnOnCollscan = warn
+}
+
+// scansCollection returns true if collection scans are reported and the plan of q scans the
+// collection. The warning is only a hint for developers, so a failing explain is ignored.
+func (mq *MongoQuery) scansCollection(q *mgo.Query) bool {
+	if !mq.warnOnCollscan {
+		return false
+	}
+	plan, err := mq.explain(q)
+	return err == nil && isCollscan(plan)
+}
+
+// explainQuery returns the query plan of q.
+func explainQuery(q *mgo.Query) (bson.M, error) {
+	plan := bson.M{}
+	err := q.Explain(plan)
+	return plan, err
+}
+
+// isCollscan returns true if plan contains a collection scan stage.
+func isCollscan(plan interface{}) bool {
+	switch p := plan.(type) {
+	case bson.M:
+		return isCollscan(map[string]interface{}(p))
+	case map[string]interface{}:
+		if p["stage"] == "COLLSCAN" {
+			return true
+		}
+		for _, v := range p {
+			if isCollscan(v) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, v := range p {
+			if isCollscan(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// budgetWarnings returns the warnings for a data query that took duration and returned
+// documents with a size of approxBytes.
+func (mq *MongoQuery) budgetWarnings(duration time.Duration, approxBytes int) []string {
+	warnings := []string{}
+	if mq.latencyBudget > 0 && duration > mq.latencyBudget {
+		warnings = append(warnings, WarningLatencyBudgetExceeded)
+	}
+	if mq.sizeBudget > 0 && approxBytes > mq.sizeBudget {
+		warnings = append(warnings, WarningSizeBudgetExceeded)
+	}
+	return warnings
+}
+
+// parsedStats returns the ParsedStats of spec, which was parsed from req.
+func (mq *MongoQuery) parsedStats(req *http.Request, spec *QuerySpec) ParsedStats {
+	stats := ParsedStats{PageDepth: spec.Page.Current}
+	for name := range mq.queryValues(req) {
+		name, _ = splitOperator(mq.resolveAlias(name))
+		if _, isMeta := validMetaParameters[name]; !isMeta && !contains(stats.FilterFieldNames, name) {
+			stats.FilterFieldNames = append(stats.FilterFieldNames, name)
+		}
+	}
+	sort.Strings(stats.FilterFieldNames)
+	for _, field := range spec.Sort {
+		stats.SortFieldNames = append(stats.SortFieldNames, strings.TrimPrefix(field, "-"))
+	}
+	for field := range spec.Fields {
+		stats.ProjectionFieldNames = append(stats.ProjectionFieldNames, field)
+	}
+	sort.Strings(stats.ProjectionFieldNames)
+	addFilterStats(&stats, spec.Filter)
+	return stats
+}
+
+// addFilterStats adds the regular expressions and $in values of filter to stats.
+func addFilterStats(stats *ParsedStats, filter interface{}) {
+	switch f := filter.(type) {
+	case bson.RegEx:
+		stats.UsedRegex = true
+	case bson.M:
+		addFilterStats(stats, map[string]interface{}(f))
+	case map[string]interface{}:
+		for k, v := range f {
+			switch k {
+			case "$regex":
+				stats.UsedRegex = true
+			case "$in":
+				if values, ok := v.([]interface{}); ok {
+					stats.InValuesTotal += len(values)
+				}
+			}
+			addFilterStats(stats, v)
+		}
+	case []interface{}:
+		for _, v := range f {
+			addFilterStats(stats, v)
+		}
+	}
+}
+
+// approxSize estimates the size of the documents in the slice content points to from the bson
+// size of the first document.
+func approxSize(content interface{}) int {
+	s := reflect.ValueOf(content).Elem()
+	if s.Len() == 0 {
+		return 0
+	}
+	b, err := bson.Marshal(s.Index(0).Interface())
+	if err != nil {
+		return 0
+	}
+	return len(b) * s.Len()
+}
@@ -0,0 +1,53 @@
+//go:build !globalsign
+// +build !globalsign
+
+// Package bson provides the bson types of the mgo driver used by mqb. Per default it is
+// gopkg.in/mgo.v2/bson, with the build tag globalsign it is github.com/globalsign/mgo/bson.
+package bson
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// types of the driver
+type (
+	D        = bson.D
+	DocElem  = bson.DocElem
+	M        = bson.M
+	ObjectId = bson.ObjectId
+	Raw      = bson.Raw
+	RegEx    = bson.RegEx
+)
+
+// IsObjectIdHex returns true if s is a valid hex representation of an ObjectId.
+func IsObjectIdHex(s string) bool {
+	return bson.IsObjectIdHex(s)
+}
+
+// Marshal serializes in into a BSON document.
+func Marshal(in interface{}) ([]byte, error) {
+	return bson.Marshal(in)
+}
+
+// NewObjectId returns a new unique ObjectId.
+func NewObjectId() ObjectId {
+	return bson.NewObjectId()
+}
+
+// NewObjectIdWithTime returns a dummy ObjectId with the timestamp part filled with t, for
+// queries on the creation time of documents.
+func NewObjectIdWithTime(t time.Time) ObjectId {
+	return bson.NewObjectIdWithTime(t)
+}
+
+// ObjectIdHex returns the ObjectId of the hex representation s. It panics if s is invalid.
+func ObjectIdHex(s string) ObjectId {
+	return bson.ObjectIdHex(s)
+}
+
+// Unmarshal deserializes the BSON document in into out.
+func Unmarshal(in []byte, out interface{}) error {
+	return bson.Unmarshal(in, out)
+}
@@ -0,0 +1,26 @@
+//go:build globalsign
+// +build globalsign
+
+package mgo
+
+import (
+	"github.com/globalsign/mgo"
+)
+
+// types of the driver
+type (
+	Collection = mgo.Collection
+	Database   = mgo.Database
+	LastError  = mgo.LastError
+	Query      = mgo.Query
+	QueryError = mgo.QueryError
+	Session    = mgo.Session
+)
+
+// ErrNotFound is returned if a query finds no document.
+var ErrNotFound = mgo.ErrNotFound
+
+// IsDup returns true if err is a duplicate key error.
+func IsDup(err error) bool {
+	return mgo.IsDup(err)
+}
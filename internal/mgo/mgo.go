@@ -0,0 +1,28 @@
+//go:build !globalsign
+// +build !globalsign
+
+// Package mgo provides the types of the mgo driver used by mqb. Per default it is
+// gopkg.in/mgo.v2, with the build tag globalsign it is the maintained fork github.com/globalsign/mgo.
+package mgo
+
+import (
+	"gopkg.in/mgo.v2"
+)
+
+// types of the driver
+type (
+	Collection = mgo.Collection
+	Database   = mgo.Database
+	LastError  = mgo.LastError
+	Query      = mgo.Query
+	QueryError = mgo.QueryError
+	Session    = mgo.Session
+)
+
+// ErrNotFound is returned if a query finds no document.
+var ErrNotFound = mgo.ErrNotFound
+
+// IsDup returns true if err is a duplicate key error.
+func IsDup(err error) bool {
+	return mgo.IsDup(err)
+}
@@ -0,0 +1,122 @@
+package mqb
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// MatchesField is the field of the documents returned by RunRaw that lists the matched fields,
+// see SetMatchHighlighting.
+const MatchesField = "_matches"
+
+// SetMatchHighlighting enables the field _matches in the documents returned by RunRaw, which
+// lists the fields whose values matched a regular expression of the filter, for example to
+// highlight them in search results:
+//     /?name=pet&city=bern  {"name": "peter", "city": "bern", "_matches": ["city", "name"]}
+// The regular expressions are evaluated again in Go, so the result is approximate: expressions
+// that are not supported by the regexp package are ignored. It has no effect on []bson.Raw
+// content, see SetRawBSON.
+func (mq *MongoQuery) SetMatchHighlighting(enabled bool) {
+	mq.matchHighlighting = enabled
+}
+
+// addMatches adds the field _matches to the documents of docs, see SetMatchHighlighting.
+func addMatches(docs []bson.M, filter map[string]interface{}) {
+	regexes := make(map[string][]*regexp.Regexp)
+	collectRegexes(filter, regexes)
+	for _, doc := range docs {
+		matches := []string{}
+		for field, res := range regexes {
+			if matchesAny(doc, field, res) {
+				matches = append(matches, field)
+			}
+		}
+		sort.Strings(matches)
+		doc[MatchesField] = matches
+	}
+}
+
+// collectRegexes adds the compiled regular expressions of the fields in filter to regexes,
+// including those in $and and $or clauses.
+func collectRegexes(filter map[string]interface{}, regexes map[string][]*regexp.Regexp) {
+	for k, v := range filter {
+		if k == "$and" || k == "$or" {
+			clauses, _ := v.([]interface{})
+			for _, c := range clauses {
+				switch clause := c.(type) {
+				case bson.M:
+					collectRegexes(clause, regexes)
+				case map[string]interface{}:
+					collectRegexes(clause, regexes)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		values := []interface{}{v}
+		if doc, ok := operatorDocument(v); ok {
+			if in, ok := doc["$in"].([]interface{}); ok {
+				values = in
+			}
+		}
+		for _, value := range values {
+			if re, ok := compileRegex(value); ok {
+				regexes[k] = append(regexes[k], re)
+			}
+		}
+	}
+}
+
+// compileRegex returns the compiled regular expression of the filter value v, which is a
+// bson.RegEx or a $regex document.
+func compileRegex(v interface{}) (*regexp.Regexp, bool) {
+	doc, ok := operatorDocument(v)
+	if !ok {
+		return nil, false
+	}
+	pattern, ok := doc["$regex"].(string)
+	if !ok {
+		return nil, false
+	}
+	options, _ := doc["$options"].(string)
+	flags := ""
+	for _, o := range options {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+	if len(flags) > 0 {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	return re, err == nil
+}
+
+// matchesAny returns true if the value of field in doc, or one of its elements, matches one of res.
+func matchesAny(doc bson.M, field string, res []*regexp.Regexp) bool {
+	v, ok := lookupPath(doc, field)
+	if !ok {
+		return false
+	}
+	values := []interface{}{v}
+	if s, ok := v.([]interface{}); ok {
+		values = s
+	}
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		for _, re := range res {
+			if re.MatchString(s) {
+				return true
+			}
+		}
+	}
+	return false
+}
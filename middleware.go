@@ -0,0 +1,56 @@
+package mqb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/ansel1/merry"
+)
+
+type contextKey string
+
+// SpecContextKey is the context key under which Middleware stores the parsed *QuerySpec.
+const SpecContextKey = contextKey("mqb.spec")
+
+// Middleware returns a middleware that parses the request with mq and stores the resulting
+// *QuerySpec in the request context. If the request cannot be parsed, the error is written
+// with WriteError and the next handler is not called.
+//
+// Example:
+//     http.Handle("/people", mqb.Middleware(mq)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+//         spec, _ := mqb.SpecFromContext(req.Context())
+//         r, err := mq.RunSpec(req.Context(), spec)
+//         ...
+//     })))
+func Middleware(mq *MongoQuery) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			spec, err := mq.ParseSpec(req.Context(), req)
+			if err != nil {
+				WriteError(w, err)
+				return
+			}
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), SpecContextKey, spec)))
+		})
+	}
+}
+
+// SpecFromContext returns the *QuerySpec stored in ctx by Middleware.
+func SpecFromContext(ctx context.Context) (*QuerySpec, bool) {
+	spec, ok := ctx.Value(SpecContextKey).(*QuerySpec)
+	return spec, ok
+}
+
+// WriteError writes err as JSON body of the form {"error": "message"} with the HTTP status code of err.
+// If err contains validation errors, their details are added:
+//     {"error": "...", "errors": [{"parameter": "age", "code": "invalid_value", "message": "..."}]}
+func WriteError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(merry.HTTPCode(err))
+	body := map[string]interface{}{"error": err.Error()}
+	if details := Details(err); len(details) > 0 {
+		body["errors"] = details
+	}
+	json.NewEncoder(w).Encode(body)
+}
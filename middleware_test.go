@@ -0,0 +1,159 @@
+package mqb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestMiddleware(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	var spec *QuerySpec
+	handler := Middleware(mq)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		spec, _ = SpecFromContext(req.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/?mybool=true&field=intMember&sort=-floatmember&limit=5&page=2", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if spec == nil {
+		t.Fatal("no spec in context")
+	}
+	if !reflect.DeepEqual(spec.Filter, bson.M{"mybool": true}) {
+		t.Errorf("wrong filter in spec: %v", spec.Filter)
+	}
+	if !reflect.DeepEqual(spec.Fields, bson.M{"intMember": 1}) {
+		t.Errorf("wrong fields in spec: %v", spec.Fields)
+	}
+	if !reflect.DeepEqual(spec.Sort, []string{"-floatmember"}) {
+		t.Errorf("wrong sort in spec: %v", spec.Sort)
+	}
+	if spec.Page.Size != 5 || spec.Page.Current != 2 {
+		t.Errorf("wrong page in spec: %v", spec.Page)
+	}
+
+	spec = nil
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/?notAMember=true", nil))
+	if spec != nil {
+		t.Error("next handler called for invalid request")
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code %d", w.Code)
+	}
+	body := struct {
+		Error  string
+		Errors []ErrorDetail
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || len(body.Error) == 0 {
+		t.Errorf("wrong error body: %v, %v", body, err)
+	}
+	if !reflect.DeepEqual(body.Errors, []ErrorDetail{{Parameter: "notAMember", Code: CodeUnsupportedParameter, Message: body.Error}}) {
+		t.Errorf("wrong error details: %v", body.Errors)
+	}
+}
+
+func TestParseSpecDoesNotKeepPage(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?limit=5&page=3", nil)); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if spec.Page.Size != DefaultPageSize || spec.Page.Current != 1 {
+		t.Errorf("page of previous request kept: %v", spec.Page)
+	}
+}
+
+func TestParseSpecExplicitPage(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, expected := range map[string]Page{
+		"/":                {Size: DefaultPageSize, Current: 1},
+		"/?limit=20":       {Size: DefaultPageSize, Current: 1, LimitExplicit: true},
+		"/?page=1":         {Size: DefaultPageSize, Current: 1, PageExplicit: true},
+		"/?limit=5&page=3": {Size: 5, Current: 3, LimitExplicit: true, PageExplicit: true},
+	} {
+		spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if spec.Page != expected {
+			t.Errorf("wrong page for %s: %+v", query, spec.Page)
+		}
+	}
+}
+
+func TestParseSpecApplied(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?limit=5", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(spec.applied, Applied{EffectiveLimit: 5}) {
+		t.Errorf("wrong applied defaults: %+v", spec.applied)
+	}
+
+	mq.SetTenant("stringmember", func(ctx context.Context) (interface{}, error) {
+		return "tenant", nil
+	})
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(spec.applied, Applied{DefaultFilters: []string{"stringmember"}, EffectiveLimit: DefaultPageSize}) {
+		t.Errorf("wrong applied defaults: %+v", spec.applied)
+	}
+
+	b, _ := json.Marshal(&Response{Page: spec.Page})
+	if strings.Contains(string(b), "applied") {
+		t.Errorf("applied defaults in response without EchoDefaults: %s", b)
+	}
+}
+
+func TestResponseApplied(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.count = func(q *mgo.Query) (int, error) { return 0, nil }
+	mq.all = func(q *mgo.Query, content interface{}) error { return nil }
+	mq.SetSortPolicy(func(req *http.Request, sort []string) ([]string, error) {
+		if len(sort) == 0 {
+			return []string{"-intMember"}, nil
+		}
+		return sort, nil
+	})
+	run := func(query string) *Response {
+		spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		r, err := mq.RunSpec(context.Background(), spec)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		return r
+	}
+	if r := run("/"); r.Applied != nil {
+		t.Errorf("applied defaults without EchoDefaults: %+v", r.Applied)
+	}
+
+	mq.EchoDefaults(true)
+	if r := run("/"); r.Applied == nil || !reflect.DeepEqual(*r.Applied, Applied{DefaultSort: []string{"-intMember"}, EffectiveLimit: DefaultPageSize}) {
+		t.Errorf("wrong applied defaults: %+v", r.Applied)
+	}
+	// the requested sort is no default
+	r := run("/?sort=mybool&limit=5")
+	if r.Applied == nil || !reflect.DeepEqual(*r.Applied, Applied{EffectiveLimit: 5}) {
+		t.Errorf("wrong applied defaults: %+v", r.Applied)
+	}
+	b, _ := json.Marshal(r)
+	if !strings.Contains(string(b), `"applied":{"effectiveLimit":5}`) {
+		t.Errorf("wrong serialization of the applied defaults: %s", b)
+	}
+}
@@ -0,0 +1,115 @@
+package mqb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// Route identifies a route mounted by Mount.
+type Route string
+
+// routes mounted by Mount
+const (
+	RouteList   Route = "list"   // RouteList is the route of the list of documents, see Handler.
+	RouteDetail Route = "detail" // RouteDetail is the route of a single document, see RunOne.
+	RouteCount  Route = "count"  // RouteCount is the route of the number of documents, see Count.
+)
+
+// Mount mounts the routes of the collection of mq on mux:
+//     GET basePath           the documents matching the request, see Handler
+//     GET basePath/count     the number of matching documents as {"count": 42}, see Count
+//     GET basePath/{id}      the document with the id, see RunOne
+// Other methods are rejected with http.StatusMethodNotAllowed and errors are written with
+// WriteError. Routes can be disabled, so that they are not found:
+//     mqb.Mount(http.DefaultServeMux, "/people", mq, mqb.RouteCount)
+// Since basePath/count is the count route, a document with the id count cannot be requested.
+func Mount(mux *http.ServeMux, basePath string, mq *MongoQuery, disabled ...Route) {
+	r := &routes{
+		list:     Handler(mq),
+		runOne:   mq.RunOne,
+		count:    mq.Count,
+		disabled: disabled,
+	}
+	r.mount(mux, basePath)
+}
+
+// routes contains the handlers of the routes mounted by Mount.
+type routes struct {
+	list     http.Handler
+	runOne   func(*http.Request, string) (interface{}, error)
+	count    func(*http.Request) (int, error)
+	disabled []Route
+}
+
+// isEnabled returns true if route is not disabled.
+func (r *routes) isEnabled(route Route) bool {
+	for _, d := range r.disabled {
+		if d == route {
+			return false
+		}
+	}
+	return true
+}
+
+// mount mounts the enabled routes on mux.
+func (r *routes) mount(mux *http.ServeMux, basePath string) {
+	basePath = "/" + strings.Trim(basePath, "/")
+	if r.isEnabled(RouteList) {
+		mux.Handle(basePath, onlyGet(r.list))
+	}
+	if !r.isEnabled(RouteDetail) && !r.isEnabled(RouteCount) {
+		return
+	}
+	prefix := strings.TrimSuffix(basePath, "/") + "/"
+	mux.Handle(prefix, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, prefix)
+		switch {
+		case id == string(RouteCount) && r.isEnabled(RouteCount):
+			onlyGet(http.HandlerFunc(r.serveCount)).ServeHTTP(w, req)
+		case len(id) > 0 && !strings.Contains(id, "/") && id != string(RouteCount) && r.isEnabled(RouteDetail):
+			onlyGet(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				r.serveDetail(w, req, id)
+			})).ServeHTTP(w, req)
+		default:
+			WriteError(w, merry.Wrap(errors.New("not found")).WithHTTPCode(http.StatusNotFound))
+		}
+	}))
+}
+
+// serveDetail writes the document with id as JSON.
+func (r *routes) serveDetail(w http.ResponseWriter, req *http.Request, id string) {
+	doc, err := r.runOne(req, id)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", MediaTypeJSON)
+	json.NewEncoder(w).Encode(doc)
+}
+
+// serveCount writes the number of documents matching req as JSON.
+func (r *routes) serveCount(w http.ResponseWriter, req *http.Request) {
+	n, err := r.count(req)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", MediaTypeJSON)
+	json.NewEncoder(w).Encode(map[string]int{"count": n})
+}
+
+// onlyGet returns a handler that rejects requests with other methods than GET and HEAD.
+func onlyGet(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			WriteError(w, merry.Wrap(errors.New("method not allowed")).WithHTTPCode(http.StatusMethodNotAllowed))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,106 @@
+package mqb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func stubRoutes(disabled ...Route) *routes {
+	return &routes{
+		list: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("list"))
+		}),
+		runOne: func(req *http.Request, id string) (interface{}, error) {
+			if id == "missing" {
+				return nil, merry.Wrap(errors.New("not found")).WithHTTPCode(http.StatusNotFound)
+			}
+			return TestStruct{StringMember: id}, nil
+		},
+		count: func(req *http.Request) (int, error) {
+			return 42, nil
+		},
+		disabled: disabled,
+	}
+}
+
+func TestMountRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	stubRoutes().mount(mux, "/people/")
+	for _, test := range []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"GET", "/people", http.StatusOK, "list"},
+		{"HEAD", "/people", http.StatusOK, ""},
+		{"GET", "/people/count", http.StatusOK, `{"count":42}`},
+		{"GET", "/people/peter", http.StatusOK, `"name":"peter"`},
+		{"GET", "/people/missing", http.StatusNotFound, `"error":"not found"`},
+		{"GET", "/people/peter/friends", http.StatusNotFound, ""},
+		{"GET", "/people/", http.StatusNotFound, ""},
+		{"POST", "/people", http.StatusMethodNotAllowed, ""},
+		{"DELETE", "/people/peter", http.StatusMethodNotAllowed, ""},
+		{"PUT", "/people/count", http.StatusMethodNotAllowed, ""},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("wrong status code for %s %s: %d", test.method, test.path, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("wrong body for %s %s: %s", test.method, test.path, w.Body.String())
+		}
+		if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("missing allow header for %s %s", test.method, test.path)
+		}
+	}
+}
+
+func TestMountDisabledRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	stubRoutes(RouteCount).mount(mux, "people")
+	for path, code := range map[string]int{
+		"/people":       http.StatusOK,
+		"/people/count": http.StatusNotFound,
+		"/people/peter": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("wrong status code for %s: %d", path, w.Code)
+		}
+	}
+
+	mux = http.NewServeMux()
+	stubRoutes(RouteList, RouteDetail, RouteCount).mount(mux, "/people")
+	for _, path := range []string{"/people", "/people/count", "/people/peter"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("disabled route %s was found: %d", path, w.Code)
+		}
+	}
+}
+
+func TestMountErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	Mount(mux, "/people", NewMongoQuery(TestStruct{}, &mgo.Database{}))
+	for _, path := range []string{"/people?notAMember=1", "/people/count?notAMember=1", "/people/peter?field=notAMember"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("error occured for %s: %s", path, err)
+		}
+		if w.Code != http.StatusBadRequest || body["error"] == nil {
+			t.Errorf("wrong error response for %s: %d %v", path, w.Code, body)
+		}
+	}
+}
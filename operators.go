@@ -0,0 +1,778 @@
+package mqb
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// operatorSeparator separates a parameter name from an operator, like in name__regex.
+const operatorSeparator = "__"
+
+// splitOperator splits a parameter of the form name__operator into name and operator.
+// If the parameter has no operator, the operator is an empty string.
+func splitOperator(parameterName string) (string, string) {
+	i := strings.LastIndex(parameterName, operatorSeparator)
+	if i <= 0 {
+		return parameterName, ""
+	}
+	return parameterName[:i], parameterName[i+len(operatorSeparator):]
+}
+
+// RegexStyle defines how regular expressions are represented in filters.
+type RegexStyle int
+
+// regex styles
+const (
+	RegexStyleType     RegexStyle = iota // RegexStyleType represents a regex as bson.RegEx value.
+	RegexStyleDocument                   // RegexStyleDocument represents a regex as {"$regex": pattern, "$options": options} document.
+)
+
+// fieldComparisonOperators maps the operators comparing two fields to the corresponding
+// aggregation operators.
+var fieldComparisonOperators = map[string]string{
+	"eqfield":  "$eq",
+	"nefield":  "$ne",
+	"gtfield":  "$gt",
+	"gtefield": "$gte",
+	"ltfield":  "$lt",
+	"ltefield": "$lte",
+}
+
+// comparisonOperators maps the operators comparing a field with a value to the corresponding
+// query operators.
+var comparisonOperators = map[string]string{
+	"gt":  "$gt",
+	"gte": "$gte",
+	"lt":  "$lt",
+	"lte": "$lte",
+}
+
+// SetMostRestrictiveOperators defines how a comparison operator that is repeated for the same
+// field is handled. Per default the request is rejected, if enabled the most restrictive value
+// is used, so /?age__gt=10&age__gt=20 filters {"age": {"$gt": 20}}.
+func (mq *MongoQuery) SetMostRestrictiveOperators(enabled bool) {
+	mq.mostRestrictiveOperators = enabled
+}
+
+// AllowRawRegexOn allows raw regular expressions for the given parameters. A raw
+// regular expression has to be passed with the regex operator:
+//
+//     /?name__regex=^pe.*er$
+//
+// The pattern has to compile and must not be longer than the maximum regex length. The plain
+// values of the parameters are escaped, like with SetEscapeRegex, so /?name=pe.* matches pe.*
+// literally.
+func (mq *MongoQuery) AllowRawRegexOn(parameters ...string) {
+	for _, p := range parameters {
+		if !contains(mq.rawRegexParameters, p) {
+			mq.rawRegexParameters = append(mq.rawRegexParameters, p)
+		}
+	}
+}
+
+// SetMaxRegexLength sets the maximum length of a regex pattern. A value of 0 disables
+// the check.
+func (mq *MongoQuery) SetMaxRegexLength(n int) {
+	mq.maxRegexLength = n
+}
+
+// SetRejectComplexRegex enables or disables the rejection of raw regex patterns with nested
+// unbounded quantifiers like (a+)+.
+func (mq *MongoQuery) SetRejectComplexRegex(reject bool) {
+	mq.rejectComplexRegex = reject
+}
+
+// createOperatorFilter creates the filter value for the parameter name with the given operator.
+func (mq *MongoQuery) createOperatorFilter(req *http.Request, name, operator string, values []string) (interface{}, error) {
+	kind, ok := mq.supportedParameters[name]
+	if _, isMeta := validMetaParameters[name]; !ok || isMeta {
+		return nil, withCode(merry.Wrap(fmt.Errorf("parameter '%s' is not supported", name+operatorSeparator+operator)).WithHTTPCode(http.StatusBadRequest), CodeUnsupportedParameter)
+	}
+	switch operator {
+	case "regex":
+		if kind != reflect.String || !contains(mq.rawRegexParameters, name) {
+			return nil, merry.Wrap(fmt.Errorf("operator '%s' is not supported for parameter '%s'", operator, name)).WithHTTPCode(http.StatusBadRequest)
+		}
+		if len(values) != 1 {
+			return nil, merry.Wrap(fmt.Errorf("parameter '%s' supports only one value", name+operatorSeparator+operator)).WithHTTPCode(http.StatusBadRequest)
+		}
+		if err := mq.validateRawRegex(values[0]); err != nil {
+			return nil, err
+		}
+		return mq.regex(values[0], mq.regexOptions), nil
+	case "exists":
+		if len(values) != 1 {
+			return nil, merry.Wrap(fmt.Errorf("parameter '%s' supports only one value", name+operatorSeparator+operator)).WithHTTPCode(http.StatusBadRequest)
+		}
+		exists, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return nil, merry.Wrap(fmt.Errorf("invalid value for %s: %s", name+operatorSeparator+operator, values[0])).WithHTTPCode(http.StatusBadRequest)
+		}
+		return map[string]interface{}{"$exists": exists}, nil
+	case "gt", "gte", "lt", "lte":
+		if class := kindClass(kind); class != "number" && class != "string" && !mq.isTimeParameter(name) {
+			return nil, merry.Wrap(fmt.Errorf("operator '%s' is not supported for parameter '%s'", operator, name)).WithHTTPCode(http.StatusBadRequest)
+		}
+		var filter interface{}
+		for _, v := range values {
+			value, literal, err := mq.resolveToken(req, name, kind, v)
+			if err != nil {
+				return nil, err
+			}
+			if value == nil {
+				if value, err = mq.parseComparisonValue(name, kind, literal); err != nil {
+					return nil, merry.Wrap(fmt.Errorf("invalid value for %s: %s", name+operatorSeparator+operator, err)).WithHTTPCode(http.StatusBadRequest)
+				}
+			}
+			if filter, err = mq.mergeFilterValues(name, filter, map[string]interface{}{comparisonOperators[operator]: value}); err != nil {
+				return nil, err
+			}
+		}
+		if filter == nil {
+			return nil, merry.Wrap(fmt.Errorf("parameter '%s' requires a value", name+operatorSeparator+operator)).WithHTTPCode(http.StatusBadRequest)
+		}
+		return filter, nil
+	case "after", "before":
+		if name != "_id" || kind != reflect.String {
+			return nil, merry.Wrap(fmt.Errorf("operator '%s' is not supported for parameter '%s'", operator, name)).WithHTTPCode(http.StatusBadRequest)
+		}
+		if len(values) != 1 {
+			return nil, merry.Wrap(fmt.Errorf("parameter '%s' supports only one value", name+operatorSeparator+operator)).WithHTTPCode(http.StatusBadRequest)
+		}
+		return createObjectIdTimeFilter(operator, values[0])
+	case "elemMatch":
+		return mq.createElemMatchFilter(name, kind, values)
+	case "startswith":
+		if kind != reflect.String {
+			return nil, merry.Wrap(fmt.Errorf("operator '%s' is not supported for parameter '%s'", operator, name)).WithHTTPCode(http.StatusBadRequest)
+		}
+		if len(values) != 1 {
+			return nil, merry.Wrap(fmt.Errorf("parameter '%s' supports only one value", name+operatorSeparator+operator)).WithHTTPCode(http.StatusBadRequest)
+		}
+		return mq.prefixFilter(name, values[0]), nil
+	}
+	return nil, withCode(merry.Wrap(fmt.Errorf("parameter '%s' is not supported", name+operatorSeparator+operator)).WithHTTPCode(http.StatusBadRequest), CodeUnsupportedParameter)
+}
+
+// prefixRangeOperators are the range operators a prefix search that is rewritten to a range
+// collides with, see SetPrefixRangeRewrite.
+var prefixRangeOperators = []string{"gt", "gte", "lt", "lte"}
+
+// checkOperatorCombinations returns an error if the parameters in values combine the operator
+// startswith with a range operator on a parameter whose prefix searches are rewritten to
+// ranges, like /?name__startswith=pe&name__gte=a. The range of the prefix and the range
+// operator can only be merged with SetMostRestrictiveOperators.
+func (mq *MongoQuery) checkOperatorCombinations(values url.Values) error {
+	if mq.mostRestrictiveOperators || len(mq.prefixRangeParameters) == 0 {
+		return nil
+	}
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	prefixed := map[string]bool{}
+	ranges := map[string]string{}
+	for _, k := range keys {
+		name, operator := splitOperator(mq.resolveAlias(k))
+		if !contains(mq.prefixRangeParameters, name) {
+			continue
+		}
+		switch {
+		case operator == "startswith":
+			prefixed[name] = true
+		case contains(prefixRangeOperators, operator):
+			if _, ok := ranges[name]; !ok {
+				ranges[name] = operator
+			}
+		}
+	}
+	names := []string{}
+	for name := range prefixed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if operator, ok := ranges[name]; ok {
+			return withCode(merry.Wrap(fmt.Errorf("operators 'startswith' and '%s' cannot be combined for parameter '%s'", operator, name)).WithHTTPCode(http.StatusBadRequest), CodeConflict)
+		}
+	}
+	return nil
+}
+
+// valuePrefixOperators are the operators that can prefix the values of numeric parameters.
+var valuePrefixOperators = []string{"gt", "gte", "lt", "lte", "ne"}
+
+// addPrefixOperatorFilters merges the values of the numeric parameter name with an operator
+// prefix into the operator filter of name and returns the other values:
+//     /?age=gt:30&age=lt:65  {"age": {"$gt": 30, "$lt": 65}}
+//     /?age=ne:30&age=ne:40  {"age": {"$nin": [30, 40]}}
+// The prefixes gt:, gte:, lt:, lte: and ne: are supported, other prefixes are rejected.
+func (mq *MongoQuery) addPrefixOperatorFilters(req *http.Request, operators map[string]interface{}, name string, kind reflect.Kind, values []string) ([]string, error) {
+	plain := []string{}
+	prefixed := make(map[string][]string)
+	for _, v := range values {
+		i := strings.Index(v, ":")
+		if i < 0 {
+			plain = append(plain, v)
+			continue
+		}
+		operator := v[:i]
+		if !contains(valuePrefixOperators, operator) {
+			return nil, withCode(merry.Wrap(fmt.Errorf("unknown operator prefix '%s:' for parameter '%s'", operator, name)).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+		}
+		prefixed[operator] = append(prefixed[operator], v[i+1:])
+	}
+	for _, operator := range valuePrefixOperators {
+		values, ok := prefixed[operator]
+		if !ok {
+			continue
+		}
+		var value interface{}
+		if operator == "ne" {
+			excluded := []interface{}{}
+			for _, v := range values {
+				e, err := mq.parseComparisonValue(name, kind, v)
+				if err != nil {
+					return nil, merry.Wrap(fmt.Errorf("invalid value for %s: %s", name, err)).WithHTTPCode(http.StatusBadRequest)
+				}
+				excluded = append(excluded, e)
+			}
+			excluded = uniqueValues(excluded)
+			value = map[string]interface{}{"$nin": excluded}
+			if len(excluded) == 1 {
+				value = map[string]interface{}{"$ne": excluded[0]}
+			}
+		} else {
+			var err error
+			if value, err = mq.createOperatorFilter(req, name, operator, values); err != nil {
+				return nil, err
+			}
+		}
+		merged, err := mq.mergeFilterValues(name, operators[name], value)
+		if err != nil {
+			return nil, err
+		}
+		operators[name] = merged
+	}
+	return plain, nil
+}
+
+// createObjectIdTimeFilter creates the filter of the _id parameter with the operator after or
+// before, which compares the creation time embedded in ObjectIds with v:
+//     /?_id__after=2023-06-01  {"_id": {"$gt": ObjectId("6477df800000000000000000")}}
+// The value is a RFC3339 time or a date in UTC. ObjectIds contain the time in seconds, so the
+// time is truncated to seconds: after matches documents created in the same second and
+// before does not.
+func createObjectIdTimeFilter(operator, v string) (interface{}, error) {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", v)
+	}
+	if err != nil {
+		if bson.IsObjectIdHex(v) {
+			return nil, merry.Wrap(fmt.Errorf("invalid value for _id__%s: %s is not a time", operator, v)).WithHTTPCode(http.StatusBadRequest)
+		}
+		return nil, merry.Wrap(fmt.Errorf("invalid value for _id__%s: %s", operator, v)).WithHTTPCode(http.StatusBadRequest)
+	}
+	if operator == "before" {
+		return map[string]interface{}{"$lt": bson.NewObjectIdWithTime(t)}, nil
+	}
+	return map[string]interface{}{"$gt": bson.NewObjectIdWithTime(t)}, nil
+}
+
+// isObjectIdRange returns true if the operator filter value v compares ObjectIds only, like
+// the filters of _id__after and _id__before.
+func isObjectIdRange(v interface{}) bool {
+	doc, ok := operatorDocument(v)
+	if !ok || len(doc) == 0 {
+		return false
+	}
+	for k, value := range doc {
+		if _, ok := comparisonOperators[strings.TrimPrefix(k, "$")]; !ok {
+			return false
+		}
+		if _, ok := value.(bson.ObjectId); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// createElemMatchFilter creates the $elemMatch filter of the slice parameter name, which
+// matches documents with an element that satisfies all comparisons:
+//     /?scores__elemMatch=gte:90,lte:100
+//     {"scores": {"$elemMatch": {"$gte": 90, "$lte": 100}}}
+// Unlike /?scores__gte=90&scores__lte=100, which matches an array with the elements 80 and 110
+// because each bound is satisfied by another element.
+func (mq *MongoQuery) createElemMatchFilter(name string, kind reflect.Kind, values []string) (interface{}, error) {
+	parameter := name + operatorSeparator + "elemMatch"
+	if !mq.isArrayParameter(name) {
+		return nil, merry.Wrap(fmt.Errorf("operator 'elemMatch' is not supported for parameter '%s', it is not an array", name)).WithHTTPCode(http.StatusBadRequest)
+	}
+	match := map[string]interface{}{}
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			i := strings.Index(part, ":")
+			if i < 0 {
+				return nil, merry.Wrap(fmt.Errorf("invalid value for %s: '%s' is not of the form operator:value", parameter, part)).WithHTTPCode(http.StatusBadRequest)
+			}
+			operator, ok := comparisonOperators[part[:i]]
+			if !ok {
+				return nil, merry.Wrap(fmt.Errorf("invalid value for %s: operator '%s' is not supported", parameter, part[:i])).WithHTTPCode(http.StatusBadRequest)
+			}
+			if _, ok := match[operator]; ok {
+				return nil, merry.Wrap(fmt.Errorf("invalid value for %s: operator '%s' is repeated", parameter, part[:i])).WithHTTPCode(http.StatusBadRequest)
+			}
+			v, err := mq.parseComparisonValue(name, kind, part[i+1:])
+			if err != nil {
+				return nil, merry.Wrap(fmt.Errorf("invalid value for %s: %s", parameter, err)).WithHTTPCode(http.StatusBadRequest)
+			}
+			match[operator] = v
+		}
+	}
+	if len(match) == 0 {
+		return nil, merry.Wrap(fmt.Errorf("parameter '%s' requires a value", parameter)).WithHTTPCode(http.StatusBadRequest)
+	}
+	return map[string]interface{}{"$elemMatch": match}, nil
+}
+
+// parseComparisonValue parses v as value of the parameter name of the given kind for a
+// comparison. Values of time fields are parsed as RFC3339 or with the layout of the time
+// partitioning, see SetTimePartitioning.
+func (mq *MongoQuery) parseComparisonValue(name string, kind reflect.Kind, v string) (interface{}, error) {
+	if mq.isTimeParameter(name) {
+		layout := time.RFC3339
+		if name == mq.partitionField {
+			layout = mq.partitionLayout
+		}
+		return time.Parse(layout, v)
+	}
+	switch kindClass(kind) {
+	case "number":
+		switch kind {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return mq.parseUint(v)
+		case reflect.Float32, reflect.Float64:
+			return mq.parseFloat(v)
+		}
+		return mq.parseInt(v)
+	case "string":
+		return v, nil
+	}
+	return nil, fmt.Errorf("comparisons are not supported for kind '%s'", kind)
+}
+
+// mergeFilterValues merges the operator filter value added for the parameter name into the
+// existing operator filter value of name, which is nil if name has no operator filter yet. All
+// operators of a request have to match, so they are merged into one document, regular
+// expressions are merged as $regex:
+//     /?age__gt=10&age__lt=20 = {"age": {"$gt": 10, "$lt": 20}}
+// If both contain the same comparison operator, the most restrictive value is used if enabled
+// with SetMostRestrictiveOperators, otherwise an error is returned. Other repeated operators
+// are a conflict.
+func (mq *MongoQuery) mergeFilterValues(name string, existing, added interface{}) (interface{}, error) {
+	if existing == nil {
+		return added, nil
+	}
+	conflict := withCode(merry.Wrap(fmt.Errorf("conflicting filters for parameter '%s'", name)).WithHTTPCode(http.StatusBadRequest), CodeConflict)
+	a, ok := operatorDocument(existing)
+	if !ok {
+		return nil, conflict
+	}
+	b, ok := operatorDocument(added)
+	if !ok {
+		return nil, conflict
+	}
+	merged := map[string]interface{}{}
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		current, ok := merged[k]
+		if !ok {
+			merged[k] = v
+			continue
+		}
+		if !mq.mostRestrictiveOperators {
+			if _, isComparison := restrictiveOrder[k]; isComparison {
+				return nil, merry.Wrap(fmt.Errorf("operator '%s' is repeated for parameter '%s'", k, name)).WithHTTPCode(http.StatusBadRequest)
+			}
+			return nil, conflict
+		}
+		restrictive, ok := mostRestrictive(k, current, v)
+		if !ok {
+			return nil, conflict
+		}
+		merged[k] = restrictive
+	}
+	return merged, nil
+}
+
+// operatorDocument returns the filter value v as document of query operators. The bool value
+// is false if v is neither an operator document nor a regular expression.
+func operatorDocument(v interface{}) (map[string]interface{}, bool) {
+	var doc map[string]interface{}
+	switch value := v.(type) {
+	case bson.RegEx:
+		return map[string]interface{}{"$regex": value.Pattern, "$options": value.Options}, true
+	case bson.M:
+		doc = value
+	case map[string]interface{}:
+		doc = value
+	default:
+		return nil, false
+	}
+	for k := range doc {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return doc, len(doc) > 0
+}
+
+// restrictiveOrder contains the comparison operators with the sign of the comparison result
+// of the more restrictive value.
+var restrictiveOrder = map[string]int{
+	"$gt":  1,
+	"$gte": 1,
+	"$lt":  -1,
+	"$lte": -1,
+}
+
+// mostRestrictive returns the more restrictive value of a and b for the comparison operator.
+// The bool value is false if operator is not a comparison or the values are not comparable.
+func mostRestrictive(operator string, a, b interface{}) (interface{}, bool) {
+	sign, ok := restrictiveOrder[operator]
+	if !ok {
+		return nil, false
+	}
+	c, ok := compareValues(a, b)
+	if !ok {
+		return nil, false
+	}
+	if c*sign >= 0 {
+		return a, true
+	}
+	return b, true
+}
+
+// compareValues compares two values of the same type. The bool value is false if the values
+// are not of the same comparable type.
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case int:
+		if y, ok := b.(int); ok {
+			return compareFloats(float64(x), float64(y)), true
+		}
+	case uint:
+		if y, ok := b.(uint); ok {
+			return compareFloats(float64(x), float64(y)), true
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			return compareFloats(x, y), true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// compareFloats returns -1 if a < b, 1 if a > b and 0 otherwise.
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// SetPrefixRangeRewrite enables the rewrite of prefix searches on the given parameters to
+// range queries. Prefix searches are done with the startswith operator or the prefix match
+// mode and are executed as anchored regex per default. On an indexed field a range query can
+// be faster, /?name__startswith=pe is rewritten to:
+//     {"name": {"$gte": "pe", "$lt": "pf"}}
+// Both match the same strings, since MongoDB compares strings by their UTF-8 bytes if no
+// collation is set. If the successor of the prefix cannot be computed, the anchored regex is used.
+func (mq *MongoQuery) SetPrefixRangeRewrite(parameters ...string) {
+	for _, p := range parameters {
+		if !contains(mq.prefixRangeParameters, p) {
+			mq.prefixRangeParameters = append(mq.prefixRangeParameters, p)
+		}
+	}
+}
+
+// prefixFilter returns the filter value for strings of the parameter name starting with prefix.
+func (mq *MongoQuery) prefixFilter(name, prefix string) interface{} {
+	// ranges compare case sensitively
+	if contains(mq.prefixRangeParameters, name) && !strings.Contains(mq.regexOptions, "i") {
+		if upper, ok := prefixSuccessor(prefix); ok {
+			return map[string]interface{}{
+				"$gte": prefix,
+				"$lt":  upper,
+			}
+		}
+	}
+	return mq.regex("^"+regexp.QuoteMeta(prefix), mq.regexOptions)
+}
+
+// prefixSuccessor returns the smallest string that is greater than all strings starting with
+// prefix, which is prefix with its last character incremented. The bool value is false for an
+// empty prefix, invalid UTF-8, and if the last character is the maximal code point or
+// precedes the surrogate range.
+func prefixSuccessor(prefix string) (string, bool) {
+	last, size := utf8.DecodeLastRuneInString(prefix)
+	if last == utf8.RuneError || last == utf8.MaxRune || last == 0xD7FF || !utf8.ValidString(prefix) {
+		return "", false
+	}
+	return prefix[:len(prefix)-size] + string(last+1), true
+}
+
+// SetRegexStyle sets how regular expressions are represented in the filter. Per default
+// RegexStyleType is used.
+func (mq *MongoQuery) SetRegexStyle(style RegexStyle) {
+	mq.regexStyle = style
+}
+
+// SetRegexOptions sets the options of the regular expressions that match string parameters,
+// including prefix searches and raw regular expressions. For example "i" matches case
+// insensitively, so /?name=peter also matches Peter:
+//     mq.SetRegexOptions("i")
+//     /?name=peter  {"name": {"$regex": "peter", "$options": "i"}}
+// The options are the characters i, m, s and x as supported by MongoDB, an error is returned
+// for others. Prefix searches are not rewritten to range queries if the options contain i,
+// see SetPrefixRangeRewrite. Per default no options are set.
+func (mq *MongoQuery) SetRegexOptions(options string) error {
+	for _, o := range options {
+		if !strings.ContainsRune("imsx", o) {
+			return fmt.Errorf("invalid regex option '%c' in '%s', valid options are i, m, s and x", o, options)
+		}
+		if strings.Count(options, string(o)) > 1 {
+			return fmt.Errorf("regex option '%c' is repeated in '%s'", o, options)
+		}
+	}
+	mq.regexOptions = options
+	return nil
+}
+
+// regex returns the filter value matching pattern with options in the configured regex style.
+func (mq *MongoQuery) regex(pattern, options string) interface{} {
+	if mq.regexStyle == RegexStyleDocument {
+		return bson.M{"$regex": pattern, "$options": options}
+	}
+	return bson.RegEx{Pattern: pattern, Options: options}
+}
+
+// validateRawRegex returns an error if pattern does not compile, is too long or is too complex.
+func (mq *MongoQuery) validateRawRegex(pattern string) error {
+	if err := mq.checkRegexLength(pattern); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return merry.Wrap(fmt.Errorf("invalid regex: %s", err)).WithHTTPCode(http.StatusBadRequest)
+	}
+	if mq.rejectComplexRegex {
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			return merry.Wrap(fmt.Errorf("invalid regex: %s", err)).WithHTTPCode(http.StatusBadRequest)
+		}
+		if hasNestedUnboundedRepeat(re, false) {
+			return merry.Wrap(fmt.Errorf("regex '%s' is too complex", pattern)).WithHTTPCode(http.StatusBadRequest)
+		}
+	}
+	return nil
+}
+
+// checkRegexLength returns an error if pattern is longer than the maximum regex length.
+func (mq *MongoQuery) checkRegexLength(pattern string) error {
+	if mq.maxRegexLength > 0 && len(pattern) > mq.maxRegexLength {
+		return merry.Wrap(fmt.Errorf("regex is longer than %d characters", mq.maxRegexLength)).WithHTTPCode(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// hasNestedUnboundedRepeat reports whether re contains an unbounded repetition inside another
+// unbounded repetition. If inside is true, re is already part of an unbounded repetition.
+func hasNestedUnboundedRepeat(re *syntax.Regexp, inside bool) bool {
+	unbounded := re.Op == syntax.OpStar || re.Op == syntax.OpPlus || (re.Op == syntax.OpRepeat && re.Max == -1)
+	if unbounded && inside {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasNestedUnboundedRepeat(sub, inside || unbounded) {
+			return true
+		}
+	}
+	return false
+}
+
+// createFieldComparisons creates the $expr clauses that compare the parameter name with each of
+// the parameters in values, like updatedat__gtfield=createdat. Both parameters must be of a
+// comparable kind. Run executes queries with $expr as aggregation pipeline on servers older than
+// MongoDB 3.6, which do not support $expr in queries, see matchStages.
+func (mq *MongoQuery) createFieldComparisons(name, operator string, values []string) ([]interface{}, error) {
+	kind, ok := mq.supportedParameters[name]
+	if _, isMeta := validMetaParameters[name]; !ok || isMeta {
+		return nil, withCode(merry.Wrap(fmt.Errorf("parameter '%s' is not supported", name+operatorSeparator+operator)).WithHTTPCode(http.StatusBadRequest), CodeUnsupportedParameter)
+	}
+	clauses := []interface{}{}
+	for _, v := range values {
+		other := mq.resolveAlias(v)
+		otherKind, ok := mq.supportedParameters[other]
+		if _, isMeta := validMetaParameters[other]; !ok || isMeta {
+			return nil, merry.Wrap(fmt.Errorf("invalid value for %s: parameter '%s' is not supported", name+operatorSeparator+operator, v)).WithHTTPCode(http.StatusBadRequest)
+		}
+		if kindClass(kind) != kindClass(otherKind) {
+			return nil, merry.Wrap(fmt.Errorf("parameters '%s' and '%s' are not comparable", name, other)).WithHTTPCode(http.StatusBadRequest)
+		}
+		clauses = append(clauses, map[string]interface{}{
+			fieldComparisonOperators[operator]: []interface{}{mq.fieldExpr(name), mq.fieldExpr(other)},
+		})
+	}
+	return clauses, nil
+}
+
+// fieldExpr returns the aggregation expression of the value of the field name.
+func (mq *MongoQuery) fieldExpr(name string) interface{} {
+	if mq.literalFields[name] {
+		return map[string]interface{}{"$getField": name}
+	}
+	return "$" + name
+}
+
+// kindClass returns the class of values with the given kind that can be compared with each other.
+func kindClass(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return kind.String()
+}
+
+// addLiteralFieldClauses moves the filters of fields with literal dots in their names, see
+// AddParameter, from filter to comparisons, since MongoDB treats the keys of a filter as paths.
+// The fields are read with $getField instead.
+func (mq *MongoQuery) addLiteralFieldClauses(filter map[string]interface{}, comparisons map[string][]interface{}) error {
+	for name, v := range filter {
+		if !mq.literalFields[name] {
+			continue
+		}
+		clauses, err := literalFieldClauses(name, v)
+		if err != nil {
+			return err
+		}
+		comparisons[name] = append(comparisons[name], clauses...)
+		delete(filter, name)
+	}
+	return nil
+}
+
+// literalFieldClauses returns the $expr clauses of the filter v of the field name with literal
+// dots.
+func literalFieldClauses(name string, v interface{}) ([]interface{}, error) {
+	field := map[string]interface{}{"$getField": name}
+	doc, ok := v.(map[string]interface{})
+	if m, isM := v.(bson.M); isM {
+		doc, ok = m, true
+	}
+	operators := []string{}
+	for op := range doc {
+		if !strings.HasPrefix(op, "$") {
+			ok = false
+		}
+		operators = append(operators, op)
+	}
+	if !ok || len(operators) == 0 {
+		return []interface{}{literalFieldMatch(field, v)}, nil
+	}
+	sort.Strings(operators)
+	clauses := []interface{}{}
+	for _, op := range operators {
+		value := doc[op]
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			clauses = append(clauses, map[string]interface{}{op: []interface{}{field, value}})
+		case "$in", "$nin":
+			values, _ := value.([]interface{})
+			or := []interface{}{}
+			for _, v := range values {
+				or = append(or, literalFieldMatch(field, v))
+			}
+			var clause interface{} = map[string]interface{}{"$or": or}
+			if op == "$nin" {
+				clause = map[string]interface{}{"$not": []interface{}{clause}}
+			}
+			clauses = append(clauses, clause)
+		case "$exists":
+			exists := "$ne"
+			if b, _ := value.(bool); !b {
+				exists = "$eq"
+			}
+			clauses = append(clauses, map[string]interface{}{exists: []interface{}{map[string]interface{}{"$type": field}, "missing"}})
+		case "$not":
+			clauses = append(clauses, map[string]interface{}{"$not": []interface{}{literalFieldMatch(field, value)}})
+		default:
+			return nil, merry.Wrap(fmt.Errorf("operator '%s' is not supported for parameter '%s'", op, name)).WithHTTPCode(http.StatusBadRequest)
+		}
+	}
+	return clauses, nil
+}
+
+// literalFieldMatch returns the $expr clause that matches the value v, which is a regular
+// expression or compared for equality, of field.
+func literalFieldMatch(field, v interface{}) interface{} {
+	if re, ok := v.(bson.RegEx); ok {
+		return map[string]interface{}{"$regexMatch": map[string]interface{}{"input": field, "regex": re.Pattern, "options": re.Options}}
+	}
+	return map[string]interface{}{"$eq": []interface{}{field, v}}
+}
+
+// addExprClause adds the comparisons to filter as an $expr. Multiple comparisons are combined
+// with an $and, ordered by parameter name.
+func addExprClause(filter map[string]interface{}, comparisons map[string][]interface{}) {
+	names := []string{}
+	for name := range comparisons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	clauses := []interface{}{}
+	for _, name := range names {
+		clauses = append(clauses, comparisons[name]...)
+	}
+	switch len(clauses) {
+	case 0:
+	case 1:
+		filter["$expr"] = clauses[0]
+	default:
+		filter["$expr"] = map[string]interface{}{"$and": clauses}
+	}
+}
@@ -0,0 +1,593 @@
+package mqb
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestSplitOperator(t *testing.T) {
+	tests := map[string][2]string{
+		"name__regex":   {"name", "regex"},
+		"name":          {"name", ""},
+		"__regex":       {"__regex", ""},
+		"my__name__gte": {"my__name", "gte"},
+	}
+	for parameter, expected := range tests {
+		name, operator := splitOperator(parameter)
+		if name != expected[0] || operator != expected[1] {
+			t.Errorf("wrong split for %s: '%s' '%s'", parameter, name, operator)
+		}
+	}
+}
+
+func TestRawRegex(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?stringmember__regex="+url.QueryEscape("^pe.*er$"), bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("raw regex on a parameter without grant did not produce an error")
+	}
+
+	mq.AllowRawRegexOn("stringmember")
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{
+		"stringmember": bson.RegEx{Pattern: "^pe.*er$", Options: ""},
+	}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+	// plain values of the parameter are escaped
+	req, _ = http.NewRequest("GET", "/?stringmember="+url.QueryEscape("pe.*"), bytes.NewBufferString(""))
+	if q, err = mq.createQueryFilter(req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": bson.RegEx{Pattern: `pe\.\*`, Options: ""}}) {
+		t.Errorf("plain value of raw regex parameter not escaped: %v", q)
+	}
+
+	invalid := []string{"pe(ter", "(a+)+", "(.*x)*", "abcdefghijklmnopqrstuvwxyz"}
+	mq.SetRejectComplexRegex(true)
+	mq.SetMaxRegexLength(20)
+	for _, pattern := range invalid {
+		req, _ = http.NewRequest("GET", "/?stringmember__regex="+url.QueryEscape(pattern), bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("invalid pattern '%s' did not produce an error", pattern)
+		}
+	}
+
+	for _, query := range []string{"/?mybool__regex=true", "/?stringmember=foo&stringmember__regex=bar", "/?stringmember__foo=bar"} {
+		req, _ = http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("query '%s' did not produce an error", query)
+		}
+	}
+}
+
+func TestFieldComparisons(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddOrOverwriteValidParameter("createdat", reflect.Struct)
+	req, _ := http.NewRequest("GET", "/?intMember__gtfield=floatmember", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{
+		"$expr": map[string]interface{}{"$gt": []interface{}{"$intMember", "$floatmember"}},
+	}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+
+	req, _ = http.NewRequest("GET", "/?uintmember__ltefield=intMember&timemember__gtfield=createdat&mybool=true", bytes.NewBufferString(""))
+	q, err = mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{
+		"mybool": true,
+		"$expr": map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"$gt": []interface{}{"$timemember", "$createdat"}},
+			map[string]interface{}{"$lte": []interface{}{"$uintmember", "$intMember"}},
+		}},
+	}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+
+	for _, query := range []string{"/?intMember__gtfield=stringmember", "/?intMember__gtfield=notAMember", "/?notAMember__gtfield=intMember", "/?intMember__gtfield=limit"} {
+		req, _ = http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("query '%s' did not produce an error", query)
+		}
+	}
+}
+
+func TestPrefixSearch(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, expected := range map[string]interface{}{
+		"/?stringmember__startswith=p.e":          bson.RegEx{Pattern: `^p\.e`, Options: ""},
+		"/?stringmember=pe&matchmode=prefix":      bson.RegEx{Pattern: "^pe", Options: ""},
+		"/?stringmember__startswith=" + "%C3%BCb": bson.RegEx{Pattern: "^üb", Options: ""},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": expected}) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	mq.SetPrefixRangeRewrite("stringmember")
+	for query, expected := range map[string]interface{}{
+		"/?stringmember__startswith=pe":            map[string]interface{}{"$gte": "pe", "$lt": "pf"},
+		"/?stringmember=pe&matchmode=prefix":       map[string]interface{}{"$gte": "pe", "$lt": "pf"},
+		"/?stringmember__startswith=%C3%BCb":       map[string]interface{}{"$gte": "üb", "$lt": "üc"},
+		"/?stringmember__startswith=a%7F":          map[string]interface{}{"$gte": "a\x7f", "$lt": "a\u0080"},
+		"/?stringmember__startswith=":              bson.RegEx{Pattern: "^", Options: ""},
+		"/?stringmember__startswith=a%F4%8F%BF%BF": bson.RegEx{Pattern: "^a\U0010FFFF", Options: ""},
+		"/?stringmember__startswith=a%ED%9F%BF":    bson.RegEx{Pattern: "^a퟿", Options: ""},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": expected}) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	for _, query := range []string{"/?intMember__startswith=1", "/?stringmember__startswith=a&stringmember__startswith=b"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("%s did not produce an error", query)
+		}
+	}
+
+	// prefix searches rewritten to ranges cannot be combined with ranges
+	mq.AddAlias("name", "stringmember")
+	for _, query := range []string{
+		"/?stringmember__startswith=pe&stringmember__gte=a",
+		"/?stringmember__lt=z&stringmember__startswith=pe",
+		"/?name__startswith=pe&stringmember__gte=a",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.createQueryFilter(req)
+		if err == nil || !strings.Contains(err.Error(), "cannot be combined") || merry.Value(err, codeKey) != CodeConflict {
+			t.Errorf("%s: wrong error: %v", query, err)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/?stringmember__startswith=pe&stringmember__exists=true&intMember__gte=1", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err != nil {
+		t.Errorf("error occured: %s", err)
+	}
+	// without the rewrite the prefix is a regular expression
+	mq = NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ = http.NewRequest("GET", "/?stringmember__startswith=pe&stringmember__gte=a", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": map[string]interface{}{"$regex": "^pe", "$options": "", "$gte": "a"}}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+}
+
+func TestPrefixSuccessorEquivalence(t *testing.T) {
+	values := []string{"", "p", "pe", "pet", "peter", "pf", "pd", "pez", "pe\x7f", "ö", "öl", "öm", "ü", "übel", "üc", "日本", "日本語", "日末", "aÿ", "aĀ", "a￿"}
+	for _, prefix := range []string{"p", "pe", "ö", "üb", "日本", "aÿ", "a￾"} {
+		upper, ok := prefixSuccessor(prefix)
+		if !ok {
+			t.Fatalf("no successor for %q", prefix)
+		}
+		for _, v := range values {
+			// MongoDB compares strings by their bytes, like Go
+			inRange := v >= prefix && v < upper
+			if inRange != strings.HasPrefix(v, prefix) {
+				t.Errorf("range [%q, %q) does not match prefix %q for %q", prefix, upper, prefix, v)
+			}
+		}
+	}
+	for _, prefix := range []string{"", "a\U0010FFFF", "a퟿", "a\xff"} {
+		if _, ok := prefixSuccessor(prefix); ok {
+			t.Errorf("successor computed for %q", prefix)
+		}
+	}
+}
+
+func TestRegexOptions(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for _, options := range []string{"g", "iu", "ii"} {
+		if err := mq.SetRegexOptions(options); err == nil {
+			t.Errorf("invalid options '%s' did not produce an error", options)
+		}
+	}
+	mq.AllowRawRegexOn("stringmember")
+	mq.SetPrefixRangeRewrite("stringmember")
+	for options, expected := range map[string]map[string]interface{}{
+		"": {
+			"/?stringmember=pe":             bson.RegEx{Pattern: "pe", Options: ""},
+			"/?stringmember__startswith=pe": map[string]interface{}{"$gte": "pe", "$lt": "pf"},
+		},
+		"i": {
+			"/?stringmember=pe":             bson.RegEx{Pattern: "pe", Options: "i"},
+			"/?stringmember__regex=^pe":     bson.RegEx{Pattern: "^pe", Options: "i"},
+			"/?stringmember__startswith=pe": bson.RegEx{Pattern: "^pe", Options: "i"},
+		},
+		"im": {
+			"/?stringmember=pe": bson.RegEx{Pattern: "pe", Options: "im"},
+		},
+	} {
+		if err := mq.SetRegexOptions(options); err != nil {
+			t.Fatalf("error occured for '%s': %s", options, err)
+		}
+		for query, value := range expected {
+			req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+			q, err := mq.createQueryFilter(req)
+			if err != nil {
+				t.Fatalf("error occured for %s: %s", query, err)
+			}
+			if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": value}) {
+				t.Errorf("wrong query filter generated for %s with options '%s': %v", query, options, q)
+			}
+		}
+	}
+}
+
+func TestRegexStyle(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AllowRawRegexOn("stringmember")
+	queries := []string{"/?stringmember=pe", "/?stringmember__regex=^pe", "/?stringmember__startswith=pe"}
+	patterns := []string{"pe", "^pe", "^pe"}
+	for i, query := range queries {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": bson.RegEx{Pattern: patterns[i], Options: ""}}) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	mq.SetRegexStyle(RegexStyleDocument)
+	for i, query := range queries {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": bson.M{"$regex": patterns[i], "$options": ""}}) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+}
+
+func TestExistsOperator(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, expected := range map[string]map[string]interface{}{
+		"/?embeddedmember.embeddedint__exists=true": {"embeddedmember.embeddedint": map[string]interface{}{"$exists": true}},
+		"/?embeddedmember__exists=false":            {"embeddedmember": map[string]interface{}{"$exists": false}},
+		"/?stringmember__exists=1&mybool=true":      {"stringmember": map[string]interface{}{"$exists": true}, "mybool": true},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	for _, query := range []string{
+		"/?embeddedmember.notAMember__exists=true",
+		"/?embeddedmember.embeddedint__exists=maybe",
+		"/?embeddedmember.embeddedint__exists=true&embeddedmember.embeddedint__exists=false",
+		"/?embeddedmember.embeddedint__exists=true&embeddedmember.embeddedint=1",
+		"/?limit__exists=true",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("%s did not produce an error", query)
+		}
+	}
+}
+
+func TestComparisonOperators(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AllowRawRegexOn("stringmember")
+	mq.SetPrefixRangeRewrite("stringmember")
+	mq.SetMostRestrictiveOperators(true)
+	for query, expected := range map[string]map[string]interface{}{
+		"/?intMember__gt=10":                  {"intMember": map[string]interface{}{"$gt": 10}},
+		"/?uintmember__lte=3":                 {"uintmember": map[string]interface{}{"$lte": uint(3)}},
+		"/?floatmember__gte=1.5":              {"floatmember": map[string]interface{}{"$gte": 1.5}},
+		"/?stringmember__lt=m":                {"stringmember": map[string]interface{}{"$lt": "m"}},
+		"/?intMember__gt=10&intMember__lt=20": {"intMember": map[string]interface{}{"$gt": 10, "$lt": 20}},
+		"/?intMember__gt=10&intMember__gte=5": {"intMember": map[string]interface{}{"$gt": 10, "$gte": 5}},
+		"/?intMember__gt=10&intMember__exists=true&mybool=true": {
+			"intMember": map[string]interface{}{"$gt": 10, "$exists": true},
+			"mybool":    true,
+		},
+		"/?stringmember__regex=^p&stringmember__lt=q":        {"stringmember": map[string]interface{}{"$regex": "^p", "$options": "", "$lt": "q"}},
+		"/?stringmember__startswith=pe&stringmember__gte=pa": {"stringmember": map[string]interface{}{"$gte": "pe", "$lt": "pf"}},
+		"/?intMember=1&intMember=2":                          {"intMember": map[string]interface{}{"$in": []interface{}{1, 2}}},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	for _, query := range []string{
+		"/?intMember__gt=abc",
+		"/?intMember__gt=",
+		"/?mybool__gt=true",
+		"/?limit__gt=1",
+		"/?intMember__gt=10&intMember=5",
+		"/?stringmember__regex=^p&stringmember__regex=^q",
+		"/?intMember__exists=true&intMember__exists=false",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("%s did not produce an error", query)
+		}
+	}
+}
+
+func TestPrefixOperators(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, expected := range map[string]map[string]interface{}{
+		"/?intMember=gt:30":                    {"intMember": map[string]interface{}{"$gt": 30}},
+		"/?intMember=lte:65":                   {"intMember": map[string]interface{}{"$lte": 65}},
+		"/?intMember=gt:30&intMember=lt:65":    {"intMember": map[string]interface{}{"$gt": 30, "$lt": 65}},
+		"/?intMember=gte:30&intMember__lt=65":  {"intMember": map[string]interface{}{"$gte": 30, "$lt": 65}},
+		"/?uintmember=gte:3":                   {"uintmember": map[string]interface{}{"$gte": uint(3)}},
+		"/?floatmember=lt:1.5":                 {"floatmember": map[string]interface{}{"$lt": 1.5}},
+		"/?intMember=ne:30":                    {"intMember": map[string]interface{}{"$ne": 30}},
+		"/?intMember=ne:30&intMember=ne:40":    {"intMember": map[string]interface{}{"$nin": []interface{}{30, 40}}},
+		"/?intMember=gt:-5&intMember=ne:0":     {"intMember": map[string]interface{}{"$gt": -5, "$ne": 0}},
+		"/?intMember=30":                       {"intMember": 30},
+		"/?intMember=-30&intMember=40":         {"intMember": map[string]interface{}{"$in": []interface{}{-30, 40}}},
+		"/?stringmember=gt:30&matchmode=exact": {"stringmember": "gt:30"},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	for query, message := range map[string]string{
+		"/?intMember=foo:30":                "unknown operator prefix 'foo:' for parameter 'intMember'",
+		"/?intMember=gt:abc":                "invalid value for intMember__gt",
+		"/?intMember=ne:abc":                "invalid value for intMember",
+		"/?intMember=gt:10&intMember=gt:20": "intMember",
+		"/?intMember=gt:10&intMember=5":     "intMember",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.createQueryFilter(req)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: wrong error: %v", query, err)
+		}
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("%s: wrong http code: %d", query, merry.HTTPCode(err))
+		}
+	}
+}
+
+func TestComparisonOperatorErrors(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, message := range map[string]string{
+		"/?intMember__foo=18":   "parameter 'intMember__foo' is not supported",
+		"/?intMember__ge=18":    "parameter 'intMember__ge' is not supported",
+		"/?mybool__gt=true":     "operator 'gt' is not supported for parameter 'mybool'",
+		"/?mybool__lte=false":   "operator 'lte' is not supported for parameter 'mybool'",
+		"/?intMember__gte=abc":  "invalid value for intMember__gte",
+		"/?notAMember__gt=1":    "parameter 'notAMember__gt' is not supported",
+		"/?stringmember__lt=10": "",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.createQueryFilter(req)
+		if len(message) == 0 {
+			if err != nil {
+				t.Errorf("%s: error occured: %s", query, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: wrong error: %v", query, err)
+		}
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("%s: wrong http code: %d", query, merry.HTTPCode(err))
+		}
+	}
+	req, _ := http.NewRequest("GET", "/?intMember__foo=18", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); merry.Value(err, codeKey) != CodeUnsupportedParameter {
+		t.Errorf("wrong code of an unknown suffix: %v", merry.Value(err, codeKey))
+	}
+}
+
+func TestRepeatedComparisonOperators(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetPrefixRangeRewrite("stringmember")
+	queries := map[string]map[string]interface{}{
+		"/?intMember__gt=10&intMember__gt=20":                  {"intMember": map[string]interface{}{"$gt": 20}},
+		"/?intMember__gte=10&intMember__gte=20":                {"intMember": map[string]interface{}{"$gte": 20}},
+		"/?intMember__lt=10&intMember__lt=20":                  {"intMember": map[string]interface{}{"$lt": 10}},
+		"/?floatmember__lte=1.5&floatmember__lte=0.5":          {"floatmember": map[string]interface{}{"$lte": 0.5}},
+		"/?uintmember__gt=3&uintmember__gt=1&uintmember__lt=9": {"uintmember": map[string]interface{}{"$gt": uint(3), "$lt": uint(9)}},
+		"/?stringmember__startswith=pe&stringmember__gte=px":   {"stringmember": map[string]interface{}{"$gte": "px", "$lt": "pf"}},
+		"/?stringmember__lt=b&stringmember__lt=a":              {"stringmember": map[string]interface{}{"$lt": "a"}},
+	}
+	for query := range queries {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("repeated operator %s did not produce an error", query)
+		}
+	}
+
+	mq.SetMostRestrictiveOperators(true)
+	for query, expected := range queries {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+}
+
+func TestMergeFilterValues(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetMostRestrictiveOperators(true)
+	tests := []struct {
+		existing, added, expected interface{}
+	}{
+		{nil, 5, 5},
+		{nil, map[string]interface{}{"$gt": 1}, map[string]interface{}{"$gt": 1}},
+		{map[string]interface{}{"$gt": 1}, bson.M{"$lt": 5}, map[string]interface{}{"$gt": 1, "$lt": 5}},
+		{bson.RegEx{Pattern: "^a", Options: "i"}, map[string]interface{}{"$exists": true}, map[string]interface{}{"$regex": "^a", "$options": "i", "$exists": true}},
+		{map[string]interface{}{"$gt": 1, "$lt": 5}, map[string]interface{}{"$gt": 2, "$lt": 9}, map[string]interface{}{"$gt": 2, "$lt": 5}},
+		{map[string]interface{}{"$gte": "b"}, map[string]interface{}{"$gte": "a"}, map[string]interface{}{"$gte": "b"}},
+		{map[string]interface{}{"$gte": 1.5}, map[string]interface{}{"$gte": 1.5}, map[string]interface{}{"$gte": 1.5}},
+	}
+	for _, test := range tests {
+		merged, err := mq.mergeFilterValues("name", test.existing, test.added)
+		if err != nil {
+			t.Fatalf("error occured for %v and %v: %s", test.existing, test.added, err)
+		}
+		if !reflect.DeepEqual(merged, test.expected) {
+			t.Errorf("wrong merge of %v and %v: %v", test.existing, test.added, merged)
+		}
+	}
+
+	for _, test := range [][2]interface{}{
+		{5, map[string]interface{}{"$gt": 1}},
+		{map[string]interface{}{"$gt": 1}, "a"},
+		{map[string]interface{}{"$gt": 1}, map[string]interface{}{"$gt": "a"}},
+		{map[string]interface{}{"$exists": true}, map[string]interface{}{"$exists": false}},
+		{bson.RegEx{Pattern: "a"}, bson.RegEx{Pattern: "b"}},
+		{map[string]interface{}{"$gt": 1}, map[string]interface{}{"name": 1}},
+		{map[string]interface{}{"$gt": 1}, map[string]interface{}{}},
+	} {
+		if _, err := mq.mergeFilterValues("name", test[0], test[1]); err == nil {
+			t.Errorf("merge of %v and %v did not produce an error", test[0], test[1])
+		}
+	}
+}
+
+func TestElemMatchOperator(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, expected := range map[string]map[string]interface{}{
+		"/?intslicemember__elemMatch=gte:90,lte:100": {"intslicemember": map[string]interface{}{
+			"$elemMatch": map[string]interface{}{"$gte": 90, "$lte": 100},
+		}},
+		"/?strSliceMember__elemMatch=gt:a&strSliceMember__elemMatch=lt:c": {"strSliceMember": map[string]interface{}{
+			"$elemMatch": map[string]interface{}{"$gt": "a", "$lt": "c"},
+		}},
+		"/?intslicemember__elemMatch=gt:1&intslicemember__exists=true": {"intslicemember": map[string]interface{}{
+			"$elemMatch": map[string]interface{}{"$gt": 1},
+			"$exists":    true,
+		}},
+		// each bound is matched independently, by any element
+		"/?intslicemember__gte=90&intslicemember__lte=100": {"intslicemember": map[string]interface{}{
+			"$gte": 90,
+			"$lte": 100,
+		}},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	for _, query := range []string{
+		"/?intMember__elemMatch=gte:1",
+		"/?intslicemember__elemMatch=gte",
+		"/?intslicemember__elemMatch=foo:1",
+		"/?intslicemember__elemMatch=gte:a",
+		"/?intslicemember__elemMatch=gte:1,gte:2",
+		"/?intslicemember__elemMatch=",
+		"/?notAMember__elemMatch=gte:1",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("%s did not produce an error", query)
+		}
+	}
+}
+
+func TestObjectIdTimeOperators(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?intMember__after=2023-06-01", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("after on a parameter other than _id did not produce an error")
+	}
+
+	mq.AddOrOverwriteValidParameter("_id", reflect.String)
+	mq.AddAlias("id", "_id")
+	june := bson.ObjectIdHex("6477df800000000000000000")
+	july := bson.NewObjectIdWithTime(time.Date(2023, 7, 1, 12, 30, 0, 0, time.UTC))
+	id := bson.ObjectIdHex("6478a1b2c3d4e5f601234567")
+	for query, expected := range map[string]map[string]interface{}{
+		"/?_id__after=2023-06-01": {
+			"_id": map[string]interface{}{"$gt": june},
+		},
+		"/?id__before=2023-07-01T14:30:00.9%2B02:00": {
+			"_id": map[string]interface{}{"$lt": july},
+		},
+		"/?_id__after=2023-06-01T00:00:00Z&_id__before=2023-07-01T12:30:00Z": {
+			"_id": map[string]interface{}{"$gt": june, "$lt": july},
+		},
+		"/?_id=6478a1b2c3d4e5f601234567&_id__after=2023-06-01": {
+			"_id":  id,
+			"$and": []interface{}{map[string]interface{}{"_id": map[string]interface{}{"$gt": june}}},
+		},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		filter, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Errorf("%s: error occured: %s", query, err)
+			continue
+		}
+		if !reflect.DeepEqual(filter, expected) {
+			t.Errorf("%s: wrong filter: %v", query, filter)
+		}
+	}
+
+	for _, query := range []string{
+		"/?_id__after=6478a1b2c3d4e5f601234567",
+		"/?_id__after=yesterday",
+		"/?_id__before=2023-06-01&_id__before=2023-07-01",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("%s: invalid value did not produce an error", query)
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/ansel1/merry"
 )
 
 var validMetaParameters = map[string]reflect.Kind{
@@ -14,8 +16,26 @@ var validMetaParameters = map[string]reflect.Kind{
 	"limit": reflect.Uint,
 	"field": reflect.String,
 	"sort":  reflect.String,
+
+	"preserveorder": reflect.Bool,
+	"within":        reflect.String,
+	"after":         reflect.String,
+	"before":        reflect.String,
+	"matchmode":     reflect.String,
+	"snapshot":      reflect.String,
+	"validate":      reflect.String,
+	"modifiedSince": reflect.String,
+	"hint":          reflect.String,
 }
 
+// FieldNameTags are the struct tag keys that are used to resolve the field names, in the given
+// order. Per default only bson tags are used like mgo does. For structs that are stored with
+// the names of their json tags, like protoc-gen-go structs, json tags can be added:
+//     mqb.FieldNameTags = []string{"bson", "json"}
+// Only the first segment of a tag is used, so json:"field_name,omitempty" resolves to field_name.
+// It has to be set before NewMongoQuery is called.
+var FieldNameTags = []string{"bson"}
+
 var mongoTags = []string{
 	"omitempty",
 	"minsize",
@@ -30,13 +50,14 @@ var mongoTags = []string{
 func createValidParametersMap(endPointStruct interface{}, disabledParameters ...string) map[string]reflect.Kind {
 	validParametersMap := make(map[string]reflect.Kind)
 	typ := reflect.TypeOf(endPointStruct)
-	val := reflect.ValueOf(endPointStruct)
 	if typ.Kind() == reflect.Ptr {
 		typ = typ.Elem()
-		val = val.Elem()
 	}
 	for i := 0; i < typ.NumField(); i++ {
 		field := typ.Field(i)
+		if !isStoredField(field) {
+			continue
+		}
 
 		fieldName := getFieldNameFromTag(field.Tag)
 		if len(fieldName) == 0 {
@@ -48,13 +69,20 @@ func createValidParametersMap(endPointStruct interface{}, disabledParameters ...
 				validParametersMap[fieldName] = field.Type.Kind()
 				continue
 			}
-			for k, v := range createValidParametersMap(val.Field(i).Interface(), disabledParameters...) {
+			// the zero value is used, because the value of an unexported embedded struct
+			// cannot be accessed
+			for k, v := range createValidParametersMap(reflect.Zero(field.Type).Interface(), disabledParameters...) {
 				validParametersMap[k] = v
 			}
+			// mgo stores structs as sub documents unless they are inlined
+			if !isInline(field.Tag) && !contains(disabledParameters, fieldName) {
+				validParametersMap[fieldName] = field.Type.Kind()
+				addNestedParameters(validParametersMap, field.Type, fieldName, disabledParameters)
+			}
 			continue
 		}
 		if field.Type.Kind() == reflect.Slice && !contains(disabledParameters, fieldName) {
-			validParametersMap[fieldName] = field.Type.Elem().Kind()
+			validParametersMap[fieldName] = elemKind(field.Type)
 			continue
 		}
 		if !contains(disabledParameters, fieldName) {
@@ -71,14 +99,246 @@ func createValidParametersMap(endPointStruct interface{}, disabledParameters ...
 	return validParametersMap
 }
 
+// isTimeParameter returns true if the parameter name represents a time.Time field of the endpoint struct.
+func (mq *MongoQuery) isTimeParameter(name string) bool {
+	typ := reflect.TypeOf(mq.endPointStruct)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	v, ok := fieldByParameterName(reflect.New(typ).Elem(), name)
+	return ok && v.Type() == reflect.TypeOf(time.Time{})
+}
+
+// isArrayParameter returns true if the parameter name represents a slice field of the endpoint struct.
+func (mq *MongoQuery) isArrayParameter(name string) bool {
+	typ := reflect.TypeOf(mq.endPointStruct)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	v, ok := fieldByParameterName(reflect.New(typ).Elem(), name)
+	return ok && v.Kind() == reflect.Slice
+}
+
+// addNestedParameters adds the fields of the struct type typ as dotted parameters of the form
+// prefix.fieldname to validParametersMap.
+func addNestedParameters(validParametersMap map[string]reflect.Kind, typ reflect.Type, prefix string, disabledParameters []string) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !isStoredField(field) {
+			continue
+		}
+
+		fieldName := getFieldNameFromTag(field.Tag)
+		if len(fieldName) == 0 {
+			fieldName = strings.ToLower(field.Name)
+		}
+		path := prefix + "." + fieldName
+		if contains(disabledParameters, path) {
+			continue
+		}
+		switch {
+		case field.Type == reflect.TypeOf(time.Time{}):
+			validParametersMap[path] = field.Type.Kind()
+		case field.Type.Kind() == reflect.Struct:
+			validParametersMap[path] = field.Type.Kind()
+			addNestedParameters(validParametersMap, field.Type, path, disabledParameters)
+		case field.Type.Kind() == reflect.Slice:
+			validParametersMap[path] = elemKind(field.Type)
+		default:
+			validParametersMap[path] = field.Type.Kind()
+		}
+	}
+}
+
+// elemKind returns the kind of the innermost element of the slice type typ. Note that
+// MongoDB matches a value only against the elements of the outer array, so a filter like
+// /?matrix=1 on a [][]int field matches no document.
+func elemKind(typ reflect.Type) reflect.Kind {
+	for typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	return typ.Kind()
+}
+
+// isStoredField returns true if the field is a parameter candidate. Unexported fields are not
+// stored by mgo, unless they are embedded. Embedded interfaces are skipped, because their
+// fields are unknown.
+func isStoredField(field reflect.StructField) bool {
+	if len(field.PkgPath) > 0 && !field.Anonymous {
+		return false
+	}
+	return !field.Anonymous || field.Type.Kind() != reflect.Interface
+}
+
+// structFieldPaths returns the paths of the stored fields of the struct type typ, prefixed with
+// prefix. Fields of sub documents are returned by their dotted path, inlined fields without
+// the path of the inlined struct.
+func structFieldPaths(typ reflect.Type, prefix string) []string {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	paths := []string{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !isStoredField(field) {
+			continue
+		}
+		fieldName := getFieldNameFromTag(field.Tag)
+		if len(fieldName) == 0 {
+			fieldName = strings.ToLower(field.Name)
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		switch {
+		case fieldType.Kind() == reflect.Struct && isInline(field.Tag):
+			paths = append(paths, structFieldPaths(fieldType, prefix)...)
+		case fieldType.Kind() == reflect.Struct && fieldType != reflect.TypeOf(time.Time{}):
+			paths = append(paths, structFieldPaths(fieldType, prefix+fieldName+".")...)
+		default:
+			paths = append(paths, prefix+fieldName)
+		}
+	}
+	return paths
+}
+
+// createFieldTree returns the paths of all stored fields of the struct type typ with their
+// kinds, including sub documents, the fields of sub documents and of arrays of sub documents.
+// Unlike the supported parameters, it does not change with disabled parameters, so it is
+// used to validate projections.
+func createFieldTree(typ reflect.Type) map[string]reflect.Kind {
+	tree := make(map[string]reflect.Kind)
+	addFieldTree(tree, typ, "", map[reflect.Type]bool{})
+	return tree
+}
+
+// addFieldTree adds the fields of the struct type typ prefixed with prefix to tree. The types
+// in visited are skipped to stop at recursive types.
+func addFieldTree(tree map[string]reflect.Kind, typ reflect.Type, prefix string, visited map[reflect.Type]bool) {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if visited[typ] {
+		return
+	}
+	visited[typ] = true
+	defer delete(visited, typ)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !isStoredField(field) {
+			continue
+		}
+		fieldName := getFieldNameFromTag(field.Tag)
+		if len(fieldName) == 0 {
+			fieldName = strings.ToLower(field.Name)
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr || fieldType.Kind() == reflect.Slice {
+			fieldType = fieldType.Elem()
+		}
+		switch {
+		case fieldType.Kind() != reflect.Struct || fieldType == reflect.TypeOf(time.Time{}):
+			tree[prefix+fieldName] = fieldType.Kind()
+		case isInline(field.Tag):
+			addFieldTree(tree, fieldType, prefix, visited)
+		default:
+			tree[prefix+fieldName] = reflect.Struct
+			addFieldTree(tree, fieldType, prefix+fieldName+".", visited)
+		}
+	}
+}
+
+// isInline returns true if the field with tag is inlined by mgo.
+func isInline(tag reflect.StructTag) bool {
+	bsonTag := tag.Get("bson")
+	if len(bsonTag) == 0 && !strings.Contains(string(tag), ":") {
+		bsonTag = string(tag)
+	}
+	return contains(strings.Split(bsonTag, ","), "inline")
+}
+
+// fieldByParameterName returns the value of the field in the struct or map val that is
+// represented by the parameter name, which can be a dotted path. The bool value is false if
+// no such field exists.
+func fieldByParameterName(val reflect.Value, name string) (reflect.Value, bool) {
+	val = reflect.Indirect(val)
+	if val.Kind() == reflect.Interface {
+		val = reflect.Indirect(val.Elem())
+	}
+	if val.Kind() != reflect.Struct && val.Kind() != reflect.Map {
+		return reflect.Value{}, false
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		// a field name containing dots, see AddParameter
+		if v, ok := fieldByName(val, name); ok {
+			return v, true
+		}
+		parent, ok := fieldByParameterName(val, name[:i])
+		if !ok {
+			return reflect.Value{}, false
+		}
+		return fieldByParameterName(parent, name[i+1:])
+	}
+	return fieldByName(val, name)
+}
+
+// fieldByName returns the field of the struct or map val with the given name, which is not
+// treated as path. Fields of inline structs are found too.
+func fieldByName(val reflect.Value, name string) (reflect.Value, bool) {
+	if val.Kind() == reflect.Map {
+		// documents returned by RunRaw
+		if val.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}, false
+		}
+		v := val.MapIndex(reflect.ValueOf(name).Convert(val.Type().Key()))
+		if !v.IsValid() {
+			return reflect.Value{}, false
+		}
+		if v.Kind() == reflect.Interface {
+			v = v.Elem()
+		}
+		return v, v.IsValid()
+	}
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !isStoredField(field) {
+			continue
+		}
+
+		fieldName := getFieldNameFromTag(field.Tag)
+		if len(fieldName) == 0 {
+			fieldName = strings.ToLower(field.Name)
+		}
+		if fieldName == name {
+			return val.Field(i), true
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+			if v, ok := fieldByName(val.Field(i), name); ok {
+				return v, true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
 // getFieldNameFromTag returns the field name if it is overridden by a tag, otherwise it returns
 // an empty string.
 func getFieldNameFromTag(tag reflect.StructTag) string {
-	fieldName := tag.Get("bson")
-	if len(fieldName) > 1 {
-		diff := newSetFromSlice(strings.Split(fieldName, ",")).Difference(newSetFromSlice(mongoTags))
-		if len(diff.ToSlice()) > 0 {
-			return diff.ToSlice()[0].(string)
+	for _, key := range FieldNameTags {
+		fieldName := tag.Get(key)
+		if key != "bson" {
+			if name := strings.Split(fieldName, ",")[0]; len(name) > 0 && name != "-" {
+				return name
+			}
+			continue
+		}
+		if len(fieldName) > 1 {
+			diff := newSetFromSlice(strings.Split(fieldName, ",")).Difference(newSetFromSlice(mongoTags))
+			if len(diff.ToSlice()) > 0 {
+				return diff.ToSlice()[0].(string)
+			}
 		}
 	}
 	if strings.Contains(string(tag), ":") {
@@ -100,9 +360,101 @@ func getUint(req *http.Request, param string) (uint, bool, error) {
 	if _uintVal, ok := req.URL.Query()[param]; ok {
 		uintVal, err := strconv.ParseUint(_uintVal[0], 10, 0)
 		if err != nil {
-			return 0, true, fmt.Errorf("invalid value for %s", _uintVal[0])
+			if i, err := strconv.ParseInt(_uintVal[0], 10, 0); err == nil && i < 0 {
+				return 0, true, withCode(merry.Wrap(fmt.Errorf("%s must be a positive integer", param)).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+			}
+			return 0, true, withCode(merry.Wrap(fmt.Errorf("%s must be a number, got '%s'", param, _uintVal[0])).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
 		}
 		return uint(uintVal), true, nil
 	}
 	return 0, false, nil
 }
+
+// getLimit returns the value of the limit parameter, which is 0 for all documents. If the
+// limit parameter is not present the bool value is false.
+func (mq *MongoQuery) getLimit(req *http.Request) (uint, bool, error) {
+	if mq.allowUnlimited {
+		if v := req.URL.Query().Get("limit"); v == "all" || v == "-1" {
+			return 0, true, nil
+		}
+	}
+	limit, ok, err := getUint(req, "limit")
+	if err != nil && mq.allowUnlimited {
+		return 0, true, withCode(merry.Wrap(fmt.Errorf("%s; use limit=all for unlimited", err)).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	return limit, ok, err
+}
+
+// getPage returns the value of the page parameter. Pages start at 1, so an error is returned
+// for non positive values unless page 0 is treated as first page. If the page parameter is not
+// present the bool value is false.
+func (mq *MongoQuery) getPage(req *http.Request) (uint, bool, error) {
+	values, ok := req.URL.Query()["page"]
+	if !ok {
+		return 0, false, nil
+	}
+	page, err := strconv.ParseInt(values[0], 10, 0)
+	if err != nil {
+		return 0, true, withCode(merry.Wrap(fmt.Errorf("page must be a number, got '%s'", values[0])).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	if page == 0 && mq.zeroPageIsFirst {
+		return 1, true, nil
+	}
+	if page <= 0 {
+		return 0, true, withCode(merry.Wrap(fmt.Errorf("page must be a positive integer, got %d, pages start at 1", page)).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	return uint(page), true, nil
+}
+
+// parseInt converts v to an int. If the automatic numeric base is enabled, the base
+// is derived from the prefix of v.
+func (mq *MongoQuery) parseInt(v string) (int, error) {
+	if err := mq.checkStrictNumber(v); err != nil {
+		return 0, err
+	}
+	if !mq.autoNumericBase {
+		return strconv.Atoi(v)
+	}
+	i, err := strconv.ParseInt(v, 0, 0)
+	return int(i), err
+}
+
+// parseUint converts v to an uint. If the automatic numeric base is enabled, the base
+// is derived from the prefix of v.
+func (mq *MongoQuery) parseUint(v string) (uint, error) {
+	if err := mq.checkStrictNumber(v); err != nil {
+		return 0, err
+	}
+	base := 10
+	if mq.autoNumericBase {
+		base = 0
+	}
+	i, err := strconv.ParseUint(v, base, 0)
+	return uint(i), err
+}
+
+// parseFloat converts v to a float64.
+func (mq *MongoQuery) parseFloat(v string) (float64, error) {
+	if err := mq.checkStrictNumber(v); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// checkStrictNumber returns an error if strict numeric parsing is enabled and v has
+// surrounding whitespace, a leading + or leading zeros.
+func (mq *MongoQuery) checkStrictNumber(v string) error {
+	if !mq.strictNumericParsing {
+		return nil
+	}
+	digits := strings.TrimPrefix(v, "-")
+	switch {
+	case strings.TrimSpace(v) != v:
+		return fmt.Errorf("invalid number '%s': surrounding whitespace", v)
+	case strings.HasPrefix(v, "+"):
+		return fmt.Errorf("invalid number '%s': leading +", v)
+	case len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9':
+		return fmt.Errorf("invalid number '%s': leading zero", v)
+	}
+	return nil
+}
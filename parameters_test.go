@@ -5,6 +5,9 @@ import (
 	"net/http"
 	"reflect"
 	"testing"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/mgo"
 )
 
 func TestCreateValidParametersMap(t *testing.T) {
@@ -81,3 +84,288 @@ func TestGetUInt(t *testing.T) {
 		t.Error("ok value should be false")
 	}
 }
+
+func TestGetLimit(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, message := range map[string]string{
+		"/?limit=-1":  "limit must be a positive integer",
+		"/?limit=ten": "limit must be a number, got 'ten'",
+		"/?limit=all": "limit must be a number, got 'all'",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, _, err := mq.getLimit(req)
+		if err == nil || err.Error() != message {
+			t.Errorf("%s: wrong error: %v", query, err)
+		}
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("%s: wrong http code: %d", query, merry.HTTPCode(err))
+		}
+	}
+
+	mq.SetAllowUnlimited(true)
+	for _, query := range []string{"/?limit=all", "/?limit=-1"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		limit, ok, err := mq.getLimit(req)
+		if err != nil || !ok || limit != 0 {
+			t.Errorf("%s: wrong unlimited limit: %d, %t, %v", query, limit, ok, err)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/?limit=-2", bytes.NewBufferString(""))
+	if _, _, err := mq.getLimit(req); err == nil || err.Error() != "limit must be a positive integer; use limit=all for unlimited" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestGetPage(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for _, query := range []string{"/?page=0", "/?page=-1", "/?page=abc"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, _, err := mq.getPage(req)
+		if err == nil {
+			t.Errorf("%s did not produce an error", query)
+			continue
+		}
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("wrong http code for %s: %d", query, merry.HTTPCode(err))
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/?page=-1", bytes.NewBufferString(""))
+	if _, _, err := mq.getPage(req); err.Error() != "page must be a positive integer, got -1, pages start at 1" {
+		t.Errorf("wrong error message: %s", err)
+	}
+
+	mq.SetZeroPageAsFirst(true)
+	req, _ = http.NewRequest("GET", "/?page=0", bytes.NewBufferString(""))
+	page, ok, err := mq.getPage(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !ok || page != 1 {
+		t.Errorf("page 0 should be treated as page 1, got %d", page)
+	}
+	req, _ = http.NewRequest("GET", "/?page=-1", bytes.NewBufferString(""))
+	if _, _, err := mq.getPage(req); err == nil {
+		t.Error("negative page did not produce an error")
+	}
+}
+
+func TestAutoNumericBase(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?intMember=0x1f&uintmember=0o17", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("hex value did not produce an error with base 10")
+	}
+
+	mq.SetAutoNumericBase(true)
+	for query, expected := range map[string]map[string]interface{}{
+		"/?intMember=0x1f&uintmember=0o17":  {"intMember": 31, "uintmember": uint(15)},
+		"/?intMember=-0x10&uintmember=0X1F": {"intMember": -16, "uintmember": uint(31)},
+		"/?intMember=42&uintmember=0b101":   {"intMember": 42, "uintmember": uint(5)},
+	} {
+		req, _ = http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+}
+
+func TestStrictNumericParsing(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for _, query := range []string{"/?intMember=007", "/?intMember=%2B10", "/?uintmember=010", "/?floatmember=01.5"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err != nil {
+			t.Errorf("lenient parsing of %s produced an error: %s", query, err)
+		}
+	}
+
+	mq.SetStrictNumericParsing(true)
+	for _, query := range []string{"/?intMember=007", "/?intMember=%2B10", "/?intMember=-01", "/?uintmember=010", "/?floatmember=01.5", "/?floatmember=%2B1.5", "/?intMember=%2010"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.createQueryFilter(req)
+		if err == nil {
+			t.Errorf("strict parsing of %s did not produce an error", query)
+			continue
+		}
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("wrong status code %d for %s", merry.HTTPCode(err), query)
+		}
+	}
+	for query, expected := range map[string]map[string]interface{}{
+		"/?intMember=10":    {"intMember": 10},
+		"/?intMember=0":     {"intMember": 0},
+		"/?intMember=-10":   {"intMember": -10},
+		"/?floatmember=0.5": {"floatmember": 0.5},
+		"/?uintmember=0":    {"uintmember": uint(0)},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Errorf("strict parsing of %s produced an error: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+}
+
+type inlineStruct struct {
+	Inlined Embedded `bson:",inline"`
+	Nested  Embedded
+}
+
+func TestCreateValidParametersMapWithSubDocuments(t *testing.T) {
+	m := createValidParametersMap(inlineStruct{})
+	for k, v := range map[string]reflect.Kind{
+		"embeddedbool":        reflect.Bool,
+		"nested":              reflect.Struct,
+		"nested.embeddedbool": reflect.Bool,
+		"nested.embeddedint":  reflect.Int64,
+	} {
+		if m[k] != v {
+			t.Errorf("parameter %s should be %s", k, v)
+		}
+	}
+	if _, ok := m["inlined"]; ok {
+		t.Error("inlined struct should not be a parameter")
+	}
+
+	m = createValidParametersMap(inlineStruct{}, "nested.embeddedint")
+	if _, ok := m["nested.embeddedint"]; ok {
+		t.Error("disabled sub document parameter should not be a parameter")
+	}
+}
+
+type matrixStruct struct {
+	Matrix [][]int
+	Cube   [][][]string
+}
+
+func TestCreateValidParametersMapWithNestedSlices(t *testing.T) {
+	m := createValidParametersMap(matrixStruct{})
+	if m["matrix"] != reflect.Int || m["cube"] != reflect.String {
+		t.Errorf("wrong kinds for nested slices: %v", m)
+	}
+
+	mq := NewMongoQuery(matrixStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?matrix=1&matrix=2", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{"matrix": map[string]interface{}{"$in": []interface{}{1, 2}}}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+}
+
+type protoStruct struct {
+	UserName   string `protobuf:"bytes,1,opt,name=user_name,json=userName,proto3" json:"user_name,omitempty"`
+	CreatedAt  int64  `protobuf:"varint,2,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	StoredName string `bson:"stored" json:"stored_name,omitempty"`
+	Internal   string `json:"-"`
+}
+
+func TestFieldNameTags(t *testing.T) {
+	params := createValidParametersMap(protoStruct{})
+	for _, name := range []string{"username", "createdat", "stored", "internal"} {
+		if _, ok := params[name]; !ok {
+			t.Errorf("parameter %s is missing per default", name)
+		}
+	}
+
+	defer func(tags []string) {
+		FieldNameTags = tags
+	}(FieldNameTags)
+	FieldNameTags = []string{"bson", "json"}
+	params = createValidParametersMap(protoStruct{})
+	for name, kind := range map[string]reflect.Kind{
+		"user_name":  reflect.String,
+		"created_at": reflect.Int64,
+		"stored":     reflect.String,
+		"internal":   reflect.String,
+	} {
+		if params[name] != kind {
+			t.Errorf("parameter %s has kind %s, but should have %s", name, params[name], kind)
+		}
+	}
+	if _, ok := params["username"]; ok {
+		t.Error("lower case go name should not be a parameter")
+	}
+
+	mq := NewMongoQuery(protoStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?user_name=peter&created_at=1&matchmode=exact", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{"user_name": "peter", "created_at": 1}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+}
+
+type embeddedInterface interface {
+	Name() string
+}
+
+type unexportedEmbedded struct {
+	PromotedMember string
+	hidden         string
+}
+
+type mixedStruct struct {
+	ExportedMember string
+	unexported     string
+	unexportedSub  Embedded
+	embeddedInterface
+	unexportedEmbedded `bson:",inline"`
+	Sub                struct {
+		Visible string
+		hidden  int
+	}
+}
+
+func TestCreateValidParametersMapUnexported(t *testing.T) {
+	var params map[string]reflect.Kind
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("panic: %v", r)
+			}
+		}()
+		params = createValidParametersMap(mixedStruct{})
+	}()
+	for name, kind := range map[string]reflect.Kind{
+		"exportedmember": reflect.String,
+		"promotedmember": reflect.String,
+		"sub":            reflect.Struct,
+		"sub.visible":    reflect.String,
+		"visible":        reflect.String,
+	} {
+		if params[name] != kind {
+			t.Errorf("parameter %s has kind %s, but should have %s", name, params[name], kind)
+		}
+	}
+	for _, name := range []string{"unexported", "unexportedsub", "embeddedint", "embeddedinterface", "unexportedembedded", "hidden", "sub.hidden"} {
+		if _, ok := params[name]; ok {
+			t.Errorf("phantom parameter %s registered", name)
+		}
+	}
+	if len(params) != 5+len(validMetaParameters) {
+		t.Errorf("wrong number of parameters: %v", params)
+	}
+
+	mq := NewMongoQuery(&mixedStruct{}, &mgo.Database{})
+	if mq.isTimeParameter("exportedmember") || mq.isTimeParameter("promotedmember") {
+		t.Error("no time parameters expected")
+	}
+	if _, ok := fieldByParameterName(reflect.ValueOf(mixedStruct{}), "hidden"); ok {
+		t.Error("unexported field found by parameter name")
+	}
+	if _, ok := fieldByParameterName(reflect.ValueOf(mixedStruct{}), "promotedmember"); !ok {
+		t.Error("promoted field not found by parameter name")
+	}
+}
@@ -0,0 +1,356 @@
+package mqb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+// DefaultMaxPartitions defines how many collections a request of RunPartitioned can query per
+// default, see SetMaxPartitions.
+const DefaultMaxPartitions = 100
+
+// SetTimePartitioning configures the collections of documents that are partitioned by the
+// time field, like monthly collections events_2023_01, events_2023_02 and so on. The function
+// collection returns the name of the collection containing the documents of a time and the
+// range of field is given with layout:
+//     mq.SetTimePartitioning("createdat", "2006-01-02", func(t time.Time) string {
+//         return t.Format("events_2006_01")
+//     })
+//     r, _ := mq.RunPartitioned(req) // /?createdat__gte=2023-01-15&createdat__lt=2023-03-01
+// The partitions must not be shorter than a day. An empty layout defaults to time.RFC3339.
+func (mq *MongoQuery) SetTimePartitioning(field, layout string, collection func(time.Time) string) error {
+	field = mq.resolveAlias(field)
+	if !mq.isTimeParameter(field) {
+		return fmt.Errorf("parameter '%s' is not a time field", field)
+	}
+	if len(layout) == 0 {
+		layout = time.RFC3339
+	}
+	mq.partitionField = field
+	mq.partitionLayout = layout
+	mq.partitionCollection = collection
+	return nil
+}
+
+// SetMaxPartitions sets the maximum number of collections a request of RunPartitioned can
+// query. Requests with a wider range are rejected with 400, since every collection is queried
+// separately.
+func (mq *MongoQuery) SetMaxPartitions(n int) {
+	mq.maxPartitions = n
+}
+
+// RunPartitioned runs the query of req on all collections of the time partitioning, see
+// SetTimePartitioning. The request has to restrict the partition field with a lower (gt or gte)
+// and an upper (lt or lte) bound, which define the queried collections. The documents of all
+// collections are merged by the sort fields and paginated as if they were in one collection.
+// The collections are queried concurrently, see SetMaxConcurrentSubqueries. Since every
+// collection returns the documents up to the requested page, deep pages are expensive.
+// Requests with cursors are rejected, preserved orders and aggregation pipelines are not
+// supported.
+func (mq *MongoQuery) RunPartitioned(req *http.Request) (*Response, error) {
+	if mq.partitionCollection == nil {
+		return nil, merry.Wrap(errors.New("time partitioning is not configured")).WithHTTPCode(http.StatusInternalServerError)
+	}
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Page.Current == 0 {
+		return nil, merry.Wrap(errors.New("page must be greater than 0, pages start at 1")).WithHTTPCode(http.StatusBadRequest)
+	}
+	if spec.cursor {
+		return nil, merry.Wrap(errors.New("cursors are not supported for partitioned collections")).WithHTTPCode(http.StatusBadRequest)
+	}
+	collections, err := mq.partitionCollections(spec.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := mq.acquireQuerySlot(req.Context()); err != nil {
+		return nil, err
+	}
+	defer mq.releaseQuerySlot()
+
+	// the queries of the partitions are not paged, they are merged first
+	unpaged := *spec
+	unpaged.Page = Page{Current: 1}
+	unpaged.Fields, _ = mergeProjection(spec.Fields, spec.Sort)
+	queries := []*mgo.Query{}
+	for _, name := range collections {
+		queries = append(queries, mq.specQueryOn(mq.dataBase.C(name), &unpaged))
+	}
+	sliceType := reflect.SliceOf(reflect.TypeOf(mq.endPointStruct))
+	items, page, err := mq.mergeQueries(req.Context(), spec, sliceType, queries)
+	if err != nil {
+		return nil, err
+	}
+	response := &Response{Page: spec.Page}
+	response.Page.Items = uint(items)
+	response.Page.calculateLastPage()
+	if page.Len() == 0 {
+		response.Content = mq.emptyContent()
+		return response, nil
+	}
+	content := reflect.New(sliceType)
+	content.Elem().Set(page)
+	response.Content = content.Interface()
+	return response, nil
+}
+
+// partitionCollections returns the collections of the time partitioning that contain the
+// documents in the range of the partition field in filter, in chronological order.
+func (mq *MongoQuery) partitionCollections(filter map[string]interface{}) ([]string, error) {
+	missing := merry.Wrap(fmt.Errorf("parameter '%s' requires a lower and an upper bound", mq.partitionField)).WithHTTPCode(http.StatusBadRequest)
+	doc, ok := operatorDocument(filter[mq.partitionField])
+	if !ok {
+		return nil, missing
+	}
+	lower, ok := doc["$gte"].(time.Time)
+	if gt, isGt := doc["$gt"].(time.Time); isGt && (!ok || gt.After(lower)) {
+		lower, ok = gt, true
+	}
+	if !ok {
+		return nil, missing
+	}
+	upper, ok := doc["$lte"].(time.Time)
+	if lt, isLt := doc["$lt"].(time.Time); isLt && (!ok || !lt.After(upper)) {
+		// the upper bound itself is excluded
+		upper, ok = lt.Add(-time.Nanosecond), true
+	}
+	if !ok {
+		return nil, missing
+	}
+	collections := []string{}
+	tooMany := merry.Wrap(fmt.Errorf("the range of parameter '%s' spans more than %d partitions", mq.partitionField, mq.maxPartitions)).WithHTTPCode(http.StatusBadRequest)
+	add := func(t time.Time) bool {
+		name := mq.partitionCollection(t)
+		if len(collections) == 0 || collections[len(collections)-1] != name {
+			collections = append(collections, name)
+		}
+		return mq.maxPartitions <= 0 || len(collections) <= mq.maxPartitions
+	}
+	// partitions are at least a day long, so the range is scanned by day until the
+	// maximum is exceeded
+	for t := lower; !t.After(upper); t = t.AddDate(0, 0, 1) {
+		if !add(t) {
+			return nil, tooMany
+		}
+	}
+	if !upper.Before(lower) && !add(upper) {
+		return nil, tooMany
+	}
+	return collections, nil
+}
+
+// sortDocuments sorts the documents of the slice docs by the sort fields. Documents with equal
+// values keep their order.
+func sortDocuments(docs reflect.Value, sortFields []string) {
+	if len(sortFields) == 0 {
+		return
+	}
+	sort.SliceStable(docs.Interface(), func(i, j int) bool {
+		for _, field := range sortFields {
+			name := strings.TrimPrefix(field, "-")
+			a, _ := fieldByParameterName(docs.Index(i), name)
+			b, _ := fieldByParameterName(docs.Index(j), name)
+			c := compareReflectValues(a, b)
+			if strings.HasPrefix(field, "-") {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// compareReflectValues compares two values of a field. Invalid values, like missing fields,
+// are less than all other values. Values that cannot be compared are equal.
+func compareReflectValues(a, b reflect.Value) int {
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return 0
+	case !a.IsValid():
+		return -1
+	case !b.IsValid():
+		return 1
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if kindClass(b.Kind()) == "number" {
+			return compareFloats(float64(a.Int()), numberOf(b))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if kindClass(b.Kind()) == "number" {
+			return compareFloats(float64(a.Uint()), numberOf(b))
+		}
+	case reflect.Float32, reflect.Float64:
+		if kindClass(b.Kind()) == "number" {
+			return compareFloats(a.Float(), numberOf(b))
+		}
+	case reflect.String:
+		if b.Kind() == reflect.String {
+			return strings.Compare(a.String(), b.String())
+		}
+	case reflect.Bool:
+		if b.Kind() == reflect.Bool && a.Bool() != b.Bool() {
+			if a.Bool() {
+				return 1
+			}
+			return -1
+		}
+	}
+	if c, ok := compareValues(a.Interface(), b.Interface()); ok {
+		return c
+	}
+	return 0
+}
+
+// numberOf returns the numeric value v as float64.
+func numberOf(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+// mergeProjection returns the projection of the queries that are merged by sortFields, which
+// has to contain the sort fields, and the fields that are not in fields but were added to it.
+// The added fields have to be removed from the merged documents with stripFields.
+func mergeProjection(fields bson.M, sortFields []string) (bson.M, []string) {
+	if len(fields) == 0 {
+		return fields, nil
+	}
+	projection := bson.M{}
+	for k, v := range fields {
+		projection[k] = v
+	}
+	exclusion := isExclusion(fields)
+	added := []string{}
+	for _, field := range sortFields {
+		name := strings.TrimPrefix(field, "-")
+		// the text score is selected anyway
+		if strings.HasPrefix(name, "$") {
+			continue
+		}
+		if exclusion {
+			// the excluded field or parent is loaded and removed after the merge
+			for k, v := range projection {
+				if v == 0 && (name == k || strings.HasPrefix(name, k+".")) {
+					delete(projection, k)
+					added = append(added, k)
+				}
+			}
+			continue
+		}
+		selected, children := false, false
+		for k := range projection {
+			selected = selected || name == k || strings.HasPrefix(name, k+".")
+			children = children || strings.HasPrefix(k, name+".")
+		}
+		// documents are not sorted by a field with selected sub fields, since they
+		// cannot be compared
+		if !selected && !children {
+			projection[name] = 1
+			added = append(added, name)
+		}
+	}
+	return projection, added
+}
+
+// stripFields sets the fields of the documents docs to their zero values, like they were not
+// selected. Fields of map documents are deleted.
+func stripFields(docs reflect.Value, fields []string) {
+	for i := 0; i < docs.Len(); i++ {
+		doc := reflect.Indirect(docs.Index(i))
+		if doc.Kind() == reflect.Interface {
+			doc = reflect.Indirect(doc.Elem())
+		}
+		for _, field := range fields {
+			if doc.Kind() == reflect.Map && doc.Type().Key().Kind() == reflect.String {
+				doc.SetMapIndex(reflect.ValueOf(field).Convert(doc.Type().Key()), reflect.Value{})
+				continue
+			}
+			if v, ok := fieldByParameterName(doc, field); ok && v.CanSet() {
+				v.Set(reflect.Zero(v.Type()))
+			}
+		}
+	}
+}
+
+// mergeQueries runs the count and the query of each of queries as subqueries, see
+// SetMaxConcurrentSubqueries, and returns the summed count and the page of spec of the merged
+// documents sorted by the sort fields of spec. The queries must not be paged, every query loads
+// the documents up to the end of the page. The projection of the queries has to be the
+// projection of mergeProjection, the added sort fields are removed from the page.
+func (mq *MongoQuery) mergeQueries(ctx context.Context, spec *QuerySpec, sliceType reflect.Type, queries []*mgo.Query) (int, reflect.Value, error) {
+	skip := int((spec.Page.Current - 1) * spec.Page.Size)
+	counts := make([]int, len(queries))
+	contents := make([]reflect.Value, len(queries))
+	calls := []func() error{}
+	for i, q := range queries {
+		i, q := i, q
+		calls = append(calls, func() error {
+			n, err := mq.count(q)
+			if err != nil {
+				return merry.Prepend(err, "could not create count query").WithHTTPCode(http.StatusInternalServerError)
+			}
+			counts[i] = n
+			if n == 0 {
+				return nil
+			}
+			if spec.Page.Size > 0 {
+				q.Limit(skip + int(spec.Page.Size))
+			}
+			content := reflect.New(sliceType)
+			if err := mq.all(q, content.Interface()); err != nil {
+				return merry.Prepend(err, "could not execute q.All()").WithHTTPCode(http.StatusInternalServerError)
+			}
+			contents[i] = content.Elem()
+			return nil
+		})
+	}
+	if err := mq.runSubqueries(ctx, calls...); err != nil {
+		return 0, reflect.Value{}, err
+	}
+	docs := reflect.MakeSlice(sliceType, 0, 0)
+	items := 0
+	for i := range queries {
+		items += counts[i]
+		if contents[i].IsValid() {
+			docs = reflect.AppendSlice(docs, contents[i])
+		}
+	}
+	sortDocuments(docs, spec.Sort)
+	page := pageOf(docs, skip, int(spec.Page.Size))
+	if _, added := mergeProjection(spec.Fields, spec.Sort); len(added) > 0 {
+		stripFields(page, added)
+	}
+	return items, page, nil
+}
+
+// pageOf returns the documents of the page starting at skip with size documents. A size of 0
+// returns all documents after skip.
+func pageOf(docs reflect.Value, skip, size int) reflect.Value {
+	if skip > docs.Len() {
+		skip = docs.Len()
+	}
+	end := docs.Len()
+	if size > 0 && skip+size < end {
+		end = skip + size
+	}
+	return docs.Slice(skip, end)
+}
@@ -0,0 +1,188 @@
+package mqb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func monthlyCollection(t time.Time) string {
+	return t.Format("events_2006_01")
+}
+
+func TestPartitionCollections(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.SetTimePartitioning("stringmember", "", monthlyCollection); err == nil {
+		t.Error("partitioning by a string field did not produce an error")
+	}
+	if err := mq.SetTimePartitioning("timemember", "2006-01-02", monthlyCollection); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	for query, expected := range map[string][]string{
+		"/?timemember__gte=2023-01-15&timemember__lt=2023-03-01":  {"events_2023_01", "events_2023_02"},
+		"/?timemember__gte=2023-01-15&timemember__lte=2023-03-01": {"events_2023_01", "events_2023_02", "events_2023_03"},
+		"/?timemember__gt=2022-11-30&timemember__lt=2023-01-02":   {"events_2022_11", "events_2022_12", "events_2023_01"},
+		"/?timemember__gte=2023-02-01&timemember__lte=2023-02-01": {"events_2023_02"},
+		"/?timemember__gte=2023-02-01&timemember__lt=2023-02-01":  {},
+		"/?timemember__gte=2023-03-01&timemember__lt=2023-01-01":  {},
+		"/?timemember__gte=2022-12-31&timemember__lt=2024-01-02": {
+			"events_2022_12", "events_2023_01", "events_2023_02", "events_2023_03", "events_2023_04", "events_2023_05", "events_2023_06",
+			"events_2023_07", "events_2023_08", "events_2023_09", "events_2023_10", "events_2023_11", "events_2023_12", "events_2024_01",
+		},
+	} {
+		spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		collections, err := mq.partitionCollections(spec.Filter)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(collections, expected) {
+			t.Errorf("wrong collections for %s: %v", query, collections)
+		}
+	}
+
+	for _, query := range []string{
+		"/",
+		"/?timemember__gte=2023-01-15",
+		"/?timemember__lt=2023-01-15",
+		"/?timemember__exists=true",
+	} {
+		spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if _, err := mq.partitionCollections(spec.Filter); err == nil {
+			t.Errorf("%s without range did not produce an error", query)
+		}
+	}
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?timemember__gte=2023-01-15T00:00:00Z", nil)); err == nil {
+		t.Error("value not matching the layout did not produce an error")
+	}
+}
+
+func TestPartitionLimits(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	if err := mq.SetTimePartitioning("timemember", "2006-01-02", monthlyCollection); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	mq.SetMaxPartitions(12)
+	for query, valid := range map[string]bool{
+		"/?timemember__gte=2023-01-01&timemember__lt=2024-01-01":  true,
+		"/?timemember__gte=2023-01-01&timemember__lte=2024-01-01": false,
+		"/?timemember__gte=0001-01-01&timemember__lt=9999-12-31":  false,
+	} {
+		spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		_, err = mq.partitionCollections(spec.Filter)
+		if valid && err != nil {
+			t.Errorf("error occured for %s: %s", query, err)
+		}
+		if !valid && merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("%s: wrong error for too many partitions: %v", query, err)
+		}
+	}
+
+	mq.SetCursorSecret([]byte("secret"))
+	cursor, err := mq.EncodeCursor([]interface{}{int64(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, parameter := range []string{"after", "before"} {
+		req := httptest.NewRequest("GET", "/?timemember__gte=2023-01-01&timemember__lt=2023-02-01&sort=intMember&"+parameter+"="+cursor, nil)
+		if _, err := mq.RunPartitioned(req); err == nil || !strings.Contains(err.Error(), "cursors are not supported") {
+			t.Errorf("%s cursor did not produce an error: %v", parameter, err)
+		}
+	}
+}
+
+func TestSortDocuments(t *testing.T) {
+	docs := []TestStruct{
+		{StringMember: "b", IntMember: 1},
+		{StringMember: "a", IntMember: 2},
+		{StringMember: "b", IntMember: 3},
+		{StringMember: "c", IntMember: 2},
+	}
+	v := reflect.ValueOf(docs)
+	sortDocuments(v, []string{"stringmember", "-intMember"})
+	if !reflect.DeepEqual(docs, []TestStruct{
+		{StringMember: "a", IntMember: 2},
+		{StringMember: "b", IntMember: 3},
+		{StringMember: "b", IntMember: 1},
+		{StringMember: "c", IntMember: 2},
+	}) {
+		t.Errorf("wrong order: %v", docs)
+	}
+
+	if page := pageOf(v, 1, 2).Interface().([]TestStruct); len(page) != 2 || page[0].IntMember != 3 || page[1].IntMember != 1 {
+		t.Errorf("wrong page: %v", page)
+	}
+	if page := pageOf(v, 3, 2); page.Len() != 1 {
+		t.Errorf("wrong last page: %v", page)
+	}
+	if page := pageOf(v, 6, 2); page.Len() != 0 {
+		t.Errorf("wrong page after the last page: %v", page)
+	}
+	if page := pageOf(v, 0, 0); page.Len() != 4 {
+		t.Errorf("wrong page without size: %v", page)
+	}
+}
+
+func TestPartitionedProjection(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	if err := mq.SetTimePartitioning("timemember", "2006-01-02", monthlyCollection); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	// every partition returns its documents with the sort field, which was added to the projection
+	var mu sync.Mutex
+	partitions := [][]TestStruct{
+		{{StringMember: "a", IntMember: 1}, {StringMember: "b", IntMember: 3}},
+		{{StringMember: "c", IntMember: 2}},
+	}
+	mq.count = func(q *mgo.Query) (int, error) { return 1, nil }
+	mq.all = func(q *mgo.Query, content interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		reflect.ValueOf(content).Elem().Set(reflect.ValueOf(partitions[0]))
+		partitions = partitions[1:]
+		return nil
+	}
+	req := httptest.NewRequest("GET", "/?timemember__gte=2023-01-15&timemember__lt=2023-03-01&field=stringmember&sort=-intMember&limit=2", nil)
+	r, err := mq.RunPartitioned(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if docs := *r.Content.(*[]TestStruct); !reflect.DeepEqual(docs, []TestStruct{{StringMember: "b"}, {StringMember: "c"}}) {
+		t.Errorf("wrong content: %v", docs)
+	}
+
+	for _, tc := range []struct {
+		fields     bson.M
+		sort       []string
+		projection bson.M
+		added      []string
+	}{
+		{bson.M{"stringmember": 1}, []string{"-intMember"}, bson.M{"stringmember": 1, "intMember": 1}, []string{"intMember"}},
+		{bson.M{"stringmember": 1, "intMember": 1}, []string{"-intMember"}, bson.M{"stringmember": 1, "intMember": 1}, []string{}},
+		{bson.M{"embeddedmember": 1}, []string{"embeddedmember.embeddedint"}, bson.M{"embeddedmember": 1}, []string{}},
+		{bson.M{"intMember": 0, "mybool": 0}, []string{"intMember"}, bson.M{"mybool": 0}, []string{"intMember"}},
+		{bson.M{}, []string{"intMember"}, bson.M{}, nil},
+	} {
+		projection, added := mergeProjection(tc.fields, tc.sort)
+		if !reflect.DeepEqual(projection, tc.projection) || !reflect.DeepEqual(added, tc.added) {
+			t.Errorf("wrong projection for %v sorted by %v: %v, added %v", tc.fields, tc.sort, projection, added)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package mqb
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+// relevanceField is the field that holds the relevance score in the scoring pipeline.
+const relevanceField = "_relevance"
+
+// Conversion is a type a sort field can be normalized to, see NormalizeSortField.
+type Conversion string
+
+// conversions of sort fields
+const (
+	ToInt    Conversion = "int"    // ToInt converts to a 32-bit integer.
+	ToLong   Conversion = "long"   // ToLong converts to a 64-bit integer.
+	ToDouble Conversion = "double" // ToDouble converts to a double.
+	ToString Conversion = "string" // ToString converts to a string.
+	ToDate   Conversion = "date"   // ToDate converts to a date.
+)
+
+// sortFieldPrefix is the prefix of the normalized copies of sort fields in the pipeline.
+const sortFieldPrefix = "_sort_"
+
+// NormalizeSortField normalizes the values of field before the documents are sorted by it. This
+// is useful if field is stored with mixed types, like age as int and as string, which MongoDB
+// sorts by type first:
+//     mq.NormalizeSortField("age", mqb.ToInt)
+// If a request sorts by field, the query is executed as aggregation pipeline that adds a
+// converted copy of field, sorts by the copy and removes it again. Values that cannot be
+// converted are sorted like missing values. The total number of items is counted as usual.
+// Since the converted values cannot use an index, all matching documents are converted and
+// sorted in memory, which is slow for large results. Requires MongoDB 4.0 or newer.
+func (mq *MongoQuery) NormalizeSortField(field string, to Conversion) error {
+	field = mq.resolveAlias(field)
+	_, ok := mq.supportedParameters[field]
+	if _, isMeta := validMetaParameters[field]; !ok || isMeta {
+		return fmt.Errorf("parameter '%s' is not supported", field)
+	}
+	switch to {
+	case ToInt, ToLong, ToDouble, ToString, ToDate:
+	default:
+		return fmt.Errorf("invalid conversion: %s", to)
+	}
+	mq.sortConversions[field] = to
+	return nil
+}
+
+// literalFieldPrefix is the prefix of the copies of selected fields with literal dots in their
+// names in the pipeline, see AddParameter.
+const literalFieldPrefix = "_literal_"
+
+// hasFieldPrefix is the prefix of the fields in the pipeline that tell if a sort field exists.
+const hasFieldPrefix = "_has_"
+
+// MissingSortLast places the documents without field after the documents with field if a
+// request sorts by it, regardless of the direction:
+//     mq.MissingSortLast("priority")
+//     /?sort=-priority returns the documents with priority 3, 2, 1 and then those without it
+// MongoDB sorts missing values before all other values otherwise. If a request sorts by one of
+// the fields, the query is executed as aggregation pipeline that adds a boolean field telling
+// if the field exists, sorts by it first and removes it again. Null values are treated as
+// missing. The total number of items is counted as usual.
+func (mq *MongoQuery) MissingSortLast(fields ...string) error {
+	for _, field := range fields {
+		field = mq.resolveAlias(field)
+		_, ok := mq.supportedParameters[field]
+		if _, isMeta := validMetaParameters[field]; !ok || isMeta {
+			return fmt.Errorf("parameter '%s' is not supported", field)
+		}
+	}
+	for _, field := range fields {
+		mq.missingSortLast[mq.resolveAlias(field)] = true
+	}
+	return nil
+}
+
+// SetRelevanceScoring enables the ordering of the results by relevance for requests that filter
+// the string parameter field. Documents whose value equals one of the requested values exactly
+// get a score of exactBoost, the others a score of 0, and the documents are sorted by score
+// before they are sorted by the sort parameter:
+//     mq.SetRelevanceScoring("name", 10)
+//     r, _ := mq.Run(req) // /?name=pete returns pete before peter
+// The query is executed as aggregation pipeline, which requires MongoDB 3.4 or newer.
+func (mq *MongoQuery) SetRelevanceScoring(field string, exactBoost float64) error {
+	field = mq.resolveAlias(field)
+	kind, ok := mq.supportedParameters[field]
+	if _, isMeta := validMetaParameters[field]; !ok || isMeta {
+		return fmt.Errorf("parameter '%s' is not supported", field)
+	}
+	if kind != reflect.String {
+		return fmt.Errorf("parameter '%s' is not a string", field)
+	}
+	mq.relevanceField = field
+	mq.relevanceBoost = exactBoost
+	return nil
+}
+
+// relevanceValues returns the values of the relevance field in req.
+func (mq *MongoQuery) relevanceValues(req *http.Request) []interface{} {
+	values := []interface{}{}
+	if len(mq.relevanceField) == 0 {
+		return values
+	}
+	for k, v := range mq.queryValues(req) {
+		if mq.resolveAlias(k) != mq.relevanceField {
+			continue
+		}
+		for _, s := range v {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// exprCheckRetry is the time after which a failed check of the $expr support is retried.
+const exprCheckRetry = time.Minute
+
+// exprSupport caches if the server supports $expr in queries.
+type exprSupport struct {
+	mu        sync.Mutex
+	checked   bool
+	supported bool
+	retryAt   time.Time
+}
+
+// sessionVersionAtLeast returns true if the version of the server of s is at least version.
+func sessionVersionAtLeast(s *mgo.Session, version ...int) (bool, error) {
+	info, err := s.BuildInfo()
+	if err != nil {
+		return false, err
+	}
+	return info.VersionAtLeast(version...), nil
+}
+
+// supportsExpr returns true if the server supports $expr in queries, which requires MongoDB
+// 3.6. The version is checked once, it is assumed to be supported if the check fails. A failed
+// check is retried after exprCheckRetry.
+func (mq *MongoQuery) supportsExpr() bool {
+	if mq.dataBase.Session == nil {
+		return true
+	}
+	mq.expr.mu.Lock()
+	defer mq.expr.mu.Unlock()
+	if !mq.expr.checked {
+		if mq.now().Before(mq.expr.retryAt) {
+			return true
+		}
+		supported, err := mq.versionAtLeast(mq.dataBase.Session, 3, 6)
+		if err != nil {
+			mq.expr.retryAt = mq.now().Add(exprCheckRetry)
+			return true
+		}
+		mq.expr.checked = true
+		mq.expr.supported = supported
+	}
+	return mq.expr.supported
+}
+
+// legacyExpr returns true if filter contains an $expr, see createFieldComparisons, that the
+// server does not support in queries. Such filters are executed as aggregation pipeline.
+func (mq *MongoQuery) legacyExpr(filter bson.M) bool {
+	_, ok := filter["$expr"]
+	return ok && !mq.supportsExpr()
+}
+
+// matchStages returns the stages of an aggregation pipeline that match filter. If the server
+// does not support $expr, the $expr of filter is evaluated with $redact, which only requires
+// MongoDB 2.6.
+func (mq *MongoQuery) matchStages(filter bson.M) []bson.M {
+	if !mq.legacyExpr(filter) {
+		return []bson.M{{"$match": filter}}
+	}
+	match := bson.M{}
+	for k, v := range filter {
+		if k != "$expr" {
+			match[k] = v
+		}
+	}
+	return []bson.M{
+		{"$match": match},
+		{"$redact": bson.M{"$cond": []interface{}{filter["$expr"], "$$KEEP", "$$PRUNE"}}},
+	}
+}
+
+// countPipeline counts the documents matching filter with an aggregation pipeline.
+func (mq *MongoQuery) countPipeline(filter bson.M) (uint, error) {
+	pipeline := append(mq.matchStages(filter), bson.M{"$group": bson.M{"_id": nil, "n": bson.M{"$sum": 1}}})
+	result := []struct {
+		N int `bson:"n"`
+	}{}
+	if err := mq.collection().Pipe(pipeline).All(&result); err != nil {
+		return 0, merry.Prepend(err, "could not create count query").WithHTTPCode(http.StatusInternalServerError)
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return uint(result[0].N), nil
+}
+
+// selectedLiteralFields returns the sorted fields with literal dots in their names, see
+// AddParameter, that are selected by fields.
+func (mq *MongoQuery) selectedLiteralFields(fields bson.M) []string {
+	literal := []string{}
+	for k := range fields {
+		if mq.literalFields[k] {
+			literal = append(literal, k)
+		}
+	}
+	sort.Strings(literal)
+	return literal
+}
+
+// specPipeline returns the aggregation pipeline for spec, if spec cannot be executed with a
+// simple query. Otherwise it returns nil.
+func (mq *MongoQuery) specPipeline(spec *QuerySpec) []bson.M {
+	computed := bson.D{}
+	sort := bson.D{}
+	if len(spec.relevanceValues) > 0 {
+		match := bson.M{"$eq": []interface{}{"$" + mq.relevanceField, spec.relevanceValues[0]}}
+		if len(spec.relevanceValues) > 1 {
+			match = bson.M{"$in": []interface{}{"$" + mq.relevanceField, spec.relevanceValues}}
+		}
+		computed = append(computed, bson.DocElem{Name: relevanceField, Value: bson.M{
+			"$cond": []interface{}{match, mq.relevanceBoost, 0},
+		}})
+		sort = append(sort, bson.DocElem{Name: relevanceField, Value: -1})
+	}
+	for _, field := range spec.Sort {
+		if field == textScoreSort {
+			sort = append(sort, bson.DocElem{Name: ScoreField, Value: textScoreProjection()})
+			continue
+		}
+		name, direction := strings.TrimPrefix(field, "-"), 1
+		if strings.HasPrefix(field, "-") {
+			direction = -1
+		}
+		if mq.missingSortLast[name] {
+			has := hasFieldPrefix + strings.Replace(name, ".", "_", -1)
+			computed = append(computed, bson.DocElem{Name: has, Value: bson.M{
+				"$gt": []interface{}{"$" + name, nil},
+			}})
+			sort = append(sort, bson.DocElem{Name: has, Value: -1})
+		}
+		if to, ok := mq.sortConversions[name]; ok {
+			normalized := sortFieldPrefix + strings.Replace(name, ".", "_", -1)
+			computed = append(computed, bson.DocElem{Name: normalized, Value: bson.M{
+				"$convert": bson.M{"input": "$" + name, "to": string(to), "onError": nil, "onNull": nil},
+			}})
+			name = normalized
+		}
+		sort = append(sort, bson.DocElem{Name: name, Value: direction})
+	}
+	legacy := mq.legacyExpr(spec.Filter)
+	literal := mq.selectedLiteralFields(spec.Fields)
+	if len(computed) == 0 && !legacy && len(literal) == 0 {
+		return nil
+	}
+
+	// the driver cannot attach a comment to a pipeline, the $match of the filter carries it
+	filter := spec.Filter
+	if len(spec.comment) > 0 {
+		filter = bson.M{"$comment": spec.comment}
+		for k, v := range spec.Filter {
+			filter[k] = v
+		}
+	}
+	// $meta fields like the text score are added with the computed fields, since a $project
+	// containing them would be an inclusion of only these fields
+	meta := bson.D{}
+	project := bson.M{}
+	for k, v := range spec.Fields {
+		if isMetaProjection(v) {
+			meta = append(meta, bson.DocElem{Name: k, Value: v})
+			continue
+		}
+		// a $project reads the keys as paths, fields with literal dots are projected into a
+		// copy, which is renamed after the $project
+		if mq.literalFields[k] {
+			project[literalFieldPrefix+strings.Replace(k, ".", "_", -1)] = bson.M{"$getField": k}
+			continue
+		}
+		project[k] = v
+	}
+	pipeline := mq.matchStages(filter)
+	if added := append(meta, computed...); len(added) > 0 {
+		pipeline = append(pipeline, bson.M{"$addFields": added})
+	}
+	if len(sort) > 0 {
+		pipeline = append(pipeline, bson.M{"$sort": sort})
+	}
+	pipeline = append(pipeline, bson.M{"$skip": int((spec.Page.Current - 1) * spec.Page.Size)})
+	if limit := mq.resultLimit(spec.Page.Size); limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	} else if spec.Page.Size > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": int(spec.Page.Size)})
+	}
+	// the computed fields are removed, an inclusion projection removes them anyway but has to
+	// keep the $meta fields
+	if len(project) == 0 || isExclusion(project) {
+		for _, c := range computed {
+			project[c.Name] = 0
+		}
+	} else {
+		for _, m := range meta {
+			project[m.Name] = 1
+		}
+	}
+	if len(project) == 0 {
+		return pipeline
+	}
+	pipeline = append(pipeline, bson.M{"$project": project})
+	for _, name := range literal {
+		copied := literalFieldPrefix + strings.Replace(name, ".", "_", -1)
+		pipeline = append(pipeline, bson.M{"$replaceWith": bson.M{"$setField": bson.M{
+			"field": name,
+			"input": bson.M{"$unsetField": bson.M{"field": copied, "input": "$$ROOT"}},
+			"value": "$" + copied,
+		}}})
+	}
+	return pipeline
+}
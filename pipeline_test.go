@@ -0,0 +1,317 @@
+package mqb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestRelevancePipeline(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for _, field := range []string{"notAMember", "intMember", "limit"} {
+		if err := mq.SetRelevanceScoring(field, 10); err == nil {
+			t.Errorf("invalid field %s did not produce an error", field)
+		}
+	}
+	mq.AddAlias("name", "stringmember")
+	if err := mq.SetRelevanceScoring("name", 10); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); p != nil {
+		t.Errorf("pipeline generated for request without relevance field: %v", p)
+	}
+
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?name=pete&sort=-intMember&limit=5&page=2", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); !reflect.DeepEqual(p, []bson.M{
+		{"$match": bson.M{"stringmember": bson.RegEx{Pattern: "pete"}}},
+		{"$addFields": bson.D{{Name: "_relevance", Value: bson.M{
+			"$cond": []interface{}{bson.M{"$eq": []interface{}{"$stringmember", "pete"}}, 10.0, 0},
+		}}}},
+		{"$sort": bson.D{{Name: "_relevance", Value: -1}, {Name: "intMember", Value: -1}}},
+		{"$skip": 5},
+		{"$limit": 5},
+		{"$project": bson.M{"_relevance": 0}},
+	}) {
+		t.Errorf("wrong pipeline generated: %v", p)
+	}
+
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?stringmember=pete&stringmember=paul&field=mybool", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	p := mq.specPipeline(spec)
+	if !reflect.DeepEqual(p[1], bson.M{"$addFields": bson.D{{Name: "_relevance", Value: bson.M{
+		"$cond": []interface{}{bson.M{"$in": []interface{}{"$stringmember", []interface{}{"pete", "paul"}}}, 10.0, 0},
+	}}}}) {
+		t.Errorf("wrong score for multiple values: %v", p[1])
+	}
+	if !reflect.DeepEqual(p[len(p)-1], bson.M{"$project": bson.M{"mybool": 1}}) {
+		t.Errorf("wrong projection: %v", p[len(p)-1])
+	}
+}
+
+func TestNormalizeSortField(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.NormalizeSortField("notAMember", ToInt); err == nil {
+		t.Error("unsupported field did not produce an error")
+	}
+	if err := mq.NormalizeSortField("stringmember", Conversion("bool")); err == nil {
+		t.Error("invalid conversion did not produce an error")
+	}
+	if err := mq.NormalizeSortField("stringmember", ToInt); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.NormalizeSortField("embeddedmember.embeddedint", ToString); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?sort=intMember", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); p != nil {
+		t.Errorf("pipeline generated without normalized sort field: %v", p)
+	}
+
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true&sort=-stringmember&sort=intMember&sort=embeddedmember.embeddedint&page=3", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); !reflect.DeepEqual(p, []bson.M{
+		{"$match": bson.M{"mybool": true}},
+		{"$addFields": bson.D{
+			{Name: "_sort_stringmember", Value: bson.M{"$convert": bson.M{"input": "$stringmember", "to": "int", "onError": nil, "onNull": nil}}},
+			{Name: "_sort_embeddedmember_embeddedint", Value: bson.M{"$convert": bson.M{"input": "$embeddedmember.embeddedint", "to": "string", "onError": nil, "onNull": nil}}},
+		}},
+		{"$sort": bson.D{{Name: "_sort_stringmember", Value: -1}, {Name: "intMember", Value: 1}, {Name: "_sort_embeddedmember_embeddedint", Value: 1}}},
+		{"$skip": 40},
+		{"$limit": 20},
+		{"$project": bson.M{"_sort_stringmember": 0, "_sort_embeddedmember_embeddedint": 0}},
+	}) {
+		t.Errorf("wrong pipeline generated: %v", p)
+	}
+}
+
+func TestMissingSortLast(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for _, field := range []string{"notAMember", "sort"} {
+		if err := mq.MissingSortLast("intMember", field); err == nil {
+			t.Errorf("invalid field %s did not produce an error", field)
+		}
+	}
+	if len(mq.missingSortLast) != 0 {
+		t.Errorf("fields were added despite an error: %v", mq.missingSortLast)
+	}
+	if err := mq.MissingSortLast("intMember", "embeddedmember.embeddedint"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?sort=floatmember", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); p != nil {
+		t.Errorf("pipeline generated without missing last sort field: %v", p)
+	}
+
+	for _, direction := range []int{1, -1} {
+		sort := "intMember"
+		if direction < 0 {
+			sort = "-" + sort
+		}
+		spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true&sort=floatmember&sort="+sort+"&sort=embeddedmember.embeddedint", nil))
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if p := mq.specPipeline(spec); !reflect.DeepEqual(p, []bson.M{
+			{"$match": bson.M{"mybool": true}},
+			{"$addFields": bson.D{
+				{Name: "_has_intMember", Value: bson.M{"$gt": []interface{}{"$intMember", nil}}},
+				{Name: "_has_embeddedmember_embeddedint", Value: bson.M{"$gt": []interface{}{"$embeddedmember.embeddedint", nil}}},
+			}},
+			{"$sort": bson.D{
+				{Name: "floatmember", Value: 1},
+				{Name: "_has_intMember", Value: -1},
+				{Name: "intMember", Value: direction},
+				{Name: "_has_embeddedmember_embeddedint", Value: -1},
+				{Name: "embeddedmember.embeddedint", Value: 1},
+			}},
+			{"$skip": 0},
+			{"$limit": 20},
+			{"$project": bson.M{"_has_intMember": 0, "_has_embeddedmember_embeddedint": 0}},
+		}) {
+			t.Errorf("wrong pipeline generated for %s: %v", sort, p)
+		}
+	}
+
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?sort=intMember&field=mybool", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	p := mq.specPipeline(spec)
+	if !reflect.DeepEqual(p[len(p)-1], bson.M{"$project": bson.M{"mybool": 1}}) {
+		t.Errorf("wrong projection: %v", p[len(p)-1])
+	}
+}
+
+func TestLegacyExprPipeline(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	checks := 0
+	supported := true
+	mq.versionAtLeast = func(s *mgo.Session, version ...int) (bool, error) {
+		checks++
+		if !reflect.DeepEqual(version, []int{3, 6}) {
+			t.Errorf("wrong version checked: %v", version)
+		}
+		return supported, nil
+	}
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true&intMember__gtfield=uintmember&limit=5&page=2", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); p != nil {
+		t.Errorf("pipeline generated for server supporting $expr: %v", p)
+	}
+
+	// the version is checked once
+	mq = NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.versionAtLeast = func(s *mgo.Session, version ...int) (bool, error) {
+		checks++
+		return false, nil
+	}
+	checks = 0
+	expr := map[string]interface{}{"$gt": []interface{}{"$intMember", "$uintmember"}}
+	for i := 0; i < 2; i++ {
+		if p := mq.specPipeline(spec); !reflect.DeepEqual(p, []bson.M{
+			{"$match": bson.M{"mybool": true}},
+			{"$redact": bson.M{"$cond": []interface{}{expr, "$$KEEP", "$$PRUNE"}}},
+			{"$skip": 5},
+			{"$limit": 5},
+		}) {
+			t.Errorf("wrong pipeline generated: %v", p)
+		}
+	}
+	if checks != 1 {
+		t.Errorf("version checked %d times", checks)
+	}
+
+	// a failed check is retried after a while
+	mq = NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	now := time.Date(2018, 2, 26, 0, 0, 0, 0, time.UTC)
+	mq.now = func() time.Time { return now }
+	checks = 0
+	checkErr := errors.New("no reachable servers")
+	mq.versionAtLeast = func(s *mgo.Session, version ...int) (bool, error) {
+		checks++
+		return false, checkErr
+	}
+	for i := 0; i < 2; i++ {
+		if p := mq.specPipeline(spec); p != nil {
+			t.Errorf("pipeline generated although the check failed: %v", p)
+		}
+	}
+	if checks != 1 {
+		t.Errorf("failed version check was retried immediately: %d checks", checks)
+	}
+	now = now.Add(exprCheckRetry)
+	checkErr = nil
+	if p := mq.specPipeline(spec); p == nil || checks != 2 {
+		t.Errorf("failed version check was not retried: %d checks, pipeline %v", checks, p)
+	}
+
+	// filters without $expr are not affected
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); p != nil {
+		t.Errorf("pipeline generated without $expr: %v", p)
+	}
+}
+
+func TestPipelineCommentAndHint(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	if err := mq.SetRelevanceScoring("stringmember", 10); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.SetAllowedHints("stringmember_1"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	mq.SetQueryComment(func(ctx context.Context, req *http.Request) string { return "endpoint" })
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?stringmember=pete", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); !reflect.DeepEqual(p[0], bson.M{"$match": bson.M{"stringmember": bson.RegEx{Pattern: "pete"}, "$comment": "endpoint"}}) {
+		t.Errorf("comment not attached to the pipeline: %v", p[0])
+	}
+	if _, ok := spec.Filter["$comment"]; ok {
+		t.Errorf("comment added to the filter of spec: %v", spec.Filter)
+	}
+
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?stringmember=pete&hint=stringmember_1", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if _, err := mq.RunSpec(context.Background(), spec); merry.HTTPCode(err) != http.StatusBadRequest {
+		t.Errorf("hint with pipeline did not produce an error: %v", err)
+	}
+}
+
+func TestScorePipeline(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.SetTextSearch("q"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.MissingSortLast("intMember"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	score := bson.M{"$meta": "textScore"}
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?q=coffee&sort=score&sort=intMember", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if p := mq.specPipeline(spec); !reflect.DeepEqual(p, []bson.M{
+		{"$match": spec.Filter},
+		{"$addFields": bson.D{
+			{Name: "score", Value: score},
+			{Name: "_has_intMember", Value: bson.M{"$gt": []interface{}{"$intMember", nil}}},
+		}},
+		{"$sort": bson.D{
+			{Name: "score", Value: score},
+			{Name: "_has_intMember", Value: -1},
+			{Name: "intMember", Value: 1},
+		}},
+		{"$skip": 0},
+		{"$limit": 20},
+		{"$project": bson.M{"_has_intMember": 0}},
+	}) {
+		t.Errorf("wrong pipeline generated: %v", p)
+	}
+
+	// selected fields keep the score
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?q=coffee&sort=score&sort=intMember&field=mybool", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	p := mq.specPipeline(spec)
+	if !reflect.DeepEqual(p[len(p)-1], bson.M{"$project": bson.M{"mybool": 1, "score": 1}}) {
+		t.Errorf("wrong projection: %v", p[len(p)-1])
+	}
+}
@@ -1,21 +1,46 @@
 package mqb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"net/http"
+	"net/url"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ansel1/merry"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
 )
 
+// match modes for string parameters
+const (
+	MatchModeRegex  = "regex"  // MatchModeRegex matches a single value as regular expression.
+	MatchModeExact  = "exact"  // MatchModeExact matches a single value exactly.
+	MatchModePrefix = "prefix" // MatchModePrefix matches values starting with a single value.
+)
+
+// AllFields is the value of the field parameter that selects all fields, see SetDefaultProjection.
+const AllFields = "*"
+
+// BoolWildcard is the value of a bool parameter that matches true and false, see SetBoolWildcard.
+const BoolWildcard = "any"
+
 var (
-	DefaultPageSize uint = 20 // DefaultPageSize defines how many elements a page contains per default.
+	DefaultPageSize     uint = 20 // DefaultPageSize defines how many elements a page contains per default.
+	DefaultMaxPathDepth      = 4  // DefaultMaxPathDepth defines how many segments a dotted parameter can have per default.
+)
+
+// errors of misconfigured databases
+var (
+	errNilDatabase = errors.New("mqb: nil *mgo.Database")
+	errNoSession   = errors.New("mqb: *mgo.Database without session")
 )
 
 // Page the paging information.
@@ -24,12 +49,64 @@ type Page struct {
 	Items   uint `json:"items"`   // Items defines the total number of items the corresponding query returns.
 	Last    uint `json:"last"`    // Last represents total number of pages a query generates (depends on the page size and the total number of elements returned by the query).
 	Current uint `json:"current"` // Current is the current page nuber for the query.
+
+	Snapshot   string      `json:"snapshot,omitempty"`   // Snapshot is the token for consistent pagination, see SetSnapshotPagination.
+	Boundaries *Boundaries `json:"boundaries,omitempty"` // Boundaries are the sort values of the first and last document, see SetPageBoundaries.
+
+	LimitExplicit bool `json:"-"` // LimitExplicit is true if the page size was given with the limit parameter.
+	PageExplicit  bool `json:"-"` // PageExplicit is true if the current page was given with the page parameter.
+}
+
+// Boundaries contains the values of the sort fields of the first and the last document of a page.
+type Boundaries struct {
+	First []interface{} `json:"first"` // First are the sort values of the first document.
+	Last  []interface{} `json:"last"`  // Last are the sort values of the last document.
 }
 
 // Response contains the result of the query, including the Page information.
 type Response struct {
-	Content interface{} `json:"content,omitempty"`
-	Page    Page        `json:"page"`
+	Content    interface{} `json:"content,omitempty"`
+	Page       Page        `json:"page"`
+	Warnings   []string    `json:"warnings,omitempty"`
+	NextCursor string      `json:"nextCursor,omitempty"` // NextCursor is the cursor to get the documents after the last document.
+	PrevCursor string      `json:"prevCursor,omitempty"` // PrevCursor is the cursor to get the documents before the first document.
+	Applied    *Applied    `json:"applied,omitempty"`    // Applied lists the defaults applied to the request, see EchoDefaults.
+	SyncedAt   *time.Time  `json:"syncedAt,omitempty"`   // SyncedAt is the value of modifiedSince for the next request, see SetSyncField.
+
+	Selectivity *float64 `json:"selectivity,omitempty"` // Selectivity is the share of the documents matching the filter, see SetIncludeSelectivity.
+}
+
+// EmptyContentStyle defines how the content of a Response without documents is serialized, see
+// SetEmptyContentStyle.
+type EmptyContentStyle int
+
+// styles of empty content
+const (
+	EmptyContentArray EmptyContentStyle = iota // EmptyContentArray serializes the content as [] (default).
+	EmptyContentOmit                           // EmptyContentOmit omits the content.
+)
+
+// SetEmptyContentStyle defines how the content of a Response without documents is serialized.
+// Per default it is an empty array, with EmptyContentOmit the Content of the Response is nil,
+// so it is omitted. RunOne is not affected, it returns an error with http.StatusNotFound if
+// the document does not exist.
+func (mq *MongoQuery) SetEmptyContentStyle(style EmptyContentStyle) {
+	mq.emptyContentStyle = style
+}
+
+// emptyContent returns the content of a Response without documents.
+func (mq *MongoQuery) emptyContent() interface{} {
+	if mq.emptyContentStyle == EmptyContentOmit {
+		return nil
+	}
+	return []interface{}{}
+}
+
+// Applied lists the defaults that were applied to a request.
+type Applied struct {
+	DefaultSort    []string `json:"defaultSort,omitempty"`    // DefaultSort are the sort fields of the sort policy applied because the request contains none.
+	DefaultFilters []string `json:"defaultFilters,omitempty"` // DefaultFilters are the parameters filtered without being in the request, like the tenant.
+	EffectiveLimit uint     `json:"effectiveLimit"`           // EffectiveLimit is the page size of the request.
 }
 
 // MongoQuery can be used to to create mgo.Query from http request parameters.
@@ -37,23 +114,157 @@ type MongoQuery struct {
 	endPointStruct               interface{}
 	dataBase                     *mgo.Database
 	supportedParameters          map[string]reflect.Kind
+	fieldTree                    map[string]reflect.Kind
+	missingSortLast              map[string]bool
+	pageBoundaries               bool
+	parameterSchema              *parameterSchema
+	verboseValidation            bool
+	arrayModes                   map[string]ArrayMode
+	countProvider                func(filter bson.M) (uint, bool, error)
+	find                         func(*mgo.Collection, queryArgs) *mgo.Query
+	count                        func(*mgo.Query) (int, error)
+	all                          func(*mgo.Query, interface{}) error
+	one                          func(*mgo.Query, interface{}) error
+	versionAtLeast               func(*mgo.Session, ...int) (bool, error)
+	expr                         exprSupport
+	textSearchParameter          string
 	additionalSupportedParamters map[string]reflect.Kind
 	disabledParameters           []string
 	page                         Page
+	preserveOrderParameter       string
+	preserveOrderAlways          bool
+	rawRegexParameters           []string
+	maxRegexLength               int
+	rejectComplexRegex           bool
+	autoNumericBase              bool
+	escapeRegex                  bool
+	regexOptions                 string
+	commaSeparatedParameters     []string
+	booleanStringFields          []string
+	literalFields                map[string]bool
+	allowedHints                 map[string][]string
+	matchHighlighting            bool
+	batchParameter               string
+	batchSize                    int
+	queryHook                    func(*http.Request, QueryInfo)
+	latencyBudget                time.Duration
+	sizeBudget                   int
+	maxResultDocuments           int
+	aliases                      map[string]string
+	recentField                  string
+	syncField                    string
+	now                          func() time.Time
+	floatTolerances              map[string]float64
+	maxProjectionFields          int
+	strictNumericParsing         bool
+	maxPathDepth                 int
+	rejectEmptyLists             bool
+	projectionPolicy             func(*http.Request) ([]string, error)
+	rejectForbiddenFields        bool
+	cursorSecret                 []byte
+	timeSeriesZeroFill           bool
+	rejectUnacceptable           bool
+	gzipThreshold                int
+	emptyContentStyle            EmptyContentStyle
+	trimValues                   bool
+	zeroPageIsFirst              bool
+	allowUnlimited               bool
+	matchMode                    string
+	boolWildcard                 bool
+	requiredGroups               [][]string
+	collectionNameFunc           func(string) string
+	querySlots                   chan struct{}
+	queueQueries                 bool
+	subqueries                   *semaphore
+	failFast                     bool
+	prefixRangeParameters        []string
+	echoDefaults                 bool
+	regexStyle                   RegexStyle
+	queryComment                 func(context.Context, *http.Request) string
+	rawBSON                      bool
+	canonicalExtendedJSON        bool
+	relevanceField               string
+	relevanceBoost               float64
+	sortConversions              map[string]Conversion
+	sortPolicy                   func(*http.Request, []string) ([]string, error)
+	sortDirections               map[string]SortDirection
+	envelope                     *EnvelopeConfig
+	includeSelectivity           bool
+	totals                       totalCache
+	parameterAuthorizer          func(*http.Request, string) error
+	valueDecoders                map[string]func(string) (string, error)
+	defaultProjection            []string
+	snapshotField                string
+	snapshotMaxAge               time.Duration
+	warnOnCollscan               bool
+	mostRestrictiveOperators     bool
+	fixedCollectionName          string
+	projectStructFields          bool
+	projectFilteredOnly          bool
+	forbidEmptyFilter            bool
+	allowBaseFilterOnly          bool
+	partitionField               string
+	partitionLayout              string
+	partitionCollection          func(time.Time) string
+	maxPartitions                int
+	explain                      func(*mgo.Query) (bson.M, error)
+	valueTokens                  map[string]map[string]func(*http.Request) (interface{}, error)
+	tokenLocation                *time.Location
+	exclusionPresets             map[string][]string
+	tenantField                  string
+	tenantExtractor              func(context.Context) (interface{}, error)
 }
 
-// NewMongoQuery returns a new MongoQuery.
+// NewMongoQuery returns a new MongoQuery. It panics if database is nil, which usually means
+// that the session setup failed.
 func NewMongoQuery(endPointStruct interface{}, database *mgo.Database) *MongoQuery {
+	if database == nil {
+		panic(errNilDatabase)
+	}
 	return &MongoQuery{
 		dataBase:                     database,
 		supportedParameters:          createValidParametersMap(endPointStruct),
+		fieldTree:                    createFieldTree(reflect.TypeOf(endPointStruct)),
 		disabledParameters:           []string{},
 		additionalSupportedParamters: make(map[string]reflect.Kind),
+		aliases:                      make(map[string]string),
+		now:                          time.Now,
+		floatTolerances:              make(map[string]float64),
+		exclusionPresets:             make(map[string][]string),
+		sortConversions:              make(map[string]Conversion),
+		missingSortLast:              make(map[string]bool),
+		sortDirections:               make(map[string]SortDirection),
+		arrayModes:                   make(map[string]ArrayMode),
+		literalFields:                make(map[string]bool),
+		valueDecoders:                make(map[string]func(string) (string, error)),
+		maxPathDepth:                 DefaultMaxPathDepth,
+		maxPartitions:                DefaultMaxPartitions,
+		matchMode:                    MatchModeRegex,
+		explain:                      explainQuery,
+		find:                         findQuery,
+		count:                        (*mgo.Query).Count,
+		all:                          (*mgo.Query).All,
+		one:                          (*mgo.Query).One,
+		versionAtLeast:               sessionVersionAtLeast,
+		subqueries:                   newSemaphore(DefaultMaxConcurrentSubqueries),
+		valueTokens:                  make(map[string]map[string]func(*http.Request) (interface{}, error)),
 		endPointStruct:               endPointStruct,
 		page:                         Page{Size: DefaultPageSize, Current: 1},
 	}
 }
 
+// NewMongoQueryForCollection returns a new MongoQuery for the collection with the given name.
+// The parameters and the decoded documents are defined by endPointStruct like with NewMongoQuery,
+// so different endpoints can share a collection:
+//     public := mqb.NewMongoQueryForCollection(PersonPublic{}, db, "people")
+//     public.SetProjectStructFields(true)
+//     admin := mqb.NewMongoQueryForCollection(Person{}, db, "people")
+func NewMongoQueryForCollection(endPointStruct interface{}, database *mgo.Database, collection string) *MongoQuery {
+	mq := NewMongoQuery(endPointStruct, database)
+	mq.SetCollectionName(collection)
+	return mq
+}
+
 // CreateQuery creates a mgo.Query from a HTTP Request for a collection represented by endpointStruct.
 //
 // Examples:
@@ -64,87 +275,474 @@ func NewMongoQuery(endPointStruct interface{}, database *mgo.Database) *MongoQue
 //     q, _ := mq.CreateQuery(req) // creates a query from the request for the people collection with the parameters "name" and "sort" disabled.
 //
 func (mq *MongoQuery) CreateQuery(req *http.Request) (*mgo.Query, error) {
-	filterMap, err := mq.createQueryFilter(req)
+	return mq.CreateQueryWithContext(req.Context(), req)
+}
+
+// CreateQueryWithContext creates a mgo.Query like CreateQuery. If a tenant is configured with
+// SetTenant, the tenant is extracted from ctx and added to the filter.
+func (mq *MongoQuery) CreateQueryWithContext(ctx context.Context, req *http.Request) (*mgo.Query, error) {
+	q, _, err := mq.createQuery(ctx, req)
+	return q, err
+}
+
+// CreateQueryWithFilter creates a mgo.Query like CreateQuery and additionally returns the filter
+// that was used to create it, for example to log or hash it.
+func (mq *MongoQuery) CreateQueryWithFilter(req *http.Request) (*mgo.Query, bson.M, error) {
+	q, filterMap, err := mq.createQuery(req.Context(), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return q, bson.M(filterMap), nil
+}
+
+// createQuery creates the mgo.Query and returns it together with the filter map it was created from.
+func (mq *MongoQuery) createQuery(ctx context.Context, req *http.Request) (*mgo.Query, map[string]interface{}, error) {
+	spec, err := mq.ParseSpec(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mq.specQuery(spec), spec.Filter, nil
+}
+
+// collection returns the collection represented by the endpoint struct.
+func (mq *MongoQuery) collection() *mgo.Collection {
+	return mq.dataBase.C(mq.collectionName())
+}
+
+// Ping checks the connection to the database by sending a ping with the session of the
+// database, for example for readiness probes:
+//     http.HandleFunc("/ready", func(w http.ResponseWriter, req *http.Request) {
+//         if err := mq.Ping(req.Context()); err != nil {
+//             mqb.WriteError(w, err)
+//         }
+//     })
+// It returns an error with http.StatusServiceUnavailable if the ping fails or ctx is done
+// before the ping returns.
+func (mq *MongoQuery) Ping(ctx context.Context) error {
+	if mq.dataBase.Session == nil {
+		return merry.Wrap(errNoSession).WithHTTPCode(http.StatusServiceUnavailable)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- mq.dataBase.Session.Ping()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return merry.Prepend(err, "could not ping database").WithHTTPCode(http.StatusServiceUnavailable)
+		}
+		return nil
+	case <-ctx.Done():
+		return merry.Prepend(ctx.Err(), "could not ping database").WithHTTPCode(http.StatusServiceUnavailable)
+	}
+}
+
+// collectionName returns the name of the collection represented by the endpoint struct.
+func (mq *MongoQuery) collectionName() string {
+	if len(mq.fixedCollectionName) > 0 {
+		return mq.fixedCollectionName
+	}
+	name := structName(mq.endPointStruct)
+	if mq.collectionNameFunc != nil {
+		return mq.collectionNameFunc(name)
+	}
+	return name
+}
+
+// SetCollectionName sets the name of the collection, which is derived from the name of the
+// endpoint struct per default. It takes precedence over SetCollectionNameFunc.
+func (mq *MongoQuery) SetCollectionName(name string) {
+	mq.fixedCollectionName = name
+}
+
+// SetProjectStructFields defines if the projection of a query is restricted to the fields of
+// the endpoint struct, so that the fields of a shared collection that are not part of the
+// endpoint struct never leave the database. Requests without field parameter select all
+// fields of the struct and exclusion presets exclude fields from them. Fields of sub
+// documents are projected by their dotted path.
+func (mq *MongoQuery) SetProjectStructFields(project bool) {
+	mq.projectStructFields = project
+}
+
+// restrictToStructFields returns the projection fields restricted to the fields of the
+// endpoint struct. An inclusion projection is already restricted to supported parameters.
+func (mq *MongoQuery) restrictToStructFields(fields map[string]interface{}) map[string]interface{} {
+	if len(fields) > 0 && !isExclusion(fields) {
+		return fields
+	}
+	restricted := map[string]interface{}{}
+	for _, path := range structFieldPaths(reflect.TypeOf(mq.endPointStruct), "") {
+		excluded := false
+		for k := range fields {
+			if path == k || strings.HasPrefix(path, k+".") {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			restricted[path] = 1
+		}
+	}
+	if len(restricted) == 0 {
+		// an empty projection selects all fields
+		restricted["_id"] = 1
+	}
+	return restricted
+}
+
+// SetCollectionNameFunc sets a function that transforms the lower case name of the endpoint
+// struct to the collection name, for example to pluralize it:
+//     mq.SetCollectionNameFunc(func(name string) string { return name + "s" })
+//     q, _ := mq.CreateQuery(req) // creates a query for the persons collection
+func (mq *MongoQuery) SetCollectionNameFunc(f func(structName string) string) {
+	mq.collectionNameFunc = f
+}
+
+// Run runs the query on the database and returns a *Response.
+func (mq *MongoQuery) Run(req *http.Request) (*Response, error) {
+	spec, err := mq.ParseSpec(req.Context(), req)
 	if err != nil {
 		return nil, err
 	}
-	q := mq.dataBase.C(structName(mq.endPointStruct)).Find(filterMap)
+	return mq.RunSpec(req.Context(), spec)
+}
 
-	selectFields, err := mq.createFieldsMap(req)
+// RunOne returns the document with the given id. The id is converted to an ObjectId if it is a
+// valid ObjectId hex string. Only the field parameter of req is used to select the fields, it is
+// authorized and restricted like in ParseSpec, and if a tenant is configured with SetTenant,
+// only the documents of the tenant are found. An error with http.StatusNotFound is returned if
+// there is no such document.
+func (mq *MongoQuery) RunOne(req *http.Request, id string) (interface{}, error) {
+	fields, err := mq.oneFields(req)
 	if err != nil {
 		return nil, err
 	}
-	q.Select(selectFields)
+	filter := map[string]interface{}{"_id": id}
+	if bson.IsObjectIdHex(id) {
+		filter["_id"] = bson.ObjectIdHex(id)
+	}
+	if err := mq.addTenantFilter(req.Context(), filter); err != nil {
+		return nil, err
+	}
+	if err := mq.acquireQuerySlot(req.Context()); err != nil {
+		return nil, err
+	}
+	defer mq.releaseQuerySlot()
+	q := mq.specQuery(&QuerySpec{Filter: filter, Fields: fields, Page: Page{Current: 1}})
+	doc := reflect.New(reflect.TypeOf(mq.endPointStruct))
+	if err := mq.one(q, doc.Interface()); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, merry.Wrap(fmt.Errorf("document '%s' not found", id)).WithHTTPCode(http.StatusNotFound)
+		}
+		return nil, merry.Prepend(err, "could not execute q.One()").WithHTTPCode(http.StatusInternalServerError)
+	}
+	return doc.Interface(), nil
+}
 
-	sortFields, err := mq.createSortFields(req)
+// oneFields returns the projection of the field parameter of req for RunOne. The other
+// parameters of req are ignored.
+func (mq *MongoQuery) oneFields(req *http.Request) (map[string]interface{}, error) {
+	req, err := formRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	u := *req.URL
+	u.RawQuery = url.Values{"field": req.URL.Query()["field"]}.Encode()
+	r := *req
+	r.URL = &u
+	errs := &errorCollector{failFast: mq.failFast}
+	if mq.authorizeParameters(&r, errs) {
+		return nil, errs.err()
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	fields, err := mq.createFieldsMap(&r)
 	if err != nil {
 		return nil, err
 	}
-	q.Sort(sortFields...)
+	if mq.projectStructFields {
+		fields = mq.restrictToStructFields(fields)
+	}
+	return fields, nil
+}
 
-	size, ok, err := getUint(req, "limit")
+// Count returns the number of documents matching the filter of req.
+func (mq *MongoQuery) Count(req *http.Request) (int, error) {
+	spec, err := mq.ParseSpec(req.Context(), req)
 	if err != nil {
-		return nil, merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
+		return 0, err
 	}
-	if ok {
-		mq.page.Size = size
+	if err := mq.acquireQuerySlot(req.Context()); err != nil {
+		return 0, err
 	}
-	current, ok, err := getUint(req, "page")
+	defer mq.releaseQuerySlot()
+	n, err := mq.countItems(spec.Filter, mq.collection().Find(spec.Filter))
 	if err != nil {
-		return nil, merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
+		return 0, err
 	}
-	if ok {
-		mq.page.Current = current
+	return int(n), nil
+}
+
+// SetCountProvider sets a function that returns the total number of items matching a filter,
+// for example from a collection with precomputed counts, because counting is expensive for
+// large collections. If it returns false, the items are counted by the database as usual:
+//     mq.SetCountProvider(func(filter bson.M) (uint, bool, error) {
+//         if len(filter) > 0 {
+//             return 0, false, nil
+//         }
+//         return cachedTotal(), true, nil
+//     })
+// It is used by Run and Count.
+func (mq *MongoQuery) SetCountProvider(provider func(filter bson.M) (uint, bool, error)) {
+	mq.countProvider = provider
+}
+
+// countItems returns the number of items matching filter from the count provider, or by
+// counting the documents of q if there is no provider or it has no count for filter.
+func (mq *MongoQuery) countItems(filter bson.M, q *mgo.Query) (uint, error) {
+	if mq.countProvider != nil {
+		n, ok, err := mq.countProvider(filter)
+		if err != nil {
+			return 0, merry.Prepend(err, "could not get count from provider").WithHTTPCode(http.StatusInternalServerError)
+		}
+		if ok {
+			return n, nil
+		}
 	}
-	if mq.page.Current == 0 {
-		return nil, merry.Wrap(errors.New("page cannot be 0")).WithHTTPCode(http.StatusBadRequest)
+	if mq.legacyExpr(filter) {
+		return mq.countPipeline(filter)
 	}
-	if mq.page.Size > 0 {
-		q = q.Limit(int(mq.page.Size))
+	n, err := mq.count(q)
+	if err != nil {
+		return 0, merry.Prepend(err, "could not create count query").WithHTTPCode(http.StatusInternalServerError)
 	}
-	q = q.Skip(int((mq.page.Current - 1) * mq.page.Size))
-	return q, nil
+	return uint(n), nil
 }
 
-// Run runs the query on the database and returns a *Response.
-func (mq *MongoQuery) Run(req *http.Request) (*Response, error) {
-	q, err := mq.CreateQuery(req)
+// RunPreservingInOrder runs the query like Run, but returns the documents in the order of the
+// values of the parameter field in req:
+//     r, _ := mq.RunPreservingInOrder(req, "id") // /?id=c&id=a&id=b returns c, a and b in that order
+// Unlike SetPreserveOrder it does not depend on the preserveorder parameter. It cannot be
+// combined with the sort parameter.
+func (mq *MongoQuery) RunPreservingInOrder(req *http.Request, field string) (*Response, error) {
+	field = mq.resolveAlias(field)
+	if _, ok := mq.supportedParameters[field]; !ok {
+		return nil, merry.Wrap(fmt.Errorf("parameter '%s' is not supported", field)).WithHTTPCode(http.StatusBadRequest)
+	}
+	spec, err := mq.ParseSpec(req.Context(), req)
 	if err != nil {
 		return nil, err
 	}
-
-	// copy query and reset limit and skip values to count total items
-	// that would be returned for a query
-	countQuery := &mgo.Query{}
-	*countQuery = *q
-	countQuery.Limit(0)
-	countQuery.Skip(0)
-	items, err := countQuery.Count()
+	// the parameters of form bodies are only in the request of spec
+	values, ok, err := orderValues(spec.req, spec.Filter, field, true)
 	if err != nil {
-		return nil, merry.New("could not create count query").Append(err.Error()).WithHTTPCode(http.StatusInternalServerError)
+		return nil, err
+	}
+	if ok {
+		spec.orderValues = values
+		spec.preserveOrder = true
+		spec.orderParameter = field
+	}
+	return mq.RunSpec(req.Context(), spec)
+}
+
+// SetMaxConcurrentQueries limits the number of queries executed concurrently by Run and RunSpec
+// to n. If the limit is reached, further queries are rejected with 503 unless queueing is
+// enabled with SetQueueQueries. A value of 0 disables the limit. It must not be called while
+// queries are running.
+func (mq *MongoQuery) SetMaxConcurrentQueries(n int) {
+	if n <= 0 {
+		mq.querySlots = nil
+		return
+	}
+	mq.querySlots = make(chan struct{}, n)
+}
+
+// SetQueueQueries defines what happens to queries that exceed the limit set with
+// SetMaxConcurrentQueries. If queue is true, they wait for a running query to finish or until
+// their context is done, otherwise they are rejected immediately.
+func (mq *MongoQuery) SetQueueQueries(queue bool) {
+	mq.queueQueries = queue
+}
+
+// acquireQuerySlot reserves a slot for a query. It returns an error with status 503 if no slot
+// is available.
+func (mq *MongoQuery) acquireQuerySlot(ctx context.Context) error {
+	if mq.querySlots == nil {
+		return nil
+	}
+	if mq.queueQueries {
+		select {
+		case mq.querySlots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return merry.Wrap(fmt.Errorf("too many concurrent queries: %s", ctx.Err())).WithHTTPCode(http.StatusServiceUnavailable)
+		}
+	}
+	select {
+	case mq.querySlots <- struct{}{}:
+		return nil
+	default:
+		return merry.Wrap(errors.New("too many concurrent queries")).WithHTTPCode(http.StatusServiceUnavailable)
+	}
+}
+
+// releaseQuerySlot releases a slot reserved with acquireQuerySlot.
+func (mq *MongoQuery) releaseQuerySlot() {
+	if mq.querySlots != nil {
+		<-mq.querySlots
+	}
+}
+
+// RunSpec runs the query described by spec on the database and returns a *Response.
+func (mq *MongoQuery) RunSpec(ctx context.Context, spec *QuerySpec) (*Response, error) {
+	return mq.runSpec(ctx, spec, reflect.TypeOf(mq.endPointStruct))
+}
+
+// runSpec runs the query described by spec and returns the documents as slice of docType.
+func (mq *MongoQuery) runSpec(ctx context.Context, spec *QuerySpec, docType reflect.Type) (response *Response, err error) {
+	info := QueryInfo{Collection: mq.collectionName(), Stats: spec.stats}
+	if mq.queryHook != nil {
+		defer func() {
+			info.Filter = spec.Filter
+			info.Err = err
+			mq.queryHook(spec.req, info)
+		}()
+	}
+	if spec.Page.Current == 0 {
+		return nil, merry.Wrap(errors.New("page must be greater than 0, pages start at 1")).WithHTTPCode(http.StatusBadRequest)
+	}
+	if err := mq.acquireQuerySlot(ctx); err != nil {
+		return nil, err
+	}
+	defer mq.releaseQuerySlot()
+	batches := mq.inBatches(spec)
+	if batches != nil {
+		if spec.cursor {
+			return nil, merry.Wrap(fmt.Errorf("cursors are not supported with more than %d values of parameter '%s'", mq.batchSize, mq.batchParameter)).WithHTTPCode(http.StatusBadRequest)
+		}
+		if mq.specPipeline(spec) != nil {
+			return nil, merry.Wrap(errors.New("batches cannot be combined with aggregation pipelines")).WithHTTPCode(http.StatusInternalServerError)
+		}
+	}
+	// the driver cannot pass a hint to an aggregation pipeline
+	if len(spec.hint) > 0 && mq.specPipeline(spec) != nil {
+		return nil, withCode(merry.Wrap(errors.New("hint cannot be combined with a query that is run as aggregation pipeline")).WithHTTPCode(http.StatusBadRequest), CodeConflict)
+	}
+	syncedAt := mq.syncedAt()
+	if len(mq.snapshotField) > 0 && len(spec.Page.Snapshot) == 0 {
+		// the first page is restricted to the snapshot too, documents inserted
+		// in the meantime would be missing on the following pages otherwise
+		if err := mq.addNewSnapshot(spec); err != nil {
+			return nil, merry.Prepend(err, "could not create snapshot").WithHTTPCode(http.StatusInternalServerError)
+		}
+	}
+	q := mq.specQuery(spec)
+	if limit := mq.resultLimit(spec.Page.Size); limit > 0 {
+		q.Limit(limit)
+	}
+
+	sliceType := reflect.SliceOf(docType)
+	var items uint
+	var content interface{}
+	var duration time.Duration
+	if batches != nil {
+		// the batches are counted and merged instead of q
+		queries := []*mgo.Query{}
+		for _, batch := range mq.batchSpecs(spec, batches) {
+			queries = append(queries, mq.specQuery(batch))
+		}
+		start := time.Now()
+		n, page, err := mq.mergeQueries(ctx, spec, sliceType, queries)
+		duration = time.Since(start)
+		if err != nil {
+			return nil, err
+		}
+		items = uint(n)
+		merged := reflect.New(sliceType)
+		merged.Elem().Set(page)
+		content = merged.Interface()
+	} else {
+		// the total items that would be returned for the query are counted
+		// without limit and skip
+		unpaged := *spec
+		unpaged.Page = Page{Current: 1}
+		n, err := mq.countItems(spec.Filter, mq.specQuery(&unpaged))
+		if err != nil {
+			return nil, err
+		}
+		items = n
 	}
 
-	response := &Response{
-		Page: mq.page,
+	response = &Response{
+		Page:     spec.Page,
+		SyncedAt: syncedAt,
+	}
+	if mq.echoDefaults {
+		applied := spec.applied
+		response.Applied = &applied
 	}
-	response.Page.Items = uint(items)
+	response.Page.Items = items
 	response.Page.calculateLastPage()
+	if err := mq.setSelectivity(ctx, response); err != nil {
+		return nil, err
+	}
 
-	// create a pointer to an empty slice with same type as enpointStruct to store the
-	// result of the query
-	slice := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(mq.endPointStruct)), 0, 0)
-	content := reflect.New(slice.Type()).Interface()
-	err = q.All(content)
-	if err != nil {
-		return nil, merry.New("could not execute q.All()").Append(err.Error()).WithHTTPCode(http.StatusInternalServerError)
+	if content == nil {
+		// create a pointer to an empty slice of docType to store the result of the query
+		content = reflect.New(sliceType).Interface()
+		start := time.Now()
+		var err error
+		if pipeline := mq.specPipeline(spec); pipeline != nil {
+			err = mq.collection().Pipe(pipeline).All(content)
+		} else {
+			err = mq.all(q, content)
+		}
+		duration = time.Since(start)
+		if err != nil {
+			return nil, merry.Prepend(err, "could not execute q.All()").WithHTTPCode(http.StatusInternalServerError)
+		}
+	}
+	truncated := mq.maxResultDocuments > 0 && truncate(content, mq.maxResultDocuments)
+	if spec.reverse {
+		reverse(content)
+	}
+	if spec.preserveOrder {
+		orderByValues(content, spec.orderParameter, spec.orderValues)
+	}
+	if err := mq.setCursors(response, spec, content); err != nil {
+		return nil, merry.Wrap(err).WithHTTPCode(http.StatusInternalServerError)
+	}
+	if mq.pageBoundaries {
+		setBoundaries(&response.Page, spec.Sort, content)
 	}
 	// to prevent the content being null
 	s := reflect.ValueOf(content)
 	if s.Elem().Len() > 0 {
 		response.Content = content
 	} else {
-		response.Content = []interface{}{}
+		response.Content = mq.emptyContent()
 	}
+	approxBytes := 0
+	if mq.sizeBudget > 0 {
+		approxBytes = approxSize(content)
+	}
+	warnings := mq.budgetWarnings(duration, approxBytes)
+	if truncated {
+		warnings = append(warnings, WarningResultTruncated)
+	}
+	if mq.scansCollection(q) {
+		warnings = append(warnings, WarningCollectionScan)
+	}
+	if len(warnings) > 0 {
+		response.Warnings = warnings
+	}
+	info.Duration = duration
+	info.Items = response.Page.Items
+	info.Page = response.Page
+	info.ApproxBytes = approxBytes
+	info.Warnings = response.Warnings
 	return response, nil
 }
 
@@ -170,108 +768,1349 @@ func (mq *MongoQuery) AddOrOverwriteValidParameter(name string, value reflect.Ki
 	}
 }
 
-func (mq *MongoQuery) createQueryFilter(req *http.Request) (map[string]interface{}, error) {
-	filter := make(map[string]interface{})
+// AddParameter adds a valid parameter with name and reflect.Kind like AddOrOverwriteValidParameter,
+// but returns an error if name is a dotted path with more segments than the maximum path depth.
+// A field whose name contains a dot that does not separate a path, like the legacy field
+// config.v2, is added with escaped dots:
+//     mq.AddParameter(`config\.v2`, reflect.String)
+//     /?config.v2=on  {"$expr": {"$regexMatch": {"input": {"$getField": "config.v2"}, "regex": "on", "options": ""}}}
+// Clients use the name without escapes. All dots of such a name have to be escaped. MongoDB
+// reads the keys of filters, projections and sorts as paths, so the field is filtered with
+// $getField and selected with an aggregation pipeline, which requires MongoDB 5.0. Requests
+// that sort by the field are rejected with 400. The filters of the field do not match array
+// elements and cannot use indexes.
+func (mq *MongoQuery) AddParameter(name string, kind reflect.Kind) error {
+	if strings.Contains(name, `\.`) {
+		literal := strings.Replace(name, `\.`, ".", -1)
+		if strings.Count(name, ".") != strings.Count(name, `\.`) {
+			return fmt.Errorf("parameter '%s' mixes escaped and unescaped dots", name)
+		}
+		mq.literalFields[literal] = true
+		mq.AddOrOverwriteValidParameter(literal, kind)
+		return nil
+	}
+	if err := mq.checkPathDepth(name); err != nil {
+		return err
+	}
+	mq.AddOrOverwriteValidParameter(name, kind)
+	return nil
+}
 
-	for parameterName, parameterValues := range req.URL.Query() {
-		s := []interface{}{}
-		if kind, ok := mq.supportedParameters[parameterName]; ok {
-			// meta parameters are not filters
-			if _, ok := validMetaParameters[parameterName]; ok {
-				continue
-			}
-			switch kind {
-			case reflect.Bool:
-				for _, v := range parameterValues {
-					b, err := strconv.ParseBool(v)
-					if err != nil {
-						return nil, merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
-					}
-					s = append(s, b)
-				}
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				for _, v := range parameterValues {
-					i, err := strconv.Atoi(v)
-					if err != nil {
-						return nil, merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
-					}
-					s = append(s, i)
-				}
-			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-				for _, v := range parameterValues {
-					i, err := strconv.ParseUint(v, 10, 0)
-					if err != nil {
-						return nil, merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
-					}
-					s = append(s, uint(i))
-				}
-			case reflect.Float32, reflect.Float64:
-				for _, v := range parameterValues {
-					f, err := strconv.ParseFloat(v, 64)
-					if err != nil {
-						return nil, merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
-					}
-					s = append(s, f)
-				}
-			case reflect.String:
-				if len(parameterValues) == 1 {
-					if bson.IsObjectIdHex(parameterValues[0]) {
-						s = []interface{}{bson.ObjectIdHex(parameterValues[0])}
-					} else {
-						s = []interface{}{bson.RegEx{Pattern: parameterValues[0], Options: ""}}
-					}
-				} else {
-					for _, v := range parameterValues {
-						if bson.IsObjectIdHex(v) {
-							s = append(s, bson.ObjectIdHex(v))
-						} else {
-							s = append(s, v)
-						}
-					}
-				}
-			default:
-				return nil, merry.Wrap(fmt.Errorf("reflection kind '%s' is not supported", kind)).WithHTTPCode(http.StatusBadRequest)
-			}
-		} else {
-			return nil, merry.Wrap(fmt.Errorf("parameter '%s' is not supported", parameterName)).WithHTTPCode(http.StatusBadRequest)
+// SetMaxPathDepth sets the maximum number of segments of a dotted parameter like
+// address.city. Deeper paths in filters, sorts and fields are rejected with 400. A value of 0
+// disables the check.
+func (mq *MongoQuery) SetMaxPathDepth(n int) {
+	mq.maxPathDepth = n
+}
+
+// checkPathDepth returns an error if the parameter name has more segments than the maximum path depth.
+func (mq *MongoQuery) checkPathDepth(name string) error {
+	if mq.literalFields[name] {
+		return nil
+	}
+	if mq.maxPathDepth > 0 && strings.Count(name, ".")+1 > mq.maxPathDepth {
+		return merry.Wrap(fmt.Errorf("parameter '%s' exceeds the maximum path depth of %d", name, mq.maxPathDepth)).WithHTTPCode(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// AddAlias adds an alias for the parameter name. An alias can be used instead of the
+// parameter in filters, fields and sorts:
+//     mq.AddAlias("userId", "userid")
+//     q, _ := mq.CreateQuery(req) // /?userId=1&field=userId&sort=-userId filters, selects and sorts by userid
+func (mq *MongoQuery) AddAlias(alias, name string) {
+	mq.aliases[alias] = name
+}
+
+// AddAliases adds multiple aliases for the parameter name, for example to support the
+// parameter names of several API versions at the same time:
+//     mq.AddAliases("firstname", "fname", "firstName")
+func (mq *MongoQuery) AddAliases(name string, aliases ...string) {
+	for _, alias := range aliases {
+		mq.AddAlias(alias, name)
+	}
+}
+
+// resolveAlias returns the parameter name the alias name stands for, including an operator
+// suffix. If name is not an alias, it is returned unchanged.
+func (mq *MongoQuery) resolveAlias(name string) string {
+	if parameter, ok := mq.aliases[name]; ok {
+		return parameter
+	}
+	if base, operator := splitOperator(name); len(operator) > 0 {
+		if parameter, ok := mq.aliases[base]; ok {
+			return parameter + operatorSeparator + operator
 		}
-		if len(s) == 1 {
-			filter[parameterName] = s[0]
-		} else {
-			filter[parameterName] = map[string]interface{}{
-				"$in": s,
-			}
+	}
+	return name
+}
+
+// SetAutoNumericBase enables or disables the detection of the base of integer values
+// from their prefix: 0x1f and 0o17 are parsed as hexadecimal and octal numbers. Note
+// that a leading 0 also denotes an octal number if enabled. Per default all integers
+// are parsed with base 10.
+func (mq *MongoQuery) SetAutoNumericBase(auto bool) {
+	mq.autoNumericBase = auto
+}
+
+// SetEscapeRegex enables or disables escaping of regex metacharacters in string filters, so
+// that a value like C++ matches literally.
+func (mq *MongoQuery) SetEscapeRegex(escape bool) {
+	mq.escapeRegex = escape
+}
+
+// SetCommaSeparatedValues enables comma separated values for the given parameters:
+// /?name=peter,paul is treated like /?name=peter&name=paul. Only unencoded commas
+// separate values, an encoded comma (%2C) remains part of the value.
+func (mq *MongoQuery) SetCommaSeparatedValues(parameters ...string) {
+	for _, p := range parameters {
+		if !contains(mq.commaSeparatedParameters, p) {
+			mq.commaSeparatedParameters = append(mq.commaSeparatedParameters, p)
 		}
 	}
-	return filter, nil
 }
 
-func (mq *MongoQuery) createFieldsMap(req *http.Request) (map[string]interface{}, error) {
-	fields := make(map[string]interface{})
-	if _field, ok := req.URL.Query()["field"]; ok {
-		for _, v := range _field {
-			if _, ok2 := mq.supportedParameters[v]; !ok2 {
-				return nil, merry.Wrap(fmt.Errorf("unsupported field value: %s", v)).WithHTTPCode(http.StatusBadRequest)
-			}
-			fields[v] = 1
+// SetBooleanStringFields sets string fields that hold booleans as strings. Their values true and
+// false match the strings exactly instead of being used as regular expression:
+//     mq.SetBooleanStringFields("isactive")
+//     /?isactive=true  {"isactive": "true"}
+// Other values are matched like those of other string fields.
+func (mq *MongoQuery) SetBooleanStringFields(fields ...string) {
+	for _, f := range fields {
+		if !contains(mq.booleanStringFields, f) {
+			mq.booleanStringFields = append(mq.booleanStringFields, f)
 		}
 	}
-	return fields, nil
 }
 
-func (mq *MongoQuery) createSortFields(req *http.Request) ([]string, error) {
-	sortFields := []string{}
-	if _sortField, ok := req.URL.Query()["sort"]; ok {
-		for _, v := range _sortField {
-			if _, ok := mq.supportedParameters[strings.Trim(v, "-")]; !ok {
-				return nil, merry.Wrap(fmt.Errorf("unsupported field value: %s", v)).WithHTTPCode(http.StatusBadRequest)
-			}
-			sortFields = append(sortFields, v)
+// isBooleanString returns true if name is a boolean string field and all values are true or false.
+func (mq *MongoQuery) isBooleanString(name string, values []string) bool {
+	if len(values) == 0 || !contains(mq.booleanStringFields, name) {
+		return false
+	}
+	for _, v := range values {
+		if v != "true" && v != "false" {
+			return false
 		}
 	}
-	return sortFields, nil
+	return true
 }
 
-func (p *Page) calculateLastPage() {
+// ArrayMode defines how multiple values of an array parameter are matched, see SetArrayMultiValueMode.
+type ArrayMode string
+
+// modes of array parameters
+const (
+	ArrayModeIn           ArrayMode = "$in"  // ArrayModeIn matches arrays containing any of the values (default).
+	ArrayModeAll          ArrayMode = "$all" // ArrayModeAll matches arrays containing all values.
+	ArrayModeAndElemMatch ArrayMode = "$and" // ArrayModeAndElemMatch matches arrays containing all values, with an $elemMatch per value.
+)
+
+// SetArrayMultiValueMode sets how multiple values of the array parameter field are matched:
+//     /?tags=red&tags=blue  (or /?tags=red,blue, see SetCommaSeparatedValues)
+//     ArrayModeIn            {"tags": {"$in": ["red", "blue"]}}
+//     ArrayModeAll           {"tags": {"$all": ["red", "blue"]}}
+//     ArrayModeAndElemMatch  {"$and": [{"tags": {"$elemMatch": {"$eq": "red"}}}, {"tags": {"$elemMatch": {"$eq": "blue"}}}]}
+// An error is returned if field is not an array.
+func (mq *MongoQuery) SetArrayMultiValueMode(field string, mode ArrayMode) error {
+	field = mq.resolveAlias(field)
+	if !mq.isArrayParameter(field) {
+		return fmt.Errorf("parameter '%s' is not an array", field)
+	}
+	switch mode {
+	case ArrayModeIn, ArrayModeAll, ArrayModeAndElemMatch:
+	default:
+		return fmt.Errorf("invalid array mode: %s", mode)
+	}
+	mq.arrayModes[field] = mode
+	return nil
+}
+
+// SetFloatTolerance sets the tolerance for equality filters of the float parameter name, so that
+// /?price=19.99 matches all values between 19.99-tolerance and 19.99+tolerance. Multiple values
+// match any of the ranges. A tolerance of 0 restores plain equality. An error is returned if
+// name is not a float parameter.
+func (mq *MongoQuery) SetFloatTolerance(name string, tolerance float64) error {
+	if kind := mq.supportedParameters[name]; kind != reflect.Float32 && kind != reflect.Float64 {
+		return fmt.Errorf("parameter '%s' is not a float parameter", name)
+	}
+	if tolerance < 0 {
+		return fmt.Errorf("invalid tolerance %v for parameter '%s'", tolerance, name)
+	}
+	if tolerance == 0 {
+		delete(mq.floatTolerances, name)
+		return nil
+	}
+	mq.floatTolerances[name] = tolerance
+	return nil
+}
+
+// SetDefaultProjection sets the fields that are selected if a request contains no field
+// parameter. The field parameter overrides the default and /?field=* selects all fields:
+//     mq.SetDefaultProjection("name", "age")
+//     q, _ := mq.CreateQuery(req) // / selects name and age, /?field=* selects all fields
+func (mq *MongoQuery) SetDefaultProjection(fields ...string) error {
+	projection := []string{}
+	for _, f := range fields {
+		f = mq.resolveAlias(f)
+		if !mq.isProjectableField(f) {
+			return fmt.Errorf("unsupported field: %s", f)
+		}
+		projection = append(projection, f)
+	}
+	mq.defaultProjection = projection
+	return nil
+}
+
+// SetProjectFilteredOnly defines if requests without field parameter select only the fields
+// that are filtered or sorted:
+//     /?name=peter&sort=age selects {"name": 1, "age": 1}
+// Requests without filter and sort select the default projection, see SetDefaultProjection.
+func (mq *MongoQuery) SetProjectFilteredOnly(filteredOnly bool) {
+	mq.projectFilteredOnly = filteredOnly
+}
+
+// filteredFields returns the supported fields that are filtered or sorted by req.
+func (mq *MongoQuery) filteredFields(req *http.Request) []string {
+	fields := []string{}
+	add := func(name string) {
+		_, ok := mq.supportedParameters[name]
+		if _, isMeta := validMetaParameters[name]; ok && !isMeta && !contains(fields, name) {
+			fields = append(fields, name)
+		}
+	}
+	for k := range req.URL.Query() {
+		name, _ := splitOperator(mq.resolveAlias(k))
+		add(mq.resolveAlias(name))
+	}
+	for _, v := range req.URL.Query()["sort"] {
+		add(mq.resolveAlias(sortFieldName(v)))
+	}
+	return fields
+}
+
+// AddExclusionPreset adds a value for the field parameter that selects all fields except the
+// given ones:
+//     mq.AddExclusionPreset("lite", "content", "attachments")
+//     q, _ := mq.CreateQuery(req) // /?field=lite returns the documents without content and attachments
+// An exclusion preset cannot be combined with other values of the field parameter.
+func (mq *MongoQuery) AddExclusionPreset(name string, fields ...string) error {
+	if _, ok := mq.supportedParameters[name]; ok {
+		return fmt.Errorf("exclusion preset '%s' conflicts with a parameter", name)
+	}
+	excluded := []string{}
+	for _, f := range fields {
+		f = mq.resolveAlias(f)
+		if !mq.isProjectableField(f) {
+			return fmt.Errorf("unsupported field: %s", f)
+		}
+		excluded = append(excluded, f)
+	}
+	mq.exclusionPresets[name] = excluded
+	return nil
+}
+
+// SetMaxProjectionFields sets the maximum number of fields a client can select with the
+// field parameter. A value of 0 disables the limit.
+func (mq *MongoQuery) SetMaxProjectionFields(n int) {
+	mq.maxProjectionFields = n
+}
+
+// SetTenant sets the field that holds the tenant of a document and the function that extracts
+// the tenant from the context. All queries are then restricted to the documents of the
+// extracted tenant and requests that filter the tenant field are rejected.
+func (mq *MongoQuery) SetTenant(field string, extractor func(ctx context.Context) (interface{}, error)) {
+	mq.tenantField = field
+	mq.tenantExtractor = extractor
+}
+
+// addTenantFilter adds the tenant extracted from ctx to filter.
+func (mq *MongoQuery) addTenantFilter(ctx context.Context, filter map[string]interface{}) error {
+	if mq.tenantExtractor == nil {
+		return nil
+	}
+	if _, ok := filter[mq.tenantField]; ok {
+		return merry.Wrap(fmt.Errorf("parameter '%s' is not supported", mq.tenantField)).WithHTTPCode(http.StatusBadRequest)
+	}
+	tenant, err := mq.tenantExtractor(ctx)
+	if err != nil {
+		return merry.Wrap(err).WithHTTPCode(http.StatusForbidden)
+	}
+	filter[mq.tenantField] = tenant
+	return nil
+}
+
+// EchoDefaults enables or disables the Applied field of the Response returned by Run, which
+// lists the defaults applied to the request like the page size or the tenant filter.
+func (mq *MongoQuery) EchoDefaults(echo bool) {
+	mq.echoDefaults = echo
+}
+
+// SetParameterAuthorizer sets a function that decides if the caller of req is allowed to use
+// parameter to filter, sort or select. It is called once for every parameter in the request
+// except the meta parameters, with the parameter name the aliases resolve to. If it returns an
+// error, the request is rejected with 403, unless the error has another HTTP code:
+//     mq.SetParameterAuthorizer(func(req *http.Request, parameter string) error {
+//         if parameter == "salary" && !isHR(req) {
+//             return errors.New("filtering by salary requires the HR role")
+//         }
+//         return nil
+//     })
+func (mq *MongoQuery) SetParameterAuthorizer(authorizer func(req *http.Request, parameter string) error) {
+	mq.parameterAuthorizer = authorizer
+}
+
+// authorizeParameters calls the parameter authorizer for every parameter in req. The errors are
+// added to errs, it returns true if no further errors should be collected.
+func (mq *MongoQuery) authorizeParameters(req *http.Request, errs *errorCollector) bool {
+	if mq.parameterAuthorizer == nil {
+		return false
+	}
+	parameters := []string{}
+	add := func(name string) {
+		name, _ = splitOperator(mq.resolveAlias(name))
+		if _, isMeta := validMetaParameters[name]; !isMeta && !contains(parameters, name) {
+			parameters = append(parameters, name)
+		}
+	}
+	for k, values := range req.URL.Query() {
+		add(k)
+		// field comparisons use the compared parameters too
+		if _, operator := splitOperator(mq.resolveAlias(k)); len(fieldComparisonOperators[operator]) > 0 {
+			for _, v := range values {
+				add(v)
+			}
+		}
+	}
+	for _, v := range req.URL.Query()["sort"] {
+		add(sortFieldName(v))
+	}
+	for _, v := range req.URL.Query()["field"] {
+		if _, ok := mq.exclusionPresets[v]; !ok && v != AllFields {
+			add(v)
+		}
+	}
+	sort.Strings(parameters)
+	for _, p := range parameters {
+		err := mq.parameterAuthorizer(req, p)
+		if err == nil {
+			continue
+		}
+		code := http.StatusForbidden
+		if e, ok := err.(merry.Error); ok && merry.HTTPCode(e) != http.StatusInternalServerError {
+			code = merry.HTTPCode(e)
+		}
+		if errs.add(p, withCode(merry.Wrap(err).WithHTTPCode(code), CodeForbidden)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterValueDecoder registers a function that decodes the values of the parameter field
+// before they are parsed, for example base64 encoded ids:
+//     mq.RegisterValueDecoder("_id", func(v string) (string, error) {
+//         b, err := base64.URLEncoding.DecodeString(v)
+//         return string(b), err
+//     })
+// If the decoder returns an error, the request is rejected with 400. The decoder is applied to
+// the values of the operators of field as well, except the field comparisons.
+func (mq *MongoQuery) RegisterValueDecoder(field string, fn func(string) (string, error)) error {
+	field = mq.resolveAlias(field)
+	_, ok := mq.supportedParameters[field]
+	if _, isMeta := validMetaParameters[field]; !ok || isMeta {
+		return fmt.Errorf("parameter '%s' is not supported", field)
+	}
+	mq.valueDecoders[field] = fn
+	return nil
+}
+
+// SetProjectionPolicy sets a function that returns the fields a request is allowed to select,
+// for example depending on the role of the caller. If a request selects no fields, all allowed
+// fields are selected. Selected fields that are not allowed are dropped, or the request is
+// rejected with 403 if reject is true. An error returned by policy rejects the request with 403.
+// The allowed fields can be aliases, see AddAlias.
+func (mq *MongoQuery) SetProjectionPolicy(policy func(req *http.Request) (allowed []string, err error), reject bool) {
+	mq.projectionPolicy = func(req *http.Request) ([]string, error) {
+		allowed, err := policy(req)
+		if err != nil {
+			return nil, err
+		}
+		resolved := make([]string, 0, len(allowed))
+		for _, a := range allowed {
+			resolved = append(resolved, mq.resolveAlias(a))
+		}
+		return resolved, nil
+	}
+	mq.rejectForbiddenFields = reject
+}
+
+// SetMatchMode sets the default match mode for single values of string parameters. Per default
+// MatchModeRegex is used, so /?name=pe matches peter. With MatchModeExact it matches only pe,
+// with MatchModePrefix it matches peter but not ape.
+// The match mode can be overridden per request with the matchmode parameter:
+//     /?name=peter&matchmode=exact
+func (mq *MongoQuery) SetMatchMode(mode string) error {
+	switch mode {
+	case MatchModeRegex, MatchModeExact, MatchModePrefix:
+		mq.matchMode = mode
+		return nil
+	}
+	return fmt.Errorf("invalid match mode: %s", mode)
+}
+
+// SetBoolWildcard enables or disables the wildcard for bool parameters. If enabled, the values
+// any and the empty value match true and false, so /?mybool=any adds no filter for mybool.
+// Wildcards are dropped from multiple values like /?mybool=true&mybool=any. Per default
+// they are rejected.
+func (mq *MongoQuery) SetBoolWildcard(enabled bool) {
+	mq.boolWildcard = enabled
+}
+
+// RequireTogether registers a group of parameters that must be supplied together. A request
+// with some but not all parameters of the group is rejected with 422, a request with none of
+// them is accepted:
+//     mq.RequireTogether("lat", "lon", "radius")
+//     q, err := mq.CreateQuery(req) // /?lat=47.3&lon=8.5 returns an error
+// Multiple groups can be registered and the parameters can be aliases.
+func (mq *MongoQuery) RequireTogether(parameters ...string) {
+	mq.requiredGroups = append(mq.requiredGroups, append([]string{}, parameters...))
+}
+
+// ForbidEmptyFilter rejects requests without filter with http.StatusUnprocessableEntity, for
+// endpoints where a request for the whole collection is never intended. Meta parameters like
+// sort and limit are no filters and per default the base filters, like the tenant of
+// SetTenant, do not count either, see AllowBaseFilterOnly.
+func (mq *MongoQuery) ForbidEmptyFilter() {
+	mq.forbidEmptyFilter = true
+}
+
+// AllowBaseFilterOnly defines if the base filters, like the tenant of SetTenant, are enough to
+// satisfy ForbidEmptyFilter.
+func (mq *MongoQuery) AllowBaseFilterOnly(allow bool) {
+	mq.allowBaseFilterOnly = allow
+}
+
+// checkEmptyFilter returns an error if ForbidEmptyFilter is set and the request has no filter.
+// userFilter is true if the request has a filter, baseFilter if a base filter was added.
+func (mq *MongoQuery) checkEmptyFilter(userFilter, baseFilter bool) error {
+	if !mq.forbidEmptyFilter || userFilter || (baseFilter && mq.allowBaseFilterOnly) {
+		return nil
+	}
+	return withCode(merry.Wrap(errors.New("at least one filter is required")).WithHTTPCode(http.StatusUnprocessableEntity), CodeMissingParameter)
+}
+
+// SetZeroPageAsFirst defines how the page parameter 0 is treated. Pages are 1-based, so per
+// default /?page=0 is rejected, if zeroIsFirst is true it returns the first page.
+func (mq *MongoQuery) SetZeroPageAsFirst(zeroIsFirst bool) {
+	mq.zeroPageIsFirst = zeroIsFirst
+}
+
+// SetAllowUnlimited allows clients to request all documents with /?limit=all, or /?limit=-1
+// as alias. Such requests return one page with all documents, like /?limit=0.
+func (mq *MongoQuery) SetAllowUnlimited(allow bool) {
+	mq.allowUnlimited = allow
+}
+
+// SetRecentField sets the time field that is filtered by the within parameter:
+//     mq.SetRecentField("createdat")
+//     q, _ := mq.CreateQuery(req) // /?within=24h returns the documents created in the last 24 hours
+func (mq *MongoQuery) SetRecentField(name string) {
+	mq.recentField = name
+}
+
+// SetSyncField sets the time field of the last modification of the documents, which is filtered
+// by the modifiedSince parameter for incremental syncs:
+//     mq.SetSyncField("updatedat")
+//     r, _ := mq.Run(req) // /?modifiedSince=2023-01-15T10:00:00Z
+// returns the documents modified after the given time. The response contains the time syncedAt
+// to use as modifiedSince of the next request. It is taken before the query runs, so documents
+// modified in the meantime are returned again rather than missed.
+func (mq *MongoQuery) SetSyncField(name string) {
+	mq.syncField = name
+}
+
+// SetClock sets the function that returns the current time. It defaults to time.Now.
+func (mq *MongoQuery) SetClock(now func() time.Time) {
+	mq.now = now
+}
+
+// addRecentFilter adds a filter for the recent field to filter if req contains the within parameter.
+func (mq *MongoQuery) addRecentFilter(req *http.Request, filter map[string]interface{}) error {
+	if _, ok := req.URL.Query()["within"]; !ok {
+		return nil
+	}
+	if len(mq.recentField) == 0 {
+		return merry.Wrap(errors.New("within is not supported")).WithHTTPCode(http.StatusBadRequest)
+	}
+	d, err := time.ParseDuration(req.URL.Query().Get("within"))
+	if err != nil || d <= 0 {
+		return merry.Wrap(fmt.Errorf("invalid value for within: %s", req.URL.Query().Get("within"))).WithHTTPCode(http.StatusBadRequest)
+	}
+	if _, ok := filter[mq.recentField]; ok {
+		return withCode(merry.Wrap(fmt.Errorf("conflicting filters for parameter '%s'", mq.recentField)).WithHTTPCode(http.StatusBadRequest), CodeConflict)
+	}
+	filter[mq.recentField] = map[string]interface{}{
+		"$gte": mq.now().Add(-d),
+	}
+	return nil
+}
+
+// syncedAt returns the time of the response used as modifiedSince of the next request, or nil
+// if there is no sync field.
+func (mq *MongoQuery) syncedAt() *time.Time {
+	if len(mq.syncField) == 0 {
+		return nil
+	}
+	now := mq.now()
+	return &now
+}
+
+// addSyncFilter adds a filter for the sync field to filter if req contains the modifiedSince parameter.
+func (mq *MongoQuery) addSyncFilter(req *http.Request, filter map[string]interface{}) error {
+	if _, ok := req.URL.Query()["modifiedSince"]; !ok {
+		return nil
+	}
+	if len(mq.syncField) == 0 {
+		return merry.Wrap(errors.New("modifiedSince is not supported")).WithHTTPCode(http.StatusBadRequest)
+	}
+	t, err := time.Parse(time.RFC3339Nano, req.URL.Query().Get("modifiedSince"))
+	if err != nil {
+		return merry.Wrap(fmt.Errorf("invalid value for modifiedSince: %s", req.URL.Query().Get("modifiedSince"))).WithHTTPCode(http.StatusBadRequest)
+	}
+	if _, ok := filter[mq.syncField]; ok {
+		return withCode(merry.Wrap(fmt.Errorf("conflicting filters for parameter '%s'", mq.syncField)).WithHTTPCode(http.StatusBadRequest), CodeConflict)
+	}
+	filter[mq.syncField] = map[string]interface{}{
+		"$gt": t,
+	}
+	return nil
+}
+
+// SetStrictNumericParsing enables or disables strict parsing of numbers. If enabled, numbers
+// with leading zeros like 007, a leading + or surrounding whitespace are rejected.
+func (mq *MongoQuery) SetStrictNumericParsing(strict bool) {
+	mq.strictNumericParsing = strict
+}
+
+// TrimValues enables or disables the removal of leading and trailing Unicode whitespace from
+// the values of filter parameters. The values are trimmed before they are converted, so
+// /?intMember=%2042 filters for 42. Values of comma separated parameters that are empty after
+// trimming are omitted like empty values, see SetRejectEmptyLists.
+func (mq *MongoQuery) TrimValues(trim bool) {
+	mq.trimValues = trim
+}
+
+// SetRejectEmptyLists defines how an empty list of a comma separated parameter like /?ids= is
+// handled. Per default an empty list matches no document, if reject is true the request is
+// rejected.
+func (mq *MongoQuery) SetRejectEmptyLists(reject bool) {
+	mq.rejectEmptyLists = reject
+}
+
+// SetPreserveOrder designates the parameter whose values define the order of the
+// results returned by Run. If always is false, the order is only preserved if the
+// request contains preserveorder=true.
+//
+// Example:
+//     mq.SetPreserveOrder("id", false)
+//     r, _ := mq.Run(req) // /?id=c&id=a&id=b&preserveorder=true returns c, a and b in that order
+//
+// Documents whose value is not in the list are appended at the end. The order is
+// applied to the documents of the requested page only.
+func (mq *MongoQuery) SetPreserveOrder(parameter string, always bool) {
+	mq.preserveOrderParameter = parameter
+	mq.preserveOrderAlways = always
+}
+
+// preserveOrderValues returns the values of the preserve order parameter from filterMap
+// in the order they were requested. The bool value is false if the order does not
+// have to be preserved for req.
+func (mq *MongoQuery) preserveOrderValues(req *http.Request, filterMap map[string]interface{}) ([]interface{}, bool, error) {
+	requested := false
+	if _, ok := req.URL.Query()["preserveorder"]; ok {
+		b, err := strconv.ParseBool(req.URL.Query().Get("preserveorder"))
+		if err != nil {
+			return nil, false, merry.Wrap(fmt.Errorf("invalid value for preserveorder: %s", req.URL.Query().Get("preserveorder"))).WithHTTPCode(http.StatusBadRequest)
+		}
+		if b && len(mq.preserveOrderParameter) == 0 {
+			return nil, false, merry.Wrap(errors.New("preserveorder is not supported")).WithHTTPCode(http.StatusBadRequest)
+		}
+		requested = b
+	}
+	if len(mq.preserveOrderParameter) == 0 || !(requested || mq.preserveOrderAlways) {
+		return nil, false, nil
+	}
+	return orderValues(req, filterMap, mq.preserveOrderParameter, requested)
+}
+
+// orderValues returns the values of the parameter name from filterMap in the order they were
+// requested, see inValues. An explicit sort of req wins over the order, unless the order is
+// required, then the sort is rejected.
+func orderValues(req *http.Request, filterMap map[string]interface{}, name string, required bool) ([]interface{}, bool, error) {
+	if _, ok := req.URL.Query()["sort"]; ok {
+		if required {
+			return nil, false, merry.Wrap(fmt.Errorf("order of '%s' cannot be combined with sort", name)).WithHTTPCode(http.StatusBadRequest)
+		}
+		return nil, false, nil
+	}
+	values, ok := inValues(filterMap, name)
+	return values, ok, nil
+}
+
+// inValues returns the values filterMap matches for the parameter name in the order they were
+// requested. The bool value is false if filterMap contains no filter for name.
+func inValues(filterMap map[string]interface{}, name string) ([]interface{}, bool) {
+	v, ok := filterMap[name]
+	if !ok {
+		return nil, false
+	}
+	if in, ok := v.(map[string]interface{}); ok {
+		if values, ok := in["$in"].([]interface{}); ok {
+			return values, true
+		}
+	}
+	return []interface{}{v}, true
+}
+
+func (mq *MongoQuery) createQueryFilter(req *http.Request) (map[string]interface{}, error) {
+	filter := make(map[string]interface{})
+	operators := make(map[string]interface{})
+	comparisons := make(map[string][]interface{})
+	errs := &errorCollector{failFast: mq.failFast}
+	matchMode, err := mq.requestMatchMode(req)
+	if errs.add("matchmode", err) {
+		return nil, errs.err()
+	}
+	if errs.add("", mq.checkRequiredGroups(req)) {
+		return nil, errs.err()
+	}
+
+	values := mq.queryValues(req)
+	if errs.add("", mq.checkOperatorCombinations(values)) {
+		return nil, errs.err()
+	}
+	names := []string{}
+	for parameterName := range values {
+		names = append(names, parameterName)
+	}
+	// sorted to report errors in a stable order
+	sort.Strings(names)
+	for _, parameterName := range names {
+		if errs.add(parameterName, mq.addParameterFilter(req, filter, operators, comparisons, parameterName, values[parameterName], matchMode)) {
+			return nil, errs.err()
+		}
+	}
+	if errs.add("", addOperatorFilters(filter, operators)) {
+		return nil, errs.err()
+	}
+	if errs.add("within", mq.addRecentFilter(req, filter)) || errs.add("modifiedSince", mq.addSyncFilter(req, filter)) || len(errs.errs) > 0 {
+		return nil, errs.err()
+	}
+	if errs.add("", mq.addLiteralFieldClauses(filter, comparisons)) {
+		return nil, errs.err()
+	}
+	addExprClause(filter, comparisons)
+	return filter, nil
+}
+
+// addParameterFilter adds the filter for the parameter with the given values to filter. Operator
+// filters are merged into operators and field comparisons are added to comparisons.
+func (mq *MongoQuery) addParameterFilter(req *http.Request, filter, operators map[string]interface{}, comparisons map[string][]interface{}, parameterName string, parameterValues []string, matchMode string) error {
+	if len(mq.textSearchParameter) > 0 && parameterName == mq.textSearchParameter {
+		return mq.addTextSearchFilter(filter, parameterValues)
+	}
+	s := []interface{}{}
+	parameterName = mq.resolveAlias(parameterName)
+	path, operator := splitOperator(parameterName)
+	if err := mq.checkPathDepth(path); err != nil {
+		return err
+	}
+	// the values of field comparisons are parameter names
+	if decode, ok := mq.valueDecoders[path]; ok && len(fieldComparisonOperators[operator]) == 0 {
+		decoded := []string{}
+		for _, v := range parameterValues {
+			if _, ok := mq.tokenResolver(path, v); ok {
+				decoded = append(decoded, v)
+				continue
+			}
+			d, err := decode(v)
+			if err != nil {
+				return merry.Wrap(fmt.Errorf("invalid value for %s: %s", parameterName, err)).WithHTTPCode(http.StatusBadRequest)
+			}
+			decoded = append(decoded, d)
+		}
+		parameterValues = decoded
+	}
+	if _, ok := mq.supportedParameters[parameterName]; !ok {
+		if name, operator := splitOperator(parameterName); len(operator) > 0 {
+			if _, ok := fieldComparisonOperators[operator]; ok {
+				clauses, err := mq.createFieldComparisons(name, operator, parameterValues)
+				if err != nil {
+					return err
+				}
+				comparisons[parameterName] = clauses
+				return nil
+			}
+			value, err := mq.createOperatorFilter(req, name, operator, parameterValues)
+			if err != nil {
+				return err
+			}
+			merged, err := mq.mergeFilterValues(name, operators[name], value)
+			if err != nil {
+				return err
+			}
+			operators[name] = merged
+			return nil
+		}
+	}
+	if kind, ok := mq.supportedParameters[parameterName]; ok {
+		// meta parameters are not filters
+		if _, ok := validMetaParameters[parameterName]; ok {
+			return nil
+		}
+		if len(parameterValues) == 0 {
+			if mq.rejectEmptyLists {
+				return merry.Wrap(fmt.Errorf("empty list for parameter '%s'", parameterName)).WithHTTPCode(http.StatusBadRequest)
+			}
+			if _, ok := filter[parameterName]; ok {
+				return withCode(merry.Wrap(fmt.Errorf("conflicting filters for parameter '%s'", parameterName)).WithHTTPCode(http.StatusBadRequest), CodeConflict)
+			}
+			// an empty $in matches no document
+			filter[parameterName] = map[string]interface{}{
+				"$in": []interface{}{},
+			}
+			return nil
+		}
+		if kindClass(kind) == "number" {
+			plain, err := mq.addPrefixOperatorFilters(req, operators, parameterName, kind, parameterValues)
+			if err != nil {
+				return err
+			}
+			if len(plain) == 0 {
+				return nil
+			}
+			parameterValues = plain
+		}
+		// resolved tokens are not parsed
+		literals := []string{}
+		for _, v := range parameterValues {
+			value, literal, err := mq.resolveToken(req, parameterName, kind, v)
+			if err != nil {
+				return err
+			}
+			if value != nil {
+				s = append(s, value)
+				continue
+			}
+			literals = append(literals, literal)
+		}
+		parameterValues = literals
+		switch kind {
+		case reflect.Bool:
+			for _, v := range parameterValues {
+				if mq.boolWildcard && (v == BoolWildcard || len(v) == 0) {
+					continue
+				}
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
+				}
+				s = append(s, b)
+			}
+			if len(s) == 0 {
+				// only wildcards, so any value matches
+				return nil
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			for _, v := range parameterValues {
+				i, err := mq.parseInt(v)
+				if err != nil {
+					return merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
+				}
+				s = append(s, i)
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			for _, v := range parameterValues {
+				i, err := mq.parseUint(v)
+				if err != nil {
+					return merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
+				}
+				s = append(s, i)
+			}
+		case reflect.Float32, reflect.Float64:
+			for _, v := range parameterValues {
+				f, err := mq.parseFloat(v)
+				if err != nil {
+					return merry.Wrap(err).WithHTTPCode(http.StatusBadRequest)
+				}
+				s = append(s, f)
+			}
+			if tolerance, ok := mq.floatTolerances[parameterName]; ok {
+				s = uniqueValues(s)
+				if len(s) > 1 {
+					ranges := []interface{}{}
+					for _, f := range s {
+						ranges = append(ranges, map[string]interface{}{
+							parameterName: toleranceRange(f.(float64), tolerance),
+						})
+					}
+					addOrClause(filter, ranges)
+					return nil
+				}
+				s[0] = toleranceRange(s[0].(float64), tolerance)
+			}
+		case reflect.String:
+			if mq.isBooleanString(parameterName, parameterValues) {
+				for _, v := range parameterValues {
+					s = append(s, v)
+				}
+			} else if len(parameterValues) == 1 && len(s) == 0 {
+				if bson.IsObjectIdHex(parameterValues[0]) {
+					s = []interface{}{bson.ObjectIdHex(parameterValues[0])}
+				} else if matchMode == MatchModeExact {
+					s = []interface{}{parameterValues[0]}
+				} else if matchMode == MatchModePrefix {
+					s = []interface{}{mq.prefixFilter(parameterName, parameterValues[0])}
+				} else {
+					if err := mq.checkRegexLength(parameterValues[0]); err != nil {
+						return err
+					}
+					pattern := parameterValues[0]
+					// raw regular expressions have to be passed with the regex operator
+					if mq.escapeRegex || contains(mq.rawRegexParameters, parameterName) {
+						pattern = regexp.QuoteMeta(pattern)
+					}
+					s = []interface{}{mq.regex(pattern, mq.regexOptions)}
+				}
+			} else {
+				for _, v := range parameterValues {
+					if bson.IsObjectIdHex(v) {
+						s = append(s, bson.ObjectIdHex(v))
+					} else {
+						s = append(s, v)
+					}
+				}
+			}
+		default:
+			if len(parameterValues) > 0 {
+				return merry.Wrap(fmt.Errorf("reflection kind '%s' is not supported", kind)).WithHTTPCode(http.StatusBadRequest)
+			}
+		}
+	} else {
+		return withCode(merry.Wrap(fmt.Errorf("parameter '%s' is not supported", parameterName)).WithHTTPCode(http.StatusBadRequest), CodeUnsupportedParameter)
+	}
+	if _, ok := filter[parameterName]; ok {
+		return withCode(merry.Wrap(fmt.Errorf("conflicting filters for parameter '%s'", parameterName)).WithHTTPCode(http.StatusBadRequest), CodeConflict)
+	}
+	s = uniqueValues(s)
+	switch {
+	case len(s) == 1:
+		filter[parameterName] = s[0]
+	case mq.arrayModes[parameterName] == ArrayModeAll:
+		filter[parameterName] = map[string]interface{}{
+			"$all": s,
+		}
+	case mq.arrayModes[parameterName] == ArrayModeAndElemMatch:
+		for _, v := range s {
+			addAndClause(filter, map[string]interface{}{
+				parameterName: map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": v}},
+			})
+		}
+	default:
+		filter[parameterName] = map[string]interface{}{
+			"$in": s,
+		}
+	}
+	return nil
+}
+
+// addOperatorFilters adds the merged operator filters to filter. An operator filter on a
+// parameter that is filtered by value too is a conflict, except for ranges of ObjectIds, which
+// are combined with the values by $and.
+func addOperatorFilters(filter, operators map[string]interface{}) error {
+	names := []string{}
+	for name := range operators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := &errorCollector{}
+	for _, name := range names {
+		if _, ok := filter[name]; ok {
+			// a range of ObjectIds is combined with the equality of the ids
+			if isObjectIdRange(operators[name]) {
+				addAndClause(filter, map[string]interface{}{name: operators[name]})
+				continue
+			}
+			errs.add(name, withCode(merry.Wrap(fmt.Errorf("conflicting filters for parameter '%s'", name)).WithHTTPCode(http.StatusBadRequest), CodeConflict))
+			continue
+		}
+		filter[name] = operators[name]
+	}
+	return errs.err()
+}
+
+// checkRequiredGroups returns an error if req contains some but not all parameters of a group
+// registered with RequireTogether.
+func (mq *MongoQuery) checkRequiredGroups(req *http.Request) error {
+	if len(mq.requiredGroups) == 0 {
+		return nil
+	}
+	supplied := []string{}
+	for k := range req.URL.Query() {
+		name, _ := splitOperator(mq.resolveAlias(k))
+		supplied = append(supplied, name)
+	}
+	for _, group := range mq.requiredGroups {
+		missing := []string{}
+		for _, member := range group {
+			if !contains(supplied, mq.resolveAlias(member)) {
+				missing = append(missing, member)
+			}
+		}
+		if len(missing) > 0 && len(missing) < len(group) {
+			return withCode(merry.Wrap(fmt.Errorf("parameters %s must be supplied together: missing %s", strings.Join(group, ", "), strings.Join(missing, ", "))).WithHTTPCode(http.StatusUnprocessableEntity), CodeMissingParameter)
+		}
+	}
+	return nil
+}
+
+// requestMatchMode returns the match mode for req, which is the value of the matchmode
+// parameter if present and the default match mode otherwise.
+func (mq *MongoQuery) requestMatchMode(req *http.Request) (string, error) {
+	values, ok := req.URL.Query()["matchmode"]
+	if _, supported := mq.supportedParameters["matchmode"]; !ok || !supported {
+		return mq.matchMode, nil
+	}
+	switch values[0] {
+	case MatchModeRegex, MatchModeExact, MatchModePrefix:
+		return values[0], nil
+	}
+	return "", merry.Wrap(fmt.Errorf("invalid value for matchmode: %s", values[0])).WithHTTPCode(http.StatusBadRequest)
+}
+
+// queryValues returns the decoded query parameters of req with the values of comma
+// separated parameters split on the unencoded commas of the raw query. Empty values
+// of comma separated parameters are omitted, so /?ids= results in an empty list.
+func (mq *MongoQuery) queryValues(req *http.Request) url.Values {
+	values := req.URL.Query()
+	if len(mq.commaSeparatedParameters) == 0 && !mq.trimValues {
+		return values
+	}
+	split := url.Values{}
+	for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+		rawValue := ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			pair, rawValue = pair[:i], pair[i+1:]
+		}
+		key, err := url.QueryUnescape(pair)
+		if err != nil {
+			continue
+		}
+		parameter := mq.resolveAlias(key)
+		if name, _ := splitOperator(parameter); !contains(mq.commaSeparatedParameters, parameter) && !contains(mq.commaSeparatedParameters, name) {
+			continue
+		}
+		if _, ok := split[key]; !ok {
+			split[key] = []string{}
+		}
+		for _, part := range strings.Split(rawValue, ",") {
+			v, err := url.QueryUnescape(part)
+			if err != nil || len(v) == 0 {
+				continue
+			}
+			split.Add(key, v)
+		}
+	}
+	for k, v := range split {
+		values[k] = v
+	}
+	if mq.trimValues {
+		for k, v := range values {
+			trimmed := []string{}
+			for _, s := range v {
+				s = strings.TrimSpace(s)
+				// like empty values of comma separated parameters
+				if _, isList := split[k]; isList && len(s) == 0 {
+					continue
+				}
+				trimmed = append(trimmed, s)
+			}
+			values[k] = trimmed
+		}
+	}
+	return values
+}
+
+// createFieldsMap returns the projection of the field parameters of req. Nested paths like
+// address.city select only the sub field, without its siblings. A path has to be a field of
+// the endpoint struct, see FieldTree, or a supported parameter.
+func (mq *MongoQuery) createFieldsMap(req *http.Request) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	errs := &errorCollector{failFast: mq.failFast}
+	_field, ok := req.URL.Query()["field"]
+	if !ok {
+		projection := mq.defaultProjection
+		if mq.projectFilteredOnly {
+			if filtered := mq.filteredFields(req); len(filtered) > 0 {
+				projection = filtered
+			}
+		}
+		for _, f := range projection {
+			fields[f] = 1
+		}
+	}
+	if ok {
+		presets := []string{}
+		all := false
+		for _, v := range _field {
+			if v == AllFields {
+				all = true
+				continue
+			}
+			if excluded, ok := mq.exclusionPresets[v]; ok {
+				presets = append(presets, v)
+				for _, e := range excluded {
+					fields[e] = 0
+				}
+				continue
+			}
+			v = mq.resolveAlias(v)
+			if mq.isScoreField(v) {
+				if errs.add("field", mq.checkTextSearch(req)) {
+					return nil, errs.err()
+				}
+				fields[v] = textScoreProjection()
+				continue
+			}
+			if err := mq.checkPathDepth(v); err != nil {
+				if errs.add("field", err) {
+					return nil, errs.err()
+				}
+				continue
+			}
+			if !mq.isProjectableField(v) {
+				if errs.add("field", withCode(merry.Wrap(fmt.Errorf("unsupported field value: %s", v)).WithHTTPCode(http.StatusBadRequest), CodeUnsupportedParameter)) {
+					return nil, errs.err()
+				}
+				continue
+			}
+			fields[v] = 1
+		}
+		// MongoDB does not allow to mix inclusion and exclusion
+		if len(presets) > 0 && len(presets) != len(_field) {
+			errs.add("field", withCode(merry.Wrap(fmt.Errorf("exclusion preset '%s' cannot be combined with other fields", presets[0])).WithHTTPCode(http.StatusBadRequest), CodeConflict))
+		}
+		if all && len(_field) > 1 {
+			errs.add("field", withCode(merry.Wrap(fmt.Errorf("field '%s' cannot be combined with other fields", AllFields)).WithHTTPCode(http.StatusBadRequest), CodeConflict))
+		}
+		if err := errs.err(); err != nil {
+			return nil, err
+		}
+	}
+	// a projection with a field and one of its sub fields is rejected by MongoDB,
+	// so only the parent is kept
+	for k := range fields {
+		if mq.literalFields[k] {
+			continue
+		}
+		for parent := range fields {
+			if strings.HasPrefix(k, parent+".") {
+				delete(fields, k)
+				break
+			}
+		}
+	}
+	if mq.maxProjectionFields > 0 && len(fields) > mq.maxProjectionFields {
+		return nil, merry.Wrap(fmt.Errorf("too many fields selected: maximum is %d", mq.maxProjectionFields)).WithHTTPCode(http.StatusBadRequest)
+	}
+	if mq.projectionPolicy != nil {
+		return mq.applyProjectionPolicy(req, fields)
+	}
+	return fields, nil
+}
+
+// isProjectableField returns true if field can be projected. Besides the supported parameters
+// all paths of the struct fields are projectable, even if they are disabled as parameters.
+func (mq *MongoQuery) isProjectableField(field string) bool {
+	// meta parameters like limit are supported parameters but not fields
+	if _, isMeta := validMetaParameters[field]; isMeta {
+		return false
+	}
+	if _, ok := mq.supportedParameters[field]; ok {
+		return true
+	}
+	// nested paths that are no parameters, like the fields of slices of structs, and fields
+	// that are disabled for filtering
+	if !strings.Contains(field, ".") && !contains(mq.disabledParameters, field) {
+		return false
+	}
+	_, ok := mq.fieldTree[field]
+	return ok
+}
+
+// FieldTree returns the paths of all fields of the endpoint struct with their kinds, including
+// sub documents and their fields like address and address.city. Slices have the kind of
+// their elements. All of them can be projected with the field parameter, while the filterable
+// parameters may be restricted, see DisableParameters.
+func (mq *MongoQuery) FieldTree() map[string]reflect.Kind {
+	tree := make(map[string]reflect.Kind, len(mq.fieldTree))
+	for k, v := range mq.fieldTree {
+		tree[k] = v
+	}
+	return tree
+}
+
+// applyProjectionPolicy restricts fields to the fields allowed by the projection policy for req.
+// If fields is empty, all allowed fields are selected.
+func (mq *MongoQuery) applyProjectionPolicy(req *http.Request, fields map[string]interface{}) (map[string]interface{}, error) {
+	allowed, err := mq.projectionPolicy(req)
+	if err != nil {
+		return nil, merry.Wrap(err).WithHTTPCode(http.StatusForbidden)
+	}
+	if isExclusion(fields) {
+		// the exclusion is converted to a selection of the allowed fields that are not excluded
+		excluded := []string{}
+		for k := range fields {
+			excluded = append(excluded, k)
+		}
+		fields = make(map[string]interface{})
+		for _, a := range allowed {
+			if !isAllowedField(a, excluded) {
+				fields[a] = 1
+			}
+		}
+		if len(fields) == 0 {
+			fields["_id"] = 1
+		}
+		return fields, nil
+	}
+	if len(fields) == 0 {
+		for _, a := range allowed {
+			fields[a] = 1
+		}
+		return fields, nil
+	}
+	for k := range fields {
+		if isAllowedField(k, allowed) {
+			continue
+		}
+		if mq.rejectForbiddenFields {
+			return nil, merry.Wrap(fmt.Errorf("field '%s' is not allowed", k)).WithHTTPCode(http.StatusForbidden)
+		}
+		delete(fields, k)
+	}
+	if len(fields) == 0 {
+		// an empty projection would select all fields
+		fields["_id"] = 1
+	}
+	return fields, nil
+}
+
+// isExclusion returns true if fields is an exclusion projection.
+func isExclusion(fields map[string]interface{}) bool {
+	for _, v := range fields {
+		// $meta fields can be added to inclusions and exclusions
+		if isMetaProjection(v) {
+			continue
+		}
+		return v == 0
+	}
+	return false
+}
+
+// isAllowedField returns true if field or one of its parents is in allowed.
+func isAllowedField(field string, allowed []string) bool {
+	for _, a := range allowed {
+		if field == a || strings.HasPrefix(field, a+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// SortDirection restricts the direction a field can be sorted in, see RestrictSortDirection.
+type SortDirection int
+
+// sort directions
+const (
+	AscendingOnly  SortDirection = iota + 1 // AscendingOnly allows only ascending sorts.
+	DescendingOnly                          // DescendingOnly allows only descending sorts.
+)
+
+// String returns the name of the direction.
+func (d SortDirection) String() string {
+	if d == DescendingOnly {
+		return "descending"
+	}
+	return "ascending"
+}
+
+// RestrictSortDirection allows sorting by field only in the given direction, for example if
+// the other direction causes expensive index scans:
+//     mq.RestrictSortDirection("sequence", mqb.DescendingOnly)
+//     /?sort=-sequence is allowed, /?sort=sequence is rejected with 422
+// The field can be given by an alias, the restriction applies to the field and all its aliases.
+// The sorts of a sort policy are restricted too, see SetSortPolicy. Since the documents before a
+// cursor are fetched in the reverse order, before cursors are rejected for such sorts.
+func (mq *MongoQuery) RestrictSortDirection(field string, direction SortDirection) error {
+	field = mq.resolveAlias(field)
+	_, ok := mq.supportedParameters[field]
+	if _, isMeta := validMetaParameters[field]; !ok || isMeta {
+		return fmt.Errorf("parameter '%s' is not supported", field)
+	}
+	if direction != AscendingOnly && direction != DescendingOnly {
+		return fmt.Errorf("invalid sort direction: %d", direction)
+	}
+	mq.sortDirections[field] = direction
+	return nil
+}
+
+// checkSortDirection returns an error if field cannot be sorted in the given direction, see
+// RestrictSortDirection.
+func (mq *MongoQuery) checkSortDirection(field string, descending bool) error {
+	if direction, ok := mq.sortDirections[field]; ok && (direction == DescendingOnly) != descending {
+		return withCode(merry.Wrap(fmt.Errorf("field '%s' can only be sorted in %s order", field, direction)).WithHTTPCode(http.StatusUnprocessableEntity), CodeInvalidValue)
+	}
+	return nil
+}
+
+// SetSortPolicy sets a function that canonicalizes the validated sort fields of a request. It
+// can rewrite, append, truncate or reject them, for example to expand business sorts:
+//     mq.SetSortPolicy(func(req *http.Request, sort []string) ([]string, error) {
+//         if len(sort) == 0 {
+//             return []string{"-rating", "-updatedat", "name"}, nil
+//         }
+//         if len(sort) > 3 {
+//             return nil, errors.New("at most 3 sort fields are supported")
+//         }
+//         return sort, nil
+//     })
+// The fields are given as name or -name, the returned fields are used as they are. Errors are
+// returned with status 422. The policy is called for requests without sort parameter too.
+func (mq *MongoQuery) SetSortPolicy(policy func(req *http.Request, sort []string) ([]string, error)) {
+	mq.sortPolicy = policy
+}
+
+// applySortPolicy returns the sort fields returned by the sort policy for sortFields.
+func (mq *MongoQuery) applySortPolicy(req *http.Request, sortFields []string) ([]string, error) {
+	sortFields, err := mq.sortPolicy(req, sortFields)
+	if err != nil {
+		return nil, merry.Wrap(err).WithHTTPCode(http.StatusUnprocessableEntity)
+	}
+	for _, field := range sortFields {
+		if err := mq.checkSortDirection(strings.TrimPrefix(field, "-"), strings.HasPrefix(field, "-")); err != nil {
+			return nil, err
+		}
+	}
+	if sortFields == nil {
+		sortFields = []string{}
+	}
+	return sortFields, nil
+}
+
+// createSortFields returns the sort fields of req. The fields are given as name or -name, or in
+// the compact form name:asc and name:desc.
+func (mq *MongoQuery) createSortFields(req *http.Request) ([]string, error) {
+	sortFields := []string{}
+	errs := &errorCollector{failFast: mq.failFast}
+	if _sortField, ok := req.URL.Query()["sort"]; ok {
+		descending := make(map[string]bool)
+		for _, v := range _sortField {
+			v, err := parseSortValue(v)
+			if err != nil {
+				if errs.add("sort", err) {
+					break
+				}
+				continue
+			}
+			name := mq.resolveAlias(strings.TrimPrefix(v, "-"))
+			if mq.isScoreField(name) {
+				if errs.add("sort", mq.checkTextSearch(req)) {
+					break
+				}
+				// the score is always sorted in descending order
+				if !contains(sortFields, textScoreSort) {
+					sortFields = append(sortFields, textScoreSort)
+				}
+				continue
+			}
+			if err := mq.checkPathDepth(name); err != nil {
+				if errs.add("sort", err) {
+					break
+				}
+				continue
+			}
+			if _, ok := mq.supportedParameters[name]; !ok || mq.literalFields[name] {
+				if errs.add("sort", withCode(merry.Wrap(fmt.Errorf("unsupported field value: %s", v)).WithHTTPCode(http.StatusBadRequest), CodeUnsupportedParameter)) {
+					break
+				}
+				continue
+			}
+			// duplicate sort keys are ignored
+			if desc, ok := descending[name]; ok {
+				if desc != strings.HasPrefix(v, "-") {
+					if errs.add("sort", withCode(merry.Wrap(fmt.Errorf("conflicting sort directions for field '%s'", name)).WithHTTPCode(http.StatusBadRequest), CodeConflict)) {
+						break
+					}
+				}
+				continue
+			}
+			if err := mq.checkSortDirection(name, strings.HasPrefix(v, "-")); err != nil {
+				if errs.add("sort", err) {
+					break
+				}
+				continue
+			}
+			descending[name] = strings.HasPrefix(v, "-")
+			if strings.HasPrefix(v, "-") {
+				name = "-" + name
+			}
+			sortFields = append(sortFields, name)
+		}
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	return sortFields, nil
+}
+
+// parseSortValue returns the value of the sort parameter v in the form name or -name. The
+// compact form name:direction is converted, the direction is asc, desc, 1 or -1.
+func parseSortValue(v string) (string, error) {
+	i := strings.LastIndex(v, ":")
+	if i < 0 {
+		return v, nil
+	}
+	name, direction := v[:i], v[i+1:]
+	if len(name) == 0 || strings.HasPrefix(name, "-") {
+		return "", withCode(merry.Wrap(fmt.Errorf("invalid sort value '%s', use name:asc or name:desc", v)).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	switch direction {
+	case "asc", "1":
+		return name, nil
+	case "desc", "-1":
+		return "-" + name, nil
+	}
+	return "", withCode(merry.Wrap(fmt.Errorf("invalid sort direction '%s' in '%s', use asc, desc, 1 or -1", direction, v)).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+}
+
+// sortFieldName returns the field name of the sort parameter value v.
+func sortFieldName(v string) string {
+	if i := strings.LastIndex(v, ":"); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimPrefix(v, "-")
+}
+
+func (p *Page) calculateLastPage() {
+	// all items are on the first page without limit, see SetAllowUnlimited
+	if p.Size == 0 {
+		p.Last = 0
+		if p.Items > 0 {
+			p.Last = 1
+		}
+		return
+	}
 	p.Last = uint(math.Ceil(float64(p.Items) / float64(p.Size)))
 }
@@ -2,14 +2,24 @@ package mqb
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
 )
 
 type Embedded struct {
@@ -78,6 +88,21 @@ func TestCreateFieldsMap(t *testing.T) {
 	if _, err := mq.createFieldsMap(req); err == nil {
 		t.Errorf("invalid pluck paramenter did not generate an error")
 	}
+
+	for _, field := range []string{"limit", "sort", "page", "field"} {
+		req, _ = http.NewRequest("GET", "/?field=mybool&field="+field, bytes.NewBufferString(""))
+		if _, err := mq.createFieldsMap(req); err == nil {
+			t.Errorf("meta parameter %s as field did not generate an error", field)
+		}
+	}
+	if err := mq.SetDefaultProjection("mybool", "limit"); err == nil {
+		t.Error("meta parameter in default projection did not generate an error")
+	}
+
+	req, _ = http.NewRequest("GET", "/?field=stringmember&stringmember=peter", bytes.NewBufferString(""))
+	if _, err := mq.createFieldsMap(req); err != nil {
+		t.Errorf("error occured: %s", err)
+	}
 }
 
 func TestCreateQueryFilter(t *testing.T) {
@@ -160,3 +185,2014 @@ func TestCreateSortFields(t *testing.T) {
 		t.Errorf("wrong sort fields generated: %v", s)
 	}
 }
+
+func TestCompactSortFields(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?sort=mybool:asc&sort=intMember:desc&sort=floatmember:-1&sort=stringmember:1&sort=-timemember", bytes.NewBufferString(""))
+	s, err := mq.createSortFields(req)
+	if err != nil {
+		t.Errorf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(s, []string{"mybool", "-intMember", "-floatmember", "stringmember", "-timemember"}) {
+		t.Errorf("wrong sort fields generated: %v", s)
+	}
+
+	for _, v := range []string{"mybool:ascending", "mybool:ASC", "mybool:", "mybool:2", "-mybool:asc", ":asc"} {
+		req, _ := http.NewRequest("GET", "/?sort="+url.QueryEscape(v), bytes.NewBufferString(""))
+		_, err := mq.createSortFields(req)
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("%s: wrong HTTP code: %d", v, merry.HTTPCode(err))
+		}
+		if err != nil && !strings.Contains(err.Error(), v) {
+			t.Errorf("%s: error does not name the value: %s", v, err)
+		}
+	}
+}
+
+func TestSortPolicy(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	var policyInput []string
+	mq.SetSortPolicy(func(req *http.Request, sort []string) ([]string, error) {
+		policyInput = sort
+		if len(sort) == 0 {
+			return []string{"-intMember", "stringmember"}, nil
+		}
+		if contains(sort, "stringmember") && contains(sort, "strSliceMember") {
+			return nil, errors.New("stringmember and strSliceMember cannot be sorted together")
+		}
+		return append(sort, "-timemember"), nil
+	})
+	for query, expected := range map[string][]string{
+		"/":                                {"-intMember", "stringmember"},
+		"/?sort=mybool:desc":               {"-mybool", "-timemember"},
+		"/?sort=intMember&sort=-intMember": nil,
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		spec, err := mq.ParseSpec(context.Background(), req)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("%s: invalid sort did not produce an error", query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: error occured: %s", query, err)
+		}
+		if !reflect.DeepEqual(spec.Sort, expected) {
+			t.Errorf("%s: wrong sort fields: %v", query, spec.Sort)
+		}
+	}
+
+	// the policy gets the validated sort fields
+	policyInput = nil
+	req, _ := http.NewRequest("GET", "/?sort=mybool:desc&sort=-mybool", bytes.NewBufferString(""))
+	if _, err := mq.ParseSpec(context.Background(), req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(policyInput, []string{"-mybool"}) {
+		t.Errorf("wrong sort fields passed to the policy: %v", policyInput)
+	}
+
+	req, _ = http.NewRequest("GET", "/?sort=stringmember&sort=strSliceMember", bytes.NewBufferString(""))
+	_, err := mq.ParseSpec(context.Background(), req)
+	if merry.HTTPCode(err) != http.StatusUnprocessableEntity {
+		t.Errorf("wrong HTTP code of a rejected sort: %d", merry.HTTPCode(err))
+	}
+	if err == nil || !strings.Contains(err.Error(), "cannot be sorted together") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestRestrictSortDirection(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddAlias("seq", "intMember")
+	for field, direction := range map[string]SortDirection{"notAMember": DescendingOnly, "limit": DescendingOnly, "mybool": SortDirection(0)} {
+		if err := mq.RestrictSortDirection(field, direction); err == nil {
+			t.Errorf("invalid restriction of %s did not produce an error", field)
+		}
+	}
+	if err := mq.RestrictSortDirection("seq", DescendingOnly); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.RestrictSortDirection("mybool", AscendingOnly); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	for query, valid := range map[string]bool{
+		"/?sort=-intMember":     true,
+		"/?sort=-seq":           true,
+		"/?sort=intMember:desc": true,
+		"/?sort=mybool":         true,
+		"/?sort=intMember":      false,
+		"/?sort=seq:asc":        false,
+		"/?sort=-mybool":        false,
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.createSortFields(req)
+		if valid && err != nil {
+			t.Errorf("%s: error occured: %s", query, err)
+		}
+		if valid {
+			continue
+		}
+		if merry.HTTPCode(err) != http.StatusUnprocessableEntity {
+			t.Errorf("%s: wrong HTTP code: %d", query, merry.HTTPCode(err))
+		}
+		if err == nil || !strings.Contains(err.Error(), "order") {
+			t.Errorf("%s: error does not name the allowed direction: %v", query, err)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/?sort=seq", bytes.NewBufferString(""))
+	if _, err := mq.createSortFields(req); err == nil || !strings.Contains(err.Error(), "'intMember' can only be sorted in descending order") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// the documents before a cursor are fetched in the reverse order
+	mq.SetCursorSecret([]byte("secret"))
+	cursor, _ := mq.EncodeCursor([]interface{}{42})
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?sort=-seq&after="+cursor, nil)); err != nil {
+		t.Errorf("error occured: %s", err)
+	}
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?sort=-seq&before="+cursor, nil)); merry.HTTPCode(err) != http.StatusUnprocessableEntity {
+		t.Errorf("before cursor of a restricted sort did not produce an error: %v", err)
+	}
+
+	// the sorts of a sort policy are restricted too
+	mq.SetSortPolicy(func(req *http.Request, sort []string) ([]string, error) {
+		return []string{"intMember"}, nil
+	})
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/", nil)); merry.HTTPCode(err) != http.StatusUnprocessableEntity {
+		t.Errorf("restricted sort of the policy did not produce an error: %v", err)
+	}
+}
+
+func TestPreserveOrderValues(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?stringmember=c&stringmember=a&preserveorder=true", bytes.NewBufferString(""))
+	filter, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if _, _, err := mq.preserveOrderValues(req, filter); err == nil {
+		t.Error("preserveorder without a configured parameter did not produce an error")
+	}
+
+	mq.SetPreserveOrder("stringmember", false)
+	values, ok, err := mq.preserveOrderValues(req, filter)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !ok || !reflect.DeepEqual(values, []interface{}{"c", "a"}) {
+		t.Errorf("wrong order values: %v", values)
+	}
+
+	req, _ = http.NewRequest("GET", "/?stringmember=c&stringmember=a", bytes.NewBufferString(""))
+	if _, ok, _ := mq.preserveOrderValues(req, filter); ok {
+		t.Error("order should only be preserved on request")
+	}
+	mq.SetPreserveOrder("stringmember", true)
+	if _, ok, _ := mq.preserveOrderValues(req, filter); !ok {
+		t.Error("order should always be preserved")
+	}
+
+	req, _ = http.NewRequest("GET", "/?stringmember=c&stringmember=a&preserveorder=true&sort=intMember", bytes.NewBufferString(""))
+	if _, _, err := mq.preserveOrderValues(req, filter); err == nil {
+		t.Error("preserveorder combined with sort did not produce an error")
+	}
+}
+
+func TestCreateQueryWithFilter(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	queries := captureQueries(mq)
+	req, _ := http.NewRequest("GET", "/?mybool=true&intMember=1&intMember=2&sort=-floatmember", bytes.NewBufferString(""))
+	q, filter, err := mq.CreateQueryWithFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(filter, bson.M{
+		"mybool": true,
+		"intMember": map[string]interface{}{
+			"$in": []interface{}{1, 2},
+		},
+	}) {
+		t.Errorf("wrong filter returned: %v", filter)
+	}
+	if q == nil || len(*queries) != 1 {
+		t.Fatal("no query returned")
+	}
+	if args := (*queries)[0]; !reflect.DeepEqual(filter, args.filter) || !reflect.DeepEqual(args.sort, []string{"-floatmember"}) {
+		t.Errorf("returned filter %v does not match query criteria %v", filter, args.filter)
+	}
+
+	req, _ = http.NewRequest("GET", "/?notAMember=1", bytes.NewBufferString(""))
+	if _, _, err := mq.CreateQueryWithFilter(req); err == nil {
+		t.Error("unsupported parameter did not produce an error")
+	}
+}
+
+func TestCreateQueryFromForm(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	req, _ := http.NewRequest("POST", "/?intMember=3&sort=-floatmember", bytes.NewBufferString("mybool=true&intMember=1&intMember=2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	_, filter, err := mq.CreateQueryWithFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(filter, bson.M{
+		"mybool":    true,
+		"intMember": map[string]interface{}{"$in": []interface{}{1, 2, 3}},
+	}) {
+		t.Errorf("wrong filter returned: %v", filter)
+	}
+	if req.URL.RawQuery != "intMember=3&sort=-floatmember" {
+		t.Errorf("query string of the request was modified: %s", req.URL.RawQuery)
+	}
+
+	// other bodies are ignored
+	req, _ = http.NewRequest("POST", "/?mybool=true", bytes.NewBufferString(`{"intMember": 1}`))
+	req.Header.Set("Content-Type", "application/json")
+	if _, filter, err = mq.CreateQueryWithFilter(req); err != nil || !reflect.DeepEqual(filter, bson.M{"mybool": true}) {
+		t.Errorf("wrong filter of a json body: %v, %v", filter, err)
+	}
+
+	req, _ = http.NewRequest("POST", "/", bytes.NewBufferString("notAMember=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, _, err := mq.CreateQueryWithFilter(req); err == nil {
+		t.Error("unsupported parameter in the body did not produce an error")
+	}
+
+	req, _ = http.NewRequest("POST", "/", bytes.NewBufferString("mybool=%zz"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, _, err := mq.CreateQueryWithFilter(req); merry.HTTPCode(err) != http.StatusBadRequest {
+		t.Errorf("invalid form body did not produce a bad request: %v", err)
+	}
+}
+
+func TestFilterWithEncodedSpecialCharacters(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetEscapeRegex(true)
+	for query, expected := range map[string]interface{}{
+		"/?stringmember=C%2B%2B":       bson.RegEx{Pattern: `C\+\+`, Options: ""},
+		"/?stringmember=C++":           bson.RegEx{Pattern: `C  `, Options: ""},
+		"/?stringmember=100%25":        bson.RegEx{Pattern: `100%`, Options: ""},
+		"/?stringmember=a%26b%3Dc%23d": bson.RegEx{Pattern: `a&b=c#d`, Options: ""},
+		"/?stringmember=a%2Cb":         bson.RegEx{Pattern: `a,b`, Options: ""},
+		"/?stringmember=Z%C3%BCrich.":  bson.RegEx{Pattern: `Zürich\.`, Options: ""},
+		"/?stringmember=a.b&stringmember=c%2Bd": map[string]interface{}{
+			"$in": []interface{}{"a.b", "c+d"},
+		},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if !reflect.DeepEqual(q["stringmember"], expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+}
+
+func TestCommaSeparatedValues(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetCommaSeparatedValues("stringmember", "intMember")
+	req, _ := http.NewRequest("GET", "/?stringmember=a,b%2Cc,%C3%BC&intMember=1,2&intMember=3&floatmember=2.1", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{
+		"stringmember": map[string]interface{}{
+			"$in": []interface{}{"a", "b,c", "ü"},
+		},
+		"intMember": map[string]interface{}{
+			"$in": []interface{}{1, 2, 3},
+		},
+		"floatmember": 2.1,
+	}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+}
+
+func TestBudgetWarnings(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if w := mq.budgetWarnings(time.Hour, 1<<30); len(w) != 0 {
+		t.Errorf("warnings without budgets: %v", w)
+	}
+
+	mq.SetSoftBudgets(100*time.Millisecond, 1000)
+	if w := mq.budgetWarnings(50*time.Millisecond, 500); len(w) != 0 {
+		t.Errorf("warnings within budgets: %v", w)
+	}
+	if w := mq.budgetWarnings(200*time.Millisecond, 5000); !reflect.DeepEqual(w, []string{WarningLatencyBudgetExceeded, WarningSizeBudgetExceeded}) {
+		t.Errorf("wrong warnings: %v", w)
+	}
+
+	content := &[]TestStruct{{StringMember: "a"}, {StringMember: "b"}}
+	if size := approxSize(content); size == 0 || size%2 != 0 {
+		t.Errorf("wrong approximate size: %d", size)
+	}
+	if size := approxSize(&[]TestStruct{}); size != 0 {
+		t.Errorf("wrong approximate size for empty content: %d", size)
+	}
+}
+
+func TestMaxResultDocuments(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if limit := mq.resultLimit(0); limit != 0 {
+		t.Errorf("limit without maximum: %d", limit)
+	}
+
+	mq.SetMaxResultDocuments(2)
+	for size, expected := range map[uint]int{0: 3, 1: 0, 2: 0, 1000: 3} {
+		if limit := mq.resultLimit(size); limit != expected {
+			t.Errorf("wrong limit for page size %d: %d", size, limit)
+		}
+	}
+
+	content := &[]TestStruct{{StringMember: "a"}, {StringMember: "b"}, {StringMember: "c"}}
+	if !truncate(content, 2) {
+		t.Error("content was not truncated")
+	}
+	if len(*content) != 2 || (*content)[1].StringMember != "b" {
+		t.Errorf("wrong truncated content: %v", *content)
+	}
+	if truncate(content, 2) {
+		t.Error("content at the maximum was truncated")
+	}
+}
+
+func TestArrayMultiValueMode(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.SetArrayMultiValueMode("stringmember", ArrayModeAll); err == nil {
+		t.Error("array mode of a field that is not an array did not produce an error")
+	}
+	if err := mq.SetArrayMultiValueMode("strSliceMember", ArrayMode("$or")); err == nil {
+		t.Error("invalid array mode did not produce an error")
+	}
+	mq.SetCommaSeparatedValues("strSliceMember", "intslicemember")
+	for mode, expected := range map[ArrayMode]map[string]interface{}{
+		ArrayModeIn: {
+			"strSliceMember": map[string]interface{}{"$in": []interface{}{"red", "blue"}},
+			"intslicemember": map[string]interface{}{"$in": []interface{}{1, 2}},
+		},
+		ArrayModeAll: {
+			"strSliceMember": map[string]interface{}{"$all": []interface{}{"red", "blue"}},
+			"intslicemember": map[string]interface{}{"$all": []interface{}{1, 2}},
+		},
+		ArrayModeAndElemMatch: {
+			"$and": []interface{}{
+				map[string]interface{}{"intslicemember": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": 1}}},
+				map[string]interface{}{"intslicemember": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": 2}}},
+				map[string]interface{}{"strSliceMember": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": "red"}}},
+				map[string]interface{}{"strSliceMember": map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": "blue"}}},
+			},
+		},
+	} {
+		for _, field := range []string{"strSliceMember", "intslicemember"} {
+			if err := mq.SetArrayMultiValueMode(field, mode); err != nil {
+				t.Fatalf("error occured: %s", err)
+			}
+		}
+		req, _ := http.NewRequest("GET", "/?strSliceMember=red,blue&intslicemember=1&intslicemember=2", bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", mode, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", mode, q)
+		}
+	}
+
+	// a single value is matched by equality in every mode
+	req, _ := http.NewRequest("GET", "/?strSliceMember=red", bytes.NewBufferString(""))
+	if q, _ := mq.createQueryFilter(req); !reflect.DeepEqual(q, map[string]interface{}{"strSliceMember": bson.RegEx{Pattern: "red"}}) {
+		t.Errorf("wrong query filter generated for a single value: %v", q)
+	}
+}
+
+func TestCountProvider(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	counted := 0
+	mq.count = func(*mgo.Query) (int, error) {
+		counted++
+		return 42, nil
+	}
+	if n, err := mq.countItems(bson.M{}, &mgo.Query{}); err != nil || n != 42 || counted != 1 {
+		t.Errorf("wrong count without provider: %d %v", n, err)
+	}
+
+	var provided bson.M
+	mq.SetCountProvider(func(filter bson.M) (uint, bool, error) {
+		provided = filter
+		if len(filter) > 0 {
+			return 0, false, nil
+		}
+		return 1000, true, nil
+	})
+	if n, err := mq.countItems(bson.M{}, &mgo.Query{}); err != nil || n != 1000 || counted != 1 {
+		t.Errorf("provider was not consulted: %d %v", n, err)
+	}
+	req, _ := http.NewRequest("GET", "/?mybool=true", bytes.NewBufferString(""))
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if n, err := mq.countItems(spec.Filter, &mgo.Query{}); err != nil || n != 42 || counted != 2 {
+		t.Errorf("wrong fallback count: %d %v", n, err)
+	}
+	if !reflect.DeepEqual(provided, bson.M{"mybool": true}) {
+		t.Errorf("wrong filter passed to the provider: %v", provided)
+	}
+
+	mq.SetCountProvider(func(filter bson.M) (uint, bool, error) {
+		return 0, false, errors.New("counts are not available")
+	})
+	if _, err := mq.countItems(bson.M{}, &mgo.Query{}); err == nil {
+		t.Error("error of the provider was not returned")
+	} else if merry.HTTPCode(err) != http.StatusInternalServerError {
+		t.Errorf("wrong status code: %d", merry.HTTPCode(err))
+	}
+}
+
+func TestAliases(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddAlias("intAlias", "intMember")
+	mq.AddAlias("flag", "mybool")
+
+	req, _ := http.NewRequest("GET", "/?intAlias=2&field=intAlias&field=flag&sort=-intAlias&sort=flag", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{"intMember": 2}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+	f, err := mq.createFieldsMap(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(f, map[string]interface{}{"intMember": 1, "mybool": 1}) {
+		t.Errorf("wrong fields map generated: %v", f)
+	}
+	s, err := mq.createSortFields(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(s, []string{"-intMember", "mybool"}) {
+		t.Errorf("wrong sort fields generated: %v", s)
+	}
+
+	req, _ = http.NewRequest("GET", "/?intAlias=2&intMember=3", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("alias and parameter in the same request did not produce an error")
+	}
+}
+
+func TestRecentFilter(t *testing.T) {
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetClock(func() time.Time { return now })
+
+	req, _ := http.NewRequest("GET", "/?within=24h", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("within without a recent field did not produce an error")
+	}
+
+	mq.SetRecentField("timemember")
+	for within, expected := range map[string]time.Time{
+		"24h":    now.Add(-24 * time.Hour),
+		"90m":    now.Add(-90 * time.Minute),
+		"1h30s":  now.Add(-time.Hour - 30*time.Second),
+		"500ms":  now.Add(-500 * time.Millisecond),
+		"168h0m": now.AddDate(0, 0, -7),
+	} {
+		req, _ = http.NewRequest("GET", "/?within="+within, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if !reflect.DeepEqual(q, map[string]interface{}{
+			"timemember": map[string]interface{}{"$gte": expected},
+		}) {
+			t.Errorf("wrong query filter generated for %s: %v", within, q)
+		}
+	}
+
+	for _, within := range []string{"1d", "-1h", "0s", ""} {
+		req, _ = http.NewRequest("GET", "/?within="+within, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("invalid within value '%s' did not produce an error", within)
+		}
+	}
+}
+
+func TestBooleanStringFields(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?stringmember=true", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": bson.RegEx{Pattern: "true", Options: ""}}) {
+		t.Errorf("wrong query filter without boolean string fields: %v", q)
+	}
+
+	mq.SetBooleanStringFields("stringmember")
+	mq.SetMatchMode(MatchModePrefix)
+	for query, expected := range map[string]map[string]interface{}{
+		"/?stringmember=true":                    {"stringmember": "true"},
+		"/?stringmember=false":                   {"stringmember": "false"},
+		"/?stringmember=true&stringmember=false": {"stringmember": map[string]interface{}{"$in": []interface{}{"true", "false"}}},
+		"/?stringmember=True":                    {"stringmember": mq.prefixFilter("stringmember", "True")},
+		"/?stringmember=true&stringmember=maybe": {"stringmember": map[string]interface{}{"$in": []interface{}{"true", "maybe"}}},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("%s: error occured: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("%s: wrong query filter: %v", query, q)
+		}
+	}
+}
+
+func TestSyncFilter(t *testing.T) {
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetClock(func() time.Time { return now })
+
+	req, _ := http.NewRequest("GET", "/?modifiedSince=2015-02-28T10:00:00Z", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("modifiedSince without a sync field did not produce an error")
+	}
+	if mq.syncedAt() != nil {
+		t.Error("syncedAt without a sync field")
+	}
+
+	mq.SetSyncField("timemember")
+	for modifiedSince, expected := range map[string]time.Time{
+		"2015-02-28T10:00:00Z":           time.Date(2015, 2, 28, 10, 0, 0, 0, time.UTC),
+		"2015-02-28T10:00:00.123456789Z": time.Date(2015, 2, 28, 10, 0, 0, 123456789, time.UTC),
+		"2015-02-28T11:00:00%2B01:00":    time.Date(2015, 2, 28, 10, 0, 0, 0, time.UTC),
+	} {
+		req, _ = http.NewRequest("GET", "/?modifiedSince="+modifiedSince, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		doc, _ := q["timemember"].(map[string]interface{})
+		if gt, ok := doc["$gt"].(time.Time); len(q) != 1 || !ok || !gt.Equal(expected) {
+			t.Errorf("wrong query filter generated for %s: %v", modifiedSince, q)
+		}
+	}
+
+	for _, query := range []string{"/?modifiedSince=2015-02-28", "/?modifiedSince=", "/?modifiedSince=2015-02-28T10:00:00Z&timemember__gte=2015-01-01T00:00:00Z"} {
+		req, _ = http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("%s did not produce an error", query)
+		}
+	}
+
+	syncedAt := mq.syncedAt()
+	if syncedAt == nil || !syncedAt.Equal(now) {
+		t.Errorf("wrong syncedAt: %v", syncedAt)
+	}
+	response := &Response{Page: Page{Size: 20, Current: 1}, SyncedAt: syncedAt}
+	b, _ := json.Marshal(response)
+	if !strings.Contains(string(b), `"syncedAt":"2015-03-01T12:00:00Z"`) {
+		t.Errorf("wrong JSON of the response: %s", b)
+	}
+	etag := response.ETag()
+	later := now.Add(time.Minute)
+	response.SyncedAt = &later
+	if response.ETag() != etag {
+		t.Error("ETag changes with syncedAt")
+	}
+}
+
+func TestFloatTolerance(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddOrOverwriteValidParameter("price", reflect.Float64)
+	if err := mq.SetFloatTolerance("intMember", 0.1); err == nil {
+		t.Error("tolerance on an int parameter did not produce an error")
+	}
+	if err := mq.SetFloatTolerance("floatmember", 0.5); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.SetFloatTolerance("price", 0.25); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/?floatmember=2&intMember=1", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{
+		"floatmember": map[string]interface{}{"$gte": 1.5, "$lte": 2.5},
+		"intMember":   1,
+	}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+
+	req, _ = http.NewRequest("GET", "/?floatmember=2&floatmember=4", bytes.NewBufferString(""))
+	q, err = mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{
+		"$or": []interface{}{
+			map[string]interface{}{"floatmember": map[string]interface{}{"$gte": 1.5, "$lte": 2.5}},
+			map[string]interface{}{"floatmember": map[string]interface{}{"$gte": 3.5, "$lte": 4.5}},
+		},
+	}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+
+	req, _ = http.NewRequest("GET", "/?floatmember=2&floatmember=4&price=1&price=2", bytes.NewBufferString(""))
+	q, err = mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if and, ok := q["$and"].([]interface{}); !ok || len(and) != 2 || len(q) != 1 {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+
+	if err := mq.SetFloatTolerance("floatmember", 0); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	req, _ = http.NewRequest("GET", "/?floatmember=2", bytes.NewBufferString(""))
+	q, _ = mq.createQueryFilter(req)
+	if !reflect.DeepEqual(q, map[string]interface{}{"floatmember": 2.0}) {
+		t.Errorf("wrong query filter generated without tolerance: %v", q)
+	}
+}
+
+func TestMaxProjectionFields(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetMaxProjectionFields(2)
+	for query, valid := range map[string]bool{
+		"/?field=mybool":                                      true,
+		"/?field=mybool&field=floatmember":                    true,
+		"/?field=mybool&field=floatmember&field=mybool":       true,
+		"/?field=mybool&field=floatmember&field=embeddedint":  false,
+		"/?field=mybool&field=floatmember&field=notAMember":   false,
+		"/?field=mybool&field=floatmember&field=stringmember": false,
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.createFieldsMap(req)
+		if valid && err != nil {
+			t.Errorf("error occured for %s: %s", query, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("query %s did not produce an error", query)
+		}
+	}
+}
+
+func TestExclusionPreset(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.AddExclusionPreset("lite", "strSliceMember", "intsliceMember"); err == nil {
+		t.Error("unsupported field did not produce an error")
+	}
+	if err := mq.AddExclusionPreset("mybool", "strSliceMember"); err == nil {
+		t.Error("preset with the name of a parameter did not produce an error")
+	}
+	if err := mq.AddExclusionPreset("lite", "strSliceMember", "intslicemember"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.AddExclusionPreset("notime", "timemember"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	for query, expected := range map[string]map[string]interface{}{
+		"/?field=lite":                {"strSliceMember": 0, "intslicemember": 0},
+		"/?field=lite&field=notime":   {"strSliceMember": 0, "intslicemember": 0, "timemember": 0},
+		"/?field=mybool&field=lite":   nil,
+		"/?field=notime&field=mybool": nil,
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		p, err := mq.createFieldsMap(req)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("mixing inclusion and exclusion did not produce an error for %s", query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error occured for %s: %s", query, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, expected) {
+			t.Errorf("wrong projection generated for %s: %v", query, p)
+		}
+	}
+
+	mq.SetProjectionPolicy(func(req *http.Request) ([]string, error) {
+		return []string{"mybool", "timemember"}, nil
+	}, false)
+	req, _ := http.NewRequest("GET", "/?field=notime", bytes.NewBufferString(""))
+	p, err := mq.createFieldsMap(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(p, map[string]interface{}{"mybool": 1}) {
+		t.Errorf("wrong projection generated with projection policy: %v", p)
+	}
+}
+
+type tenantKey struct{}
+
+func TestCreateQueryWithContext(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.AddOrOverwriteValidParameter("tenant", reflect.String)
+	mq.SetTenant("tenant", func(ctx context.Context) (interface{}, error) {
+		tenant, ok := ctx.Value(tenantKey{}).(string)
+		if !ok {
+			return nil, errors.New("no tenant")
+		}
+		return tenant, nil
+	})
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	queries := captureQueries(mq)
+
+	req, _ := http.NewRequest("GET", "/?mybool=true", bytes.NewBufferString(""))
+	if _, err := mq.CreateQueryWithContext(ctx, req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if f := (*queries)[0].filter; !reflect.DeepEqual(f, bson.M{"mybool": true, "tenant": "acme"}) {
+		t.Errorf("wrong query filter generated: %v", f)
+	}
+
+	if _, err := mq.CreateQueryWithContext(context.Background(), req); err == nil {
+		t.Error("missing tenant did not produce an error")
+	}
+	if _, err := mq.CreateQuery(req); err == nil {
+		t.Error("missing tenant in request context did not produce an error")
+	}
+
+	for _, query := range []string{"/?tenant=other", "/?tenant=a&tenant=b"} {
+		req, _ = http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.CreateQueryWithContext(ctx, req); err == nil {
+			t.Errorf("tenant override '%s' did not produce an error", query)
+		}
+	}
+}
+
+func TestCreateQuerySelect(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	queries := captureQueries(mq)
+	req, _ := http.NewRequest("GET", "/?mybool=true", bytes.NewBufferString(""))
+	if _, err := mq.CreateQuery(req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if s := (*queries)[0].selector; s != nil {
+		t.Errorf("query without field parameter has a projection: %v", s)
+	}
+
+	req, _ = http.NewRequest("GET", "/?field=mybool", bytes.NewBufferString(""))
+	if _, err := mq.CreateQuery(req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if s := (*queries)[1].selector; !reflect.DeepEqual(s, bson.M{"mybool": 1}) {
+		t.Errorf("wrong projection: %v", s)
+	}
+}
+
+func TestNilDatabase(t *testing.T) {
+	func() {
+		defer func() {
+			if r := recover(); r != errNilDatabase {
+				t.Errorf("wrong panic: %v", r)
+			}
+		}()
+		NewMongoQuery(TestStruct{}, nil)
+	}()
+
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	func() {
+		defer func() {
+			if r := recover(); r != errNoSession {
+				t.Errorf("wrong panic: %v", r)
+			}
+		}()
+		mq.CreateQuery(httptest.NewRequest("GET", "/", nil))
+	}()
+	if err := mq.Ping(context.Background()); merry.HTTPCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("wrong error of ping without session: %v", err)
+	}
+}
+
+func TestAllowedHints(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	req, _ := http.NewRequest("GET", "/?hint=stringmember_1", bytes.NewBufferString(""))
+	if _, err := mq.CreateQuery(req); err == nil {
+		t.Error("hint without allowed hints did not produce an error")
+	}
+	for _, h := range []string{"stringmember", "_1", "location_2dsphere", "stringmember_text"} {
+		if err := mq.SetAllowedHints(h); err == nil {
+			t.Errorf("invalid hint %s did not produce an error", h)
+		}
+	}
+	if err := mq.SetAllowedHints("stringmember_1", "intMember_1_created_at_-1"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	queries := captureQueries(mq)
+	for query, expected := range map[string][]string{
+		"/?mybool=true":                                nil,
+		"/?hint=stringmember_1":                        {"stringmember"},
+		"/?mybool=true&hint=intMember_1_created_at_-1": {"intMember", "-created_at"},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.CreateQuery(req); err != nil {
+			t.Fatalf("%s: error occured: %s", query, err)
+		}
+		if h := (*queries)[len(*queries)-1].hint; !reflect.DeepEqual(h, expected) {
+			t.Errorf("%s: wrong hint: %v", query, h)
+		}
+	}
+
+	for _, query := range []string{"/?hint=mybool_1", "/?hint=stringmember_-1", "/?hint=stringmember_1&hint=stringmember_1"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.CreateQuery(req)
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("%s: wrong HTTP code: %d", query, merry.HTTPCode(err))
+		}
+	}
+}
+
+func TestLiteralDotParameter(t *testing.T) {
+	type config struct {
+		Enabled bool
+	}
+	type legacy struct {
+		Name   string
+		Config config
+	}
+	mq := NewMongoQuery(legacy{}, &mgo.Database{})
+	mq.SetMaxPathDepth(2)
+	if err := mq.AddParameter(`config\.v2`, reflect.String); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.AddParameter(`a\.b\.c`, reflect.Int); err != nil {
+		t.Fatalf("literal parameter exceeding the maximum path depth produced an error: %s", err)
+	}
+	if err := mq.AddParameter(`config.x\.y`, reflect.Int); err == nil {
+		t.Error("parameter with escaped and unescaped dots did not produce an error")
+	}
+
+	req, _ := http.NewRequest("GET", "/?config.v2=on&a.b.c__gt=3&a.b.c__lt=9&name=peter&field=config", bytes.NewBufferString(""))
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	// MongoDB reads the keys of a filter as paths
+	if !reflect.DeepEqual(spec.Filter, bson.M{
+		"name": bson.RegEx{Pattern: "peter", Options: ""},
+		"$expr": map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"$gt": []interface{}{map[string]interface{}{"$getField": "a.b.c"}, 3}},
+			map[string]interface{}{"$lt": []interface{}{map[string]interface{}{"$getField": "a.b.c"}, 9}},
+			map[string]interface{}{"$regexMatch": map[string]interface{}{"input": map[string]interface{}{"$getField": "config.v2"}, "regex": "on", "options": ""}},
+		}},
+	}) {
+		t.Errorf("wrong filter: %v", spec.Filter)
+	}
+
+	req, _ = http.NewRequest("GET", "/?a.b.c=1&a.b.c=2&config.v2__exists=false", bytes.NewBufferString(""))
+	if spec, err = mq.ParseSpec(context.Background(), req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	field := map[string]interface{}{"$getField": "a.b.c"}
+	if !reflect.DeepEqual(spec.Filter, bson.M{
+		"$expr": map[string]interface{}{"$and": []interface{}{
+			map[string]interface{}{"$or": []interface{}{
+				map[string]interface{}{"$eq": []interface{}{field, 1}},
+				map[string]interface{}{"$eq": []interface{}{field, 2}},
+			}},
+			map[string]interface{}{"$eq": []interface{}{map[string]interface{}{"$type": map[string]interface{}{"$getField": "config.v2"}}, "missing"}},
+		}},
+	}) {
+		t.Errorf("wrong filter: %v", spec.Filter)
+	}
+
+	// sorts are read as paths too
+	req, _ = http.NewRequest("GET", "/?sort=a.b.c", bytes.NewBufferString(""))
+	if _, err := mq.ParseSpec(context.Background(), req); merry.HTTPCode(err) != http.StatusBadRequest {
+		t.Errorf("sort by literal field did not produce an error: %v", err)
+	}
+
+	// selected fields are projected with $getField and renamed
+	req, _ = http.NewRequest("GET", "/?field=config.v2&field=config&field=name", bytes.NewBufferString(""))
+	if spec, err = mq.ParseSpec(context.Background(), req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(spec.Fields, bson.M{"config.v2": 1, "config": 1, "name": 1}) {
+		t.Errorf("wrong fields: %v", spec.Fields)
+	}
+	pipeline := mq.specPipeline(spec)
+	if len(pipeline) < 2 {
+		t.Fatalf("literal field is not selected with a pipeline: %v", pipeline)
+	}
+	if !reflect.DeepEqual(pipeline[len(pipeline)-2:], []bson.M{
+		{"$project": bson.M{"_literal_config_v2": bson.M{"$getField": "config.v2"}, "config": 1, "name": 1}},
+		{"$replaceWith": bson.M{"$setField": bson.M{
+			"field": "config.v2",
+			"input": bson.M{"$unsetField": bson.M{"field": "_literal_config_v2", "input": "$$ROOT"}},
+			"value": "$_literal_config_v2",
+		}}},
+	}) {
+		t.Errorf("wrong projection of literal field: %v", pipeline)
+	}
+
+	doc := bson.M{"config.v2": "on", "config": bson.M{"v2": "off"}}
+	if v, ok := fieldByParameterName(reflect.ValueOf(doc), "config.v2"); !ok || v.Interface() != "on" {
+		t.Errorf("wrong value of the literal field: %v", v)
+	}
+	doc = bson.M{"config": bson.M{"v2": "off"}}
+	if v, ok := fieldByParameterName(reflect.ValueOf(doc), "config.v2"); !ok || v.Interface() != "off" {
+		t.Errorf("wrong value of the path: %v", v)
+	}
+}
+
+func TestMaxPathDepth(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.AddParameter("a.b.c.d", reflect.Int); err != nil {
+		t.Errorf("error occured: %s", err)
+	}
+	if err := mq.AddParameter("a.b.c.d.e", reflect.Int); err == nil {
+		t.Error("parameter exceeding the maximum path depth did not produce an error")
+	}
+	if _, ok := mq.supportedParameters["a.b.c.d.e"]; ok {
+		t.Error("parameter exceeding the maximum path depth was added")
+	}
+	mq.AddOrOverwriteValidParameter("a.b.c.d.e", reflect.Int)
+
+	for query, valid := range map[string]bool{
+		"/?a.b.c.d=1":       true,
+		"/?a.b.c.d.e=1":     false,
+		"/?a.b.c.d.e.f.g=1": false,
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.createQueryFilter(req)
+		if valid && err != nil {
+			t.Errorf("error occured for %s: %s", query, err)
+		}
+		if !valid && (err == nil || !strings.Contains(err.Error(), "a.b.c.d.e")) {
+			t.Errorf("query %s did not produce an error naming the parameter: %v", query, err)
+		}
+	}
+
+	for _, query := range []string{"/?sort=a.b.c.d.e", "/?sort=-a.b.c.d.e", "/?field=a.b.c.d.e"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.ParseSpec(context.Background(), req)
+		if err == nil || !strings.Contains(err.Error(), "maximum path depth") {
+			t.Errorf("query %s did not produce a path depth error: %v", query, err)
+		}
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("wrong status code for %s: %d", query, merry.HTTPCode(err))
+		}
+	}
+
+	mq.SetMaxPathDepth(0)
+	req, _ := http.NewRequest("GET", "/?a.b.c.d.e=1", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err != nil {
+		t.Errorf("error occured without maximum path depth: %s", err)
+	}
+}
+
+func TestCreateFieldsMapWithSubFields(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, expected := range map[string]map[string]interface{}{
+		"/?field=embeddedmember.embeddedbool":                                                       {"embeddedmember.embeddedbool": 1},
+		"/?field=embeddedmember.embeddedbool&field=embeddedmember.embeddedint":                      {"embeddedmember.embeddedbool": 1, "embeddedmember.embeddedint": 1},
+		"/?field=embeddedmember.embeddedbool&field=embeddedmember":                                  {"embeddedmember": 1},
+		"/?field=embeddedmember&field=embeddedmember.embeddedint&field=embeddedmember.embeddedbool": {"embeddedmember": 1},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		f, err := mq.createFieldsMap(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if !reflect.DeepEqual(f, expected) {
+			t.Errorf("wrong fields map generated for %s: %v", query, f)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/?field=embeddedmember.notAMember", bytes.NewBufferString(""))
+	if _, err := mq.createFieldsMap(req); err == nil {
+		t.Error("invalid sub field did not produce an error")
+	}
+
+	// a document projected to embeddedmember.embeddedbool
+	b, _ := bson.Marshal(bson.M{"embeddedmember": bson.M{"embeddedbool": true}})
+	doc := TestStruct{}
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if doc.EmbeddedMember != (Embedded{EmbeddedBool: true}) {
+		t.Errorf("wrong document decoded: %v", doc)
+	}
+}
+
+func TestProjectionOfStructFields(t *testing.T) {
+	type address struct {
+		City   string
+		Street string
+	}
+	type item struct {
+		Name  string
+		Price float64
+	}
+	type person struct {
+		Name    string
+		Address *address
+		Items   []item
+		Tags    []string
+	}
+	mq := NewMongoQuery(person{}, &mgo.Database{})
+	mq.DisableParameters("address.city")
+	for query, expected := range map[string]map[string]interface{}{
+		"/?field=address.city":                 {"address.city": 1},
+		"/?field=items.name&field=tags":        {"items.name": 1, "tags": 1},
+		"/?field=address&field=address.city":   {"address": 1},
+		"/?field=address&field=address.street": {"address": 1},
+		"/?field=name&field=address.street":    {"name": 1, "address.street": 1},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		f, err := mq.createFieldsMap(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(f, expected) {
+			t.Errorf("wrong fields map generated for %s: %v", query, f)
+		}
+	}
+	for _, query := range []string{"/?field=address.country", "/?field=items.name.first", "/?address.city=bern"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.ParseSpec(context.Background(), req); err == nil {
+			t.Errorf("query %s did not produce an error", query)
+		}
+	}
+
+	// fields disabled for filtering and their sub fields can still be selected
+	mq.DisableParameters("tags", "address")
+	for _, query := range []string{"/?field=tags", "/?field=address", "/?field=address.street"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createFieldsMap(req); err != nil {
+			t.Errorf("error occured for %s: %s", query, err)
+		}
+	}
+
+	if tree := mq.FieldTree(); !reflect.DeepEqual(tree, map[string]reflect.Kind{
+		"name":           reflect.String,
+		"address":        reflect.Struct,
+		"address.city":   reflect.String,
+		"address.street": reflect.String,
+		"items":          reflect.Struct,
+		"items.name":     reflect.String,
+		"items.price":    reflect.Float64,
+		"tags":           reflect.String,
+	}) {
+		t.Errorf("wrong field tree: %v", tree)
+	}
+}
+
+func TestNestedProjection(t *testing.T) {
+	type address struct {
+		City   string
+		Street string
+	}
+	type person struct {
+		Name    string
+		Address address
+		Labels  map[string]string
+	}
+	mq := NewMongoQuery(person{}, &mgo.Database{})
+	mq.SetProjectStructFields(true)
+	// sub fields of maps are not in the field tree and have to be registered
+	mq.AddOrOverwriteValidParameter("labels.color", reflect.String)
+	for query, expected := range map[string]bson.M{
+		"/?field=address.city":                    {"address.city": 1},
+		"/?field=address.city&field=labels.color": {"address.city": 1, "labels.color": 1},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		spec, err := mq.ParseSpec(context.Background(), req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(spec.Fields, expected) {
+			t.Errorf("wrong fields generated for %s: %v", query, spec.Fields)
+		}
+	}
+	for _, query := range []string{"/?field=address.zip", "/?field=labels.size", "/?field=address.city.name"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.ParseSpec(context.Background(), req); err == nil {
+			t.Errorf("query %s did not produce an error", query)
+		}
+	}
+}
+
+func TestCommaSeparatedEmptyList(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetCommaSeparatedValues("stringmember", "intMember", "floatmember")
+	mq.SetFloatTolerance("floatmember", 0.1)
+	for _, query := range []string{"/?stringmember=", "/?stringmember=,", "/?intMember=", "/?floatmember", "/?stringmember=&stringmember="} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		for _, v := range q {
+			if !reflect.DeepEqual(v, map[string]interface{}{"$in": []interface{}{}}) || len(q) != 1 {
+				t.Errorf("wrong query filter generated for %s: %v", query, q)
+			}
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/?stringmember=a,,b", bytes.NewBufferString(""))
+	q, _ := mq.createQueryFilter(req)
+	if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": map[string]interface{}{"$in": []interface{}{"a", "b"}}}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+
+	mq.SetRejectEmptyLists(true)
+	req, _ = http.NewRequest("GET", "/?stringmember=", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("empty list did not produce an error")
+	}
+}
+
+func TestProjectionPolicy(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetProjectionPolicy(func(req *http.Request) ([]string, error) {
+		switch req.Header.Get("Role") {
+		case "public":
+			return []string{"stringmember", "mybool"}, nil
+		case "partner":
+			return []string{"stringmember", "mybool", "embeddedmember"}, nil
+		}
+		return nil, errors.New("unknown role")
+	}, false)
+
+	for _, test := range []struct {
+		role     string
+		query    string
+		expected map[string]interface{}
+	}{
+		{"public", "/", map[string]interface{}{"stringmember": 1, "mybool": 1}},
+		{"public", "/?field=mybool&field=intMember", map[string]interface{}{"mybool": 1}},
+		{"public", "/?field=intMember", map[string]interface{}{"_id": 1}},
+		{"partner", "/?field=embeddedmember.embeddedint&field=intMember", map[string]interface{}{"embeddedmember.embeddedint": 1}},
+	} {
+		req, _ := http.NewRequest("GET", test.query, bytes.NewBufferString(""))
+		req.Header.Set("Role", test.role)
+		f, err := mq.createFieldsMap(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if !reflect.DeepEqual(f, test.expected) {
+			t.Errorf("wrong fields map generated for %s %s: %v", test.role, test.query, f)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/", bytes.NewBufferString(""))
+	if _, err := mq.createFieldsMap(req); merry.HTTPCode(err) != http.StatusForbidden {
+		t.Errorf("policy error did not produce a 403: %v", err)
+	}
+
+	mq.SetProjectionPolicy(func(req *http.Request) ([]string, error) {
+		return []string{"stringmember"}, nil
+	}, true)
+	req, _ = http.NewRequest("GET", "/?field=stringmember&field=intMember", bytes.NewBufferString(""))
+	if _, err := mq.createFieldsMap(req); merry.HTTPCode(err) != http.StatusForbidden {
+		t.Errorf("forbidden field did not produce a 403: %v", err)
+	}
+
+	// the policy can allow aliases
+	mq.AddAlias("name", "stringmember")
+	mq.SetProjectionPolicy(func(req *http.Request) ([]string, error) {
+		return []string{"name"}, nil
+	}, true)
+	for _, query := range []string{"/?field=name", "/?field=stringmember"} {
+		req, _ = http.NewRequest("GET", query, bytes.NewBufferString(""))
+		f, err := mq.createFieldsMap(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(f, map[string]interface{}{"stringmember": 1}) {
+			t.Errorf("wrong fields map generated for %s: %v", query, f)
+		}
+	}
+}
+
+func TestMultipleAliases(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddAliases("stringmember", "sm", "stringMember", "name")
+	for _, alias := range []string{"sm", "stringMember", "name", "stringmember"} {
+		req, _ := http.NewRequest("GET", "/?"+alias+"=a&"+alias+"=b", bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": map[string]interface{}{"$in": []interface{}{"a", "b"}}}) {
+			t.Errorf("wrong query filter generated for %s: %v", alias, q)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/?sm=a&name=b", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("two aliases of the same parameter did not produce an error")
+	}
+}
+
+func TestDeduplicateValues(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?stringmember=active&stringmember=active&stringmember=archived&intMember=1&intMember=1", bytes.NewBufferString(""))
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{
+		"stringmember": map[string]interface{}{"$in": []interface{}{"active", "archived"}},
+		"intMember":    1,
+	}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+
+	req, _ = http.NewRequest("GET", "/?stringmember=active&stringmember=%20active%20&stringmember=archived", bytes.NewBufferString(""))
+	q, _ = mq.createQueryFilter(req)
+	if !reflect.DeepEqual(q["stringmember"], map[string]interface{}{"$in": []interface{}{"active", " active ", "archived"}}) {
+		t.Errorf("values should not be trimmed per default: %v", q)
+	}
+	mq.TrimValues(true)
+	q, _ = mq.createQueryFilter(req)
+	if !reflect.DeepEqual(q["stringmember"], map[string]interface{}{"$in": []interface{}{"active", "archived"}}) {
+		t.Errorf("wrong query filter generated with trimmed values: %v", q)
+	}
+}
+
+func TestTrimValues(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetStrictNumericParsing(true)
+	req, _ := http.NewRequest("GET", "/?intMember=%2042&floatmember=1.5%09&uintmember=%E2%80%837", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("untrimmed numeric values did not produce an error")
+	}
+	mq.TrimValues(true)
+	q, err := mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q, map[string]interface{}{
+		"intMember":   42,
+		"floatmember": 1.5,
+		"uintmember":  uint(7),
+	}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+
+	mq.SetCommaSeparatedValues("intMember")
+	req, _ = http.NewRequest("GET", "/?intMember=1,%20,%202", bytes.NewBufferString(""))
+	q, err = mq.createQueryFilter(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(q["intMember"], map[string]interface{}{"$in": []interface{}{1, 2}}) {
+		t.Errorf("wrong query filter generated: %v", q)
+	}
+	req, _ = http.NewRequest("GET", "/?intMember=%20,%20", bytes.NewBufferString(""))
+	q, _ = mq.createQueryFilter(req)
+	if !reflect.DeepEqual(q["intMember"], map[string]interface{}{"$in": []interface{}{}}) {
+		t.Errorf("values that are empty after trimming should be omitted: %v", q)
+	}
+	mq.SetRejectEmptyLists(true)
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("list that is empty after trimming did not produce an error")
+	}
+}
+
+func TestDeduplicateSortFields(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?sort=-stringmember&sort=mybool&sort=-stringmember&sort=mybool", bytes.NewBufferString(""))
+	s, err := mq.createSortFields(req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(s, []string{"-stringmember", "mybool"}) {
+		t.Errorf("wrong sort fields generated: %v", s)
+	}
+
+	req, _ = http.NewRequest("GET", "/?sort=-stringmember&sort=stringmember", bytes.NewBufferString(""))
+	if _, err := mq.createSortFields(req); err == nil {
+		t.Error("conflicting sort directions did not produce an error")
+	}
+}
+
+func TestMatchMode(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for query, expected := range map[string]interface{}{
+		"/?stringmember=peter":                 bson.RegEx{Pattern: "peter", Options: ""},
+		"/?stringmember=peter&matchmode=regex": bson.RegEx{Pattern: "peter", Options: ""},
+		"/?stringmember=peter&matchmode=exact": "peter",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": expected}) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/?stringmember=peter&matchmode=fuzzy", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("invalid match mode did not produce an error")
+	}
+
+	if err := mq.SetMatchMode("fuzzy"); err == nil {
+		t.Error("invalid default match mode did not produce an error")
+	}
+	if err := mq.SetMatchMode(MatchModeExact); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	for query, expected := range map[string]interface{}{
+		"/?stringmember=peter":                 "peter",
+		"/?stringmember=peter&matchmode=regex": bson.RegEx{Pattern: "peter", Options: ""},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, map[string]interface{}{"stringmember": expected}) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+}
+
+func TestRunPreservingInOrder(t *testing.T) {
+	mq := NewMongoQuery(orderedStruct{}, &mgo.Database{})
+	a, b, c := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	req, _ := http.NewRequest("GET", "/?_id="+c.Hex()+"&_id="+a.Hex()+"&_id="+b.Hex(), bytes.NewBufferString(""))
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	values, ok := inValues(spec.Filter, "_id")
+	if !ok {
+		t.Fatal("no values found for _id")
+	}
+	content := &[]orderedStruct{{ID: a}, {ID: b}, {ID: c}}
+	orderByValues(content, "_id", values)
+	if !reflect.DeepEqual(*content, []orderedStruct{{ID: c}, {ID: a}, {ID: b}}) {
+		t.Errorf("order does not match the requested ids: %v", *content)
+	}
+
+	for _, query := range []string{"/?_id=" + a.Hex(), "/?_id=" + a.Hex() + "&sort=name"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.RunPreservingInOrder(req, "notAMember"); err == nil {
+			t.Errorf("unsupported field did not produce an error for %s", query)
+		}
+	}
+	req, _ = http.NewRequest("GET", "/?_id="+a.Hex()+"&sort=name", bytes.NewBufferString(""))
+	if _, err := mq.RunPreservingInOrder(req, "_id"); err == nil {
+		t.Error("combination with sort did not produce an error")
+	}
+	req, _ = http.NewRequest("POST", "/?_id="+a.Hex(), bytes.NewBufferString("sort=name"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := mq.RunPreservingInOrder(req, "_id"); err == nil {
+		t.Error("combination with sort in the form body did not produce an error")
+	}
+
+	// the documents are returned in the order of the requested ids
+	mq = NewMongoQuery(orderedStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.count = func(q *mgo.Query) (int, error) { return 3, nil }
+	mq.all = func(q *mgo.Query, content interface{}) error {
+		*content.(*[]orderedStruct) = []orderedStruct{{ID: a}, {ID: b}, {ID: c}}
+		return nil
+	}
+	req, _ = http.NewRequest("GET", "/?_id="+c.Hex()+"&_id="+a.Hex()+"&_id="+b.Hex(), bytes.NewBufferString(""))
+	r, err := mq.RunPreservingInOrder(req, "_id")
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if docs := *r.Content.(*[]orderedStruct); !reflect.DeepEqual(docs, []orderedStruct{{ID: c}, {ID: a}, {ID: b}}) {
+		t.Errorf("order does not match the requested ids: %v", docs)
+	}
+}
+
+func TestBoolWildcard(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for _, query := range []string{"/?mybool=any", "/?mybool=", "/?mybool=true&mybool=any"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.createQueryFilter(req); err == nil {
+			t.Errorf("wildcard is not rejected per default for %s", query)
+		}
+	}
+
+	mq.SetBoolWildcard(true)
+	for query, expected := range map[string]map[string]interface{}{
+		"/?mybool=any":                          {},
+		"/?mybool=":                             {},
+		"/?mybool=any&mybool=":                  {},
+		"/?mybool=false":                        {"mybool": false},
+		"/?mybool=true&mybool=any":              {"mybool": true},
+		"/?mybool=true&mybool=any&mybool=false": {"mybool": map[string]interface{}{"$in": []interface{}{true, false}}},
+		"/?mybool=any&intMember=1":              {"intMember": 1},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Errorf("error occured for %s: %s", query, err)
+			continue
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/?mybool=maybe", bytes.NewBufferString(""))
+	if _, err := mq.createQueryFilter(req); err == nil {
+		t.Error("invalid bool value did not produce an error")
+	}
+}
+
+func TestRequireTogether(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.RequireTogether("intMember", "uintmember", "floatmember")
+	mq.RequireTogether("floatmember", "bool")
+	mq.AddAlias("bool", "mybool")
+	for query, missing := range map[string]string{
+		"/":                  "",
+		"/?stringmember=foo": "",
+		"/?intMember=1&uintmember=2&floatmember=3&bool=true": "",
+		"/?intMember=1":                            "uintmember, floatmember",
+		"/?intMember=1&uintmember=2":               "floatmember",
+		"/?floatmember=3&mybool=true":              "intMember, uintmember",
+		"/?intMember=1&uintmember=2&floatmember=3": "bool",
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		_, err := mq.createQueryFilter(req)
+		if len(missing) == 0 {
+			if err != nil {
+				t.Errorf("error occured for %s: %s", query, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("incomplete group did not produce an error for %s", query)
+			continue
+		}
+		if merry.HTTPCode(err) != http.StatusUnprocessableEntity {
+			t.Errorf("wrong http code for %s: %d", query, merry.HTTPCode(err))
+		}
+		if !strings.HasSuffix(err.Error(), "missing "+missing) {
+			t.Errorf("wrong error message for %s: %s", query, err)
+		}
+	}
+}
+
+type Person struct {
+	Name string
+}
+
+func TestSetCollectionNameFunc(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Name: "test"})
+	if name := mq.collection().Name; name != "teststruct" {
+		t.Errorf("wrong default collection name: %s", name)
+	}
+
+	mq = NewMongoQuery(Person{}, &mgo.Database{Name: "test"})
+	mq.SetCollectionNameFunc(func(name string) string {
+		if name == "person" {
+			return "people"
+		}
+		return name + "s"
+	})
+	if c := mq.collection(); c.Name != "people" || c.FullName != "test.people" {
+		t.Errorf("wrong collection name: %s", c.FullName)
+	}
+	mq = NewMongoQuery(TestStruct{}, &mgo.Database{Name: "test"})
+	mq.SetCollectionNameFunc(func(name string) string { return name + "s" })
+	if name := mq.collection().Name; name != "teststructs" {
+		t.Errorf("wrong collection name: %s", name)
+	}
+}
+
+func TestSharedCollection(t *testing.T) {
+	mq := NewMongoQueryForCollection(TestStruct{}, &mgo.Database{Name: "test"}, "people")
+	mq.SetCollectionNameFunc(func(name string) string { return name + "s" })
+	if c := mq.collection(); c.FullName != "test.people" {
+		t.Errorf("wrong collection name: %s", c.FullName)
+	}
+
+	type hidden struct{ Secret string }
+	type PersonPublic struct {
+		Name     string
+		Embedded `bson:",inline"`
+		Address  struct {
+			City string `bson:"city"`
+		} `bson:"address"`
+		Created time.Time
+		hidden
+	}
+	mq = NewMongoQueryForCollection(PersonPublic{}, &mgo.Database{Name: "test"}, "people")
+	mq.AddExclusionPreset("short", "address")
+	for query, expected := range map[string]bson.M{
+		"/":            {},
+		"/?field=name": {"name": 1},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		spec, err := mq.ParseSpec(context.Background(), req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(spec.Fields, expected) {
+			t.Errorf("wrong projection without struct projection for %s: %v", query, spec.Fields)
+		}
+	}
+
+	mq.SetProjectStructFields(true)
+	for query, expected := range map[string]bson.M{
+		"/":             {"name": 1, "embeddedbool": 1, "embeddedint": 1, "address.city": 1, "created": 1, "hidden.secret": 1},
+		"/?field=name":  {"name": 1},
+		"/?field=short": {"name": 1, "embeddedbool": 1, "embeddedint": 1, "created": 1, "hidden.secret": 1},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		spec, err := mq.ParseSpec(context.Background(), req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(spec.Fields, expected) {
+			t.Errorf("wrong projection for %s: %v", query, spec.Fields)
+		}
+	}
+}
+
+func TestMaxConcurrentQueries(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.acquireQuerySlot(context.Background()); err != nil {
+		t.Fatalf("error occured without limit: %s", err)
+	}
+	mq.releaseQuerySlot()
+
+	mq.SetMaxConcurrentQueries(2)
+	for i := 0; i < 2; i++ {
+		if err := mq.acquireQuerySlot(context.Background()); err != nil {
+			t.Fatalf("error occured for query %d: %s", i+1, err)
+		}
+	}
+	err := mq.acquireQuerySlot(context.Background())
+	if err == nil {
+		t.Fatal("third concurrent query was not shed")
+	}
+	if merry.HTTPCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("wrong http code: %d", merry.HTTPCode(err))
+	}
+
+	mq.SetQueueQueries(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := mq.acquireQuerySlot(ctx); err == nil || merry.HTTPCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("queued query was not rejected after the context was done: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- mq.acquireQuerySlot(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("queued query did not wait for a free slot")
+	case <-time.After(10 * time.Millisecond):
+	}
+	mq.releaseQuerySlot()
+	if err := <-done; err != nil {
+		t.Errorf("error occured for queued query: %s", err)
+	}
+}
+
+// captureQueries records the arguments of the queries created by mq.
+func captureQueries(mq *MongoQuery) *[]queryArgs {
+	var mu sync.Mutex
+	captured := &[]queryArgs{}
+	mq.find = func(c *mgo.Collection, args queryArgs) *mgo.Query {
+		mu.Lock()
+		*captured = append(*captured, args)
+		mu.Unlock()
+		return findQuery(c, args)
+	}
+	return captured
+}
+
+type requestIDKey struct{}
+
+func TestQueryComment(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	queries := captureQueries(mq)
+	req, _ := http.NewRequest("GET", "/?mybool=true", bytes.NewBufferString(""))
+	if _, err := mq.CreateQuery(req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if c := (*queries)[0].comment; len(c) > 0 {
+		t.Errorf("comment attached per default: %s", c)
+	}
+
+	mq.SetSoftBudgets(200*time.Millisecond, 0)
+	mq.SetStructuredQueryComment(func(ctx context.Context, req *http.Request) string {
+		id, _ := ctx.Value(requestIDKey{}).(string)
+		return id
+	})
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "4f2a")
+	if _, err := mq.CreateQueryWithContext(ctx, req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	comment := QueryComment{}
+	if err := json.Unmarshal([]byte((*queries)[1].comment), &comment); err != nil {
+		t.Fatalf("comment is not valid JSON: %s", err)
+	}
+	if comment != (QueryComment{RequestID: "4f2a", Collection: "teststruct", LatencyBudget: "200ms"}) {
+		t.Errorf("wrong comment attached: %+v", comment)
+	}
+
+	mq.SetQueryComment(func(ctx context.Context, req *http.Request) string {
+		return "endpoint " + req.URL.Path
+	})
+	if _, err := mq.CreateQuery(req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if c := (*queries)[2].comment; c != "endpoint /" {
+		t.Errorf("wrong comment attached: %s", c)
+	}
+}
+
+func TestParameterAuthorizer(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddAlias("salary", "floatmember")
+	called := []string{}
+	mq.SetParameterAuthorizer(func(req *http.Request, parameter string) error {
+		called = append(called, parameter)
+		switch parameter {
+		case "floatmember":
+			return errors.New("requires HR role")
+		case "intMember":
+			return merry.New("unknown caller").WithHTTPCode(http.StatusUnauthorized)
+		}
+		return nil
+	})
+
+	req, _ := http.NewRequest("GET", "/?mybool=true&limit=5&page=1", bytes.NewBufferString(""))
+	if _, err := mq.ParseSpec(context.Background(), req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(called, []string{"mybool"}) {
+		t.Errorf("authorizer called for wrong parameters: %v", called)
+	}
+
+	called = []string{}
+	req, _ = http.NewRequest("GET", "/?salary__gtefield=uintmember&mybool=true&sort=-intMember&sort=mybool&field=salary&field=stringmember", bytes.NewBufferString(""))
+	_, err := mq.ParseSpec(context.Background(), req)
+	if err == nil {
+		t.Fatal("unauthorized parameters did not produce an error")
+	}
+	if !reflect.DeepEqual(called, []string{"floatmember", "intMember", "mybool", "stringmember", "uintmember"}) {
+		t.Errorf("authorizer called for wrong parameters: %v", called)
+	}
+	details := Details(err)
+	if len(details) != 2 || details[0].Parameter != "floatmember" || details[0].Code != CodeForbidden || details[1].Parameter != "intMember" {
+		t.Errorf("wrong error details: %v", details)
+	}
+	if merry.HTTPCode(err) != http.StatusForbidden {
+		t.Errorf("wrong http code: %d", merry.HTTPCode(err))
+	}
+
+	req, _ = http.NewRequest("GET", "/?sort=intMember", bytes.NewBufferString(""))
+	if _, err := mq.ParseSpec(context.Background(), req); merry.HTTPCode(err) != http.StatusUnauthorized {
+		t.Errorf("http code of the authorizer error not used: %v", err)
+	}
+}
+
+func TestRunOne(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	func() {
+		defer func() {
+			if r := recover(); r != errNoSession {
+				t.Errorf("wrong panic: %v", r)
+			}
+		}()
+		mq.RunOne(httptest.NewRequest("GET", "/", nil), "a")
+	}()
+
+	mq = NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	called := []string{}
+	mq.SetParameterAuthorizer(func(req *http.Request, parameter string) error {
+		called = append(called, parameter)
+		if parameter == "floatmember" {
+			return errors.New("requires HR role")
+		}
+		return nil
+	})
+	found := 0
+	mq.one = func(q *mgo.Query, doc interface{}) error {
+		found++
+		return mgo.ErrNotFound
+	}
+
+	// only the field parameter is used
+	_, err := mq.RunOne(httptest.NewRequest("GET", "/?field=mybool&intMember=3&sort=stringmember", nil), "a")
+	if merry.HTTPCode(err) != http.StatusNotFound || found != 1 {
+		t.Errorf("wrong error for missing document: %v", err)
+	}
+	if !reflect.DeepEqual(called, []string{"mybool"}) {
+		t.Errorf("authorizer called for wrong parameters: %v", called)
+	}
+
+	_, err = mq.RunOne(httptest.NewRequest("GET", "/?field=floatmember", nil), "a")
+	if merry.HTTPCode(err) != http.StatusForbidden || found != 1 {
+		t.Errorf("unauthorized field did not produce an error: %v", err)
+	}
+
+	_, err = mq.RunOne(httptest.NewRequest("GET", "/?field=notAMember", nil), "a")
+	if merry.HTTPCode(err) != http.StatusBadRequest || found != 1 {
+		t.Errorf("unsupported field did not produce an error: %v", err)
+	}
+}
+
+func TestRegisterValueDecoder(t *testing.T) {
+	mq := NewMongoQuery(orderedStruct{}, &mgo.Database{})
+	decodeID := func(v string) (string, error) {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(b), nil
+	}
+	if err := mq.RegisterValueDecoder("notAMember", decodeID); err == nil {
+		t.Error("unsupported parameter did not produce an error")
+	}
+	if err := mq.RegisterValueDecoder("_id", decodeID); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.RegisterValueDecoder("name", url.QueryUnescape); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	a, b := bson.NewObjectId(), bson.NewObjectId()
+	encode := func(id bson.ObjectId) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(id))
+	}
+	for query, expected := range map[string]map[string]interface{}{
+		"/?_id=" + encode(a):                       {"_id": a},
+		"/?_id=" + encode(a) + "&_id=" + encode(b): {"_id": map[string]interface{}{"$in": []interface{}{a, b}}},
+		"/?name=p%2525e&matchmode=exact":           {"name": "p%e"},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		q, err := mq.createQueryFilter(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(q, expected) {
+			t.Errorf("wrong query filter generated for %s: %v", query, q)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/?_id=not*base64", bytes.NewBufferString(""))
+	_, err := mq.createQueryFilter(req)
+	if err == nil {
+		t.Fatal("invalid value did not produce an error")
+	}
+	if merry.HTTPCode(err) != http.StatusBadRequest {
+		t.Errorf("wrong http code: %d", merry.HTTPCode(err))
+	}
+}
+
+func TestDefaultProjection(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.SetDefaultProjection("mybool", "notAMember"); err == nil {
+		t.Error("unsupported field did not produce an error")
+	}
+	if err := mq.SetDefaultProjection("mybool", "embeddedmember.embeddedint"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	for query, expected := range map[string]map[string]interface{}{
+		"/":                    {"mybool": 1, "embeddedmember.embeddedint": 1},
+		"/?mybool=true":        {"mybool": 1, "embeddedmember.embeddedint": 1},
+		"/?field=stringmember": {"stringmember": 1},
+		"/?field=*":            {},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		p, err := mq.createFieldsMap(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(p, expected) {
+			t.Errorf("wrong projection generated for %s: %v", query, p)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/?field=*&field=mybool", bytes.NewBufferString(""))
+	if _, err := mq.createFieldsMap(req); err == nil {
+		t.Error("combination of all fields with other fields did not produce an error")
+	}
+}
+
+func TestParsedStats(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddAlias("name", "stringmember")
+	req, _ := http.NewRequest("GET", "/?name=pe.*&intMember=1&intMember=2&intMember=3&mybool=true&floatmember__gte=1&uintmember__lt=9&sort=-floatmember&sort=uintmember&field=mybool&page=3", bytes.NewBufferString(""))
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	expected := ParsedStats{
+		FilterFieldNames:     []string{"floatmember", "intMember", "mybool", "stringmember", "uintmember"},
+		SortFieldNames:       []string{"floatmember", "uintmember"},
+		ProjectionFieldNames: []string{"mybool"},
+		UsedRegex:            true,
+		InValuesTotal:        3,
+		PageDepth:            3,
+	}
+	if !reflect.DeepEqual(spec.stats, expected) {
+		t.Errorf("wrong stats: %+v", spec.stats)
+	}
+
+	req, _ = http.NewRequest("GET", "/?mybool=true", bytes.NewBufferString(""))
+	spec, err = mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if spec.stats.UsedRegex || spec.stats.InValuesTotal != 0 || spec.stats.PageDepth != 1 {
+		t.Errorf("wrong stats: %+v", spec.stats)
+	}
+}
+
+func BenchmarkParsedStats(b *testing.B) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?stringmember=pe.*&intMember=1&intMember=2&mybool=true&sort=-floatmember&field=mybool", bytes.NewBufferString(""))
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		b.Fatalf("error occured: %s", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mq.parsedStats(req, spec)
+	}
+}
+
+func TestWarnOnCollscan(t *testing.T) {
+	collscan := bson.M{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "COLLSCAN"}}}
+	index := bson.M{"queryPlanner": bson.M{"winningPlan": bson.M{
+		"stage":      "FETCH",
+		"inputStage": bson.M{"stage": "IXSCAN", "indexName": "name_1"},
+	}}}
+	nested := bson.M{"queryPlanner": bson.M{"winningPlan": bson.M{
+		"stage":       "OR",
+		"inputStages": []interface{}{bson.M{"stage": "IXSCAN"}, bson.M{"stage": "COLLSCAN"}},
+	}}}
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	plan := collscan
+	explained := 0
+	mq.explain = func(*mgo.Query) (bson.M, error) {
+		explained++
+		return plan, nil
+	}
+	if mq.scansCollection(&mgo.Query{}) || explained != 0 {
+		t.Error("query explained without SetWarnOnCollscan")
+	}
+	mq.SetWarnOnCollscan(true)
+	for p, expected := range map[string]bool{"collscan": true, "index": false, "nested": true} {
+		plan = map[string]bson.M{"collscan": collscan, "index": index, "nested": nested}[p]
+		if mq.scansCollection(&mgo.Query{}) != expected {
+			t.Errorf("wrong collection scan detection for %s plan", p)
+		}
+	}
+	mq.explain = func(*mgo.Query) (bson.M, error) {
+		return nil, errors.New("explain failed")
+	}
+	if mq.scansCollection(&mgo.Query{}) {
+		t.Error("failed explain reported a collection scan")
+	}
+
+	// Run adds the warning to the response
+	mq = NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.SetWarnOnCollscan(true)
+	mq.count = func(q *mgo.Query) (int, error) { return 1, nil }
+	mq.all = func(q *mgo.Query, content interface{}) error {
+		*content.(*[]TestStruct) = []TestStruct{{IntMember: 1}}
+		return nil
+	}
+	for p, expected := range map[string][]string{"collscan": {WarningCollectionScan}, "index": nil} {
+		plan := map[string]bson.M{"collscan": collscan, "index": index}[p]
+		mq.explain = func(*mgo.Query) (bson.M, error) {
+			return plan, nil
+		}
+		r, err := mq.Run(httptest.NewRequest("GET", "/?mybool=true", nil))
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if !reflect.DeepEqual(r.Warnings, expected) {
+			t.Errorf("wrong warnings for %s plan: %v", p, r.Warnings)
+		}
+	}
+}
+
+func TestProjectFilteredOnly(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.AddAlias("name", "stringmember")
+	mq.AddAlias("age", "intMember")
+	mq.SetDefaultProjection("mybool")
+	mq.SetProjectFilteredOnly(true)
+	for query, expected := range map[string]map[string]interface{}{
+		"/?name=peter&sort=age":                          {"stringmember": 1, "intMember": 1},
+		"/?name=peter&sort=-name&limit=5&page=2":         {"stringmember": 1},
+		"/?intMember__gt=3&embeddedmember.embeddedint=1": {"intMember": 1, "embeddedmember.embeddedint": 1},
+		"/?name=peter&field=floatmember":                 {"floatmember": 1},
+		"/?limit=5":                                      {"mybool": 1},
+		"/":                                              {"mybool": 1},
+	} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		p, err := mq.createFieldsMap(req)
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if !reflect.DeepEqual(p, expected) {
+			t.Errorf("wrong projection generated for %s: %v", query, p)
+		}
+	}
+
+	mq.SetProjectFilteredOnly(false)
+	req, _ := http.NewRequest("GET", "/?name=peter&sort=age", bytes.NewBufferString(""))
+	if p, _ := mq.createFieldsMap(req); !reflect.DeepEqual(p, map[string]interface{}{"mybool": 1}) {
+		t.Errorf("wrong projection generated without SetProjectFilteredOnly: %v", p)
+	}
+}
+
+func TestForbidEmptyFilter(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetBoolWildcard(true)
+	for _, query := range []string{"/", "/?sort=mybool&limit=5&page=2", "/?field=mybool", "/?mybool=any"} {
+		req, _ := http.NewRequest("GET", query, bytes.NewBufferString(""))
+		if _, err := mq.ParseSpec(context.Background(), req); err != nil {
+			t.Errorf("error occured for %s without ForbidEmptyFilter: %s", query, err)
+		}
+		mq.ForbidEmptyFilter()
+		_, err := mq.ParseSpec(context.Background(), req)
+		if err == nil {
+			t.Errorf("empty filter %s did not produce an error", query)
+		} else if merry.HTTPCode(err) != http.StatusUnprocessableEntity {
+			t.Errorf("wrong status code for %s: %d", query, merry.HTTPCode(err))
+		}
+		mq.forbidEmptyFilter = false
+	}
+
+	mq.ForbidEmptyFilter()
+	req, _ := http.NewRequest("GET", "/?mybool=true&sort=mybool", bytes.NewBufferString(""))
+	if _, err := mq.ParseSpec(context.Background(), req); err != nil {
+		t.Errorf("error occured: %s", err)
+	}
+
+	mq.AddOrOverwriteValidParameter("tenant", reflect.String)
+	mq.SetTenant("tenant", func(ctx context.Context) (interface{}, error) {
+		return "acme", nil
+	})
+	req, _ = http.NewRequest("GET", "/?limit=5", bytes.NewBufferString(""))
+	if _, err := mq.ParseSpec(context.Background(), req); err == nil {
+		t.Error("request with only the tenant filter did not produce an error")
+	}
+	mq.AllowBaseFilterOnly(true)
+	if _, err := mq.ParseSpec(context.Background(), req); err != nil {
+		t.Errorf("error occured with AllowBaseFilterOnly: %s", err)
+	}
+}
+
+func TestCalculateLastPage(t *testing.T) {
+	for _, tc := range []struct {
+		items, size, last uint
+	}{
+		{0, 20, 0},
+		{20, 20, 1},
+		{21, 20, 2},
+		{0, 0, 0},
+		{21, 0, 1},
+	} {
+		p := Page{Items: tc.items, Size: tc.size}
+		p.calculateLastPage()
+		if p.Last != tc.last {
+			t.Errorf("wrong last page for %d items with size %d: %d", tc.items, tc.size, p.Last)
+		}
+	}
+
+	// limit=all pages without size
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.SetAllowUnlimited(true)
+	mq.count = func(q *mgo.Query) (int, error) { return 42, nil }
+	mq.all = func(q *mgo.Query, content interface{}) error { return nil }
+	r, err := mq.Run(httptest.NewRequest("GET", "/?limit=all", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if r.Page.Size != 0 || r.Page.Last != 1 {
+		t.Errorf("wrong page without limit: %+v", r.Page)
+	}
+}
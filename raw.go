@@ -0,0 +1,124 @@
+package mqb
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// SetRawBSON defines the content type of RunRaw. Per default the content is a []bson.M, if raw
+// is true it is a []json.RawMessage of the stored documents, which keeps the order of their
+// fields.
+func (mq *MongoQuery) SetRawBSON(raw bool) {
+	mq.rawBSON = raw
+}
+
+// SetCanonicalExtendedJSON defines how RunRaw renders ObjectIds and dates. Per default they are
+// rendered as hex string and RFC3339 time, if canonical is true they are converted to
+// canonical extended JSON:
+//     {"_id": {"$oid": "5a934e000102030405000000"}, "createdat": {"$date": {"$numberLong": "1519603200000"}}}
+func (mq *MongoQuery) SetCanonicalExtendedJSON(canonical bool) {
+	mq.canonicalExtendedJSON = canonical
+}
+
+// RunRaw runs the query like Run, but returns the documents as they are stored instead of
+// decoding them into the endpoint struct, so fields that do not exist on the endpoint struct
+// are preserved. The endpoint struct is only used to validate the parameters.
+func (mq *MongoQuery) RunRaw(req *http.Request) (*Response, error) {
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		return nil, err
+	}
+	if mq.rawBSON {
+		response, err := mq.runSpec(req.Context(), spec, reflect.TypeOf(bson.Raw{}))
+		if err != nil {
+			return nil, err
+		}
+		// bson.Raw is rendered as struct by encoding/json
+		if raws, ok := response.Content.(*[]bson.Raw); ok {
+			docs := make([]json.RawMessage, 0, len(*raws))
+			for _, raw := range *raws {
+				doc := bson.D{}
+				if err := raw.Unmarshal(&doc); err != nil {
+					return nil, merry.Prepend(err, "could not decode raw document").WithHTTPCode(http.StatusInternalServerError)
+				}
+				b, err := json.Marshal(orderedValue(doc, mq.canonicalExtendedJSON))
+				if err != nil {
+					return nil, merry.Prepend(err, "could not render raw document").WithHTTPCode(http.StatusInternalServerError)
+				}
+				docs = append(docs, b)
+			}
+			response.Content = &docs
+		}
+		return response, nil
+	}
+	response, err := mq.runSpec(req.Context(), spec, reflect.TypeOf(bson.M{}))
+	if err != nil {
+		return nil, err
+	}
+	if docs, ok := response.Content.(*[]bson.M); ok {
+		if mq.matchHighlighting {
+			addMatches(*docs, spec.Filter)
+		}
+		if mq.canonicalExtendedJSON {
+			for _, doc := range *docs {
+				toExtendedJSON(doc)
+			}
+		}
+	}
+	return response, nil
+}
+
+// orderedValue returns v with its documents converted to orderedDocument. If canonical is true,
+// the ObjectIds and dates are converted to canonical extended JSON, see toExtendedJSON.
+func orderedValue(v interface{}, canonical bool) interface{} {
+	switch value := v.(type) {
+	case bson.D:
+		doc := make(orderedDocument, len(value))
+		for i, e := range value {
+			doc[i] = bson.DocElem{Name: e.Name, Value: orderedValue(e.Value, canonical)}
+		}
+		return doc
+	case []interface{}:
+		for i := range value {
+			value[i] = orderedValue(value[i], canonical)
+		}
+		return value
+	}
+	if canonical {
+		return extendedJSONValue(v)
+	}
+	return v
+}
+
+// toExtendedJSON converts the ObjectIds and dates in doc to canonical extended JSON.
+func toExtendedJSON(doc bson.M) {
+	for k, v := range doc {
+		doc[k] = extendedJSONValue(v)
+	}
+}
+
+// extendedJSONValue returns v in canonical extended JSON.
+func extendedJSONValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case bson.ObjectId:
+		return bson.M{"$oid": value.Hex()}
+	case time.Time:
+		ms := value.Unix()*1000 + int64(value.Nanosecond()/int(time.Millisecond))
+		return bson.M{"$date": bson.M{"$numberLong": strconv.FormatInt(ms, 10)}}
+	case bson.M:
+		toExtendedJSON(value)
+		return value
+	case []interface{}:
+		for i := range value {
+			value[i] = extendedJSONValue(value[i])
+		}
+		return value
+	}
+	return v
+}
@@ -0,0 +1,139 @@
+package mqb
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestRunRawValidation(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?notAMember=1", bytes.NewBufferString(""))
+	if _, err := mq.RunRaw(req); err == nil {
+		t.Error("unsupported parameter did not produce an error")
+	}
+}
+
+func TestExtendedJSON(t *testing.T) {
+	id := bson.ObjectIdHex("5a934e000102030405000000")
+	created := time.Date(2018, 2, 26, 0, 0, 0, 5e6, time.UTC)
+	newDoc := func() bson.M {
+		return bson.M{
+			"_id":       id,
+			"createdat": created,
+			"unknown":   "kept",
+			"sub":       bson.M{"ref": id},
+			"list":      []interface{}{created, 1},
+		}
+	}
+
+	b, _ := json.Marshal(newDoc())
+	if string(b) != `{"_id":"5a934e000102030405000000","createdat":"2018-02-26T00:00:00.005Z","list":["2018-02-26T00:00:00.005Z",1],"sub":{"ref":"5a934e000102030405000000"},"unknown":"kept"}` {
+		t.Errorf("wrong default rendering: %s", b)
+	}
+
+	doc := newDoc()
+	toExtendedJSON(doc)
+	b, _ = json.Marshal(doc)
+	if string(b) != `{"_id":{"$oid":"5a934e000102030405000000"},"createdat":{"$date":{"$numberLong":"1519603200005"}},"list":[{"$date":{"$numberLong":"1519603200005"}},1],"sub":{"ref":{"$oid":"5a934e000102030405000000"}},"unknown":"kept"}` {
+		t.Errorf("wrong canonical extended JSON: %s", b)
+	}
+}
+
+func TestRawDocumentFields(t *testing.T) {
+	a, b := bson.NewObjectId(), bson.NewObjectId()
+	content := &[]bson.M{{"_id": a, "sub": bson.M{"name": "x"}}, {"_id": b, "sub": bson.M{"name": "y"}}}
+	v, ok := fieldByParameterName(reflect.ValueOf((*content)[0]), "sub.name")
+	if !ok || v.Interface() != "x" {
+		t.Errorf("wrong value for dotted path: %v", v)
+	}
+	if _, ok := fieldByParameterName(reflect.ValueOf((*content)[0]), "missing"); ok {
+		t.Error("missing field found")
+	}
+	orderByValues(content, "_id", []interface{}{b, a})
+	if (*content)[0]["_id"] != b {
+		t.Errorf("raw documents not ordered: %v", *content)
+	}
+	values, ok := sortValues(reflect.ValueOf(*content).Index(0), []string{"-sub.name", "_id"})
+	if !ok || !reflect.DeepEqual(values, []interface{}{"y", b}) {
+		t.Errorf("wrong sort values: %v", values)
+	}
+}
+
+func TestMatchHighlighting(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req, _ := http.NewRequest("GET", "/?stringmember=pe&strSliceMember=ern&intMember=3", bytes.NewBufferString(""))
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := []bson.M{
+		{"stringmember": "peter", "strSliceMember": []interface{}{"zurich", "bern"}, "intMember": 3},
+		{"stringmember": "paul", "strSliceMember": []interface{}{"geneva"}, "intMember": 3},
+		{"intMember": 3},
+	}
+	addMatches(docs, spec.Filter)
+	expected := [][]string{{"strSliceMember", "stringmember"}, {}, {}}
+	for i, doc := range docs {
+		if !reflect.DeepEqual(doc[MatchesField], expected[i]) {
+			t.Errorf("document %d: expected %v, got %v", i, expected[i], doc[MatchesField])
+		}
+	}
+
+	// regular expressions in $or clauses and $in lists
+	filter := map[string]interface{}{
+		"$or": []interface{}{
+			bson.M{"stringmember": bson.M{"$in": []interface{}{bson.RegEx{Pattern: "^x"}, bson.RegEx{Pattern: "^PA", Options: "i"}}}},
+			bson.M{"intMember": 3},
+		},
+	}
+	addMatches(docs, filter)
+	if !reflect.DeepEqual(docs[1][MatchesField], []string{"stringmember"}) {
+		t.Errorf("expected match in $or clause, got %v", docs[1][MatchesField])
+	}
+}
+
+func TestRunRawBSON(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.SetRawBSON(true)
+	id := bson.ObjectIdHex("5a934e000102030405000000")
+	created := time.Date(2018, 2, 26, 0, 0, 0, 0, time.UTC)
+	data, err := bson.Marshal(bson.D{
+		{Name: "_id", Value: id},
+		{Name: "unknown", Value: "kept"},
+		{Name: "sub", Value: bson.D{{Name: "z", Value: 1}, {Name: "a", Value: []interface{}{created}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.count = func(q *mgo.Query) (int, error) { return 1, nil }
+	mq.all = func(q *mgo.Query, content interface{}) error {
+		docs := reflect.ValueOf(content).Elem()
+		docs.Set(reflect.Append(docs, reflect.ValueOf(bson.Raw{Kind: 0x03, Data: data})))
+		return nil
+	}
+	for canonical, expected := range map[bool]string{
+		false: `[{"_id":"5a934e000102030405000000","unknown":"kept","sub":{"z":1,"a":["2018-02-26T00:00:00Z"]}}]`,
+		true:  `[{"_id":{"$oid":"5a934e000102030405000000"},"unknown":"kept","sub":{"z":1,"a":[{"$date":{"$numberLong":"1519603200000"}}]}}]`,
+	} {
+		mq.SetCanonicalExtendedJSON(canonical)
+		req, _ := http.NewRequest("GET", "/?mybool=true", bytes.NewBufferString(""))
+		r, err := mq.RunRaw(req)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		b, err := json.Marshal(r.Content)
+		if err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if string(b) != expected {
+			t.Errorf("wrong raw documents with canonical %t: %s", canonical, b)
+		}
+	}
+}
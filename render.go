@@ -0,0 +1,92 @@
+package mqb
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// RenderFilter renders filter as stable JSON that can be pasted into the mongo shell, for
+// example to log the filter in a query hook:
+//     mq.SetQueryHook(func(req *http.Request, info mqb.QueryInfo) {
+//         f, _ := mqb.RenderFilter(info.Filter)
+//         log.Printf("%s: %s", info.Collection, f)
+//     })
+// ObjectIds are rendered as {"$oid": "<hex>"}, regular expressions as {"$regex": "<pattern>",
+// "$options": "<options>"} and dates as {"$date": "<RFC3339>"}. Keys of maps are sorted, the
+// order of bson.D documents is kept. The filter is not modified.
+func RenderFilter(filter map[string]interface{}) (string, error) {
+	b, err := json.Marshal(renderValue(filter))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// orderedDocument is a document that is rendered in the order of its elements.
+type orderedDocument []bson.DocElem
+
+// MarshalJSON implements json.Marshaler.
+func (d orderedDocument) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, e := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(e.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// renderValue returns a copy of v with the bson values replaced by their shell representation.
+func renderValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case bson.ObjectId:
+		return orderedDocument{{Name: "$oid", Value: value.Hex()}}
+	case bson.RegEx:
+		return orderedDocument{{Name: "$regex", Value: value.Pattern}, {Name: "$options", Value: value.Options}}
+	case time.Time:
+		return orderedDocument{{Name: "$date", Value: value.UTC().Format(time.RFC3339Nano)}}
+	case bson.M:
+		return renderValue(map[string]interface{}(value))
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(value))
+		for k, e := range value {
+			rendered[k] = renderValue(e)
+		}
+		return rendered
+	case bson.D:
+		rendered := make(orderedDocument, 0, len(value))
+		for _, e := range value {
+			rendered = append(rendered, bson.DocElem{Name: e.Name, Value: renderValue(e.Value)})
+		}
+		return rendered
+	case []interface{}:
+		rendered := make([]interface{}, 0, len(value))
+		for _, e := range value {
+			rendered = append(rendered, renderValue(e))
+		}
+		return rendered
+	case []bson.M:
+		rendered := make([]interface{}, 0, len(value))
+		for _, e := range value {
+			rendered = append(rendered, renderValue(e))
+		}
+		return rendered
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+package mqb
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestRenderFilter(t *testing.T) {
+	id := bson.ObjectIdHex("54f3084a0b3a4a2b7c000001")
+	filter := bson.M{
+		"_id":  bson.M{"$in": []interface{}{id, bson.ObjectIdHex("54f3084a0b3a4a2b7c000002")}},
+		"name": bson.RegEx{Pattern: "^pe", Options: "i"},
+		"$and": []interface{}{
+			map[string]interface{}{"created": bson.M{"$gte": time.Date(2015, 3, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))}},
+		},
+		"$or":   []bson.M{{"age": 3}, {"tags": bson.D{{Name: "$size", Value: 2}, {Name: "$all", Value: []interface{}{"b", "a"}}}}},
+		"count": 1.5,
+	}
+	s, err := RenderFilter(filter)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	expected := `{"$and":[{"created":{"$gte":{"$date":"2015-03-01T11:00:00Z"}}}],` +
+		`"$or":[{"age":3},{"tags":{"$size":2,"$all":["b","a"]}}],` +
+		`"_id":{"$in":[{"$oid":"54f3084a0b3a4a2b7c000001"},{"$oid":"54f3084a0b3a4a2b7c000002"}]},` +
+		`"count":1.5,"name":{"$regex":"^pe","$options":"i"}}`
+	if s != expected {
+		t.Errorf("wrong rendering:\n%s\n%s", s, expected)
+	}
+	if filter["_id"].(bson.M)["$in"].([]interface{})[0] != id {
+		t.Error("filter was modified")
+	}
+	for i := 0; i < 10; i++ {
+		if again, _ := RenderFilter(filter); again != s {
+			t.Fatalf("rendering is not stable: %s", again)
+		}
+	}
+
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?stringmember=pe.*&mybool=true", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	s, err = RenderFilter(spec.Filter)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if s != `{"mybool":true,"stringmember":{"$regex":"pe.*","$options":""}}` {
+		t.Errorf("wrong rendering of parsed filter: %s", s)
+	}
+}
@@ -0,0 +1,218 @@
+package mqb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/ansel1/merry"
+)
+
+// parameterSchema is the subset of JSON Schema supported by SetParameterSchema.
+type parameterSchema struct {
+	Type                 string                      `json:"type"`
+	Properties           map[string]*parameterSchema `json:"properties"`
+	Required             []string                    `json:"required"`
+	AdditionalProperties *bool                       `json:"additionalProperties"`
+	Items                *parameterSchema            `json:"items"`
+	Enum                 []interface{}               `json:"enum"`
+	Minimum              *float64                    `json:"minimum"`
+	Maximum              *float64                    `json:"maximum"`
+	Pattern              string                      `json:"pattern"`
+	MinItems             *int                        `json:"minItems"`
+	MaxItems             *int                        `json:"maxItems"`
+
+	pattern *regexp.Regexp
+}
+
+// SetParameterSchema sets a JSON Schema the query parameters of a request are validated against
+// before the query is built. The parameters are validated as object with a property per
+// parameter, the values of a parameter are a string, a number, an integer, a boolean or, for
+// parameters that can be repeated, an array:
+//     mq.SetParameterSchema([]byte(`{
+//         "type": "object",
+//         "properties": {
+//             "status": {"type": "array", "items": {"enum": ["open", "closed"]}},
+//             "limit":  {"type": "integer", "minimum": 1, "maximum": 100}
+//         },
+//         "required": ["status"],
+//         "additionalProperties": false
+//     }`))
+// The keywords type, properties, required, additionalProperties, items, enum, minimum,
+// maximum, pattern, minItems and maxItems are supported, the others are ignored. A parameter
+// given more than once is invalid unless its type is array. The validation errors are returned
+// like the other validation errors, see Errors. A nil schema disables the validation.
+func (mq *MongoQuery) SetParameterSchema(schema []byte) error {
+	if schema == nil {
+		mq.parameterSchema = nil
+		return nil
+	}
+	s := &parameterSchema{}
+	if err := json.Unmarshal(schema, s); err != nil {
+		return fmt.Errorf("invalid schema: %s", err)
+	}
+	if len(s.Type) > 0 && s.Type != "object" {
+		return fmt.Errorf("invalid schema: type must be object, not %s", s.Type)
+	}
+	for name, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return fmt.Errorf("invalid schema of parameter '%s': %s", name, err)
+		}
+	}
+	mq.parameterSchema = s
+	return nil
+}
+
+// compile checks the type of the parameter schema s and compiles its patterns.
+func (s *parameterSchema) compile() error {
+	switch s.Type {
+	case "", "string", "integer", "number", "boolean":
+	case "array":
+		if s.Items != nil {
+			if s.Items.Type == "array" {
+				return fmt.Errorf("nested arrays are not supported")
+			}
+			if err := s.Items.compile(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("type %s is not supported", s.Type)
+	}
+	if len(s.Pattern) > 0 {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	}
+	return nil
+}
+
+// validateSchema validates the parameters of req against the parameter schema. The errors are
+// added to errs, it returns true if the request is invalid.
+func (mq *MongoQuery) validateSchema(req *http.Request, errs *errorCollector) bool {
+	if mq.parameterSchema == nil {
+		return false
+	}
+	values := req.URL.Query()
+	invalid := false
+	for _, name := range mq.parameterSchema.Required {
+		if _, ok := values[name]; !ok {
+			invalid = true
+			if errs.add(name, withCode(merry.Wrap(fmt.Errorf("parameter '%s' is required", name)).WithHTTPCode(http.StatusBadRequest), CodeMissingParameter)) {
+				return true
+			}
+		}
+	}
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	// sorted to report errors in a stable order
+	sort.Strings(names)
+	for _, name := range names {
+		var err error
+		if s, ok := mq.parameterSchema.Properties[name]; ok {
+			err = s.validate(name, values[name])
+		} else if a := mq.parameterSchema.AdditionalProperties; a != nil && !*a {
+			err = withCode(merry.Wrap(fmt.Errorf("parameter '%s' is not supported", name)).WithHTTPCode(http.StatusBadRequest), CodeUnsupportedParameter)
+		}
+		if err != nil {
+			invalid = true
+			if errs.add(name, err) {
+				return true
+			}
+		}
+	}
+	return invalid
+}
+
+// validate validates the values of the parameter name against the parameter schema s.
+func (s *parameterSchema) validate(name string, values []string) error {
+	invalid := func(format string, a ...interface{}) error {
+		return withCode(merry.Wrap(fmt.Errorf("invalid value for %s: %s", name, fmt.Sprintf(format, a...))).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	if s.Type != "array" {
+		if len(values) != 1 {
+			return invalid("only one value is supported")
+		}
+		if msg := s.validateValue(values[0]); len(msg) > 0 {
+			return invalid(msg)
+		}
+		return nil
+	}
+	if s.MinItems != nil && len(values) < *s.MinItems {
+		return invalid("at least %d values are required", *s.MinItems)
+	}
+	if s.MaxItems != nil && len(values) > *s.MaxItems {
+		return invalid("at most %d values are allowed", *s.MaxItems)
+	}
+	if s.Items == nil {
+		return nil
+	}
+	for _, v := range values {
+		if msg := s.Items.validateValue(v); len(msg) > 0 {
+			return invalid(msg)
+		}
+	}
+	return nil
+}
+
+// validateValue validates the value v against the schema s, which is not an array. It returns
+// the reason if v is invalid and an empty string otherwise.
+func (s *parameterSchema) validateValue(v string) string {
+	var value interface{} = v
+	switch s.Type {
+	case "integer":
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Sprintf("'%s' is not an integer", v)
+		}
+		value = float64(i)
+	case "number":
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Sprintf("'%s' is not a number", v)
+		}
+		value = f
+	case "boolean":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Sprintf("'%s' is not a boolean", v)
+		}
+		value = b
+	}
+	if len(s.Enum) > 0 && !inEnum(value, s.Enum) {
+		return fmt.Sprintf("'%s' is not one of %v", v, s.Enum)
+	}
+	if f, ok := value.(float64); ok {
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Sprintf("%s is less than the minimum %v", v, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Sprintf("%s is greater than the maximum %v", v, *s.Maximum)
+		}
+	}
+	if s.pattern != nil && !s.pattern.MatchString(v) {
+		return fmt.Sprintf("'%s' does not match %s", v, s.Pattern)
+	}
+	return ""
+}
+
+// inEnum returns true if value is one of the values of enum. Strings are compared with the
+// values of enum as text, because untyped parameters are strings.
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, e := range enum {
+		if s, ok := value.(string); ok && s == fmt.Sprint(e) {
+			return true
+		}
+		if value == e {
+			return true
+		}
+	}
+	return false
+}
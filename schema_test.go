@@ -0,0 +1,92 @@
+package mqb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"stringmember": {"type": "array", "items": {"enum": ["open", "closed"]}, "maxItems": 2},
+		"intMember":    {"type": "integer", "minimum": 1, "maximum": 10},
+		"mybool":       {"type": "boolean"},
+		"limit":        {"type": "integer", "enum": [10, 20]},
+		"sort":         {"type": "string", "pattern": "^-?(intMember|stringmember)$"}
+	},
+	"required": ["stringmember"],
+	"additionalProperties": false
+}`
+
+func TestParameterSchema(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	for _, schema := range []string{`{`, `{"type": "array"}`, `{"properties": {"a": {"type": "date"}}}`, `{"properties": {"a": {"pattern": "("}}}`} {
+		if err := mq.SetParameterSchema([]byte(schema)); err == nil {
+			t.Errorf("invalid schema %s did not produce an error", schema)
+		}
+	}
+	if err := mq.SetParameterSchema([]byte(testSchema)); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	for _, query := range []string{
+		"/?stringmember=open",
+		"/?stringmember=open&stringmember=closed&intMember=10&mybool=false&limit=20&sort=-intMember",
+	} {
+		if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil)); err != nil {
+			t.Errorf("error occured for %s: %s", query, err)
+		}
+	}
+
+	for query, expected := range map[string][]ErrorDetail{
+		"/?mybool=true": {
+			{Parameter: "stringmember", Code: CodeMissingParameter, Message: "parameter 'stringmember' is required"},
+		},
+		"/?stringmember=pending&floatmember=1.5": {
+			{Parameter: "floatmember", Code: CodeUnsupportedParameter, Message: "parameter 'floatmember' is not supported"},
+			{Parameter: "stringmember", Code: CodeInvalidValue, Message: "invalid value for stringmember: 'pending' is not one of [open closed]"},
+		},
+		"/?stringmember=open&limit=15&intMember=11": {
+			{Parameter: "intMember", Code: CodeInvalidValue, Message: "invalid value for intMember: 11 is greater than the maximum 10"},
+			{Parameter: "limit", Code: CodeInvalidValue, Message: "invalid value for limit: '15' is not one of [10 20]"},
+		},
+		"/?stringmember=open&intMember=1.5&mybool=yes&mybool=no": {
+			{Parameter: "intMember", Code: CodeInvalidValue, Message: "invalid value for intMember: '1.5' is not an integer"},
+			{Parameter: "mybool", Code: CodeInvalidValue, Message: "invalid value for mybool: only one value is supported"},
+		},
+		"/?stringmember=open&stringmember=open&stringmember=closed&sort=floatmember": {
+			{Parameter: "sort", Code: CodeInvalidValue, Message: "invalid value for sort: 'floatmember' does not match ^-?(intMember|stringmember)$"},
+			{Parameter: "stringmember", Code: CodeInvalidValue, Message: "invalid value for stringmember: at most 2 values are allowed"},
+		},
+	} {
+		_, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err == nil {
+			t.Errorf("query %s did not produce an error", query)
+			continue
+		}
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("wrong status code for %s: %d", query, merry.HTTPCode(err))
+		}
+		if details := Details(err); !reflect.DeepEqual(details, expected) {
+			t.Errorf("wrong errors for %s: %v", query, details)
+		}
+	}
+
+	// CreateQuery validates the schema too
+	if _, err := mq.CreateQuery(httptest.NewRequest("GET", "/?mybool=true", nil)); err == nil {
+		t.Error("CreateQuery did not validate the schema")
+	}
+
+	if err := mq.SetParameterSchema(nil); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true", nil)); err != nil {
+		t.Errorf("error occured without schema: %s", err)
+	}
+}
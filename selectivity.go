@@ -0,0 +1,125 @@
+package mqb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// SelectivityCacheTTL defines how long the total number of documents of the collection is
+// cached, see SetIncludeSelectivity.
+const SelectivityCacheTTL = time.Minute
+
+// SetIncludeSelectivity adds the estimated selectivity of the filter to the responses of Run,
+// which is the number of matching items divided by the number of documents in the collection:
+//     {"content": [...], "page": {"items": 50, ...}, "selectivity": 0.25}
+// Clients can use it to warn about broad searches. The total number of documents is counted
+// without the filter of the request, but with the tenant filter if a tenant is configured with
+// SetTenant, and cached per tenant for SelectivityCacheTTL, so the selectivity is an estimate.
+// The selectivity of an empty collection is 0.
+func (mq *MongoQuery) SetIncludeSelectivity(include bool) {
+	mq.includeSelectivity = include
+}
+
+// totalCache caches the number of documents of a collection per tenant.
+type totalCache struct {
+	mu       sync.Mutex
+	totals   map[string]cachedTotal
+	counting map[string]*totalCount
+}
+
+// cachedTotal is a cached number of documents.
+type cachedTotal struct {
+	total   int
+	expires time.Time
+}
+
+// totalCount is a running count of the documents of a tenant, which concurrent requests of
+// the tenant wait for instead of counting again.
+type totalCount struct {
+	done  chan struct{}
+	total int
+	err   error
+}
+
+// setSelectivity sets the selectivity of response if it is enabled with SetIncludeSelectivity.
+func (mq *MongoQuery) setSelectivity(ctx context.Context, response *Response) error {
+	if !mq.includeSelectivity {
+		return nil
+	}
+	total, err := mq.collectionTotal(ctx)
+	if err != nil {
+		return err
+	}
+	selectivity := 0.0
+	if total > 0 {
+		selectivity = float64(response.Page.Items) / float64(total)
+	}
+	response.Selectivity = &selectivity
+	return nil
+}
+
+// collectionTotal returns the cached number of documents in the collection that belong to the
+// tenant extracted from ctx. The documents are counted without holding the lock of the cache,
+// so slow counts only delay the requests of the same tenant, and only until ctx is done.
+func (mq *MongoQuery) collectionTotal(ctx context.Context) (int, error) {
+	filter := bson.M{}
+	if err := mq.addTenantFilter(ctx, filter); err != nil {
+		return 0, err
+	}
+	key := ""
+	if tenant, ok := filter[mq.tenantField]; ok {
+		key = fmt.Sprintf("%#v", tenant)
+	}
+	mq.totals.mu.Lock()
+	if cached, ok := mq.totals.totals[key]; ok && mq.now().Before(cached.expires) {
+		mq.totals.mu.Unlock()
+		return cached.total, nil
+	}
+	count, ok := mq.totals.counting[key]
+	if !ok {
+		if mq.totals.counting == nil {
+			mq.totals.counting = make(map[string]*totalCount)
+		}
+		count = &totalCount{done: make(chan struct{})}
+		mq.totals.counting[key] = count
+		go mq.countTotal(key, filter, count)
+	}
+	mq.totals.mu.Unlock()
+	select {
+	case <-count.done:
+		return count.total, count.err
+	case <-ctx.Done():
+		return 0, merry.Prepend(ctx.Err(), "could not count the documents of the collection").WithHTTPCode(http.StatusServiceUnavailable)
+	}
+}
+
+// countTotal counts the documents matching the tenant filter and caches the total with key.
+func (mq *MongoQuery) countTotal(key string, filter bson.M, count *totalCount) {
+	n, err := mq.count(mq.find(mq.collection(), queryArgs{filter: filter}))
+	mq.totals.mu.Lock()
+	defer mq.totals.mu.Unlock()
+	defer close(count.done)
+	delete(mq.totals.counting, key)
+	if err != nil {
+		count.err = merry.Prepend(err, "could not count the documents of the collection").WithHTTPCode(http.StatusInternalServerError)
+		return
+	}
+	count.total = n
+	now := mq.now()
+	if mq.totals.totals == nil {
+		mq.totals.totals = make(map[string]cachedTotal)
+	}
+	// the totals of inactive tenants are not kept
+	for k, cached := range mq.totals.totals {
+		if !now.Before(cached.expires) {
+			delete(mq.totals.totals, k)
+		}
+	}
+	mq.totals.totals[key] = cachedTotal{total: n, expires: now.Add(SelectivityCacheTTL)}
+}
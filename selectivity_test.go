@@ -0,0 +1,176 @@
+package mqb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestSelectivity(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	total := 200
+	totalCounts := 0
+	// the total is counted with a query without the filter of the request
+	var mu sync.Mutex
+	argsOf := make(map[*mgo.Query]queryArgs)
+	mq.find = func(c *mgo.Collection, args queryArgs) *mgo.Query {
+		q := findQuery(c, args)
+		mu.Lock()
+		argsOf[q] = args
+		mu.Unlock()
+		return q
+	}
+	filterOf := func(q *mgo.Query) bson.M {
+		mu.Lock()
+		defer mu.Unlock()
+		return argsOf[q].filter
+	}
+	mq.count = func(q *mgo.Query) (int, error) {
+		if _, ok := filterOf(q)["mybool"]; ok {
+			return 50, nil
+		}
+		totalCounts++
+		return total, nil
+	}
+	mq.all = func(q *mgo.Query, content interface{}) error { return nil }
+	now := time.Date(2018, 2, 26, 0, 0, 0, 0, time.UTC)
+	mq.now = func() time.Time { return now }
+	run := func() *Response {
+		spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := mq.RunSpec(context.Background(), spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	if r := run(); r.Selectivity != nil || totalCounts != 0 {
+		t.Errorf("selectivity is computed per default: %v", r.Selectivity)
+	}
+
+	mq.SetIncludeSelectivity(true)
+	if r := run(); r.Selectivity == nil || *r.Selectivity != 0.25 {
+		t.Errorf("wrong selectivity: %v", r.Selectivity)
+	}
+	// the total is cached
+	total = 100
+	if r := run(); *r.Selectivity != 0.25 || totalCounts != 1 {
+		t.Errorf("total is not cached: %v, %d counts", *r.Selectivity, totalCounts)
+	}
+	now = now.Add(SelectivityCacheTTL)
+	if r := run(); *r.Selectivity != 0.5 || totalCounts != 2 {
+		t.Errorf("expired total is not counted again: %v, %d counts", *r.Selectivity, totalCounts)
+	}
+
+	total = 0
+	now = now.Add(SelectivityCacheTTL)
+	if r := run(); *r.Selectivity != 0 {
+		t.Errorf("wrong selectivity of an empty collection: %v", *r.Selectivity)
+	}
+
+	// the total is counted and cached per tenant
+	type tenantKey struct{}
+	mq.SetTenant("stringmember", func(ctx context.Context) (interface{}, error) {
+		return ctx.Value(tenantKey{}), nil
+	})
+	counted := []bson.M{}
+	mq.count = func(q *mgo.Query) (int, error) {
+		filter := filterOf(q)
+		if _, ok := filter["mybool"]; ok {
+			return 50, nil
+		}
+		counted = append(counted, filter)
+		return 100 * len(counted), nil
+	}
+	selectivities := []float64{}
+	for _, tenant := range []string{"a", "b", "a"} {
+		ctx := context.WithValue(context.Background(), tenantKey{}, tenant)
+		spec, err := mq.ParseSpec(ctx, httptest.NewRequest("GET", "/?mybool=true", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := mq.RunSpec(ctx, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selectivities = append(selectivities, *r.Selectivity)
+	}
+	if !reflect.DeepEqual(counted, []bson.M{{"stringmember": "a"}, {"stringmember": "b"}}) {
+		t.Errorf("total not counted per tenant: %v", counted)
+	}
+	if !reflect.DeepEqual(selectivities, []float64{0.5, 0.25, 0.5}) {
+		t.Errorf("wrong selectivities per tenant: %v", selectivities)
+	}
+}
+
+func TestSelectivityConcurrentCounts(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	type tenantKey struct{}
+	mq.SetTenant("stringmember", func(ctx context.Context) (interface{}, error) {
+		return ctx.Value(tenantKey{}), nil
+	})
+	// the count of tenant a blocks until it is released
+	release := make(chan struct{})
+	var mu sync.Mutex
+	counts := 0
+	argsOf := make(map[*mgo.Query]queryArgs)
+	mq.find = func(c *mgo.Collection, args queryArgs) *mgo.Query {
+		q := findQuery(c, args)
+		mu.Lock()
+		argsOf[q] = args
+		mu.Unlock()
+		return q
+	}
+	mq.count = func(q *mgo.Query) (int, error) {
+		mu.Lock()
+		tenant := argsOf[q].filter["stringmember"]
+		counts++
+		mu.Unlock()
+		if tenant == "a" {
+			<-release
+		}
+		return 100, nil
+	}
+	tenantContext := func(tenant string) context.Context {
+		return context.WithValue(context.Background(), tenantKey{}, tenant)
+	}
+
+	ctx, cancel := context.WithTimeout(tenantContext("a"), 10*time.Millisecond)
+	defer cancel()
+	if _, err := mq.collectionTotal(ctx); merry.HTTPCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("done context did not produce an error: %v", err)
+	}
+	// other tenants are not blocked by the running count
+	if n, err := mq.collectionTotal(tenantContext("b")); err != nil || n != 100 {
+		t.Errorf("wrong total of tenant b: %d, %v", n, err)
+	}
+	// requests of the same tenant wait for the running count
+	results := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			n, _ := mq.collectionTotal(tenantContext("a"))
+			results <- n
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if a, b := <-results, <-results; a != 100 || b != 100 {
+		t.Errorf("wrong totals of tenant a: %d, %d", a, b)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if counts != 2 {
+		t.Errorf("wrong number of counts: %d", counts)
+	}
+}
@@ -0,0 +1,151 @@
+package mqb
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+// SetSnapshotPagination enables consistent pagination while documents are inserted. The field
+// has to increase with every insert, like _id with ObjectIds or a creation time. A response to
+// a request without snapshot parameter contains the highest value of field of the matching
+// documents as opaque token in Page.Snapshot. Requests with the token only match documents with
+// a value less or equal than the token, so later inserts do not shift the pages:
+//     mq.SetSnapshotPagination("_id", time.Hour)
+//     /?name=peter&page=2&snapshot=<token>
+// The snapshot filter is added to the filters of the request, filters on field are kept. Tokens
+// older than maxAge are rejected with http.StatusGone, a maxAge of 0 disables the expiry. The
+// tokens are signed like cursors, so a secret has to be set with SetCursorSecret before.
+func (mq *MongoQuery) SetSnapshotPagination(field string, maxAge time.Duration) error {
+	if len(mq.cursorSecret) == 0 {
+		return errors.New("snapshot pagination requires a secret, see SetCursorSecret")
+	}
+	field = mq.resolveAlias(field)
+	_, ok := mq.supportedParameters[field]
+	if _, isMeta := validMetaParameters[field]; field != "_id" && (!ok || isMeta) {
+		return fmt.Errorf("parameter '%s' is not supported", field)
+	}
+	mq.snapshotField = field
+	mq.snapshotMaxAge = maxAge
+	return nil
+}
+
+// snapshotToken is the content of a snapshot token.
+type snapshotToken struct {
+	Field  string      `bson:"f"`
+	Value  interface{} `bson:"v"`
+	Issued time.Time   `bson:"t"`
+}
+
+// snapshotMAC returns the signature of the snapshot token payload. The payload is prefixed, so
+// that cursors and snapshot tokens cannot be exchanged.
+func (mq *MongoQuery) snapshotMAC(payload []byte) []byte {
+	return mq.cursorMAC(append([]byte("snapshot:"), payload...))
+}
+
+// encodeSnapshot encodes value into a signed snapshot token issued now.
+func (mq *MongoQuery) encodeSnapshot(value interface{}) (string, error) {
+	if len(mq.cursorSecret) == 0 {
+		return "", errors.New("snapshot pagination requires a secret, see SetCursorSecret")
+	}
+	payload, err := bson.Marshal(snapshotToken{Field: mq.snapshotField, Value: value, Issued: mq.now()})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(append(payload, mq.snapshotMAC(payload)...)), nil
+}
+
+// decodeSnapshot decodes and validates a snapshot token created with encodeSnapshot. Tokens
+// that were tampered with are rejected.
+func (mq *MongoQuery) decodeSnapshot(token string) (*snapshotToken, error) {
+	if len(mq.cursorSecret) == 0 {
+		return nil, merry.Wrap(errors.New("snapshot pagination requires a secret, see SetCursorSecret")).WithHTTPCode(http.StatusInternalServerError)
+	}
+	malformed := withCode(merry.Wrap(errors.New("malformed snapshot token")).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) <= cursorMACSize {
+		return nil, malformed
+	}
+	b, mac := b[:len(b)-cursorMACSize], b[len(b)-cursorMACSize:]
+	if !hmac.Equal(mac, mq.snapshotMAC(b)) {
+		return nil, withCode(merry.Wrap(errors.New("invalid snapshot token")).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	t := &snapshotToken{}
+	if err := bson.Unmarshal(b, t); err != nil || t.Value == nil || t.Issued.IsZero() {
+		return nil, malformed
+	}
+	if t.Field != mq.snapshotField {
+		return nil, withCode(merry.Wrap(fmt.Errorf("snapshot token is not valid for field '%s'", mq.snapshotField)).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	if mq.snapshotMaxAge > 0 && mq.now().Sub(t.Issued) > mq.snapshotMaxAge {
+		return nil, withCode(merry.Wrap(errors.New("snapshot token expired")).WithHTTPCode(http.StatusGone), CodeInvalidValue)
+	}
+	return t, nil
+}
+
+// addSnapshotFilter adds the filter for the snapshot parameter of req to spec.
+func (mq *MongoQuery) addSnapshotFilter(req *http.Request, spec *QuerySpec) error {
+	values, ok := req.URL.Query()["snapshot"]
+	if !ok {
+		return nil
+	}
+	if len(mq.snapshotField) == 0 {
+		return merry.Wrap(errors.New("snapshot pagination is not enabled")).WithHTTPCode(http.StatusBadRequest)
+	}
+	if len(values) > 1 {
+		return merry.Wrap(errors.New("snapshot can only be given once")).WithHTTPCode(http.StatusBadRequest)
+	}
+	t, err := mq.decodeSnapshot(values[0])
+	if err != nil {
+		return err
+	}
+	addAndClause(spec.Filter, map[string]interface{}{mq.snapshotField: map[string]interface{}{"$lte": t.Value}})
+	spec.Page.Snapshot = values[0]
+	return nil
+}
+
+// addNewSnapshot restricts spec to the highest value of the snapshot field of the documents
+// matching its filter and sets the token of the snapshot. Nothing is changed if no document
+// matches.
+func (mq *MongoQuery) addNewSnapshot(spec *QuerySpec) error {
+	doc := bson.M{}
+	err := mq.one(mq.collection().Find(spec.Filter).Select(bson.M{mq.snapshotField: 1}).Sort("-"+mq.snapshotField), &doc)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	value, ok := lookupPath(doc, mq.snapshotField)
+	if !ok {
+		return nil
+	}
+	if spec.Page.Snapshot, err = mq.encodeSnapshot(value); err != nil {
+		return err
+	}
+	addAndClause(spec.Filter, map[string]interface{}{mq.snapshotField: map[string]interface{}{"$lte": value}})
+	return nil
+}
+
+// lookupPath returns the value of the dotted path in doc.
+func lookupPath(doc bson.M, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, segment := range strings.Split(path, ".") {
+		m, ok := current.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[segment]; !ok {
+			return nil, false
+		}
+	}
+	return current, current != nil
+}
@@ -0,0 +1,144 @@
+package mqb
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestSnapshotPagination(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?snapshot=abc", nil)); err == nil {
+		t.Error("snapshot without snapshot pagination did not produce an error")
+	}
+	if err := mq.SetSnapshotPagination("_id", time.Hour); err == nil {
+		t.Error("snapshot pagination without secret did not produce an error")
+	}
+	mq.SetCursorSecret([]byte("secret"))
+	if err := mq.SetSnapshotPagination("notAMember", time.Hour); err == nil {
+		t.Error("unsupported field did not produce an error")
+	}
+	if err := mq.SetSnapshotPagination("_id", time.Hour); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	mq.SetClock(func() time.Time { return now })
+	id := bson.NewObjectId()
+	token, err := mq.encodeSnapshot(id)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?mybool=true&page=2&snapshot="+token, nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(spec.Filter, bson.M{
+		"mybool": true,
+		"$and": []interface{}{
+			map[string]interface{}{"_id": map[string]interface{}{"$lte": id}},
+		},
+	}) {
+		t.Errorf("wrong filter generated: %v", spec.Filter)
+	}
+	if spec.Page.Snapshot != token {
+		t.Errorf("snapshot token not kept: %s", spec.Page.Snapshot)
+	}
+
+	other := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	other.SetCursorSecret([]byte("secret"))
+	other.SetSnapshotPagination("timemember", 0)
+	if _, err := other.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?snapshot="+token, nil)); err == nil {
+		t.Error("snapshot of other field did not produce an error")
+	}
+
+	for _, query := range []string{"/?snapshot=abc", "/?snapshot=", "/?snapshot=" + token + "&snapshot=" + token} {
+		_, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err == nil {
+			t.Errorf("invalid snapshot %s did not produce an error", query)
+		} else if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("wrong status code for %s: %d", query, merry.HTTPCode(err))
+		}
+	}
+
+	// forged tokens are rejected, even if they are well-formed
+	forged := func(value interface{}, issued time.Time) string {
+		payload, err := bson.Marshal(snapshotToken{Field: "_id", Value: value, Issued: issued})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := base64.RawURLEncoding.DecodeString(token)
+		return base64.RawURLEncoding.EncodeToString(append(payload, b[len(b)-cursorMACSize:]...))
+	}
+	cursor, _ := mq.EncodeCursor([]interface{}{id})
+	for _, token := range []string{forged(id, now.Add(24*time.Hour)), forged(bson.NewObjectId(), now), cursor} {
+		_, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?snapshot="+token, nil))
+		if err == nil || merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("forged snapshot token did not produce a bad request: %v", err)
+		}
+	}
+
+	now = now.Add(2 * time.Hour)
+	_, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?snapshot="+token, nil))
+	if err == nil {
+		t.Fatal("expired snapshot did not produce an error")
+	}
+	if merry.HTTPCode(err) != http.StatusGone {
+		t.Errorf("wrong status code for expired snapshot: %d", merry.HTTPCode(err))
+	}
+}
+
+func TestAddNewSnapshot(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{Session: &mgo.Session{}})
+	mq.SetCursorSecret([]byte("secret"))
+	if err := mq.SetSnapshotPagination("embeddedmember.embeddedint", 0); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	var found error
+	mq.one = func(q *mgo.Query, doc interface{}) error {
+		if found != nil {
+			return found
+		}
+		*doc.(*bson.M) = bson.M{"embeddedmember": bson.M{"embeddedint": 42}}
+		return nil
+	}
+	spec := &QuerySpec{Filter: bson.M{"mybool": true}}
+	if err := mq.addNewSnapshot(spec); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if !reflect.DeepEqual(spec.Filter, bson.M{
+		"mybool": true,
+		"$and":   []interface{}{map[string]interface{}{"embeddedmember.embeddedint": map[string]interface{}{"$lte": 42}}},
+	}) {
+		t.Errorf("wrong filter generated: %v", spec.Filter)
+	}
+	token, err := mq.decodeSnapshot(spec.Page.Snapshot)
+	if err != nil || token.Value != 42 {
+		t.Errorf("wrong snapshot token: %v, %v", token, err)
+	}
+
+	// nothing is changed without matching documents
+	found = mgo.ErrNotFound
+	spec = &QuerySpec{Filter: bson.M{"mybool": true}}
+	if err := mq.addNewSnapshot(spec); err != nil || len(spec.Page.Snapshot) > 0 || len(spec.Filter) != 1 {
+		t.Errorf("snapshot added without matching documents: %v, %v", spec, err)
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	doc := bson.M{"a": bson.M{"b": bson.M{"c": 1}, "n": nil}, "s": "x"}
+	for path, expected := range map[string]interface{}{"a.b.c": 1, "s": "x", "a.b.x": nil, "s.x": nil, "a.n": nil, "x": nil} {
+		v, ok := lookupPath(doc, path)
+		if v != expected || ok != (expected != nil) {
+			t.Errorf("wrong value of %s: %v, %t", path, v, ok)
+		}
+	}
+}
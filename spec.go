@@ -0,0 +1,239 @@
+package mqb
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+// QuerySpec is a parsed request. It can be inspected and modified before it is executed with RunSpec.
+type QuerySpec struct {
+	Filter bson.M   // Filter is the filter of the query.
+	Fields bson.M   // Fields is the projection of the query, an empty projection selects all fields.
+	Sort   []string // Sort contains the sort fields of the query.
+	Page   Page     // Page contains the requested page size and page number.
+
+	req            *http.Request
+	orderParameter string
+	orderValues    []interface{}
+	preserveOrder  bool
+	reverse        bool
+	cursor         bool
+	applied        Applied
+	comment        string
+	hint           []string
+
+	relevanceValues []interface{}
+	stats           ParsedStats
+}
+
+// ParseSpec parses and validates the parameters of req and returns the resulting QuerySpec.
+// If a tenant is configured with SetTenant, the tenant is extracted from ctx. The parameters of
+// form-encoded POST, PUT and PATCH requests are read from the body and the query string, see
+// formRequest.
+func (mq *MongoQuery) ParseSpec(ctx context.Context, req *http.Request) (*QuerySpec, error) {
+	req, err := formRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	// the authorization and validation errors of the filter, projection, sort and page are
+	// returned together
+	errs := &errorCollector{failFast: mq.failFast}
+	if mq.authorizeParameters(req, errs) {
+		return nil, errs.err()
+	}
+	// the query is not built from parameters that violate the schema
+	if mq.validateSchema(req, errs) {
+		return nil, errs.err()
+	}
+	filterMap, err := mq.createQueryFilter(req)
+	if errs.add("", err) {
+		return nil, errs.err()
+	}
+	applied := Applied{}
+	if err == nil {
+		userFilter := len(filterMap) > 0
+		if err := mq.addTenantFilter(ctx, filterMap); err != nil {
+			return nil, err
+		}
+		if mq.tenantExtractor != nil {
+			applied.DefaultFilters = append(applied.DefaultFilters, mq.tenantField)
+		}
+		if errs.add("", mq.checkEmptyFilter(userFilter, len(applied.DefaultFilters) > 0)) {
+			return nil, errs.err()
+		}
+	}
+
+	selectFields, err := mq.createFieldsMap(req)
+	if errs.add("field", err) {
+		return nil, errs.err()
+	}
+	if err == nil && mq.projectStructFields {
+		selectFields = mq.restrictToStructFields(selectFields)
+	}
+
+	sortFields, err := mq.createSortFields(req)
+	if errs.add("sort", err) {
+		return nil, errs.err()
+	}
+	if err == nil && mq.sortPolicy != nil {
+		requested := len(sortFields) > 0
+		sortFields, err = mq.applySortPolicy(req, sortFields)
+		if errs.add("sort", err) {
+			return nil, errs.err()
+		}
+		if !requested && len(sortFields) > 0 {
+			applied.DefaultSort = append([]string{}, sortFields...)
+		}
+	}
+
+	hint, err := mq.getHint(req)
+	if errs.add("hint", err) {
+		return nil, errs.err()
+	}
+	if errs.add("validate", mq.checkValidateParameter(req)) {
+		return nil, errs.err()
+	}
+
+	page := mq.page
+	size, ok, err := mq.getLimit(req)
+	if errs.add("limit", err) {
+		return nil, errs.err()
+	}
+	if ok && err == nil {
+		page.Size = size
+		page.LimitExplicit = true
+	}
+	current, ok, err := mq.getPage(req)
+	if errs.add("page", err) {
+		return nil, errs.err()
+	}
+	if ok && err == nil {
+		page.Current = current
+		page.PageExplicit = true
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	// the text score has to be selected to sort by it
+	if contains(sortFields, textScoreSort) {
+		selectFields[ScoreField] = textScoreProjection()
+	}
+
+	orderValues, preserveOrder, err := mq.preserveOrderValues(req, filterMap)
+	if err != nil {
+		return nil, err
+	}
+
+	applied.EffectiveLimit = page.Size
+	spec := &QuerySpec{
+		Filter:         filterMap,
+		Fields:         selectFields,
+		Sort:           sortFields,
+		Page:           page,
+		req:            req,
+		orderParameter: mq.preserveOrderParameter,
+		orderValues:    orderValues,
+		preserveOrder:  preserveOrder,
+		applied:        applied,
+		hint:           hint,
+
+		relevanceValues: mq.relevanceValues(req),
+	}
+	if mq.queryComment != nil {
+		spec.comment = mq.queryComment(ctx, req)
+	}
+	if err := mq.addCursorFilter(req, spec); err != nil {
+		return nil, err
+	}
+	if err := mq.addSnapshotFilter(req, spec); err != nil {
+		return nil, err
+	}
+	spec.stats = mq.parsedStats(req, spec)
+	return spec, nil
+}
+
+// specQuery creates the mgo.Query for spec.
+func (mq *MongoQuery) specQuery(spec *QuerySpec) *mgo.Query {
+	return mq.specQueryOn(mq.collection(), spec)
+}
+
+// specQueryOn creates the mgo.Query for spec on the collection c.
+func (mq *MongoQuery) specQueryOn(c *mgo.Collection, spec *QuerySpec) *mgo.Query {
+	// mgo panics with a nil pointer dereference otherwise
+	if mq.dataBase.Session == nil {
+		panic(errNoSession)
+	}
+	args := queryArgs{
+		filter:  spec.Filter,
+		sort:    spec.Sort,
+		comment: spec.comment,
+		hint:    spec.hint,
+		skip:    int((spec.Page.Current - 1) * spec.Page.Size),
+	}
+	// an empty projection is not the same as no projection for every server version
+	if len(spec.Fields) > 0 {
+		args.selector = spec.Fields
+	}
+	if spec.Page.Size > 0 {
+		args.limit = int(spec.Page.Size)
+	}
+	return mq.find(c, args)
+}
+
+// queryArgs are the arguments of a find query, see findQuery.
+type queryArgs struct {
+	filter   bson.M
+	selector bson.M // nil selects all fields
+	sort     []string
+	comment  string
+	hint     []string
+	limit    int // 0 is no limit
+	skip     int
+}
+
+// findQuery creates the mgo.Query with args on the collection c.
+func findQuery(c *mgo.Collection, args queryArgs) *mgo.Query {
+	q := c.Find(args.filter)
+	if args.selector != nil {
+		q.Select(args.selector)
+	}
+	q.Sort(args.sort...)
+	if len(args.comment) > 0 {
+		q.Comment(args.comment)
+	}
+	if len(args.hint) > 0 {
+		q.Hint(args.hint...)
+	}
+	if args.limit > 0 {
+		q = q.Limit(args.limit)
+	}
+	return q.Skip(args.skip)
+}
+
+// formRequest returns req with the parameters of its form-encoded body added to the query
+// string, so that searches can be submitted as application/x-www-form-urlencoded POST bodies.
+// Body values precede the query values of the same parameter, like in req.Form. Other requests
+// are returned unchanged.
+func formRequest(req *http.Request) (*http.Request, error) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut && req.Method != http.MethodPatch {
+		return req, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return req, nil
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, merry.Wrap(fmt.Errorf("invalid form body: %s", err)).WithHTTPCode(http.StatusBadRequest)
+	}
+	u := *req.URL
+	u.RawQuery = req.Form.Encode()
+	r := *req
+	r.URL = &u
+	return &r, nil
+}
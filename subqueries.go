@@ -0,0 +1,143 @@
+package mqb
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ansel1/merry"
+)
+
+// DefaultMaxConcurrentSubqueries is the default limit of SetMaxConcurrentSubqueries.
+const DefaultMaxConcurrentSubqueries = 4
+
+// SetMaxConcurrentSubqueries limits the number of sub-queries executed concurrently to n.
+// Requests that spawn several queries, like RunPartitioned with a query per collection, run
+// them concurrently. The limit is shared by all requests of mq, so together they never hold
+// more than n connections for sub-queries. Sub-queries wait for a free slot until the context
+// of the request is done, then they are rejected with 503. A value less than 1 runs the
+// sub-queries one after another. It must not be called while queries are running.
+func (mq *MongoQuery) SetMaxConcurrentSubqueries(n int) {
+	if n < 1 {
+		n = 1
+	}
+	mq.subqueries = newSemaphore(int64(n))
+}
+
+// runSubqueries runs calls concurrently, limited by SetMaxConcurrentSubqueries. The slots for
+// all calls that run at the same time are acquired at once, so concurrent requests cannot block
+// each other with partially acquired slots. It returns the error of the first failed call.
+func (mq *MongoQuery) runSubqueries(ctx context.Context, calls ...func() error) error {
+	workers := int64(len(calls))
+	if workers > mq.subqueries.size {
+		workers = mq.subqueries.size
+	}
+	if workers == 0 {
+		return nil
+	}
+	if err := mq.subqueries.acquire(ctx, workers); err != nil {
+		return merry.Wrap(fmt.Errorf("too many concurrent sub-queries: %s", err)).WithHTTPCode(http.StatusServiceUnavailable)
+	}
+	defer mq.subqueries.release(workers)
+
+	errs := make([]error, len(calls))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := int64(0); i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = calls[i]()
+			}
+		}()
+	}
+	for i := range calls {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// semaphore is a weighted semaphore, waiters are served in FIFO order.
+type semaphore struct {
+	size    int64
+	mu      sync.Mutex
+	cur     int64
+	waiters list.List
+}
+
+// semaphoreWaiter is a waiter for n slots of a semaphore, ready is closed when they are acquired.
+type semaphoreWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// newSemaphore returns a semaphore with size slots.
+func newSemaphore(size int64) *semaphore {
+	return &semaphore{size: size}
+}
+
+// acquire acquires n slots, which must not be more than the size of s. It blocks until the
+// slots are available or ctx is done.
+func (s *semaphore) acquire(ctx context.Context, n int64) error {
+	s.mu.Lock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return nil
+	}
+	w := semaphoreWaiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-w.ready:
+			// acquired while the context was done
+			return nil
+		default:
+		}
+		isFront := s.waiters.Front() == elem
+		s.waiters.Remove(elem)
+		// the following waiters may fit now
+		if isFront {
+			s.notifyWaiters()
+		}
+		return ctx.Err()
+	}
+}
+
+// release releases n slots.
+func (s *semaphore) release(n int64) {
+	s.mu.Lock()
+	s.cur -= n
+	s.notifyWaiters()
+	s.mu.Unlock()
+}
+
+// notifyWaiters acquires the slots for the waiters in order as long as they fit.
+func (s *semaphore) notifyWaiters() {
+	for next := s.waiters.Front(); next != nil; next = s.waiters.Front() {
+		w := next.Value.(semaphoreWaiter)
+		if s.size-s.cur < w.n {
+			return
+		}
+		s.cur += w.n
+		s.waiters.Remove(next)
+		close(w.ready)
+	}
+}
@@ -0,0 +1,87 @@
+package mqb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+// fakeCollection records the maximum number of concurrent calls.
+type fakeCollection struct {
+	mu       sync.Mutex
+	inFlight int
+	max      int
+	calls    int
+}
+
+func (c *fakeCollection) find() error {
+	c.mu.Lock()
+	c.inFlight++
+	c.calls++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return nil
+}
+
+func TestMaxConcurrentSubqueries(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetMaxConcurrentSubqueries(3)
+	c := &fakeCollection{}
+	calls := []func() error{}
+	for i := 0; i < 10; i++ {
+		calls = append(calls, c.find)
+	}
+	// concurrent requests share the limit
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := mq.runSubqueries(context.Background(), calls...); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.calls != 40 {
+		t.Errorf("wrong number of calls: %d", c.calls)
+	}
+	if c.max > 3 {
+		t.Errorf("%d calls in flight, the limit is 3", c.max)
+	}
+	if c.max < 2 {
+		t.Errorf("calls did not run concurrently")
+	}
+
+	failed := errors.New("failed")
+	err := mq.runSubqueries(context.Background(), c.find, func() error { return failed }, c.find)
+	if err != failed {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// waiting sub-queries are rejected when the context is done
+	mq.SetMaxConcurrentSubqueries(1)
+	mq.subqueries.acquire(context.Background(), 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = mq.runSubqueries(ctx, c.find)
+	if merry.HTTPCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("wrong HTTP code: %d", merry.HTTPCode(err))
+	}
+	mq.subqueries.release(1)
+	if err := mq.runSubqueries(context.Background(), c.find); err != nil {
+		t.Errorf("slot was not released: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package mqb
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// ScoreField is the virtual field of the text score of a document, see SetTextSearch.
+const ScoreField = "score"
+
+// textScoreSort is the sort field of the text score, as understood by mgo.
+const textScoreSort = "$textScore:" + ScoreField
+
+// SetTextSearch enables the text search with the given parameter, which requires a text index
+// on the collection:
+//     mq.SetTextSearch("q")
+//     /?q=coffee shop  {"$text": {"$search": "coffee shop"}}
+// Requests with the text search can select and sort by the virtual field score, the relevance
+// of a document for the search:
+//     /?q=coffee&field=name&field=score&sort=score
+// The score is always sorted in descending order, the best matches first, and it is selected if
+// it is sorted. Selecting or sorting by score without the text search is rejected. To decode the
+// score, run the query with RunRaw or with RunAs and a struct containing the endpoint struct and
+// the score. The virtual field is not available if the endpoint struct has a field score.
+func (mq *MongoQuery) SetTextSearch(parameter string) error {
+	if _, ok := mq.supportedParameters[parameter]; ok {
+		return fmt.Errorf("parameter '%s' is already supported", parameter)
+	}
+	mq.textSearchParameter = parameter
+	return nil
+}
+
+// RunAs runs the query like Run, but decodes the documents into the type of doc instead of the
+// endpoint struct, for example to decode the text score:
+//     type scoredPerson struct {
+//         Person `bson:",inline"`
+//         Score  float64 `bson:"score"`
+//     }
+//     r, _ := mq.RunAs(req, scoredPerson{}) // r.Content is a *[]scoredPerson
+// The parameters are still validated with the endpoint struct.
+func (mq *MongoQuery) RunAs(req *http.Request, doc interface{}) (*Response, error) {
+	spec, err := mq.ParseSpec(req.Context(), req)
+	if err != nil {
+		return nil, err
+	}
+	return mq.runSpec(req.Context(), spec, reflect.TypeOf(doc))
+}
+
+// addTextSearchFilter adds the $text filter for the values of the text search parameter to filter.
+func (mq *MongoQuery) addTextSearchFilter(filter map[string]interface{}, values []string) error {
+	if len(values) != 1 {
+		return merry.Wrap(fmt.Errorf("parameter '%s' supports only one value", mq.textSearchParameter)).WithHTTPCode(http.StatusBadRequest)
+	}
+	if len(values[0]) == 0 {
+		return merry.Wrap(fmt.Errorf("parameter '%s' requires a value", mq.textSearchParameter)).WithHTTPCode(http.StatusBadRequest)
+	}
+	filter["$text"] = bson.M{"$search": values[0]}
+	return nil
+}
+
+// isScoreField returns true if name is the virtual score field of the text search.
+func (mq *MongoQuery) isScoreField(name string) bool {
+	if len(mq.textSearchParameter) == 0 || name != ScoreField {
+		return false
+	}
+	_, ok := mq.supportedParameters[name]
+	return !ok
+}
+
+// checkTextSearch returns an error if req does not contain the text search, which is required
+// by the score field.
+func (mq *MongoQuery) checkTextSearch(req *http.Request) error {
+	if len(req.URL.Query().Get(mq.textSearchParameter)) > 0 {
+		return nil
+	}
+	return withCode(merry.Wrap(fmt.Errorf("field '%s' requires the parameter '%s'", ScoreField, mq.textSearchParameter)).WithHTTPCode(http.StatusBadRequest), CodeMissingParameter)
+}
+
+// textScoreProjection returns the projection of the text score.
+func textScoreProjection() bson.M {
+	return bson.M{"$meta": "textScore"}
+}
+
+// isMetaProjection returns true if v projects a $meta field like the text score.
+func isMetaProjection(v interface{}) bool {
+	m, ok := v.(bson.M)
+	if !ok {
+		return false
+	}
+	_, ok = m["$meta"]
+	return ok
+}
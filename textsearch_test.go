@@ -0,0 +1,75 @@
+package mqb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestTextSearch(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	req := httptest.NewRequest("GET", "/?field=score", nil)
+	if _, err := mq.ParseSpec(context.Background(), req); err == nil {
+		t.Error("score without text search did not produce an error")
+	}
+	if err := mq.SetTextSearch("stringmember"); err == nil {
+		t.Error("text search with a supported parameter did not produce an error")
+	}
+	if err := mq.SetTextSearch("q"); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("GET", "/?q=coffee&field=stringmember&field=score&sort=score", nil)
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec.Filter, bson.M{"$text": bson.M{"$search": "coffee"}}) {
+		t.Errorf("wrong filter: %v", spec.Filter)
+	}
+	if !reflect.DeepEqual(spec.Fields, bson.M{"stringmember": 1, "score": bson.M{"$meta": "textScore"}}) {
+		t.Errorf("wrong fields: %v", spec.Fields)
+	}
+	if !reflect.DeepEqual(spec.Sort, []string{"$textScore:score"}) {
+		t.Errorf("wrong sort: %v", spec.Sort)
+	}
+
+	// the score is selected if it is sorted
+	req = httptest.NewRequest("GET", "/?q=coffee&sort=-score&sort=intMember", nil)
+	spec, err = mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec.Fields, bson.M{"score": bson.M{"$meta": "textScore"}}) {
+		t.Errorf("wrong fields: %v", spec.Fields)
+	}
+	if !reflect.DeepEqual(spec.Sort, []string{"$textScore:score", "intMember"}) {
+		t.Errorf("wrong sort: %v", spec.Sort)
+	}
+
+	for _, query := range []string{"/?field=score", "/?sort=score"} {
+		_, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if merry.HTTPCode(err) != http.StatusBadRequest {
+			t.Errorf("%s: wrong HTTP code: %d", query, merry.HTTPCode(err))
+		}
+		if details := Details(err); len(details) == 0 || details[0].Code != CodeMissingParameter {
+			t.Errorf("%s: wrong error details: %v", query, details)
+		}
+	}
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?q=a&q=b", nil)); err == nil {
+		t.Error("text search with two values did not produce an error")
+	}
+
+	if isExclusion(map[string]interface{}{"score": bson.M{"$meta": "textScore"}}) {
+		t.Error("projection of the score is an exclusion")
+	}
+	if !isExclusion(map[string]interface{}{"score": bson.M{"$meta": "textScore"}, "stringmember": 0}) {
+		t.Error("exclusion with the score is not an exclusion")
+	}
+}
@@ -0,0 +1,153 @@
+package mqb
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+)
+
+// built-in value tokens of time fields
+const (
+	TokenNow          = "now"          // TokenNow is the current time.
+	TokenToday        = "today"        // TokenToday is the start of the current day, see SetTokenLocation.
+	TokenStartOfMonth = "startofmonth" // TokenStartOfMonth is the start of the current month, see SetTokenLocation.
+)
+
+// RegisterValueToken registers a token for the given parameters that is replaced by the value
+// returned by resolve for the request, so that clients can filter without knowing the value:
+//     mq.RegisterValueToken("me", func(req *http.Request) (interface{}, error) {
+//         user, ok := userFromContext(req.Context())
+//         if !ok {
+//             return nil, merry.New("not logged in").WithHTTPCode(http.StatusUnauthorized)
+//         }
+//         return user.ID, nil
+//     }, "owner", "assignee")
+//     /?owner=me
+// A value is a token if it equals the name of the token exactly and the parameter is one of the
+// parameters of the token, the values of other parameters are not replaced. The resolved value
+// has to match the kind of the parameter, numbers are converted, otherwise the request is
+// rejected with 400. Errors of resolve are returned with their HTTP code. A literal value that
+// equals a token name has to be quoted, like /?owner="me". The token now is built in for time
+// fields, see SetTokenLocation for more.
+func (mq *MongoQuery) RegisterValueToken(name string, resolve func(req *http.Request) (interface{}, error), parameters ...string) error {
+	if len(parameters) == 0 {
+		return fmt.Errorf("token '%s' has no parameters", name)
+	}
+	resolved := []string{}
+	for _, parameter := range parameters {
+		parameter = mq.resolveAlias(parameter)
+		_, ok := mq.supportedParameters[parameter]
+		if _, isMeta := validMetaParameters[parameter]; !ok || isMeta {
+			return fmt.Errorf("parameter '%s' is not supported", parameter)
+		}
+		resolved = append(resolved, parameter)
+	}
+	for _, parameter := range resolved {
+		if mq.valueTokens[parameter] == nil {
+			mq.valueTokens[parameter] = make(map[string]func(*http.Request) (interface{}, error))
+		}
+		mq.valueTokens[parameter][name] = resolve
+	}
+	return nil
+}
+
+// SetTokenLocation enables the time tokens today and startofmonth, which resolve to the start
+// of the current day and month in loc.
+func (mq *MongoQuery) SetTokenLocation(loc *time.Location) {
+	mq.tokenLocation = loc
+}
+
+// tokenResolver returns the resolver of the token v for the parameter name. The bool value is
+// false if v is not a token.
+func (mq *MongoQuery) tokenResolver(name, v string) (func(*http.Request) (interface{}, error), bool) {
+	if resolve, ok := mq.valueTokens[name][v]; ok {
+		return resolve, true
+	}
+	if !mq.isTimeParameter(name) {
+		return nil, false
+	}
+	switch {
+	case v == TokenNow:
+		return func(*http.Request) (interface{}, error) { return mq.now(), nil }, true
+	case v == TokenToday && mq.tokenLocation != nil:
+		return func(*http.Request) (interface{}, error) {
+			now := mq.now().In(mq.tokenLocation)
+			return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, mq.tokenLocation), nil
+		}, true
+	case v == TokenStartOfMonth && mq.tokenLocation != nil:
+		return func(*http.Request) (interface{}, error) {
+			now := mq.now().In(mq.tokenLocation)
+			return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, mq.tokenLocation), nil
+		}, true
+	}
+	return nil, false
+}
+
+// resolveToken returns the resolved value of v for the parameter name of the given kind if v
+// is a token. Otherwise it returns v, which is unquoted if it is a quoted token name.
+func (mq *MongoQuery) resolveToken(req *http.Request, name string, kind reflect.Kind, v string) (interface{}, string, error) {
+	if len(v) > 2 && strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`) {
+		if _, ok := mq.tokenResolver(name, v[1:len(v)-1]); ok {
+			return nil, v[1 : len(v)-1], nil
+		}
+		return nil, v, nil
+	}
+	resolve, ok := mq.tokenResolver(name, v)
+	if !ok {
+		return nil, v, nil
+	}
+	value, err := resolve(req)
+	if err != nil {
+		return nil, "", merry.Prepend(err, fmt.Sprintf("could not resolve '%s' for %s", v, name))
+	}
+	converted, ok := convertTokenValue(value, kind, mq.isTimeParameter(name))
+	if !ok {
+		// the client chose the parameter of the token
+		return nil, "", withCode(merry.Wrap(fmt.Errorf("invalid value for %s: token '%s' cannot be used for this parameter", name, v)).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	return converted, "", nil
+}
+
+// convertTokenValue converts the resolved value of a token to the type of the values parsed
+// for a parameter of the given kind. The bool value is false if the types do not match.
+func convertTokenValue(value interface{}, kind reflect.Kind, isTime bool) (interface{}, bool) {
+	if isTime {
+		t, ok := value.(time.Time)
+		return t, ok
+	}
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return nil, false
+	}
+	switch {
+	case kindClass(kind) == "number" && kindClass(v.Kind()) == "number":
+		switch kind {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if f := numberOf(v); f >= 0 && f == float64(uint(f)) {
+				return uint(f), true
+			}
+			return nil, false
+		case reflect.Float32, reflect.Float64:
+			return numberOf(v), true
+		}
+		if f := numberOf(v); f == float64(int(f)) {
+			return int(f), true
+		}
+		return nil, false
+	case kind == reflect.String:
+		if id, ok := value.(bson.ObjectId); ok {
+			return id, true
+		}
+		if v.Kind() == reflect.String {
+			return v.String(), true
+		}
+	case kind == reflect.Bool && v.Kind() == reflect.Bool:
+		return v.Bool(), true
+	}
+	return nil, false
+}
@@ -0,0 +1,155 @@
+package mqb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ansel1/merry"
+	"github.com/zbindenren/mqb/internal/bson"
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestValueTokens(t *testing.T) {
+	now := time.Date(2023, 3, 15, 22, 30, 0, 0, time.UTC)
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetClock(func() time.Time { return now })
+	me := func(req *http.Request) (interface{}, error) {
+		user := req.Header.Get("X-User")
+		if len(user) == 0 {
+			return nil, merry.New("not logged in").WithHTTPCode(http.StatusUnauthorized)
+		}
+		return user, nil
+	}
+	for _, parameters := range [][]string{{}, {"notAMember"}, {"stringmember", "limit"}} {
+		if err := mq.RegisterValueToken("me", me, parameters...); err == nil {
+			t.Errorf("token for parameters %v did not produce an error", parameters)
+		}
+	}
+	if err := mq.RegisterValueToken("me", me, "stringmember"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if err := mq.RegisterValueToken("answer", func(req *http.Request) (interface{}, error) {
+		return 42, nil
+	}, "intMember", "uintmember", "mybool", "timemember"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+
+	req := httptest.NewRequest("GET", "/?stringmember=me&intMember=answer&timemember__lt=now&uintmember=answer&uintmember=1", nil)
+	req.Header.Set("X-User", "peter")
+	spec, err := mq.ParseSpec(context.Background(), req)
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	expected := bson.M{
+		"stringmember": "peter",
+		"intMember":    42,
+		"timemember":   map[string]interface{}{"$lt": now},
+		"uintmember":   map[string]interface{}{"$in": []interface{}{uint(42), uint(1)}},
+	}
+	if !reflect.DeepEqual(spec.Filter, expected) {
+		t.Errorf("wrong filter: %v", spec.Filter)
+	}
+
+	// tokens are only replaced in the values of their parameters
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?floatmember=answer", nil)); err == nil {
+		t.Error("token of another parameter was replaced")
+	}
+	req = httptest.NewRequest("GET", "/?strSliceMember=me", nil)
+	req.Header.Set("X-User", "peter")
+	if spec, err = mq.ParseSpec(context.Background(), req); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if s, _ := RenderFilter(spec.Filter); s != `{"strSliceMember":{"$regex":"me","$options":""}}` {
+		t.Errorf("token of another parameter was replaced: %s", s)
+	}
+
+	// tokens are resolved per request
+	_, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?stringmember=me", nil))
+	if err == nil {
+		t.Error("failed token resolution did not produce an error")
+	} else if merry.HTTPCode(err) != http.StatusUnauthorized {
+		t.Errorf("wrong status code: %d", merry.HTTPCode(err))
+	}
+
+	// quoted tokens and values that only contain a token are literals
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", `/?stringmember="me"&mybool=true`, nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if s, _ := RenderFilter(spec.Filter); s != `{"mybool":true,"stringmember":{"$regex":"me","$options":""}}` {
+		t.Errorf("wrong filter for quoted token: %s", s)
+	}
+	spec, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", `/?stringmember="now"`, nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if s, _ := RenderFilter(spec.Filter); s != `{"stringmember":{"$regex":"\"now\"","$options":""}}` {
+		t.Errorf("quoted value that is not a token of the field was unquoted: %s", s)
+	}
+
+	// the resolved value has to match the kind of the parameter
+	for _, query := range []string{"/?mybool=answer", "/?timemember__gt=answer"} {
+		_, err = mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err == nil {
+			t.Errorf("type mismatch of %s did not produce an error", query)
+		} else if merry.HTTPCode(err) != http.StatusBadRequest || merry.Value(err, codeKey) != CodeInvalidValue {
+			t.Errorf("wrong status code for %s: %d", query, merry.HTTPCode(err))
+		}
+	}
+}
+
+func TestTimeValueTokens(t *testing.T) {
+	now := time.Date(2023, 3, 15, 23, 30, 0, 0, time.UTC)
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetClock(func() time.Time { return now })
+	req := httptest.NewRequest("GET", "/?timemember__gte=today", nil)
+	if _, err := mq.ParseSpec(context.Background(), req); err == nil {
+		t.Error("today without a location did not produce an error")
+	}
+
+	loc := time.FixedZone("CET", 3600)
+	mq.SetTokenLocation(loc)
+	for query, expected := range map[string]time.Time{
+		"/?timemember__gte=today":        time.Date(2023, 3, 16, 0, 0, 0, 0, loc),
+		"/?timemember__gte=startofmonth": time.Date(2023, 3, 1, 0, 0, 0, 0, loc),
+	} {
+		spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", query, nil))
+		if err != nil {
+			t.Fatalf("error occured for %s: %s", query, err)
+		}
+		if v := spec.Filter["timemember"].(map[string]interface{})["$gte"].(time.Time); !v.Equal(expected) {
+			t.Errorf("wrong value for %s: %s", query, v)
+		}
+	}
+
+	// time tokens are literals of other fields
+	spec, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?stringmember=now", nil))
+	if err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	if s, _ := RenderFilter(spec.Filter); s != `{"stringmember":{"$regex":"now","$options":""}}` {
+		t.Errorf("wrong filter: %s", s)
+	}
+}
+
+func TestResolveTokenKeepsCause(t *testing.T) {
+	cause := errors.New("session store unavailable")
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if err := mq.RegisterValueToken("me", func(req *http.Request) (interface{}, error) {
+		return nil, merry.Wrap(cause).WithHTTPCode(http.StatusServiceUnavailable)
+	}, "stringmember"); err != nil {
+		t.Fatalf("error occured: %s", err)
+	}
+	_, _, err := mq.resolveToken(httptest.NewRequest("GET", "/", nil), "stringmember", reflect.String, "me")
+	if !errors.Is(err, cause) {
+		t.Errorf("cause was lost: %s", err)
+	}
+	if merry.HTTPCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code: %d", merry.HTTPCode(err))
+	}
+}
@@ -1,7 +1,9 @@
 package mqb
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/deckarep/golang-set"
@@ -33,3 +35,77 @@ func structName(structObj interface{}) string {
 	}
 	return strings.ToLower(typ.Name())
 }
+
+// orderByValues sorts the slice content points to in the order of values, where the
+// value of each element is the field represented by the parameter name. Elements with
+// a value not contained in values keep their order and are moved to the end.
+func orderByValues(content interface{}, name string, values []interface{}) {
+	rank := make(map[string]int)
+	for i, v := range values {
+		if _, ok := rank[fmt.Sprint(v)]; !ok {
+			rank[fmt.Sprint(v)] = i
+		}
+	}
+	slice := reflect.ValueOf(content).Elem()
+	position := func(i int) int {
+		if v, ok := fieldByParameterName(slice.Index(i), name); ok {
+			if r, ok := rank[fmt.Sprint(v.Interface())]; ok {
+				return r
+			}
+		}
+		return len(values)
+	}
+	sort.SliceStable(slice.Interface(), func(i, j int) bool {
+		return position(i) < position(j)
+	})
+}
+
+// toleranceRange returns a filter that matches all values between f-tolerance and f+tolerance.
+func toleranceRange(f, tolerance float64) map[string]interface{} {
+	return map[string]interface{}{
+		"$gte": f - tolerance,
+		"$lte": f + tolerance,
+	}
+}
+
+// addOrClause adds an $or of clauses to filter. If filter already contains an $or, both are
+// combined with an $and.
+func addOrClause(filter map[string]interface{}, clauses []interface{}) {
+	or, ok := filter["$or"]
+	if !ok {
+		filter["$or"] = clauses
+		return
+	}
+	delete(filter, "$or")
+	and, _ := filter["$and"].([]interface{})
+	filter["$and"] = append(and, map[string]interface{}{"$or": or}, map[string]interface{}{"$or": clauses})
+}
+
+// addAndClause adds clause to the $and of filter.
+func addAndClause(filter map[string]interface{}, clause interface{}) {
+	and, _ := filter["$and"].([]interface{})
+	filter["$and"] = append(and, clause)
+}
+
+// reverse reverses the order of the elements of the slice content points to.
+func reverse(content interface{}) {
+	s := reflect.ValueOf(content).Elem()
+	swap := reflect.Swapper(s.Interface())
+	for i, j := 0, s.Len()-1; i < j; i, j = i+1, j-1 {
+		swap(i, j)
+	}
+}
+
+// uniqueValues returns values without duplicates, keeping the first occurrence of each value.
+func uniqueValues(values []interface{}) []interface{} {
+	seen := make(map[string]bool)
+	unique := []interface{}{}
+	for _, v := range values {
+		key := fmt.Sprintf("%T:%v", v, v)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -1,6 +1,11 @@
 package mqb
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zbindenren/mqb/internal/bson"
+)
 
 type TestAStructName struct{}
 
@@ -13,3 +18,23 @@ func TestStructName(t *testing.T) {
 		t.Errorf("wrong structname generated")
 	}
 }
+
+type orderedStruct struct {
+	ID   bson.ObjectId `bson:"_id"`
+	Name string
+}
+
+func TestOrderByValues(t *testing.T) {
+	a, b, c := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	content := &[]orderedStruct{{ID: a, Name: "a"}, {ID: b, Name: "b"}, {ID: c, Name: "c"}}
+	orderByValues(content, "_id", []interface{}{c, a, c, b})
+	if !reflect.DeepEqual(*content, []orderedStruct{{ID: c, Name: "c"}, {ID: a, Name: "a"}, {ID: b, Name: "b"}}) {
+		t.Errorf("wrong order for object ids: %v", *content)
+	}
+
+	content = &[]orderedStruct{{Name: "a"}, {Name: "x"}, {Name: "b"}, {Name: "c"}}
+	orderByValues(content, "name", []interface{}{"c", "missing", "a", "b"})
+	if !reflect.DeepEqual(*content, []orderedStruct{{Name: "c"}, {Name: "a"}, {Name: "b"}, {Name: "x"}}) {
+		t.Errorf("wrong order for strings: %v", *content)
+	}
+}
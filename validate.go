@@ -0,0 +1,195 @@
+package mqb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ansel1/merry"
+)
+
+// VerboseHeader is the header that requests a validation report, see SetVerboseValidation.
+const VerboseHeader = "X-MQB-Verbose"
+
+// states of a parameter in a ValidationReport
+const (
+	ParameterValid    = "valid"    // ParameterValid is the status of a valid parameter.
+	ParameterInvalid  = "invalid"  // ParameterInvalid is the status of a parameter with an invalid value.
+	ParameterUnknown  = "unknown"  // ParameterUnknown is the status of a parameter that is not supported.
+	ParameterDisabled = "disabled" // ParameterDisabled is the status of a parameter disabled with DisableParameters.
+	ParameterMeta     = "meta"     // ParameterMeta is the status of a valid meta parameter like sort or limit.
+)
+
+// ValidationReport describes how the parameters of a request are resolved, see Validate.
+type ValidationReport struct {
+	Valid      bool                   `json:"valid"`            // Valid is true if the request is valid.
+	Parameters []ParameterReport      `json:"parameters"`       // Parameters are the reports of the parameters, sorted by name.
+	Errors     []ErrorDetail          `json:"errors,omitempty"` // Errors are the errors of the request, including those of parameter combinations.
+	Filter     map[string]interface{} `json:"filter"`           // Filter is the filter built from the valid parameters.
+}
+
+// ParameterReport describes how a parameter of a request is resolved.
+type ParameterReport struct {
+	Name     string                 `json:"name"`               // Name is the name of the parameter in the request.
+	Values   []string               `json:"values"`             // Values are the values of the parameter.
+	Status   string                 `json:"status"`             // Status is one of ParameterValid, ParameterInvalid, ParameterUnknown, ParameterDisabled and ParameterMeta.
+	Field    string                 `json:"field,omitempty"`    // Field is the field the parameter is resolved to, aliases are resolved.
+	Operator string                 `json:"operator,omitempty"` // Operator is the operator of the parameter, like gte.
+	Kind     string                 `json:"kind,omitempty"`     // Kind is the kind of the field.
+	Filter   map[string]interface{} `json:"filter,omitempty"`   // Filter is the filter built from the parameter alone, with the converted values.
+	Error    string                 `json:"error,omitempty"`    // Error is the reason the parameter is invalid.
+}
+
+// SetVerboseValidation enables validation reports for requests with the header X-MQB-Verbose: 1
+// or the parameter validate=verbose. Handler then writes the ValidationReport of the request
+// instead of running the query, with status 400 if the request is invalid and 200 otherwise.
+// This helps clients to understand why a request is rejected.
+func (mq *MongoQuery) SetVerboseValidation(enabled bool) {
+	mq.verboseValidation = enabled
+}
+
+// isVerboseRequest returns true if req requests a validation report and reports are enabled.
+func (mq *MongoQuery) isVerboseRequest(req *http.Request) bool {
+	if !mq.verboseValidation {
+		return false
+	}
+	return req.Header.Get(VerboseHeader) == "1" || req.URL.Query().Get("validate") == "verbose"
+}
+
+// checkValidateParameter returns an error if req contains the parameter validate and validation
+// reports are not enabled, or if its value is not verbose.
+func (mq *MongoQuery) checkValidateParameter(req *http.Request) error {
+	values, ok := req.URL.Query()["validate"]
+	if !ok {
+		return nil
+	}
+	if !mq.verboseValidation {
+		return withCode(merry.Wrap(errors.New("parameter 'validate' is not supported")).WithHTTPCode(http.StatusBadRequest), CodeUnsupportedParameter)
+	}
+	if len(values) != 1 || values[0] != "verbose" {
+		return withCode(merry.Wrap(fmt.Errorf("invalid value for validate: %s", strings.Join(values, ","))).WithHTTPCode(http.StatusBadRequest), CodeInvalidValue)
+	}
+	return nil
+}
+
+// Validate validates all parameters of req, regardless of SetFailFast, and returns a report
+// how every parameter is resolved. The query is not run, so the database is not accessed.
+func (mq *MongoQuery) Validate(req *http.Request) *ValidationReport {
+	report := &ValidationReport{Valid: true, Parameters: []ParameterReport{}}
+	// an invalid form body is reported by ParseSpec
+	if r, err := formRequest(req); err == nil {
+		req = r
+	}
+	matchMode, err := mq.requestMatchMode(req)
+	if err != nil {
+		matchMode = mq.matchMode
+	}
+	values := mq.queryValues(req)
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	valid := url.Values{}
+	for _, name := range names {
+		p := mq.parameterReport(req, name, values[name], matchMode)
+		if p.Status == ParameterValid || p.Status == ParameterMeta {
+			valid[name] = values[name]
+		} else {
+			report.Valid = false
+		}
+		report.Parameters = append(report.Parameters, p)
+	}
+
+	if _, err := mq.ParseSpec(req.Context(), req); err != nil {
+		report.Valid = false
+		report.Errors = Details(err)
+		if report.Errors == nil {
+			report.Errors = []ErrorDetail{{Code: CodeInvalidValue, Message: err.Error()}}
+		}
+	}
+	validReq := req.Clone(req.Context())
+	validReq.URL.RawQuery = valid.Encode()
+	if filter, err := mq.createQueryFilter(validReq); err == nil {
+		report.Filter = filter
+	}
+	return report
+}
+
+// parameterReport returns the report of the parameter name with values of req.
+func (mq *MongoQuery) parameterReport(req *http.Request, name string, values []string, matchMode string) ParameterReport {
+	p := ParameterReport{Name: name, Values: values}
+	resolved := mq.resolveAlias(name)
+	path, operator := splitOperator(resolved)
+	if contains(mq.disabledParameters, resolved) || contains(mq.disabledParameters, path) {
+		p.Status = ParameterDisabled
+		return p
+	}
+	if _, isMeta := validMetaParameters[resolved]; isMeta {
+		p.Status = ParameterMeta
+		if err := mq.validateMetaParameter(req, resolved); err != nil {
+			p.Status = ParameterInvalid
+			p.Error = err.Error()
+		}
+		return p
+	}
+	if kind, ok := mq.supportedParameters[path]; ok && len(operator) > 0 {
+		p.Field, p.Operator, p.Kind = path, operator, kind.String()
+	} else if kind, ok := mq.supportedParameters[resolved]; ok {
+		p.Field, p.Kind = resolved, kind.String()
+	} else if len(mq.textSearchParameter) == 0 || resolved != mq.textSearchParameter {
+		p.Status = ParameterUnknown
+		return p
+	}
+	filter := make(map[string]interface{})
+	operators := make(map[string]interface{})
+	comparisons := make(map[string][]interface{})
+	if err := mq.addParameterFilter(req, filter, operators, comparisons, name, values, matchMode); err != nil {
+		p.Status = ParameterInvalid
+		p.Error = err.Error()
+		return p
+	}
+	addOperatorFilters(filter, operators)
+	addExprClause(filter, comparisons)
+	p.Status = ParameterValid
+	if len(filter) > 0 {
+		p.Filter = filter
+	}
+	return p
+}
+
+// validateMetaParameter returns an error if the value of the meta parameter name in req is invalid.
+// Only the parameters sort, field, limit, page, hint and validate are validated on their own.
+func (mq *MongoQuery) validateMetaParameter(req *http.Request, name string) error {
+	var err error
+	switch name {
+	case "sort":
+		_, err = mq.createSortFields(req)
+	case "field":
+		_, err = mq.createFieldsMap(req)
+	case "limit":
+		_, _, err = mq.getLimit(req)
+	case "page":
+		_, _, err = mq.getPage(req)
+	case "hint":
+		_, err = mq.getHint(req)
+	case "validate":
+		err = mq.checkValidateParameter(req)
+	}
+	return err
+}
+
+// writeValidationReport writes report to w, with status 400 if the request is invalid.
+func writeValidationReport(w http.ResponseWriter, report *ValidationReport) {
+	w.Header().Set("Content-Type", MediaTypeJSON)
+	if report.Valid {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,94 @@
+package mqb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zbindenren/mqb/internal/mgo"
+)
+
+func TestValidate(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	mq.SetFailFast(true)
+	mq.DisableParameters("floatmember")
+	mq.AddAlias("flag", "mybool")
+	report := mq.Validate(httptest.NewRequest("GET", "/?intMember=abc&flag=true&floatmember=1&notAMember=x&sort=-intMember&limit=x&uintmember__gte=3", nil))
+	if report.Valid {
+		t.Error("invalid request is reported as valid")
+	}
+	expected := []ParameterReport{
+		{Name: "flag", Values: []string{"true"}, Status: ParameterValid, Field: "mybool", Kind: "bool", Filter: map[string]interface{}{"mybool": true}},
+		{Name: "floatmember", Values: []string{"1"}, Status: ParameterDisabled},
+		{Name: "intMember", Values: []string{"abc"}, Status: ParameterInvalid, Field: "intMember", Kind: "int64", Error: `strconv.Atoi: parsing "abc": invalid syntax`},
+		{Name: "limit", Values: []string{"x"}, Status: ParameterInvalid, Error: "limit must be a number, got 'x'"},
+		{Name: "notAMember", Values: []string{"x"}, Status: ParameterUnknown},
+		{Name: "sort", Values: []string{"-intMember"}, Status: ParameterMeta},
+		{Name: "uintmember__gte", Values: []string{"3"}, Status: ParameterValid, Field: "uintmember", Operator: "gte", Kind: "uint", Filter: map[string]interface{}{"uintmember": map[string]interface{}{"$gte": uint(3)}}},
+	}
+	if !reflect.DeepEqual(report.Parameters, expected) {
+		t.Errorf("wrong parameter reports:\n%v\n%v", report.Parameters, expected)
+	}
+	if len(report.Errors) == 0 {
+		t.Error("report contains no errors")
+	}
+	if !reflect.DeepEqual(report.Filter, map[string]interface{}{"mybool": true, "uintmember": map[string]interface{}{"$gte": uint(3)}}) {
+		t.Errorf("wrong filter of the valid parameters: %v", report.Filter)
+	}
+
+	report = mq.Validate(httptest.NewRequest("GET", "/?flag=true&sort=-intMember", nil))
+	if !report.Valid || len(report.Errors) > 0 {
+		t.Errorf("valid request is reported as invalid: %v", report.Errors)
+	}
+}
+
+func TestVerboseValidationHandler(t *testing.T) {
+	mq := NewMongoQuery(TestStruct{}, &mgo.Database{})
+	if mq.isVerboseRequest(httptest.NewRequest("GET", "/?validate=verbose", nil)) {
+		t.Error("verbose request without verbose validation")
+	}
+	// the parameter is not supported without verbose validation
+	w := httptest.NewRecorder()
+	Handler(mq).ServeHTTP(w, httptest.NewRequest("GET", "/?validate=verbose&mybool=true", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "validate") {
+		t.Errorf("validate without verbose validation did not produce an error: %d %s", w.Code, w.Body)
+	}
+	if report := mq.Validate(httptest.NewRequest("GET", "/?validate=verbose", nil)); report.Valid {
+		t.Error("validate without verbose validation is reported as valid")
+	}
+
+	mq.SetVerboseValidation(true)
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?validate=verbose", nil)); err != nil {
+		t.Errorf("error occured: %s", err)
+	}
+	if _, err := mq.ParseSpec(context.Background(), httptest.NewRequest("GET", "/?validate=quiet", nil)); err == nil {
+		t.Error("invalid value of validate did not produce an error")
+	}
+	h := Handler(mq)
+	for query, code := range map[string]int{
+		"/?validate=verbose&mybool=true": http.StatusOK,
+		"/?validate=verbose&mybool=yes":  http.StatusBadRequest,
+		"/?mybool=yes":                   http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("GET", query, nil)
+		if query == "/?mybool=yes" {
+			req.Header.Set(VerboseHeader, "1")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("wrong status code for %s: %d", query, w.Code)
+		}
+		report := ValidationReport{}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("error occured: %s", err)
+		}
+		if report.Valid != (code == http.StatusOK) {
+			t.Errorf("wrong report for %s: %s", query, w.Body)
+		}
+	}
+}